@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"zedclaudeproxy/internal/proxy"
+)
+
+// runDecrypt implements the decrypt subcommand, printing a history batch or a
+// thinking file the proxy encrypted
+func runDecrypt(args []string) error {
+	var key string
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s decrypt [flags] <file>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&key, "encryption-key", os.Getenv(envPrefix+"ENCRYPTION_KEY"), "Key the file is encrypted with: env:<var>, file:<path> or kms:<blob>")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || key == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	if err := proxy.Decrypt(context.Background(), writer, data, key); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"zedclaudeproxy/internal/proxy"
+)
+
+// runExport implements the export subcommand, rendering a conversation
+// recorded in the history store as Markdown or HTML
+func runExport(args []string) error {
+	var (
+		opts   proxy.ExportOptions
+		output string
+		since  string
+	)
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s export [flags] <conversation id>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.Store, "history-store", os.Getenv(envPrefix+"HISTORY_STORE"), "History store the proxy uploads transcripts to: file:<dir>, s3://<bucket>/<prefix> or gs://<bucket>/<prefix>")
+	flags.StringVar(&opts.StoreEndpoint, "history-store-endpoint", os.Getenv(envPrefix+"HISTORY_STORE_ENDPOINT"), "API endpoint of the history object store (empty uses the provider's)")
+	flags.StringVar(&opts.EncryptionKey, "encryption-key", os.Getenv(envPrefix+"ENCRYPTION_KEY"), "Key the history store is encrypted with: env:<var>, file:<path> or kms:<blob>")
+	flags.StringVar(&opts.Format, "format", proxy.ExportMarkdown, "Output format: markdown or html")
+	flags.BoolVar(&opts.Thinking, "thinking", true, "Include the thinking of the responses, collapsed in <details> blocks")
+	flags.StringVar(&since, "since", "", "Only read the transcripts uploaded on or after this day, as YYYY-MM-DD (empty reads all)")
+	flags.StringVar(&output, "o", "", "File to write the export to (default stdout)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || opts.Store == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	opts.Conversation = flags.Arg(0)
+	if since != "" {
+		day, err := time.Parse("2006-01-02", since)
+		if err != nil {
+			return fmt.Errorf("invalid -since day %q: %w", since, err)
+		}
+		opts.Since = day
+	}
+
+	out := os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+	if err := proxy.ExportConversation(context.Background(), writer, opts); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
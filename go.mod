@@ -1,3 +1,5 @@
 module zedclaudeproxy
 
 go 1.24
+
+require github.com/yuin/gopher-lua v1.1.1
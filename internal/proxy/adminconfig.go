@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// AdminConfigEndpoint is the admin endpoint inspecting and changing the runtime
+// configuration
+const AdminConfigEndpoint = "/admin/config"
+
+// RuntimeConfig holds the settings that can be changed while the proxy runs
+type RuntimeConfig struct {
+	ThinkingBudget      int               `json:"thinking_budget"`
+	ThinkingBudgets     map[string]int    `json:"thinking_budgets"`
+	ModelAliases        map[string]string `json:"model_aliases"`
+	LogThinking         bool              `json:"log_thinking"`
+	LogThinkingLive     bool              `json:"log_thinking_live"`
+	LogToolCalls        bool              `json:"log_tool_calls"`
+	RateLimitRPM        int               `json:"rate_limit_rpm"`
+	RateLimitConcurrent int               `json:"rate_limit_concurrent"`
+}
+
+// runtimeSettings are the settings of RuntimeConfig the proxy itself applies,
+// the others live in the rewriter configuration
+type runtimeSettings struct {
+	logThinking         bool
+	logThinkingLive     bool
+	logToolCalls        bool
+	rateLimitRPM        int
+	rateLimitConcurrent int
+}
+
+// settings returns the runtime settings in use
+func (p *Proxy) settings() *runtimeSettings {
+	return p.runtime.Load()
+}
+
+// runtimeConfig returns the current runtime configuration
+func (p *Proxy) runtimeConfig() RuntimeConfig {
+	rw, s := p.rewriter.Config(), p.settings()
+	return RuntimeConfig{
+		ThinkingBudget:      rw.ThinkingBudget,
+		ThinkingBudgets:     rw.ThinkingBudgets,
+		ModelAliases:        rw.ModelAliases,
+		LogThinking:         s.logThinking,
+		LogThinkingLive:     s.logThinkingLive,
+		LogToolCalls:        s.logToolCalls,
+		RateLimitRPM:        s.rateLimitRPM,
+		RateLimitConcurrent: s.rateLimitConcurrent,
+	}
+}
+
+// validate checks a runtime configuration
+func (c *RuntimeConfig) validate() error {
+	if c.ThinkingBudget < rewrite.MinThinkingBudget {
+		return fmt.Errorf("thinking_budget: %d is below the minimum of %d", c.ThinkingBudget, rewrite.MinThinkingBudget)
+	}
+	if err := validateThinkingBudgets(c.ThinkingBudgets); err != nil {
+		return err
+	}
+	if c.RateLimitRPM < 0 || c.RateLimitConcurrent < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	return nil
+}
+
+// applyRuntimeConfig switches to a runtime configuration
+func (p *Proxy) applyRuntimeConfig(c RuntimeConfig) {
+	rw := p.rewriter.Config()
+	rw.ThinkingBudget, rw.ThinkingBudgets, rw.ModelAliases = c.ThinkingBudget, c.ThinkingBudgets, c.ModelAliases
+	p.rewriter.SetConfig(rw)
+	p.runtime.Store(&runtimeSettings{
+		logThinking:         c.LogThinking,
+		logThinkingLive:     c.LogThinkingLive,
+		logToolCalls:        c.LogToolCalls,
+		rateLimitRPM:        c.RateLimitRPM,
+		rateLimitConcurrent: c.RateLimitConcurrent,
+	})
+}
+
+// handleGetConfig serves the runtime configuration
+func (p *Proxy) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.runtimeConfig())
+}
+
+// handlePutConfig changes the settings present in the body, leaving the others
+// as they are. Maps replace the current ones as a whole. The active schedules
+// keep overriding the settings they set.
+func (p *Proxy) handlePutConfig(w http.ResponseWriter, r *http.Request) {
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, 1<<20)); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Error reading request body")
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body.Bytes(), &fields); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON body: "+err.Error())
+		return
+	}
+
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	// Changes go to the base configuration, the active schedules still
+	// override the settings they set
+	next, err := p.baseConfig.overlay(body.Bytes())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid configuration: "+err.Error())
+		return
+	}
+	if err := next.validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid configuration: "+err.Error())
+		return
+	}
+
+	p.baseConfig = next
+	p.applyRuntimeConfig(p.scheduledConfig(p.activeSchedules))
+	log.Printf("Runtime configuration changed by %s: %s", clientID(r), strings.Join(slices.Sorted(maps.Keys(fields)), ", "))
+	writeJSON(w, p.runtimeConfig())
+}
+
+// requireAdminToken rejects admin requests without the admin token when one is
+// configured. The runtime configuration and the purge are only served with a
+// token, as they can change how every request is handled or delete history.
+func (p *Proxy) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.cfg.AdminToken == "" {
+			if r.URL.Path == AdminConfigEndpoint || r.URL.Path == PurgeEndpoint {
+				writeAPIError(w, http.StatusForbidden, "permission_error", "Runtime configuration and purging require an admin token (--admin-token)")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zedclaudeproxy admin"`)
+			writeAPIError(w, http.StatusUnauthorized, "authentication_error", "Invalid or missing admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
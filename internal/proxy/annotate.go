@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+
+	"zedclaudeproxy/internal/rewrite"
+	"zedclaudeproxy/internal/sse"
+)
+
+// usageAnnotation describes the thinking of a response in the "proxy" object
+// added to its message_delta event, next to the usage the API reports
+type usageAnnotation struct {
+	ThinkingTokens   int64 `json:"thinking_tokens_estimated"`
+	ThinkingBudget   int   `json:"thinking_budget,omitempty"`
+	ThinkingFiltered bool  `json:"thinking_filtered"`
+}
+
+// usageAnnotator is the built-in middleware adding the thinking tokens of
+// streamed responses to their message_delta event, for clients that want to
+// show them although the thinking itself was removed
+type usageAnnotator struct{}
+
+// Request returns a hook annotating the message_delta of streamed responses
+func (usageAnnotator) Request(req *Request) (StreamHook, error) {
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		return nil, nil
+	}
+	return &usageAnnotationHook{req: req}, nil
+}
+
+// usageAnnotationHook annotates the message_delta of a single response
+type usageAnnotationHook struct {
+	req *Request
+}
+
+// Event adds the "proxy" object to message_delta. The usage of the request is
+// updated before the hooks run, so the thinking is complete by then.
+func (h *usageAnnotationHook) Event(event *sse.Event) bool {
+	if event.Event != "message_delta" {
+		return true
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return true
+	}
+	data["proxy"] = usageAnnotation{
+		ThinkingTokens:   h.req.usage.thinkingTokens(),
+		ThinkingBudget:   thinkingBudget(h.req.Body),
+		ThinkingFiltered: rewrite.HasThinkingSuffix(h.req.ClientModel),
+	}
+	setEventData(event, data)
+	return true
+}
+
+// Done does nothing
+func (h *usageAnnotationHook) Done() {}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time            time.Time       `json:"time"`
+	Client          string          `json:"client"`
+	Method          string          `json:"method"`
+	Path            string          `json:"path"`
+	RequestHeaders  http.Header     `json:"request_headers"`
+	RequestBody     json.RawMessage `json:"request_body,omitempty"`
+	RequestBytes    int             `json:"request_bytes"`
+	Status          int             `json:"status"`
+	ResponseHeaders http.Header     `json:"response_headers"`
+	ResponseBytes   int64           `json:"response_bytes"`
+	DurationMS      int64           `json:"duration_ms"`
+	Model           string          `json:"model,omitempty"`
+	Usage           *tokenUsage     `json:"usage,omitempty"`
+	StopReason      string          `json:"stop_reason,omitempty"`
+}
+
+// auditLog appends a JSON line per forwarded call to a file
+type auditLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	redact bool
+}
+
+// openAuditLog opens the audit log file for appending
+func openAuditLog(path string, redactContent bool) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, redact: redactContent}, nil
+}
+
+// write appends an entry to the audit log
+func (a *auditLog) write(entry *auditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding audit entry: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// audit records every call passing through next in the audit log
+func (p *Proxy) audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.auditLog == nil || r.URL.Path == usageEndpoint {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Read the body for the log and hand an identical one to the proxy.
+		// Streamed bodies such as file uploads are only logged by size.
+		var bodyBytes []byte
+		var upload *countingBody
+		if streamsBody(r) {
+			upload = &countingBody{ReadCloser: r.Body}
+			r.Body = upload
+		} else {
+			var err error
+			if bodyBytes, err = io.ReadAll(r.Body); err != nil {
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+				return
+			}
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		entry := &auditEntry{
+			Time:           time.Now(),
+			Client:         clientID(r),
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			RequestHeaders: p.sensitive.Headers(r.Header),
+			RequestBody:    auditRequestBody(bodyBytes, p.auditLog.redact, p.sensitive),
+			RequestBytes:   len(bodyBytes),
+		}
+
+		recorder := &auditResponseWriter{ResponseWriter: w, usage: &requestUsage{}}
+		recorder.tap.usage = recorder.usage
+		next.ServeHTTP(recorder, r)
+
+		if upload != nil {
+			entry.RequestBytes = int(upload.read)
+		}
+		entry.Status = recorder.status
+		entry.ResponseHeaders = p.sensitive.Headers(w.Header())
+		entry.ResponseBytes = recorder.written
+		entry.DurationMS = time.Since(entry.Time).Milliseconds()
+		if usage := recorder.usage; usage.Model != "" {
+			entry.Model = usage.Model
+			entry.Usage = &usage.Usage
+			entry.StopReason = usage.StopReason
+		}
+		p.auditLog.write(entry)
+	})
+}
+
+// auditRequestBody returns the request body to log without its sensitive
+// fields, replacing the message and system prompt content with its size when
+// redaction is enabled
+func auditRequestBody(bodyBytes []byte, redact bool, sensitive *sensitiveData) json.RawMessage {
+	var bodyJSON map[string]any
+	if err := json.Unmarshal(bodyBytes, &bodyJSON); err != nil {
+		// Bodies that aren't JSON objects are only logged by size
+		return nil
+	}
+
+	if redact {
+		if system, ok := bodyJSON["system"]; ok {
+			bodyJSON["system"] = redactedContent(system)
+		}
+		if messages, ok := bodyJSON["messages"].([]any); ok {
+			for _, message := range messages {
+				if message, ok := message.(map[string]any); ok {
+					message["content"] = redactedContent(message["content"])
+				}
+			}
+		}
+	}
+
+	data, err := json.Marshal(sensitive.Value(bodyJSON))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// redactedContent replaces content with a placeholder recording its size
+func redactedContent(content any) string {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return "[redacted]"
+	}
+	return fmt.Sprintf("[redacted %d bytes]", len(data))
+}
+
+// auditResponseWriter captures the status, size and usage of a response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	usage   *requestUsage
+	tap     sseDataTap
+}
+
+// WriteHeader records the status code
+func (a *auditResponseWriter) WriteHeader(statusCode int) {
+	if a.status == 0 {
+		a.status = statusCode
+	}
+	a.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the size of the response and observes the usage of streams
+func (a *auditResponseWriter) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	if a.Header().Get("Content-Encoding") == "" && strings.HasPrefix(a.Header().Get("Content-Type"), "text/event-stream") {
+		a.tap.write(p)
+	}
+	n, err := a.ResponseWriter.Write(p)
+	a.written += int64(n)
+	return n, err
+}
+
+// Flush sends buffered data to the client
+func (a *auditResponseWriter) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+// Read reads from the body, counting the bytes read
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// proxyTokenHeader is an alternative header for clients that can't set Authorization
+const proxyTokenHeader = "X-Proxy-Token"
+
+// contextKey is the type for values stored in request contexts
+type contextKey int
+
+const (
+	clientIDKey contextKey = iota
+	// escalationRetryKey marks the retries of requests with a larger thinking budget
+	escalationRetryKey
+)
+
+// loadClientTokens parses the configured name:token pairs into a map of
+// tokens to client names, returning nil when authentication is disabled
+func loadClientTokens(tokenList, tokensFile string) (map[string]string, error) {
+	var entries []string
+	if tokenList != "" {
+		entries = append(entries, strings.Split(tokenList, ",")...)
+	}
+	if tokensFile != "" {
+		data, err := os.ReadFile(tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	tokens := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		name, token, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("invalid token entry %q: expected name:token", entry)
+		}
+		tokens[token] = name
+	}
+
+	return tokens, nil
+}
+
+// lookupClientToken returns the client name for a token using constant time comparisons
+func (p *Proxy) lookupClientToken(token string) (string, bool) {
+	var name string
+	found := 0
+	for candidate, candidateName := range p.clientTokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			name = candidateName
+			found = 1
+		}
+	}
+	return name, found == 1
+}
+
+// requireAuth rejects requests without a valid proxy token when authentication is
+// enabled, and records the client identity in the request context
+func (p *Proxy) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.clientTokens == nil && p.jwt == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Accept bearer tokens, basic auth (token as password) or the proxy token header
+		var token, header string
+		if value := r.Header.Get(proxyTokenHeader); value != "" {
+			token, header = value, proxyTokenHeader
+		} else if value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token, header = strings.TrimSpace(value), "Authorization"
+		} else if _, password, ok := r.BasicAuth(); ok {
+			token, header = password, "Authorization"
+		}
+
+		// Static tokens are tried first, then JWTs of the OIDC provider
+		name, ok := p.lookupClientToken(token)
+		if !ok && p.jwt != nil && looksLikeJWT(token) {
+			var err error
+			if name, err = p.jwt.validate(token); err != nil {
+				log.Printf("Rejecting JWT from %s: %v", clientID(r), err)
+			}
+			ok = err == nil
+		}
+		if token == "" || !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zedclaudeproxy"`)
+			writeAPIError(w, http.StatusUnauthorized, "authentication_error", "Invalid or missing proxy token")
+			return
+		}
+
+		// The proxy credentials must not be forwarded upstream
+		r.Header.Del(header)
+
+		// Send the request with the client's own API key when one is configured
+		if key, ok := p.apiKeyFor(name); ok {
+			r.Header.Set("X-Api-Key", key)
+			r.Header.Del("Authorization")
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIDKey, name)))
+	})
+}
+
+// trustClients lets requests through without a proxy token, identifying their
+// clients by IP address. They are sent with the API key configured for the
+// clients without their own, if any.
+func (p *Proxy) trustClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := p.cfg.ClientAPIKeys["*"]; ok {
+			r.Header.Set("X-Api-Key", key)
+			r.Header.Del("Authorization")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyFor returns the API key configured for a client, or for all clients
+func (p *Proxy) apiKeyFor(client string) (string, bool) {
+	if key, ok := p.cfg.ClientAPIKeys[client]; ok {
+		return key, true
+	}
+	key, ok := p.cfg.ClientAPIKeys["*"]
+	return key, ok
+}
+
+// clientID returns the authenticated client name, or the remote IP when authentication is disabled
+func clientID(r *http.Request) string {
+	if name, ok := r.Context().Value(clientIDKey).(string); ok {
+		return name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// BatchesEndpoint is the path of the Message Batches API
+const BatchesEndpoint = "/v1/messages/batches"
+
+// batchRetention is how long the results of a batch can be downloaded
+const batchRetention = 29 * 24 * time.Hour
+
+// forwardBatch forwards a batch creation request with each of its requests
+// rewritten like a Messages API request. Batch listing, retrieval and results
+// are forwarded as they are.
+func (p *Proxy) forwardBatch(w http.ResponseWriter, r *http.Request) {
+	// Reject clients that used up their daily budget
+	if p.checkDailyBudget(w, clientID(r)) {
+		r.Body.Close()
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	var bodyJSON map[string]any
+	if err := json.Unmarshal(bodyBytes, &bodyJSON); err != nil {
+		log.Printf("Error parsing batch request body: %v", err)
+		p.forwardRequestAsIs(w, r, bodyBytes)
+		return
+	}
+
+	requests, _ := bodyJSON["requests"].([]any)
+	thinking := 0
+	for i, item := range requests {
+		item, _ := item.(map[string]any)
+		params, ok := item["params"].(map[string]any)
+		if !ok {
+			continue
+		}
+		if p.cfg.ValidateRequests {
+			if err := validateMessagesRequest(params); err != nil {
+				var invalidField *validationError
+				if errors.As(err, &invalidField) {
+					err = fmt.Errorf("requests.%d.params.%w", i, err)
+				}
+				log.Printf("Invalid batch request: %v", err)
+				writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+		if p.rewriteBatchParams(r.Header, params) {
+			thinking++
+		}
+	}
+	log.Printf("Forwarding batch of %d requests, %d with thinking", len(requests), thinking)
+
+	if bodyBytes, err = json.Marshal(bodyJSON); err != nil {
+		http.Error(w, "Error re-encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	p.forwardRequestAsIs(w, r, bodyBytes)
+}
+
+// rewriteBatchParams rewrites the parameters of a single batch request,
+// reporting whether thinking was enabled. Batches don't stream, so the stream
+// field the thinking rewrite adds is removed again.
+func (p *Proxy) rewriteBatchParams(header http.Header, params map[string]any) bool {
+	p.rewriter.ResolveAlias(params)
+	p.pinModel(nil, params)
+	model, _ := params["model"].(string)
+
+	enabled := rewrite.HasThinkingSuffix(model)
+	if enabled {
+		p.rewriter.Thinking(header, params, model, 0)
+		delete(params, "stream")
+		if p.thinkingMemory != nil {
+			p.thinkingMemory.reinject(params)
+		}
+	} else {
+		p.rewriter.Passthrough(header, params, model)
+	}
+	redactRequest(p.requestRedactors, params)
+	return enabled
+}
+
+// batchResultsID returns the ID of the batch whose results a request
+// downloads, or "" for other requests
+func batchResultsID(r *http.Request) string {
+	if r.Method != http.MethodGet {
+		return ""
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, BatchesEndpoint+"/")
+	if !ok {
+		return ""
+	}
+	id, ok := strings.CutSuffix(rest, "/results")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return ""
+	}
+	return id
+}
+
+// batchResultsTap reads the usage of the succeeded requests from the JSONL
+// results of a batch as they are downloaded
+type batchResultsTap struct {
+	partial []byte
+	results []*requestUsage
+}
+
+// write splits the results into lines and observes each of them
+func (t *batchResultsTap) write(p []byte) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.observe(t.partial[:i])
+		t.partial = t.partial[i+1:]
+	}
+}
+
+// observe reads the usage of a single result
+func (t *batchResultsTap) observe(line []byte) {
+	var result struct {
+		Result struct {
+			Type    string          `json:"type"`
+			Message json.RawMessage `json:"message"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(line, &result); err != nil || result.Result.Type != "succeeded" {
+		return
+	}
+	usage := &requestUsage{Batch: true}
+	usage.observeMessage(result.Result.Message)
+	if usage.Model != "" {
+		t.results = append(t.results, usage)
+	}
+}
+
+// close observes the last result, which may lack its newline, and returns the
+// usage of all of them
+func (t *batchResultsTap) close() []*requestUsage {
+	if len(bytes.TrimSpace(t.partial)) > 0 {
+		t.observe(t.partial)
+	}
+	t.partial = nil
+	return t.results
+}
+
+// recordBatchResults accounts for the usage of the results of a batch, the
+// first time they are downloaded in full, against the client downloading them
+func (p *Proxy) recordBatchResults(client, id string, results []*requestUsage) {
+	if !p.spend.countBatch(id) {
+		return
+	}
+	for _, usage := range results {
+		p.usage.record(client, usage)
+		p.spend.record(client, usage)
+	}
+	log.Printf("Accounted for the usage of %d results of batch %s", len(results), id)
+}
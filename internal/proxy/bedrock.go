@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// bedrockAnthropicVersion is the API version Bedrock expects in request bodies
+const bedrockAnthropicVersion = "bedrock-2023-05-31"
+
+// defaultBedrockModels maps Anthropic model names to Bedrock model IDs
+var defaultBedrockModels = map[string]string{
+	"claude-3-7-sonnet-latest":   "anthropic.claude-3-7-sonnet-20250219-v1:0",
+	"claude-3-7-sonnet-20250219": "anthropic.claude-3-7-sonnet-20250219-v1:0",
+	"claude-3-5-sonnet-latest":   "anthropic.claude-3-5-sonnet-20241022-v2:0",
+	"claude-3-5-sonnet-20241022": "anthropic.claude-3-5-sonnet-20241022-v2:0",
+	"claude-3-5-haiku-latest":    "anthropic.claude-3-5-haiku-20241022-v1:0",
+	"claude-3-5-haiku-20241022":  "anthropic.claude-3-5-haiku-20241022-v1:0",
+}
+
+// bedrockProfileModels are the Bedrock models only served through cross-region
+// inference profiles, whose IDs are prefixed with the geography of the region
+var bedrockProfileModels = map[string]bool{
+	"anthropic.claude-3-7-sonnet-20250219-v1:0": true,
+}
+
+// bedrockGeography returns the inference profile prefix of the geography of a
+// region, empty when there is no profile for it
+func bedrockGeography(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return "us-gov"
+	case strings.HasPrefix(region, "us-"):
+		return "us"
+	case strings.HasPrefix(region, "eu-"):
+		return "eu"
+	case strings.HasPrefix(region, "ap-"):
+		return "apac"
+	}
+	return ""
+}
+
+// errUnsupportedEndpoint is returned for paths the backend cannot serve
+var errUnsupportedEndpoint = errors.New("endpoint not supported by the configured backend")
+
+// bedrockUpstreams returns the upstream for the Bedrock runtime in the configured region
+func (p *Proxy) bedrockUpstreams() ([]*upstream, error) {
+	region := p.cfg.BedrockRegion
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, errors.New("-bedrock-region or AWS_REGION is required for the bedrock backend")
+	}
+	p.cfg.BedrockRegion = region
+
+	// Parse the model mappings up front
+	models, err := bedrockModelMap(region, p.cfg.BedrockModels)
+	if err != nil {
+		return nil, err
+	}
+	p.bedrockModels = models
+
+	return []*upstream{{
+		url:     fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", region),
+		breaker: p.newCircuitBreaker(),
+		bedrock: true,
+	}}, nil
+}
+
+// bedrockModelMap returns the default model mappings for a region merged with
+// the configured overrides, which are used as given
+func bedrockModelMap(region, overrides string) (map[string]string, error) {
+	geography := bedrockGeography(region)
+	models := make(map[string]string, len(defaultBedrockModels))
+	for name, id := range defaultBedrockModels {
+		if bedrockProfileModels[id] && geography != "" {
+			id = geography + "." + id
+		}
+		models[name] = id
+	}
+
+	if overrides == "" {
+		return models, nil
+	}
+	for _, mapping := range strings.Split(overrides, ",") {
+		name, id, ok := strings.Cut(strings.TrimSpace(mapping), "=")
+		if !ok || name == "" || id == "" {
+			return nil, fmt.Errorf("invalid -bedrock-models entry %q: expected model=bedrock-model-id", mapping)
+		}
+		models[name] = id
+	}
+
+	return models, nil
+}
+
+// bedrockModelID maps an Anthropic model name to a Bedrock model ID, passing
+// through names that are not mapped so Bedrock IDs can be used directly
+func (p *Proxy) bedrockModelID(model string) string {
+	if id, ok := p.bedrockModels[model]; ok {
+		return id
+	}
+	return model
+}
+
+// newBedrockRequest translates a Messages API request into a signed Bedrock
+// InvokeModel or InvokeModelWithResponseStream request
+func (p *Proxy) newBedrockRequest(r *http.Request, endpoint string, bodyBytes []byte) (*http.Request, error) {
+	if r.Method != http.MethodPost || r.URL.Path != MessagesEndpoint {
+		return nil, errUnsupportedEndpoint
+	}
+
+	var bodyJSON map[string]any
+	if err := json.Unmarshal(bodyBytes, &bodyJSON); err != nil {
+		return nil, fmt.Errorf("bedrock backend requires a JSON body: %w", err)
+	}
+
+	// The model and streaming mode move from the body into the URL
+	model, _ := bodyJSON["model"].(string)
+	stream, _ := bodyJSON["stream"].(bool)
+	delete(bodyJSON, "model")
+	delete(bodyJSON, "stream")
+	bodyJSON["anthropic_version"] = bedrockAnthropicVersion
+
+	// Beta features are passed in the body instead of a header
+	if beta := r.Header.Get("anthropic-beta"); beta != "" {
+		var betas []string
+		for _, name := range strings.Split(beta, ",") {
+			betas = append(betas, strings.TrimSpace(name))
+		}
+		bodyJSON["anthropic_beta"] = betas
+	}
+
+	payload, err := json.Marshal(bodyJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	action := "invoke"
+	accept := "application/json"
+	if stream {
+		action = "invoke-with-response-stream"
+		accept = "application/vnd.amazon.eventstream"
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, endpoint+"/model/"+p.bedrockModelID(model)+"/"+action, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, payload, creds, p.cfg.BedrockRegion, "bedrock", time.Now())
+
+	return req, nil
+}
+
+// adaptBedrockResponse converts a Bedrock event stream response body into an
+// Anthropic compatible SSE stream so the rest of the proxy can process it unchanged
+func adaptBedrockResponse(resp *http.Response) {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/vnd.amazon.eventstream") {
+		return
+	}
+
+	pr, pw := io.Pipe()
+	go func(body io.ReadCloser) {
+		defer body.Close()
+		pw.CloseWithError(bedrockEventStreamToSSE(body, pw))
+	}(resp.Body)
+
+	resp.Body = pr
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// bedrockEventStreamToSSE decodes Bedrock event stream chunks and writes them as SSE events
+func bedrockEventStreamToSSE(r io.Reader, w io.Writer) error {
+	for {
+		message, err := readEventStreamMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Exceptions are reported as Anthropic error events
+		if message.Headers[":message-type"] == "exception" {
+			var exception struct {
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(message.Payload, &exception); err != nil {
+				exception.Message = string(message.Payload)
+			}
+			data, _ := json.Marshal(map[string]any{
+				"type": "error",
+				"error": map[string]string{
+					"type":    message.Headers[":exception-type"],
+					"message": exception.Message,
+				},
+			})
+			if _, err := fmt.Fprintf(w, "event: error\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if message.Headers[":event-type"] != "chunk" {
+			continue
+		}
+
+		// Each chunk wraps a base64 encoded Anthropic streaming event
+		var chunk struct {
+			Bytes string `json:"bytes"`
+		}
+		if err := json.Unmarshal(message.Payload, &chunk); err != nil {
+			log.Printf("Error parsing Bedrock chunk: %v", err)
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(chunk.Bytes)
+		if err != nil {
+			log.Printf("Error decoding Bedrock chunk: %v", err)
+			continue
+		}
+
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Printf("Error parsing Bedrock event: %v", err)
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return err
+		}
+	}
+}
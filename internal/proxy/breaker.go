@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// circuitState represents the state of a circuit breaker
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// String returns the name of the circuit state
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops sending requests to an upstream after repeated failures,
+// letting a single probe request through once the cooldown has elapsed
+type circuitBreaker struct {
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probeAt  time.Time
+}
+
+// allow reports whether a request may be sent upstream
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		// Let a single probe request through
+		b.state = circuitHalfOpen
+		b.probeAt = time.Now()
+		log.Printf("Circuit breaker half-open, probing upstream")
+		return true
+	case circuitHalfOpen:
+		// A probe is already in flight, unless it never came back
+		if time.Since(b.probeAt) < b.cooldown {
+			return false
+		}
+		b.probeAt = time.Now()
+		log.Printf("Circuit breaker probe unresolved after %s, probing upstream again", b.cooldown)
+		return true
+	default:
+		return true
+	}
+}
+
+// isOpen reports whether the breaker is failing fast, without changing its state
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == circuitOpen && time.Since(b.openedAt) < b.cooldown
+}
+
+// success records a successful upstream request and closes the circuit
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != circuitClosed {
+		log.Printf("Circuit breaker closed, upstream recovered")
+	}
+	b.state = circuitClosed
+	b.failures = 0
+}
+
+// release ends a half-open probe that never reached a verdict, e.g. the client
+// went away, so the next request probes the upstream again
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+	}
+}
+
+// failure records a failed upstream request, opening the circuit once the
+// threshold is reached or when a half-open probe fails
+func (b *circuitBreaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state != circuitOpen {
+			log.Printf("Circuit breaker open after %d consecutive upstream failures", b.failures)
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// retryIn returns how long until the open circuit will allow a probe
+func (b *circuitBreaker) retryIn() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return max(b.cooldown-time.Since(b.openedAt), 0)
+}
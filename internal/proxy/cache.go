@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cacheStatusHeader tells clients that a response was served from the cache
+const cacheStatusHeader = "X-Proxy-Cache"
+
+// responseCache keeps the complete responses to Messages API requests for a
+// while, so identical requests are answered without calling the upstream
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+// cachedResponse is a complete upstream response
+type cachedResponse struct {
+	storedAt time.Time
+	header   http.Header
+	body     []byte
+}
+
+// newResponseCache returns a cache keeping up to maxEntries responses for ttl
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cachedResponse),
+	}
+}
+
+// cacheKey hashes what determines the response to a request: its path, the
+// headers selecting API features, the credentials so accounts don't share
+// responses, and the body with its keys sorted
+func cacheKey(r *http.Request, bodyBytes []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+	for _, name := range []string{"Anthropic-Version", "Anthropic-Beta", "X-Api-Key", "Authorization"} {
+		fmt.Fprintf(hash, "%s: %q\n", name, r.Header.Values(name))
+	}
+
+	// Decoding and encoding the body again normalizes its key order and spacing
+	var body any
+	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err == nil {
+		if normalized, err := json.Marshal(body); err == nil {
+			bodyBytes = normalized
+		}
+	}
+	hash.Write(bodyBytes)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// cacheable checks if the response to a request may be cached
+func cacheable(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == MessagesEndpoint
+}
+
+// get returns a response replaying the cached response to a request, or nil
+func (c *responseCache) get(r *http.Request, bodyBytes []byte) *http.Response {
+	key := cacheKey(r, bodyBytes)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Since(entry.storedAt) > c.ttl {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	log.Printf("Serving cached response from %s ago", time.Since(entry.storedAt).Round(time.Second))
+	header := entry.header.Clone()
+	header.Set(cacheStatusHeader, "hit")
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+	}
+}
+
+// store tees a successful response body so it is cached once it was read
+// completely
+func (c *responseCache) store(r *http.Request, bodyBytes []byte, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		cache:      c,
+		key:        cacheKey(r, bodyBytes),
+		header:     resp.Header.Clone(),
+		stream:     isEventStream(resp),
+	}
+}
+
+// add caches a response, evicting expired entries and then the oldest ones to
+// stay within the size limit
+func (c *responseCache) add(key string, entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.entries {
+		if time.Since(e.storedAt) > c.ttl {
+			delete(c.entries, k)
+		}
+	}
+	for len(c.entries) >= c.maxEntries {
+		var oldest string
+		for k, e := range c.entries {
+			if oldest == "" || e.storedAt.Before(c.entries[oldest].storedAt) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = entry
+}
+
+// cachingBody captures a response body, caching it when it was read to the
+// end. Streams are only cached when they completed with message_stop.
+type cachingBody struct {
+	io.ReadCloser
+	cache    *responseCache
+	key      string
+	header   http.Header
+	stream   bool
+	captured bytes.Buffer
+	complete bool
+}
+
+// Read reads from the response body, capturing the data
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.captured.Write(p[:n])
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+// Close closes the response body and caches it if it is complete
+func (b *cachingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.complete {
+		return err
+	}
+
+	if b.stream {
+		usage := &requestUsage{}
+		tap := &sseDataTap{usage: usage}
+		tap.write(b.captured.Bytes())
+		if !usage.Stopped || usage.UpstreamError {
+			return err
+		}
+	}
+	b.cache.add(b.key, &cachedResponse{
+		storedAt: time.Now(),
+		header:   b.header,
+		body:     b.captured.Bytes(),
+	})
+	return err
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// checkRequestCaps rejects requests whose thinking budget or max_tokens, as
+// they would be forwarded, exceed the configured caps
+func (p *Proxy) checkRequestCaps(req *Request) error {
+	if limit := p.cfg.MaxThinkingBudget; limit > 0 {
+		if budget := thinkingBudget(req.Body); budget > limit {
+			return fmt.Errorf("thinking budget %d exceeds the proxy's maximum of %d tokens", budget, limit)
+		}
+	}
+	if limit := p.cfg.MaxOutputTokens; limit > 0 {
+		if maxTokens := intValue(req.Body["max_tokens"]); maxTokens > limit {
+			return fmt.Errorf("max_tokens %d exceeds the proxy's maximum of %d tokens", maxTokens, limit)
+		}
+	}
+	return nil
+}
+
+// thinkingBudget returns the thinking budget of a request body, set by the
+// client or by the rewrites
+func thinkingBudget(bodyJSON map[string]any) int {
+	switch thinking := bodyJSON["thinking"].(type) {
+	case rewrite.ThinkingConfig:
+		return thinking.BudgetTokens
+	case map[string]any:
+		return intValue(thinking["budget_tokens"])
+	}
+	return 0
+}
+
+// checkDailyBudget answers with a rate limit error when the client used up its
+// daily token or cost budget, reporting whether it did. The budgets are
+// checked before requests start, so concurrent requests may overshoot them.
+func (p *Proxy) checkDailyBudget(w http.ResponseWriter, client string) bool {
+	if p.cfg.DailyTokenBudget <= 0 && p.cfg.DailyCostBudget <= 0 {
+		return false
+	}
+	now := time.Now().UTC()
+	spent := p.spend.get(client, now)
+
+	var reason string
+	switch {
+	case p.cfg.DailyTokenBudget > 0 && spent.Tokens >= p.cfg.DailyTokenBudget:
+		reason = fmt.Sprintf("%d of %d tokens", spent.Tokens, p.cfg.DailyTokenBudget)
+	case p.cfg.DailyCostBudget > 0 && spent.CostUSD >= p.cfg.DailyCostBudget:
+		reason = fmt.Sprintf("~$%.2f of $%.2f", spent.CostUSD, p.cfg.DailyCostBudget)
+	default:
+		return false
+	}
+
+	reset := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	log.Printf("Rejecting request of client %s: daily budget exhausted (%s)", client, reason)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(reset.Sub(now).Seconds())+1))
+	writeAPIError(w, http.StatusTooManyRequests, "rate_limit_error",
+		fmt.Sprintf("Daily budget of the proxy exhausted: used %s today, resets at %s", reason, reset.Format(time.RFC3339)))
+	return true
+}
+
+// clientSpend is what a client used in a day
+type clientSpend struct {
+	Tokens  int64
+	CostUSD float64
+}
+
+// spendTracker accumulates the tokens and estimated cost of each client over
+// the current UTC day
+type spendTracker struct {
+	mu      sync.Mutex
+	day     time.Time
+	clients map[string]*clientSpend
+	// Batches whose results were accounted for, by when
+	batches map[string]time.Time
+}
+
+// newSpendTracker returns a tracker without spending
+func newSpendTracker() *spendTracker {
+	return &spendTracker{clients: make(map[string]*clientSpend), batches: make(map[string]time.Time)}
+}
+
+// countBatch reports whether the results of a batch are accounted for the
+// first time, forgetting the batches whose results expired
+func (s *spendTracker) countBatch(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for batch, counted := range s.batches {
+		if now.Sub(counted) > batchRetention {
+			delete(s.batches, batch)
+		}
+	}
+	if _, ok := s.batches[id]; ok {
+		return false
+	}
+	s.batches[id] = now
+	return true
+}
+
+// rollover forgets the spending of previous days, the lock must be held
+func (s *spendTracker) rollover(now time.Time) {
+	if day := now.UTC().Truncate(24 * time.Hour); !day.Equal(s.day) {
+		s.day = day
+		clear(s.clients)
+	}
+}
+
+// record adds the usage of a completed request to its client's spending
+func (s *spendTracker) record(client string, u *requestUsage) {
+	if u.Model == "" || u.Cached {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover(time.Now())
+	spent := s.clients[client]
+	if spent == nil {
+		spent = &clientSpend{}
+		s.clients[client] = spent
+	}
+	spent.Tokens += u.Usage.InputTokens + u.Usage.CacheCreationInputTokens + u.Usage.CacheReadInputTokens + u.Usage.OutputTokens
+	spent.CostUSD += estimateCost(u)
+}
+
+// get returns what a client used today
+func (s *spendTracker) get(client string, now time.Time) clientSpend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover(now)
+	if spent := s.clients[client]; spent != nil {
+		return *spent
+	}
+	return clientSpend{}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// maxChaosDisconnectEvent bounds the event after which a stream is cut
+const maxChaosDisconnectEvent = 30
+
+// chaosConfig injects faults into Messages API responses, to test how clients
+// behave when the API is degraded
+type chaosConfig struct {
+	// delay is the longest random delay added before each streamed event
+	delay time.Duration
+	// Probabilities of cutting a stream, and of answering with a rate limit or
+	// overloaded error instead of forwarding the request
+	disconnect, rateLimited, overloaded float64
+}
+
+// parseChaos parses a comma separated list of faults: "delay=<duration>",
+// "disconnect=<probability>", "429=<probability>" and "529=<probability>",
+// returning nil when spec is empty
+func parseChaos(spec string) (*chaosConfig, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	c := &chaosConfig{}
+	for _, entry := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid chaos entry %q: expected name=value", entry)
+		}
+		if name == "delay" {
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay < 0 {
+				return nil, fmt.Errorf("invalid chaos delay %q: must be a positive duration", value)
+			}
+			c.delay = delay
+			continue
+		}
+
+		probability, err := strconv.ParseFloat(value, 64)
+		if err != nil || probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("invalid chaos probability %q for %s: must be between 0 and 1", value, name)
+		}
+		switch name {
+		case "disconnect":
+			c.disconnect = probability
+		case "429":
+			c.rateLimited = probability
+		case "529":
+			c.overloaded = probability
+		default:
+			return nil, fmt.Errorf("unknown chaos fault %q: must be delay, disconnect, 429 or 529", name)
+		}
+	}
+	if c.rateLimited+c.overloaded > 1 {
+		return nil, errors.New("invalid chaos probabilities: 429 and 529 add up to more than 1")
+	}
+	return c, nil
+}
+
+// String describes the faults for the startup log
+func (c *chaosConfig) String() string {
+	return fmt.Sprintf("delays up to %s, disconnect %g, 429 %g, 529 %g", c.delay, c.disconnect, c.rateLimited, c.overloaded)
+}
+
+// injectError answers a request with a synthetic rate limit or overloaded
+// error at their probabilities, reporting whether it did
+func (c *chaosConfig) injectError(w http.ResponseWriter) bool {
+	switch roll := rand.Float64(); {
+	case roll < c.rateLimited:
+		log.Printf("Chaos: answering with a synthetic 429")
+		w.Header().Set("Retry-After", "1")
+		writeAPIError(w, http.StatusTooManyRequests, "rate_limit_error", "Rate limited by the proxy's chaos mode")
+		return true
+	case roll < c.rateLimited+c.overloaded:
+		log.Printf("Chaos: answering with a synthetic 529")
+		writeAPIError(w, 529, "overloaded_error", "Overloaded by the proxy's chaos mode")
+		return true
+	}
+	return false
+}
+
+// chaosMonkey is the built-in middleware delaying the events of streamed
+// responses and cutting some of them short
+type chaosMonkey struct {
+	config *chaosConfig
+}
+
+// Request returns a hook injecting faults into streamed responses
+func (m chaosMonkey) Request(req *Request) (StreamHook, error) {
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		return nil, nil
+	}
+	hook := &chaosHook{config: m.config, label: req.label}
+	if rand.Float64() < m.config.disconnect {
+		hook.disconnectAfter = 1 + rand.IntN(maxChaosDisconnectEvent)
+	}
+	return hook, nil
+}
+
+// chaosHook injects faults into a single response
+type chaosHook struct {
+	config *chaosConfig
+	label  string
+	events int
+	// disconnectAfter is the number of events after which the stream is cut, 0 for never
+	disconnectAfter int
+}
+
+// Event waits a random delay, and cuts the connection once the stream reached
+// the event it should be cut at, or before it completes when it is shorter
+func (h *chaosHook) Event(event *sse.Event) bool {
+	h.events++
+	if h.disconnectAfter > 0 && (h.events > h.disconnectAfter || event.Event == "message_stop") {
+		log.Printf("[%s] Chaos: disconnecting after %d events", h.label, h.events-1)
+		// Aborting the handler drops the connection without ending the response
+		panic(http.ErrAbortHandler)
+	}
+	if h.config.delay > 0 {
+		time.Sleep(rand.N(h.config.delay))
+	}
+	return true
+}
+
+// Done does nothing
+func (h *chaosHook) Done() {}
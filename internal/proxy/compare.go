@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// CompareSuffix marks the requests to duplicate to the comparison model, e.g.
+// "claude-sonnet-4-5-thinking-ab"
+const CompareSuffix = "-ab"
+
+// Comparison holds the transcripts of a request answered by the requested
+// model, whose response the client received, and by the comparison model
+type Comparison struct {
+	Time         time.Time   `json:"time"`
+	Request      string      `json:"request"`
+	Conversation string      `json:"conversation,omitempty"`
+	Client       string      `json:"client"`
+	Primary      *Transcript `json:"primary,omitempty"`
+	Secondary    *Transcript `json:"secondary,omitempty"`
+	// Errors of the sides that didn't complete
+	PrimaryError   string `json:"primary_error,omitempty"`
+	SecondaryError string `json:"secondary_error,omitempty"`
+}
+
+// compareTimeout bounds the request to the comparison model and the upload of
+// the comparison
+const compareTimeout = 10 * time.Minute
+
+// comparisonStore saves comparisons to a history store, one object each
+type comparisonStore struct {
+	store  historyStore
+	prefix string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// newComparisonStore returns the store described by spec, encrypted with enc
+// when it is set
+func newComparisonStore(spec, endpoint string, enc *encryptor) (*comparisonStore, error) {
+	store, prefix, err := parseHistoryStore(spec, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("comparison store %q: %w", spec, err)
+	}
+	return &comparisonStore{store: encryptStore(store, enc), prefix: prefix}, nil
+}
+
+// save uploads a comparison as JSON, under a key sorting by time
+func (s *comparisonStore) save(c *Comparison) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+	key := fmt.Sprintf("%s%s-%d-%d.json", s.prefix, c.Time.UTC().Format("2006/01/02/20060102T150405Z"), os.Getpid(), seq)
+
+	ctx, cancel := context.WithTimeout(context.Background(), compareTimeout)
+	defer cancel()
+	if err := s.store.Put(ctx, key, data); err != nil {
+		return fmt.Errorf("saving %s: %w", s.store.Location(key), err)
+	}
+	return nil
+}
+
+// stripCompareSuffix removes the comparison suffix from the model of a
+// request, reporting whether it was there
+func stripCompareSuffix(bodyJSON map[string]any) bool {
+	model, _ := bodyJSON["model"].(string)
+	base, ok := strings.CutSuffix(model, CompareSuffix)
+	if !ok || base == "" {
+		return false
+	}
+	log.Printf("Comparing '%s' with the comparison model", base)
+	bodyJSON["model"] = base
+	return true
+}
+
+// comparing decides whether a request is duplicated to the comparison model:
+// when it asked for it with the suffix, or else in the configured share of
+// requests
+func (p *Proxy) comparing(marked bool) bool {
+	if p.comparisons == nil {
+		return false
+	}
+	return marked || rand.Float64()*100 < p.cfg.ComparePercent
+}
+
+// comparisonRecorder is the built-in middleware collecting the transcript of
+// the responses to compared requests. It runs before the thinking filter so
+// the transcripts keep the thinking blocks, and redacts their text itself as
+// the text redaction runs later.
+type comparisonRecorder struct {
+	proxy *Proxy
+}
+
+// Request returns a hook collecting the response of compared streamed requests
+func (m comparisonRecorder) Request(req *Request) (StreamHook, error) {
+	if !req.compare {
+		return nil, nil
+	}
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		log.Printf("[%s] Not comparing a request that isn't streamed", req.label)
+		req.compare = false
+		return nil, nil
+	}
+	req.comparison = &comparison{proxy: m.proxy, record: &Comparison{
+		Time:         req.started,
+		Request:      req.label,
+		Conversation: req.Conversation,
+		Client:       req.Client,
+	}, pending: 2}
+	return &comparisonHook{req: req, collector: newTranscriptCollector(m.proxy.textRedactors, m.proxy.memory.newAccount(req.label))}, nil
+}
+
+// comparisonHook collects the content blocks of the primary response
+type comparisonHook struct {
+	req       *Request
+	collector *transcriptCollector
+}
+
+// Event accumulates the content blocks of the response. Events are never modified.
+func (h *comparisonHook) Event(event *sse.Event) bool {
+	h.collector.observe(event)
+	return true
+}
+
+// Done completes the primary side of the comparison
+func (h *comparisonHook) Done() {
+	defer h.collector.close()
+	c := h.req.comparison
+	if c == nil || !c.started {
+		return
+	}
+	usage := h.req.usage
+	if usage.Model == "" {
+		c.primaryDone(nil, errors.New("the upstream never started a message"))
+		return
+	}
+	c.primaryDone(c.proxy.newTranscript(h.req, h.req.Body, usage, h.collector.content()))
+}
+
+// comparison is a comparison in progress, saved once both sides completed
+type comparison struct {
+	proxy *Proxy
+	// started is set once the request went to the comparison model, as
+	// requests rejected before being forwarded aren't compared
+	started bool
+
+	mu      sync.Mutex
+	record  *Comparison
+	pending int
+	primary bool
+}
+
+// primaryDone completes the primary side, once
+func (c *comparison) primaryDone(transcript *Transcript, err error) {
+	c.mu.Lock()
+	done := c.primary
+	c.primary = true
+	c.mu.Unlock()
+	if done {
+		return
+	}
+	c.done(func(r *Comparison) {
+		if err != nil {
+			r.PrimaryError = err.Error()
+		}
+		r.Primary = transcript
+	})
+}
+
+// endComparison completes the primary side of a compared request once it was
+// forwarded, when its response wasn't streamed to the end, e.g. an error
+func (p *Proxy) endComparison(req *Request) {
+	if c := req.comparison; c != nil && c.started {
+		c.primaryDone(nil, errors.New("the request failed"))
+	}
+}
+
+// done applies the result of a side, saving the comparison after the last one
+func (c *comparison) done(apply func(*Comparison)) {
+	c.mu.Lock()
+	apply(c.record)
+	c.pending--
+	last := c.pending == 0
+	c.mu.Unlock()
+	if !last {
+		return
+	}
+	if err := c.proxy.comparisons.save(c.record); err != nil {
+		log.Printf("[%s] Error saving comparison: %v", c.record.Request, err)
+		return
+	}
+	log.Printf("[%s] Saved the comparison of %s and %s", c.record.Request, transcriptModel(c.record.Primary), transcriptModel(c.record.Secondary))
+}
+
+// transcriptModel returns the model of a transcript, or "no response"
+func transcriptModel(t *Transcript) string {
+	if t == nil {
+		return "no response"
+	}
+	return t.Model
+}
+
+// startComparison sends a request, as it is forwarded, to the comparison model
+// in the background. The client never sees its response.
+func (p *Proxy) startComparison(r *http.Request, req *Request) {
+	c := req.comparison
+	if c == nil {
+		return
+	}
+	c.started = true
+
+	body := maps.Clone(req.Body)
+	body["model"] = p.cfg.CompareModel
+	if _, err := p.fitModelCapabilities(r.Header, body, true); err != nil {
+		c.done(func(r *Comparison) { r.SecondaryError = err.Error() })
+		return
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		c.done(func(r *Comparison) { r.SecondaryError = err.Error() })
+		return
+	}
+	header := r.Header.Clone()
+	log.Printf("[%s] Sending the request to %s for comparison", req.label, p.cfg.CompareModel)
+
+	go func() {
+		usage := &requestUsage{}
+		content, err := p.sendComparison(header, req.label, req.Client, bodyBytes, usage)
+		usage.Duration = time.Since(req.started)
+		// The comparison model's tokens are spent by the client too
+		p.usage.record(req.Client, usage)
+		p.spend.record(req.Client, usage)
+
+		var transcript *Transcript
+		if err == nil {
+			transcript, err = p.newTranscript(req, body, usage, content)
+		}
+		c.done(func(r *Comparison) {
+			if err != nil {
+				r.SecondaryError = err.Error()
+			}
+			r.Secondary = transcript
+		})
+	}()
+}
+
+// sendComparison sends the request labeled label to the comparison model,
+// returning the content of its response and accounting for its usage
+func (p *Proxy) sendComparison(header http.Header, label, client string, bodyBytes []byte, usage *requestUsage) ([]map[string]any, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), clientIDKey, client), compareTimeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, MessagesEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = header
+
+	resp, err := p.sendOrReplay(r, bodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("comparison model returned %s: %s", resp.Status, truncate(string(body), 200))
+	}
+
+	collector := newTranscriptCollector(p.textRedactors, p.memory.newAccount(label))
+	defer collector.close()
+	reader := sse.NewReader(resp.Body)
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *sse.ParseError
+		if errors.As(err, &parseErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		usage.observeData(event.Data)
+		collector.observe(event)
+	}
+	if usage.Model == "" {
+		return nil, errors.New("the comparison model never started a message")
+	}
+	return collector.content(), nil
+}
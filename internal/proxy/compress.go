@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// decompressResponse replaces a gzip or deflate encoded response body with the
+// decoded stream so it can be parsed and recorded. Go's transport only does this
+// itself when it chose the encoding, which isn't the case for servers that
+// ignore Accept-Encoding.
+func decompressResponse(resp *http.Response) error {
+	decoded, err := newDecoder(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		return fmt.Errorf("decoding response body: %w", err)
+	}
+	if decoded == nil {
+		return nil
+	}
+
+	resp.Body = &decodedBody{ReadCloser: decoded, raw: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// maxDecodedRequestSize bounds the size of decompressed request bodies, so a
+// small compressed body can't expand without limit
+const maxDecodedRequestSize = 64 << 20
+
+// decompressRequest decodes gzip and deflate encoded request bodies, so they
+// can be parsed and rewritten like the others, and forwarded unencoded
+func decompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoded, err := newDecoder(r.Header.Get("Content-Encoding"), r.Body)
+		var unsupported *unsupportedEncodingError
+		if errors.As(err, &unsupported) {
+			writeAPIError(w, http.StatusUnsupportedMediaType, "invalid_request_error", "Unsupported request body encoding: "+unsupported.encoding)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid compressed request body: "+err.Error())
+			return
+		}
+		if decoded != nil {
+			r.Body = &decodedBody{ReadCloser: http.MaxBytesReader(w, decoded, maxDecodedRequestSize), raw: r.Body}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unsupportedEncodingError is returned for content encodings without a decoder
+type unsupportedEncodingError struct {
+	encoding string
+}
+
+// Error describes the encoding
+func (e *unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q", e.encoding)
+}
+
+// newDecoder returns a reader decoding a body of the given content encoding,
+// or nil when it isn't encoded
+func newDecoder(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+	case "", "identity":
+		return nil, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	}
+	return nil, &unsupportedEncodingError{encoding: encoding}
+}
+
+// decodedBody reads a decoded response body, closing the raw body with it
+type decodedBody struct {
+	io.ReadCloser
+	raw io.ReadCloser
+}
+
+// Close closes the decoder and the raw response body
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.raw.Close()
+}
+
+// acceptsGzip checks if the client accepts gzip encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(value), ";")
+		if strings.EqualFold(coding, "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses a response, flushing the compressor with every
+// flush so streamed events still reach the client immediately
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// newGzipResponseWriter returns a writer compressing the response to w
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+	return &gzipResponseWriter{ResponseWriter: w, gz: gzip.NewWriter(w)}
+}
+
+// Write compresses data to the response
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	return g.gz.Write(p)
+}
+
+// Flush sends the data compressed so far to the client
+func (g *gzipResponseWriter) Flush() {
+	if err := g.gz.Flush(); err != nil {
+		log.Printf("Error flushing compressed response: %v", err)
+		return
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes the end of the compressed stream
+func (g *gzipResponseWriter) Close() {
+	if err := g.gz.Close(); err != nil {
+		log.Printf("Error finishing compressed response: %v", err)
+	}
+}
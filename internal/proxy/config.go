@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// FileConfig holds the settings loaded from the JSON configuration file, for
+// settings that don't fit in flags
+type FileConfig struct {
+	// BetaRules decide which anthropic-beta values are attached to requests,
+	// replacing the defaults when set
+	BetaRules []rewrite.BetaRule `json:"beta_rules"`
+
+	// SystemPrompts add text to the system prompt of matching requests, applied in order
+	SystemPrompts []rewrite.SystemPromptRule `json:"system_prompts"`
+
+	// ThinkingBudgets maps model glob patterns to their default thinking budget
+	ThinkingBudgets map[string]int `json:"thinking_budgets"`
+
+	// EffortBudgets maps the effort levels of "-thinking-<effort>" aliases to
+	// their thinking budget, replacing the defaults of the levels set
+	EffortBudgets map[string]int `json:"effort_budgets"`
+
+	// ContextWindows maps model glob patterns to their context window in tokens
+	ContextWindows map[string]int `json:"context_windows"`
+
+	// Models add model capabilities to the built-in registry by glob pattern
+	Models map[string]ModelCapabilities `json:"models"`
+
+	// FallbackModels maps model glob patterns to the model requests are sent
+	// to when the upstream stays overloaded
+	FallbackModels map[string]string `json:"fallback_models"`
+
+	// PinnedModels maps "-latest" model aliases to the snapshots they are
+	// pinned to
+	PinnedModels map[string]string `json:"pinned_models"`
+
+	// ModelAliases maps model names clients may use to the model they stand for
+	ModelAliases map[string]string `json:"model_aliases"`
+
+	// Redactions replace matches of regular expressions in the text of
+	// streamed responses, applied in order
+	Redactions []RedactionRule `json:"redactions"`
+
+	// RequestRedactions replace matches of regular expressions or built-in
+	// detectors in the content of requests before they are forwarded
+	RequestRedactions []RedactionRule `json:"request_redactions"`
+
+	// ClientAPIKeys maps authenticated client names to the Anthropic API key
+	// their requests are sent with, "*" matching the other clients. Values of
+	// the form env:NAME are read from the environment.
+	ClientAPIKeys map[string]string `json:"client_api_keys"`
+
+	// HeaderRules set, add or remove headers of the requests forwarded to the
+	// Anthropic API, applied in order. Values of the form env:NAME are read
+	// from the environment.
+	HeaderRules []HeaderRule `json:"header_rules"`
+
+	// Schedules override runtime settings while their cron expressions
+	// match, applied in order
+	Schedules []ScheduleRule `json:"schedules"`
+}
+
+// LoadConfigFile reads a JSON configuration file and applies it to cfg
+func LoadConfigFile(filename string, cfg *Config) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var file FileConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing %s: %w", filename, err)
+	}
+
+	if err := validateThinkingBudgets(file.ThinkingBudgets); err != nil {
+		return err
+	}
+
+	for pattern, window := range file.ContextWindows {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("context_windows: invalid pattern %q: %w", pattern, err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("context_windows: window %d for %q must be positive", window, pattern)
+		}
+	}
+
+	if err := validateModels(file.Models); err != nil {
+		return err
+	}
+	if err := validateFallbackModels(file.FallbackModels); err != nil {
+		return err
+	}
+
+	for effort, budget := range file.EffortBudgets {
+		if !slices.Contains(rewrite.EffortLevels, effort) {
+			return fmt.Errorf("effort_budgets: unknown effort level %q: must be one of %s", effort, strings.Join(rewrite.EffortLevels, ", "))
+		}
+		if budget < rewrite.MinThinkingBudget {
+			return fmt.Errorf("effort_budgets: budget %d for %q is below the minimum of %d", budget, effort, rewrite.MinThinkingBudget)
+		}
+	}
+
+	for client, key := range file.ClientAPIKeys {
+		if name, ok := strings.CutPrefix(key, "env:"); ok {
+			key = os.Getenv(name)
+			if key == "" {
+				return fmt.Errorf("client_api_keys: environment variable %s for %q is not set", name, client)
+			}
+			file.ClientAPIKeys[client] = key
+		}
+		if key == "" {
+			return fmt.Errorf("client_api_keys: empty API key for %q", client)
+		}
+	}
+
+	if err := validateHeaderRules(file.HeaderRules); err != nil {
+		return err
+	}
+
+	cfg.Rewrite.BetaRules = file.BetaRules
+	cfg.Rewrite.SystemPrompts = file.SystemPrompts
+	cfg.Rewrite.ThinkingBudgets = file.ThinkingBudgets
+	cfg.Rewrite.EffortBudgets = file.EffortBudgets
+	cfg.Rewrite.ModelAliases = file.ModelAliases
+	cfg.ContextWindows = file.ContextWindows
+	cfg.Models = file.Models
+	cfg.PinnedModels = file.PinnedModels
+	cfg.FallbackModels = file.FallbackModels
+	cfg.Redactions = file.Redactions
+	cfg.RequestRedactions = file.RequestRedactions
+	cfg.ClientAPIKeys = file.ClientAPIKeys
+	cfg.HeaderRules = file.HeaderRules
+	cfg.Schedules = file.Schedules
+
+	return nil
+}
+
+// validateThinkingBudgets checks the patterns and budgets of per-model thinking budgets
+func validateThinkingBudgets(budgets map[string]int) error {
+	for pattern, budget := range budgets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("thinking_budgets: invalid pattern %q: %w", pattern, err)
+		}
+		if budget < rewrite.MinThinkingBudget {
+			return fmt.Errorf("thinking_budgets: budget %d for %q is below the minimum of %d", budget, pattern, rewrite.MinThinkingBudget)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+)
+
+// Modes of handling requests that overflow the context window of their model
+const (
+	ContextOverflowOff      = "off"      // Forward requests as they are
+	ContextOverflowReject   = "reject"   // Reject overflowing requests with a clear error
+	ContextOverflowTruncate = "truncate" // Drop the oldest messages until the request fits
+)
+
+// countTokensThreshold is the share of the available context above which the
+// local estimate is checked with the token counting API
+const countTokensThreshold = 0.8
+
+// countTokensFields are the Messages API fields the token counting API accepts
+var countTokensFields = []string{"model", "messages", "system", "tools", "tool_choice", "thinking", "mcp_servers"}
+
+// validateContextOverflow checks that a context overflow mode is known
+func validateContextOverflow(mode string) error {
+	switch mode {
+	case "", ContextOverflowOff, ContextOverflowReject, ContextOverflowTruncate:
+		return nil
+	}
+	return fmt.Errorf("invalid context overflow mode %q: must be %s, %s or %s",
+		mode, ContextOverflowOff, ContextOverflowReject, ContextOverflowTruncate)
+}
+
+// contextOverflowError reports a request too long for the context window
+type contextOverflowError struct {
+	tokens, window, maxTokens int
+}
+
+func (e *contextOverflowError) Error() string {
+	return fmt.Sprintf("prompt is too long: about %d tokens > %d maximum (context window of %d tokens minus max_tokens of %d)",
+		e.tokens, e.window-e.maxTokens, e.window, e.maxTokens)
+}
+
+// contextWindowFor returns the context window of a model, from the most
+// specific (longest) matching pattern, else the model registry, else the
+// default
+func (p *Proxy) contextWindowFor(model string) int {
+	window, matched := p.cfg.ContextWindow, ""
+	for pattern, patternWindow := range p.cfg.ContextWindows {
+		if ok, _ := path.Match(pattern, model); ok && len(pattern) > len(matched) {
+			window, matched = patternWindow, pattern
+		}
+	}
+	if caps, ok := p.modelCapabilities(model); ok && matched == "" {
+		window = caps.ContextWindow
+	}
+	return window
+}
+
+// fitContextWindow checks that a request leaves room for max_tokens in the
+// context window of its model. Overflowing requests are rejected, or in
+// truncate mode have their oldest messages dropped until they fit.
+func (p *Proxy) fitContextWindow(r *http.Request, req *Request) error {
+	mode := p.cfg.ContextOverflow
+	if mode == "" || mode == ContextOverflowOff {
+		return nil
+	}
+
+	model, _ := req.Body["model"].(string)
+	window := p.contextWindowFor(model)
+	maxTokens := intValue(req.Body["max_tokens"])
+	limit := window - maxTokens
+	tokens, scale := p.countRequestTokens(r, req.Body, limit)
+	if tokens <= limit {
+		return nil
+	}
+	if mode == ContextOverflowReject {
+		return &contextOverflowError{tokens: tokens, window: window, maxTokens: maxTokens}
+	}
+
+	// Drop the oldest messages, restarting the conversation at a user turn
+	// that doesn't answer a dropped tool call
+	messages, _ := req.Body["messages"].([]any)
+	dropped := 0
+	for len(messages) > 1 && (tokens > limit || !startsConversation(messages[0])) {
+		tokens -= int(estimateJSONTokens(messages[0]) * scale)
+		messages = messages[1:]
+		dropped++
+	}
+	if tokens > limit {
+		return &contextOverflowError{tokens: tokens, window: window, maxTokens: maxTokens}
+	}
+
+	log.Printf("Dropped the %d oldest messages to fit the context window of %s (about %d tokens)", dropped, model, tokens)
+	req.Body["messages"] = messages
+	req.Modified = true
+	return nil
+}
+
+// countRequestTokens returns the input tokens of a request, estimated locally
+// and counted with the token counting API when the estimate is close to the
+// limit. The ratio of the count to the estimate calibrates later estimates.
+func (p *Proxy) countRequestTokens(r *http.Request, bodyJSON map[string]any, limit int) (int, float64) {
+	estimate := estimateJSONTokens(bodyJSON)
+	if !p.cfg.ContextCountTokens || estimate < countTokensThreshold*float64(limit) {
+		return int(estimate), 1
+	}
+
+	count, err := p.countTokens(r, bodyJSON)
+	if err != nil {
+		log.Printf("Error counting tokens, using the estimate of %d: %v", int(estimate), err)
+		return int(estimate), 1
+	}
+	log.Printf("Counted %d input tokens (estimated %d)", count, int(estimate))
+	return count, float64(count) / max(estimate, 1)
+}
+
+// countTokens counts the input tokens of a Messages API request with the token
+// counting API
+func (p *Proxy) countTokens(r *http.Request, bodyJSON map[string]any) (int, error) {
+	countBody := make(map[string]any, len(countTokensFields))
+	for _, field := range countTokensFields {
+		if value, ok := bodyJSON[field]; ok {
+			countBody[field] = value
+		}
+	}
+	bodyBytes, err := json.Marshal(countBody)
+	if err != nil {
+		return 0, err
+	}
+
+	countReq := r.Clone(r.Context())
+	countReq.URL.Path = CountTokensEndpoint
+	resp, err := p.sendOrReplay(countReq, bodyBytes)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("token counting returned %d: %s", resp.StatusCode, bytes.TrimSpace(data))
+	}
+	var result struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return 0, err
+	}
+	return result.InputTokens, nil
+}
+
+// estimateJSONTokens roughly estimates the tokens of a JSON value
+func estimateJSONTokens(value any) float64 {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	return estimateInputTokens(data)
+}
+
+// startsConversation checks if a message can be the first of a conversation:
+// a user turn that isn't the result of an earlier tool call
+func startsConversation(message any) bool {
+	msg, _ := message.(map[string]any)
+	if msg["role"] != "user" {
+		return false
+	}
+	blocks, _ := msg["content"].([]any)
+	for _, block := range blocks {
+		if block, ok := block.(map[string]any); ok && block["type"] == "tool_result" {
+			return false
+		}
+	}
+	return true
+}
+
+// intValue returns a JSON number decoded into an interface as an int
+func intValue(value any) int {
+	switch v := value.(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
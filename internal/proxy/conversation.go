@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConversationHeader lets clients name the conversation a request belongs to.
+// It is removed before the request is forwarded.
+const ConversationHeader = "X-Conversation-Id"
+
+// ConversationsEndpoint is the admin endpoint listing the tracked conversations
+const ConversationsEndpoint = "/conversations"
+
+// Bounds of the conversation history kept in memory
+const (
+	maxConversations        = 500
+	maxConversationRequests = 200
+)
+
+// conversationID returns the conversation a Messages API request belongs to,
+// from the conversation header or else a hash of the system prompt and first
+// message, which every turn of a conversation repeats
+func conversationID(header http.Header, bodyJSON map[string]any) string {
+	if id := strings.TrimSpace(header.Get(ConversationHeader)); id != "" {
+		return id
+	}
+
+	messages, _ := bodyJSON["messages"].([]any)
+	if len(messages) == 0 {
+		return ""
+	}
+	prefix, err := json.Marshal([]any{bodyJSON["system"], messages[0]})
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(prefix)
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+// conversationRequest is a completed request of a conversation
+type conversationRequest struct {
+	Label          string    `json:"label"`
+	Time           time.Time `json:"time"`
+	DurationMS     int64     `json:"duration_ms"`
+	Client         string    `json:"client"`
+	Model          string    `json:"model"`
+	StopReason     string    `json:"stop_reason,omitempty"`
+	InputTokens    int64     `json:"input_tokens"`
+	OutputTokens   int64     `json:"output_tokens"`
+	ThinkingTokens int64     `json:"thinking_tokens_estimated"`
+	Cached         bool      `json:"cached,omitempty"`
+}
+
+// conversation is the history of the requests of a conversation
+type conversation struct {
+	ID        string                `json:"id"`
+	FirstSeen time.Time             `json:"first_seen"`
+	LastSeen  time.Time             `json:"last_seen"`
+	Usage     usageTotals           `json:"usage"`
+	Requests  []conversationRequest `json:"requests,omitempty"`
+}
+
+// conversationTracker keeps the history of recent conversations, dropping the
+// least recently active ones past the limit
+type conversationTracker struct {
+	mu            sync.Mutex
+	conversations map[string]*conversation
+}
+
+// newConversationTracker returns a tracker without conversations
+func newConversationTracker() *conversationTracker {
+	return &conversationTracker{conversations: make(map[string]*conversation)}
+}
+
+// record adds a completed request to its conversation
+func (t *conversationTracker) record(id string, request conversationRequest, u *requestUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.conversations[id]
+	if !ok {
+		if len(t.conversations) >= maxConversations {
+			t.evictOldest()
+		}
+		c = &conversation{ID: id, FirstSeen: request.Time}
+		t.conversations[id] = c
+	}
+	c.LastSeen = request.Time
+	c.Usage.add(u, estimateCost(u))
+	c.Requests = append(c.Requests, request)
+	if len(c.Requests) > maxConversationRequests {
+		c.Requests = slices.Delete(c.Requests, 0, len(c.Requests)-maxConversationRequests)
+	}
+}
+
+// evictOldest drops the least recently active conversation
+func (t *conversationTracker) evictOldest() {
+	var oldest *conversation
+	for _, c := range t.conversations {
+		if oldest == nil || c.LastSeen.Before(oldest.LastSeen) {
+			oldest = c
+		}
+	}
+	if oldest != nil {
+		delete(t.conversations, oldest.ID)
+	}
+}
+
+// list returns the conversations without their requests, most recent first
+func (t *conversationTracker) list() []conversation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]conversation, 0, len(t.conversations))
+	for _, c := range t.conversations {
+		summary := *c
+		summary.Requests = nil
+		list = append(list, summary)
+	}
+	slices.SortFunc(list, func(a, b conversation) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return list
+}
+
+// get returns a copy of a conversation with its requests
+func (t *conversationTracker) get(id string) (conversation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.conversations[id]
+	if !ok {
+		return conversation{}, false
+	}
+	result := *c
+	result.Requests = slices.Clone(c.Requests)
+	return result, true
+}
+
+// handleConversations serves the list of tracked conversations
+func (p *Proxy) handleConversations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.conversations.list())
+}
+
+// handleConversation serves the history of a single conversation
+func (p *Proxy) handleConversation(w http.ResponseWriter, r *http.Request) {
+	c, ok := p.conversations.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "Unknown conversation")
+		return
+	}
+	writeJSON(w, c)
+}
+
+// writeJSON writes an indented JSON response
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// DryRunParam is the query parameter making the proxy answer a Messages API
+// request with the request it would send upstream, without sending it
+const DryRunParam = "dry_run"
+
+// dryRunResponse is the request the proxy would send upstream
+type dryRunResponse struct {
+	Method string             `json:"method"`
+	URL    string             `json:"url"`
+	Header http.Header        `json:"headers"`
+	Body   any                `json:"body"`
+	Proxy  *proxyErrorContext `json:"proxy"`
+}
+
+// isDryRun checks if a request asks for a dry run
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get(DryRunParam))
+	return dryRun
+}
+
+// writeDryRun answers with the request that would be sent to the first
+// healthy target: its URL, headers with the credentials redacted, and body
+// once rewritten, along with the changes the proxy made to the request
+func (p *Proxy) writeDryRun(w http.ResponseWriter, r *http.Request, bodyBytes []byte, req *Request) {
+	target := p.upstreams[0]
+	// Nothing is sent, so the breakers aren't asked for a probe
+	for _, u := range p.upstreams {
+		if !u.breaker.isOpen() {
+			target = u
+			break
+		}
+	}
+
+	forwardReq, err := p.newUpstreamRequest(target, r, bodyBytes)
+	if err != nil {
+		log.Printf("Error building dry run request: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "api_error", "Error building the upstream request: "+err.Error())
+		return
+	}
+	sent, err := io.ReadAll(forwardReq.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "api_error", "Error reading the upstream request: "+err.Error())
+		return
+	}
+
+	// Show JSON bodies as they are, anything else as a string
+	var body any = p.sensitive.Text(string(sent))
+	if json.Valid(sent) {
+		body = json.RawMessage(p.sensitive.JSON(sent))
+	}
+	log.Printf("[%s] Dry run: not sending the request to %s", req.label, forwardReq.URL.Redacted())
+	writeJSON(w, dryRunResponse{
+		Method: forwardReq.Method,
+		URL:    forwardReq.URL.Redacted(),
+		Header: p.sensitive.Headers(forwardReq.Header),
+		Body:   body,
+		Proxy:  req.errorContext(0),
+	})
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// encryptedMagic starts the data encrypted by the proxy, so encrypted and
+// plain objects can be told apart when reading them back
+const encryptedMagic = "zcpenc1\n"
+
+// encryptedLinePrefix starts the lines of files encrypted line by line
+const encryptedLinePrefix = "zcpenc1:"
+
+// kmsTimeout bounds the call decrypting the data key with AWS KMS
+const kmsTimeout = 30 * time.Second
+
+// encryptor encrypts thinking and transcripts at rest with AES-256-GCM
+type encryptor struct {
+	aead cipher.AEAD
+}
+
+// loadEncryptor returns an encryptor for the key described by spec, nil when
+// spec is empty: "env:NAME" or "file:PATH" hold a base64 encoded 32 byte key,
+// "kms:BLOB" is a data key encrypted with AWS KMS, as returned by
+// GenerateDataKey, decrypted with the AWS_* credentials from the environment
+func loadEncryptor(ctx context.Context, spec string) (*encryptor, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	kind, arg, _ := strings.Cut(spec, ":")
+	var (
+		key []byte
+		err error
+	)
+	switch kind {
+	case "env":
+		value := os.Getenv(arg)
+		if value == "" {
+			return nil, fmt.Errorf("encryption key: %s is not set", arg)
+		}
+		key, err = decodeKey(value)
+	case "file":
+		var data []byte
+		if data, err = os.ReadFile(arg); err == nil {
+			key, err = decodeKey(string(data))
+		}
+	case "kms":
+		var blob []byte
+		if blob, err = decodeBase64(arg); err == nil {
+			key, err = kmsDecrypt(ctx, blob)
+		}
+	default:
+		return nil, fmt.Errorf("encryption key %q: expected env:NAME, file:PATH or kms:BLOB", spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key: expected 32 bytes for AES-256, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptor{aead: aead}, nil
+}
+
+// decodeKey decodes a base64 encoded key, ignoring surrounding whitespace
+func decodeKey(value string) ([]byte, error) {
+	key, err := decodeBase64(strings.TrimSpace(value))
+	if err != nil {
+		return nil, errors.New("the key must be base64 encoded")
+	}
+	return key, nil
+}
+
+// decodeBase64 decodes standard or URL safe base64, padded or not
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.TrimRight(value, "=")
+	if strings.ContainsAny(value, "-_") {
+		return base64.RawURLEncoding.DecodeString(value)
+	}
+	return base64.RawStdEncoding.DecodeString(value)
+}
+
+// kmsDecrypt decrypts a data key with AWS KMS in the region from AWS_REGION
+func kmsDecrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		return nil, errors.New("AWS_REGION is required to decrypt the key with KMS")
+	}
+	payload, err := json.Marshal(map[string]string{"CiphertextBlob": base64.StdEncoding.EncodeToString(blob)})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kmsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://kms."+region+".amazonaws.com/", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	signV4(req, payload, creds, region, "kms", time.Now())
+
+	body, err := readObjectStoreResponse(objectStoreClient.Do(req))
+	if err != nil {
+		return nil, fmt.Errorf("KMS decrypt: %w", err)
+	}
+	var result struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("KMS decrypt: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(result.Plaintext)
+}
+
+// seal encrypts data, prefixing it with the magic and a random nonce
+func (e *encryptor) seal(data []byte) []byte {
+	nonce := make([]byte, e.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := append([]byte(encryptedMagic), nonce...)
+	return e.aead.Seal(sealed, nonce, data, nil)
+}
+
+// isEncrypted reports whether data was encrypted by the proxy
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+// open decrypts data sealed by seal. Data that isn't encrypted, such as what
+// was stored before encryption was enabled, is returned as it is.
+func (e *encryptor) open(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	if e == nil {
+		return nil, errors.New("data is encrypted, an encryption key is required")
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < e.aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	nonce, ciphertext := data[:e.aead.NonceSize()], data[e.aead.NonceSize():]
+	plain, err := e.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("decryption failed, wrong key or corrupted data")
+	}
+	return plain, nil
+}
+
+// sealLine encrypts a line of a file encrypted line by line, as text
+func (e *encryptor) sealLine(line []byte) []byte {
+	sealed := e.seal(line)[len(encryptedMagic):]
+	return []byte(encryptedLinePrefix + base64.StdEncoding.EncodeToString(sealed))
+}
+
+// openLine decrypts a line sealed by sealLine, returning other lines as they are
+func (e *encryptor) openLine(line []byte) ([]byte, error) {
+	encoded, ok := bytes.CutPrefix(line, []byte(encryptedLinePrefix))
+	if !ok {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, errors.New("invalid encrypted line")
+	}
+	return e.open(append([]byte(encryptedMagic), sealed...))
+}
+
+// Decrypt writes the content of a file the proxy encrypted with the key
+// described by keySpec to w: a history batch (still gzipped) or a file of
+// thinking blocks encrypted line by line
+func Decrypt(ctx context.Context, w io.Writer, data []byte, keySpec string) error {
+	e, err := loadEncryptor(ctx, keySpec)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return errors.New("an encryption key is required")
+	}
+	if isEncrypted(data) {
+		plain, err := e.open(data)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(plain)
+		return err
+	}
+	for i, line := range bytes.SplitAfter(data, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\n")
+		if len(trimmed) == 0 {
+			continue
+		}
+		plain, err := e.openLine(trimmed)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if _, err := w.Write(append(plain, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptedStore encrypts the objects saved to a history store and decrypts
+// them when they are read back
+type encryptedStore struct {
+	historyStore
+	encryptor *encryptor
+}
+
+// encryptStore returns store encrypting its objects with e, or store itself
+// when e is nil
+func encryptStore(store historyStore, e *encryptor) historyStore {
+	if e == nil {
+		return store
+	}
+	return encryptedStore{historyStore: store, encryptor: e}
+}
+
+// openHistoryStore returns the history store described by spec for reading,
+// decrypting its objects with the key described by keySpec. Without a key,
+// encrypted objects fail with an error saying a key is required.
+func openHistoryStore(ctx context.Context, spec, endpoint, keySpec string) (historyStore, string, error) {
+	store, prefix, err := parseHistoryStore(spec, endpoint)
+	if err != nil {
+		return nil, "", fmt.Errorf("history store %q: %w", spec, err)
+	}
+	e, err := loadEncryptor(ctx, keySpec)
+	if err != nil {
+		return nil, "", err
+	}
+	return encryptedStore{historyStore: store, encryptor: e}, prefix, nil
+}
+
+// Put encrypts data and saves it under a key
+func (s encryptedStore) Put(ctx context.Context, key string, data []byte) error {
+	if s.encryptor == nil {
+		return s.historyStore.Put(ctx, key, data)
+	}
+	return s.historyStore.Put(ctx, key, s.encryptor.seal(data))
+}
+
+// Get returns the decrypted data saved under a key
+func (s encryptedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.historyStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.encryptor.open(data)
+}
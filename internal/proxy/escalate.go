@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// escalatable checks if a request may be retried with a larger thinking
+// budget: a streamed "-thinking" request, whose thinking the client doesn't
+// see, that isn't already a retry
+func (p *Proxy) escalatable(r *http.Request, req *Request) bool {
+	if p.cfg.EscalateBudgetMax <= 0 || r.Context().Value(escalationRetryKey) != nil {
+		return false
+	}
+	stream, _ := req.Body["stream"].(bool)
+	return stream && rewrite.HasThinkingSuffix(req.ClientModel) && thinkingBudget(req.Body) > 0
+}
+
+// escalatedBudget returns the budget to retry with after budget was used up,
+// doubled up to the escalation and thinking budget caps, or 0 when it can't grow
+func (p *Proxy) escalatedBudget(budget int) int {
+	next := min(2*budget, p.cfg.EscalateBudgetMax)
+	if p.cfg.MaxThinkingBudget > 0 {
+		next = min(next, p.cfg.MaxThinkingBudget)
+	}
+	if next <= budget {
+		return 0
+	}
+	return next
+}
+
+// forwardEscalating forwards a request holding its response back until the
+// answer starts. When the thinking used up its budget without an answer, the
+// response is dropped and the request, as the client sent it, is handled again
+// once with a doubled budget. Otherwise the held response is sent as it is.
+func (p *Proxy) forwardEscalating(w http.ResponseWriter, r *http.Request, bodyBytes []byte, req *Request, original []byte, header http.Header) {
+	// The held response is parsed, so it must not be compressed for the client
+	r.Header.Del("Accept-Encoding")
+	held := &heldResponse{w: w, usage: req.usage, header: make(http.Header), status: http.StatusOK}
+	p.forwardRequestAndHandleResponse(held, r, bodyBytes, req)
+
+	budget := thinkingBudget(req.Body)
+	next := p.escalatedBudget(budget)
+	if !held.holding || next == 0 || !thinkingTruncated(req.usage, budget) {
+		held.release()
+		return
+	}
+
+	log.Printf("[%s] Thinking used up its budget of %d tokens without an answer (stop reason %s), retrying with %d",
+		req.label, budget, req.usage.StopReason, next)
+	retry := r.Clone(context.WithValue(r.Context(), escalationRetryKey, true))
+	retry.Header = header
+	retry.Header.Set(ThinkingBudgetHeader, strconv.Itoa(next))
+	retry.Body = io.NopCloser(bytes.NewReader(original))
+	retry.ContentLength = int64(len(original))
+	p.handle(w, retry)
+}
+
+// thinkingTruncated checks if a response stopped at max_tokens or with its
+// thinking budget used up
+func thinkingTruncated(usage *requestUsage, budget int) bool {
+	return usage.StopReason == "max_tokens" || float64(usage.thinkingTokens()) >= thinkingExhaustedRatio*float64(budget)
+}
+
+// heldResponse buffers a streamed response until its answer starts, the first
+// content block of the upstream that isn't thinking, and then writes it
+// through. Thinking previews don't count as the answer. Error responses are
+// written through from the start.
+type heldResponse struct {
+	w http.ResponseWriter
+	// usage of the response, updated before its events are written
+	usage   *requestUsage
+	header  http.Header
+	status  int
+	buffer  bytes.Buffer
+	holding bool
+	// released is set once the response is written through
+	released bool
+}
+
+// Header returns the headers of the response, the client's once released
+func (h *heldResponse) Header() http.Header {
+	if h.released {
+		return h.w.Header()
+	}
+	return h.header
+}
+
+// WriteHeader holds the status back, unless it is an error
+func (h *heldResponse) WriteHeader(status int) {
+	if h.released {
+		return
+	}
+	h.status, h.holding = status, true
+	if status < 200 || status >= 300 {
+		h.release()
+	}
+}
+
+// Write buffers the body until the answer starts
+func (h *heldResponse) Write(p []byte) (int, error) {
+	if h.released {
+		return h.w.Write(p)
+	}
+	h.holding = true
+	h.buffer.Write(p)
+	if h.usage.AnswerStarted {
+		h.release()
+	}
+	return len(p), nil
+}
+
+// Flush sends the data written so far once released
+func (h *heldResponse) Flush() {
+	if flusher, ok := h.w.(http.Flusher); ok && h.released {
+		flusher.Flush()
+	}
+}
+
+// release writes the held response through to the client, if anything was written
+func (h *heldResponse) release() {
+	if h.released || !h.holding {
+		return
+	}
+	h.released, h.holding = true, false
+	for name, values := range h.header {
+		h.w.Header()[name] = values
+	}
+	h.w.WriteHeader(h.status)
+	if _, err := h.w.Write(h.buffer.Bytes()); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+	h.buffer.Reset()
+	h.Flush()
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of the events in the event log
+const (
+	eventFromUpstream = "upstream"
+	eventToClient     = "client"
+)
+
+// loggedEvent is an SSE event of a streamed response in the event log
+type loggedEvent struct {
+	Time      time.Time `json:"time"`
+	Request   string    `json:"request"`
+	Direction string    `json:"direction"`
+	Event     string    `json:"event,omitempty"`
+	// Data is the decoded JSON data of the event, or its text when it isn't JSON
+	Data     any      `json:"data,omitempty"`
+	Comments []string `json:"comments,omitempty"`
+}
+
+// eventLog appends every event of streamed responses to a file as a JSON line,
+// once as received from the upstream and once as forwarded to the client, so
+// the two can be compared when debugging the filtering
+type eventLog struct {
+	mu        sync.Mutex
+	file      *os.File
+	sensitive *sensitiveData
+}
+
+// openEventLog opens the event log file for appending
+func openEventLog(path string, sensitive *sensitiveData) (*eventLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{file: file, sensitive: sensitive}, nil
+}
+
+// write appends an event to the log
+func (l *eventLog) write(event *loggedEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event for the event log: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing event log: %v", err)
+	}
+}
+
+// tap returns the upstream body and the client writer of a response, logging
+// the events read from the one and written to the other
+func (l *eventLog) tap(label string, body io.ReadCloser, w http.ResponseWriter) (io.ReadCloser, http.ResponseWriter) {
+	upstream := &eventLogTap{log: l, request: label, direction: eventFromUpstream}
+	client := &eventLogTap{log: l, request: label, direction: eventToClient}
+	return &eventLogBody{ReadCloser: body, tap: upstream}, &eventLogWriter{ResponseWriter: w, tap: client}
+}
+
+// eventLogTap splits a stream into events and logs them
+type eventLogTap struct {
+	log       *eventLog
+	request   string
+	direction string
+
+	partial []byte
+	event   loggedEvent
+	data    []string
+	inEvent bool
+}
+
+// write logs the events completed by p
+func (t *eventLogTap) write(p []byte) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimRight(string(t.partial[:i]), "\r")
+		t.partial = t.partial[i+1:]
+
+		// An empty line ends the event
+		if line == "" {
+			if t.inEvent {
+				t.flush()
+			}
+			continue
+		}
+		t.inEvent = true
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "":
+			t.event.Comments = append(t.event.Comments, value)
+		case "event":
+			t.event.Event = value
+		case "data":
+			t.data = append(t.data, value)
+		}
+	}
+}
+
+// flush logs the event read so far
+func (t *eventLogTap) flush() {
+	event := t.event
+	event.Time, event.Request, event.Direction = time.Now(), t.request, t.direction
+	if data := strings.Join(t.data, "\n"); json.Valid([]byte(data)) {
+		event.Data = json.RawMessage(t.log.sensitive.JSON([]byte(data)))
+	} else if data != "" {
+		event.Data = t.log.sensitive.Text(data)
+	}
+	t.log.write(&event)
+	t.event, t.data, t.inEvent = loggedEvent{}, nil, false
+}
+
+// eventLogBody logs the events of an upstream response as they are read
+type eventLogBody struct {
+	io.ReadCloser
+	tap *eventLogTap
+}
+
+// Read reads from the body, logging the events read
+func (b *eventLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.tap.write(p[:n])
+	return n, err
+}
+
+// eventLogWriter logs the events written to the client
+type eventLogWriter struct {
+	http.ResponseWriter
+	tap *eventLogTap
+}
+
+// Write writes to the client, logging the events written
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.tap.write(p[:n])
+	return n, err
+}
+
+// Flush sends the data written so far to the client
+func (w *eventLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// eventStreamMessage is a single message of the AWS binary event stream encoding
+type eventStreamMessage struct {
+	Headers map[string]string
+	Payload []byte
+}
+
+// maxEventStreamMessage bounds the size of a single event stream message
+const maxEventStreamMessage = 16 * 1024 * 1024
+
+// readEventStreamMessage reads and validates the next message from an AWS event stream
+func readEventStreamMessage(r io.Reader) (*eventStreamMessage, error) {
+	// The prelude holds the total length, the headers length and a CRC of both
+	var prelude [12]byte
+	if _, err := io.ReadFull(r, prelude[:]); err != nil {
+		return nil, err
+	}
+
+	totalLength := binary.BigEndian.Uint32(prelude[0:4])
+	headersLength := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, errors.New("event stream prelude checksum mismatch")
+	}
+	if totalLength < 16 || totalLength > maxEventStreamMessage || headersLength > totalLength-16 {
+		return nil, fmt.Errorf("invalid event stream message length %d", totalLength)
+	}
+
+	// Read the rest of the message, including the trailing message CRC
+	message := make([]byte, totalLength)
+	copy(message, prelude[:])
+	if _, err := io.ReadFull(r, message[12:]); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(message[:totalLength-4]) != binary.BigEndian.Uint32(message[totalLength-4:]) {
+		return nil, errors.New("event stream message checksum mismatch")
+	}
+
+	headers, err := parseEventStreamHeaders(message[12 : 12+headersLength])
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventStreamMessage{
+		Headers: headers,
+		Payload: message[12+headersLength : totalLength-4],
+	}, nil
+}
+
+// parseEventStreamHeaders decodes event stream headers, keeping only string values
+func parseEventStreamHeaders(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	errTruncated := errors.New("truncated event stream header")
+
+	for len(data) > 0 {
+		nameLength := int(data[0])
+		if len(data) < 1+nameLength+1 {
+			return nil, errTruncated
+		}
+		name := string(data[1 : 1+nameLength])
+		valueType := data[1+nameLength]
+		data = data[2+nameLength:]
+
+		// Skip over the value based on its type
+		var size int
+		switch valueType {
+		case 0, 1: // bool true, bool false
+			size = 0
+		case 2: // byte
+			size = 1
+		case 3: // short
+			size = 2
+		case 4: // integer
+			size = 4
+		case 5, 8: // long, timestamp
+			size = 8
+		case 9: // uuid
+			size = 16
+		case 6, 7: // byte array, string
+			if len(data) < 2 {
+				return nil, errTruncated
+			}
+			size = 2 + int(binary.BigEndian.Uint16(data[0:2]))
+		default:
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+		if len(data) < size {
+			return nil, errTruncated
+		}
+
+		if valueType == 7 {
+			headers[name] = string(data[2:size])
+		}
+		data = data[size:]
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Formats conversations are exported to
+const (
+	ExportMarkdown = "markdown"
+	ExportHTML     = "html"
+)
+
+// ExportOptions selects the conversation to export from the history store and
+// how it is rendered
+type ExportOptions struct {
+	// Store, StoreEndpoint and EncryptionKey describe the history store, as in Config
+	Store         string
+	StoreEndpoint string
+	EncryptionKey string
+	// Conversation is the id of the conversation to export
+	Conversation string
+	// Format is ExportMarkdown or ExportHTML
+	Format string
+	// Thinking includes the thinking of the responses, collapsed in <details> blocks
+	Thinking bool
+	// Since skips the batches uploaded on earlier days when set
+	Since time.Time
+}
+
+// ExportConversation renders a conversation recorded in the history store
+func ExportConversation(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	if opts.Format != ExportMarkdown && opts.Format != ExportHTML {
+		return fmt.Errorf("unknown export format %q: must be %s or %s", opts.Format, ExportMarkdown, ExportHTML)
+	}
+	store, prefix, err := openHistoryStore(ctx, opts.Store, opts.StoreEndpoint, opts.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	transcripts, err := loadTranscripts(ctx, store, prefix, opts.Since, func(t *Transcript) bool {
+		return t.Conversation == opts.Conversation
+	})
+	if err != nil {
+		return err
+	}
+	if len(transcripts) == 0 {
+		return fmt.Errorf("conversation %q not found in %s", opts.Conversation, store.Location(prefix))
+	}
+
+	export := buildExport(opts.Conversation, transcripts, opts.Thinking)
+	if opts.Format == ExportHTML {
+		return exportTemplate.Execute(w, export)
+	}
+	_, err = io.WriteString(w, export.markdown())
+	return err
+}
+
+// loadTranscripts returns the transcripts keep selects in the order of their
+// requests. Batches are named after the day they were uploaded, so the ones
+// from before since are skipped without downloading them.
+func loadTranscripts(ctx context.Context, store historyStore, prefix string, since time.Time, keep func(*Transcript) bool) ([]*Transcript, error) {
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", store.Location(prefix), err)
+	}
+
+	var transcripts []*Transcript
+	for _, object := range objects {
+		key := object.Key
+		if !strings.HasSuffix(key, ".jsonl.gz") {
+			continue
+		}
+		if name := strings.TrimPrefix(key, prefix); len(name) >= 10 {
+			if day, err := time.Parse("2006/01/02", name[:10]); err == nil && day.Before(since.Truncate(24*time.Hour)) {
+				continue
+			}
+		}
+
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", store.Location(key), err)
+		}
+		batch, err := decodeTranscripts(data)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", store.Location(key), err)
+		}
+		for _, transcript := range batch {
+			if keep(transcript) {
+				transcripts = append(transcripts, transcript)
+			}
+		}
+	}
+	slices.SortStableFunc(transcripts, func(a, b *Transcript) int {
+		return a.Time.Compare(b.Time)
+	})
+	return transcripts, nil
+}
+
+// decodeTranscripts reads a batch of gzipped JSON lines
+func decodeTranscripts(data []byte) ([]*Transcript, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var batch []*Transcript
+	decoder := json.NewDecoder(reader)
+	for {
+		var transcript Transcript
+		err := decoder.Decode(&transcript)
+		if errors.Is(err, io.EOF) {
+			return batch, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, &transcript)
+	}
+}
+
+// conversationExport is a conversation ready to be rendered
+type conversationExport struct {
+	ID     string
+	System string
+	Turns  []exportTurn
+	Start  time.Time
+	Models []string
+}
+
+// exportTurn is a message of the conversation
+type exportTurn struct {
+	Role   string
+	Model  string
+	Time   time.Time
+	Blocks []exportBlock
+}
+
+// exportBlock is a content block of a message, Kind being its type
+type exportBlock struct {
+	Kind string
+	Name string
+	Text string
+}
+
+// buildExport turns the transcripts of a conversation into its messages. Each
+// request repeats the conversation so far, so only the messages added since
+// the previous request are taken from it, followed by the response.
+func buildExport(id string, transcripts []*Transcript, thinking bool) *conversationExport {
+	export := &conversationExport{ID: id, Start: transcripts[0].Time}
+	previous := 0
+	for _, transcript := range transcripts {
+		var body struct {
+			System   any `json:"system"`
+			Messages []struct {
+				Role    string `json:"role"`
+				Content any    `json:"content"`
+			} `json:"messages"`
+		}
+		json.Unmarshal(transcript.Body, &body)
+		if export.System == "" {
+			export.System = systemText(body.System)
+		}
+		if !slices.Contains(export.Models, transcript.Model) {
+			export.Models = append(export.Models, transcript.Model)
+		}
+
+		// The previous response is repeated as an assistant message
+		start := previous + 1
+		if previous == 0 || start >= len(body.Messages) {
+			start = max(0, min(previous, len(body.Messages)-1))
+		}
+		for _, message := range body.Messages[start:] {
+			export.Turns = append(export.Turns, exportTurn{Role: message.Role, Blocks: exportBlocks(message.Content, thinking)})
+		}
+		previous = len(body.Messages)
+
+		content := make([]any, len(transcript.Content))
+		for i, block := range transcript.Content {
+			content[i] = block
+		}
+		export.Turns = append(export.Turns, exportTurn{
+			Role:   "assistant",
+			Model:  transcript.Model,
+			Time:   transcript.Time,
+			Blocks: exportBlocks(content, thinking),
+		})
+	}
+	return export
+}
+
+// systemText returns the text of a system prompt
+func systemText(system any) string {
+	var parts []string
+	for _, block := range exportBlocks(system, false) {
+		parts = append(parts, block.Text)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// exportBlocks returns the blocks of message content, a string or a list of
+// content blocks
+func exportBlocks(content any, thinking bool) []exportBlock {
+	if text, ok := content.(string); ok {
+		return []exportBlock{{Kind: "text", Text: text}}
+	}
+	list, _ := content.([]any)
+
+	var blocks []exportBlock
+	for _, item := range list {
+		block, _ := item.(map[string]any)
+		switch blockType, _ := block["type"].(string); blockType {
+		case "text":
+			text, _ := block["text"].(string)
+			blocks = append(blocks, exportBlock{Kind: "text", Text: text})
+		case "thinking":
+			if text, _ := block["thinking"].(string); thinking && text != "" {
+				blocks = append(blocks, exportBlock{Kind: "thinking", Text: text})
+			}
+		case "tool_use", "server_tool_use":
+			name, _ := block["name"].(string)
+			input, _ := json.MarshalIndent(block["input"], "", "  ")
+			blocks = append(blocks, exportBlock{Kind: "tool_use", Name: name, Text: string(input)})
+		case "tool_result":
+			id, _ := block["tool_use_id"].(string)
+			var parts []string
+			for _, part := range exportBlocks(block["content"], false) {
+				parts = append(parts, part.Text)
+			}
+			blocks = append(blocks, exportBlock{Kind: "tool_result", Name: id, Text: strings.Join(parts, "\n")})
+		case "redacted_thinking", "":
+		default:
+			blocks = append(blocks, exportBlock{Kind: "other", Name: blockType})
+		}
+	}
+	return blocks
+}
+
+// markdown renders the conversation as Markdown, with the thinking and tool
+// results collapsed in <details> blocks
+func (e *conversationExport) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Conversation %s\n\n", e.ID)
+	fmt.Fprintf(&b, "_Started %s with %s_\n\n", e.Start.Format(time.RFC1123), strings.Join(e.Models, ", "))
+	if e.System != "" {
+		fmt.Fprintf(&b, "<details>\n<summary>System prompt</summary>\n\n%s\n\n</details>\n\n", fenced("", e.System))
+	}
+
+	for _, turn := range e.Turns {
+		switch {
+		case turn.Model != "":
+			fmt.Fprintf(&b, "## Assistant (%s, %s)\n\n", turn.Model, turn.Time.Format("2006-01-02 15:04:05"))
+		case turn.Role == "user":
+			b.WriteString("## User\n\n")
+		default:
+			b.WriteString("## Assistant\n\n")
+		}
+		for _, block := range turn.Blocks {
+			switch block.Kind {
+			case "text":
+				fmt.Fprintf(&b, "%s\n\n", block.Text)
+			case "thinking":
+				fmt.Fprintf(&b, "<details>\n<summary>Thinking</summary>\n\n%s\n\n</details>\n\n", block.Text)
+			case "tool_use":
+				fmt.Fprintf(&b, "**Tool call `%s`**\n\n%s\n\n", block.Name, fenced("json", block.Text))
+			case "tool_result":
+				fmt.Fprintf(&b, "<details>\n<summary>Tool result</summary>\n\n%s\n\n</details>\n\n", fenced("", block.Text))
+			default:
+				fmt.Fprintf(&b, "_[%s block]_\n\n", block.Name)
+			}
+		}
+	}
+	return b.String()
+}
+
+// fenced returns text in a code block, with a fence longer than any in the text
+func fenced(language, text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + text + "\n" + fence
+}
+
+// exportTemplate renders a conversation as a standalone HTML page
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Conversation {{.ID}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+.turn { border-left: 3px solid #ccc; padding-left: 1em; margin: 1.5em 0; }
+.assistant { border-color: #d97757; }
+.text, pre { white-space: pre-wrap; }
+pre { background: #f5f5f5; padding: 0.5em; overflow-x: auto; }
+details { margin: 0.5em 0; }
+summary { cursor: pointer; color: #666; }
+.thinking { color: #555; font-style: italic; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Conversation {{.ID}}</h1>
+<p><em>Started {{.Start.Format "Mon, 02 Jan 2006 15:04:05 MST"}} with {{range $i, $m := .Models}}{{if $i}}, {{end}}{{$m}}{{end}}</em></p>
+{{if .System}}<details><summary>System prompt</summary><pre>{{.System}}</pre></details>{{end}}
+{{range .Turns}}<div class="turn {{.Role}}">
+{{if .Model}}<h2>Assistant ({{.Model}}, {{.Time.Format "2006-01-02 15:04:05"}})</h2>{{else}}<h2>{{if eq .Role "user"}}User{{else}}Assistant{{end}}</h2>{{end}}
+{{range .Blocks}}{{if eq .Kind "text"}}<div class="text">{{.Text}}</div>
+{{else if eq .Kind "thinking"}}<details><summary>Thinking</summary><div class="thinking">{{.Text}}</div></details>
+{{else if eq .Kind "tool_use"}}<p><strong>Tool call <code>{{.Name}}</code></strong></p><pre>{{.Text}}</pre>
+{{else if eq .Kind "tool_result"}}<details><summary>Tool result</summary><pre>{{.Text}}</pre></details>
+{{else}}<p><em>[{{.Name}} block]</em></p>
+{{end}}{{end}}</div>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// fallbackHeader names the model a response came from when the proxy fell
+// back from the requested model
+const fallbackHeader = "X-Proxy-Fallback-Model"
+
+// validateFallbackModels checks the patterns and models of the fallbacks
+func validateFallbackModels(fallbacks map[string]string) error {
+	for pattern, model := range fallbacks {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("fallback_models: invalid pattern %q: %w", pattern, err)
+		}
+		if model == "" {
+			return fmt.Errorf("fallback_models: empty fallback model for %q", pattern)
+		}
+	}
+	return nil
+}
+
+// fallbackModelFor returns the fallback model of a model, from the most
+// specific (longest) matching pattern, or "" when it has none
+func (p *Proxy) fallbackModelFor(model string) string {
+	fallback, matched := "", ""
+	for pattern, patternFallback := range p.cfg.FallbackModels {
+		if ok, _ := path.Match(pattern, model); ok && len(pattern) > len(matched) {
+			fallback, matched = patternFallback, pattern
+		}
+	}
+	if fallback == model {
+		return ""
+	}
+	return fallback
+}
+
+// sendWithFallback sends a Messages API request, and when the upstream is
+// still overloaded after the retries and failover, sends it once more with the
+// fallback model of the requested one. The request is adjusted to what the
+// fallback model supports, and its response is marked with the model it came
+// from so clients know a substitution happened.
+func (p *Proxy) sendWithFallback(r *http.Request, bodyBytes []byte, req *Request) (*http.Response, error) {
+	resp, err := p.sendOrReplay(r, bodyBytes)
+	if err != nil || resp.StatusCode != 529 {
+		return resp, err
+	}
+	model, _ := req.Body["model"].(string)
+	fallback := p.fallbackModelFor(model)
+	if fallback == "" {
+		return resp, nil
+	}
+
+	log.Printf("[%s] %s is overloaded, falling back to %s", req.label, model, fallback)
+	body := maps.Clone(req.Body)
+	body["model"] = fallback
+	if _, err := p.fitModelCapabilities(r.Header, body, true); err != nil {
+		log.Printf("[%s] Can't fall back from %s to %s: %v", req.label, model, fallback, err)
+		return resp, nil
+	}
+	fallbackBytes, err := json.Marshal(body)
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp, err = p.sendOrReplay(r, fallbackBytes)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = body
+	resp.Header.Set(fallbackHeader, fallback)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 && isEventStream(resp) {
+		req.hooks = append(req.hooks, &fallbackHook{requested: model, fallback: fallback})
+	}
+	return resp, nil
+}
+
+// fallbackAnnotation describes the substitution of the requested model in the
+// "proxy" object added to the message_start event of a response
+type fallbackAnnotation struct {
+	RequestedModel string `json:"requested_model"`
+	FallbackModel  string `json:"fallback_model"`
+	Reason         string `json:"fallback_reason"`
+}
+
+// fallbackHook annotates the message_start event of a response that came from
+// the fallback model
+type fallbackHook struct {
+	requested, fallback string
+}
+
+// Event adds the "proxy" object to message_start
+func (h *fallbackHook) Event(event *sse.Event) bool {
+	if event.Event != "message_start" {
+		return true
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return true
+	}
+	data["proxy"] = fallbackAnnotation{RequestedModel: h.requested, FallbackModel: h.fallback, Reason: "overloaded"}
+	setEventData(event, data)
+	return true
+}
+
+// Done does nothing
+func (h *fallbackHook) Done() {}
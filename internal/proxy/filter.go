@@ -0,0 +1,609 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// StreamFilter removes thinking blocks from a Messages API event stream,
+// passing their content on. A StreamFilter holds the state of a single stream.
+type StreamFilter struct {
+	onThinking   func(index, part int, thinking string, last bool)
+	liveThinking bool
+	remapIndices bool
+	label        string
+
+	// Accumulated content of the thinking blocks being filtered, by index. The
+	// model may interleave several thinking blocks with tool_use and text blocks
+	thinkingBlocks map[int]*spillBuffer
+	// Memory the thinking is accounted to, nil keeps it all in memory
+	memory *memoryAccount
+
+	// Content of the completed thinking blocks in order, by index
+	completed []completedThinking
+	// When the first thinking block started and the last one ended
+	thinkingStart, thinkingEnd time.Time
+
+	// Thinking received but not logged yet by index, in live mode
+	livePending map[int]string
+
+	// Client index of each forwarded content block by upstream index, so the
+	// forwarded blocks can be numbered contiguously from 0
+	clientIndices map[int]int
+
+	// Content blocks of the response in upstream order, holding the thinking
+	// blocks as clients must send them back and nil for forwarded blocks, with
+	// the position of each block by index
+	layout         []map[string]any
+	layoutPosition map[int]int
+	// IDs of the tool_use blocks of the response
+	toolUseIDs []string
+
+	// Characters of each thinking block forwarded as a text block, 0 drops
+	// thinking blocks entirely
+	previewChars int
+	// Thinking blocks being forwarded as previews, by index
+	previews map[int]*thinkingPreview
+
+	// Progress reported while thinking is filtered, one of the ThinkingProgress
+	// constants or empty, at most every progressInterval
+	progress         string
+	progressInterval time.Duration
+	lastProgress     time.Time
+}
+
+// Ways of reporting progress while thinking is filtered
+const (
+	// ThinkingProgressComment sends SSE comments, which clients ignore
+	ThinkingProgressComment = "comment"
+	// ThinkingProgressText forwards thinking blocks as text blocks holding
+	// the progress, which editors show
+	ThinkingProgressText = "text"
+)
+
+// completedThinking is the content of a completed thinking block
+type completedThinking struct {
+	index   int
+	content *spillBuffer
+	// handedOver is set once the content was spilled and handed to the caller
+	// of Layout, which closes it
+	handedOver bool
+}
+
+// thinkingPreview tracks the text forwarded for a thinking block
+type thinkingPreview struct {
+	chars     int
+	truncated bool
+}
+
+// previewEllipsis ends the previews of thinking cut short
+const previewEllipsis = "…"
+
+// liveLineLength is the length after which live thinking logs are broken at a
+// space rather than waiting for the end of the line
+const liveLineLength = 160
+
+// NewStreamFilter returns a filter for a new stream, labelling its logs so the
+// thinking content of concurrent streams can be told apart. onThinking, when
+// set, is called with each completed thinking block, whole with a part of 0,
+// or in parts numbered from 1 when it was spilled to disk. With liveThinking,
+// thinking is also logged line by line as it arrives. With remapIndices, the
+// index of the forwarded content blocks is rewritten to leave no gaps where
+// thinking blocks were removed.
+func NewStreamFilter(onThinking func(index, part int, thinking string, last bool), liveThinking, remapIndices bool, label string) *StreamFilter {
+	return &StreamFilter{
+		onThinking:     onThinking,
+		liveThinking:   liveThinking,
+		remapIndices:   remapIndices,
+		label:          label,
+		thinkingBlocks: make(map[int]*spillBuffer),
+		clientIndices:  make(map[int]int),
+		livePending:    make(map[int]string),
+		layoutPosition: make(map[int]int),
+		previews:       make(map[int]*thinkingPreview),
+	}
+}
+
+// SetPreview forwards the first chars characters of each thinking block to the
+// client as a text block in its place, so the direction of the reasoning shows
+// without all of it. Redacted thinking is still dropped.
+func (f *StreamFilter) SetPreview(chars int) {
+	f.previewChars = chars
+}
+
+// SetProgress reports the thinking tokens generated so far every interval
+// while thinking blocks are filtered, as SSE comments or as text blocks in
+// place of the thinking blocks
+func (f *StreamFilter) SetProgress(mode string, interval time.Duration) {
+	f.progress, f.progressInterval = mode, interval
+}
+
+// SetMemory accounts the thinking content to a request, spilling it to disk
+// beyond the memory limits
+func (f *StreamFilter) SetMemory(account *memoryAccount) {
+	f.memory = account
+}
+
+// Process inspects the next event of the stream and reports whether it should
+// be forwarded to the client
+func (f *StreamFilter) Process(event *sse.Event) bool {
+	// Handle different types of events
+	if isThinkingBlock(event) {
+		// Found a thinking block, start accumulating its content
+		index, _ := getContentBlockIndex(event)
+		f.thinkingBlocks[index] = &spillBuffer{account: f.memory}
+		f.addToLayout(index, event)
+		if f.thinkingStart.IsZero() {
+			f.thinkingStart = time.Now()
+		}
+		f.lastProgress = time.Now()
+		log.Printf("Found thinking block at index %d (%s)", index, f.label)
+
+		// Start a text block for the preview or the progress instead, which
+		// clients send back like the other forwarded blocks
+		showing := f.previewChars > 0 || f.progress == ThinkingProgressText
+		if block := f.layoutBlock(index); showing && block != nil && block["type"] == "thinking" {
+			f.previews[index] = &thinkingPreview{}
+			f.layout = append(f.layout, nil)
+			setEventData(event, map[string]any{
+				"type":          "content_block_start",
+				"index":         index,
+				"content_block": map[string]any{"type": "text", "text": ""},
+			})
+			return f.forward(event)
+		}
+		return false // Skip sending this event
+	}
+
+	if isContentBlockDelta(event) || isContentBlockStop(event) {
+		index, err := getContentBlockIndex(event)
+		thinkingContent, ok := f.thinkingBlocks[index]
+		if err == nil && ok {
+			if isContentBlockDelta(event) {
+				// Keep the signature clients must send back with the block
+				if signature, err := extractSignatureDelta(event); err == nil && signature != "" {
+					if block := f.layoutBlock(index); block != nil {
+						previous, _ := block["signature"].(string)
+						block["signature"] = previous + signature
+					}
+				}
+
+				// Extract thinking content from the delta
+				thinkingDelta, err := extractThinkingDelta(event)
+				if err == nil && thinkingDelta != "" {
+					thinkingContent.WriteString(thinkingDelta)
+					if f.liveThinking {
+						f.logLive(index, thinkingDelta, false)
+					}
+					if preview := f.previews[index]; preview != nil && f.previewChars > 0 {
+						if text := preview.take(thinkingDelta, f.previewChars); text != "" {
+							setEventData(event, textDelta(index, text))
+							return f.forward(event)
+						}
+					}
+				}
+				return false // Skip sending this event
+			}
+
+			// The thinking block is complete, pass its content on
+			if f.liveThinking {
+				f.logLive(index, "", true)
+			}
+			if f.onThinking != nil {
+				f.passThinking(index, thinkingContent)
+			}
+			f.completed = append(f.completed, completedThinking{index: index, content: thinkingContent})
+			f.thinkingEnd = time.Now()
+			delete(f.thinkingBlocks, index)
+			if _, ok := f.previews[index]; ok {
+				delete(f.previews, index)
+				return f.forward(event)
+			}
+			return false // Skip sending this event
+		}
+	}
+
+	// Forward all other events
+	if event.Event == "content_block_start" {
+		f.addToLayout(-1, event)
+	}
+	return f.forward(event)
+}
+
+// passThinking passes the content of a completed thinking block on, reading it
+// back from disk in chunks when it was spilled
+func (f *StreamFilter) passThinking(index int, content *spillBuffer) {
+	if !content.Spilled() {
+		f.onThinking(index, 0, content.String(), true)
+		return
+	}
+	part := 0
+	err := content.chunks(spillChunkSize, func(text string, last bool) {
+		part++
+		f.onThinking(index, part, text, last)
+	})
+	if err != nil {
+		log.Printf("[%s] Error reading spilled thinking block %d: %v", f.label, index, err)
+	}
+}
+
+// forward prepares an event for the client, reporting that it is forwarded
+func (f *StreamFilter) forward(event *sse.Event) bool {
+	if f.remapIndices {
+		f.remapIndex(event)
+	}
+	return true
+}
+
+// Insert reports the progress of thinking blocks due before their deltas, and
+// ends the text of a preview before its block stops, separating it from the
+// answer and marking where the thinking was cut short
+func (f *StreamFilter) Insert(event *sse.Event) []*sse.Event {
+	if isContentBlockDelta(event) {
+		return f.reportProgress(event)
+	}
+	if !isContentBlockStop(event) || len(f.previews) == 0 {
+		return nil
+	}
+	index, err := getContentBlockIndex(event)
+	preview, ok := f.previews[index]
+	if err != nil || !ok {
+		return nil
+	}
+	text := "\n\n"
+	if preview.truncated {
+		text = previewEllipsis + text
+	}
+	closing := &sse.Event{Event: "content_block_delta"}
+	setEventData(closing, textDelta(index, text))
+	f.forward(closing)
+	return []*sse.Event{closing}
+}
+
+// reportProgress returns an event reporting the thinking tokens generated so
+// far when a delta of a filtered thinking block arrives after the interval
+func (f *StreamFilter) reportProgress(event *sse.Event) []*sse.Event {
+	if f.progress == "" || time.Since(f.lastProgress) < f.progressInterval {
+		return nil
+	}
+	index, err := getContentBlockIndex(event)
+	if _, ok := f.thinkingBlocks[index]; err != nil || !ok {
+		return nil
+	}
+	f.lastProgress = time.Now()
+
+	var chars int64
+	for _, block := range f.thinkingBlocks {
+		chars += block.Len()
+	}
+	for _, block := range f.completed {
+		chars += block.content.Len()
+	}
+	message := fmt.Sprintf("Thinking… ~%d tokens so far", (chars+3)/4)
+
+	if f.progress == ThinkingProgressComment {
+		return []*sse.Event{{Comments: []string{message}}}
+	}
+	if _, ok := f.previews[index]; !ok {
+		// Redacted thinking has no text block to report in
+		return nil
+	}
+	progress := &sse.Event{Event: "content_block_delta"}
+	setEventData(progress, textDelta(index, message+"\n"))
+	f.forward(progress)
+	return []*sse.Event{progress}
+}
+
+// take returns the part of a thinking delta within the preview
+func (p *thinkingPreview) take(delta string, limit int) string {
+	if p.truncated {
+		return ""
+	}
+	if n := utf8.RuneCountInString(delta); p.chars+n <= limit {
+		p.chars += n
+		return delta
+	}
+	p.truncated = true
+	end := 0
+	for ; p.chars < limit; p.chars++ {
+		_, size := utf8.DecodeRuneInString(delta[end:])
+		end += size
+	}
+	return delta[:end]
+}
+
+// textDelta returns the data of a text_delta event
+func textDelta(index int, text string) map[string]any {
+	return map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{"type": "text_delta", "text": text},
+	}
+}
+
+// setEventData replaces the data of an event
+func setEventData(event *sse.Event, data map[string]any) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	event.Data = string(encoded)
+	event.Raw = ""
+}
+
+// addToLayout adds the content block started by an event to the layout of the
+// response. Thinking blocks are kept by index until they are complete.
+func (f *StreamFilter) addToLayout(index int, event *sse.Event) {
+	var start struct {
+		ContentBlock map[string]any `json:"content_block"`
+	}
+	if err := json.Unmarshal([]byte(event.Data), &start); err != nil || start.ContentBlock == nil {
+		return
+	}
+	block := start.ContentBlock
+
+	if index < 0 {
+		// Forwarded block, only tool_use ids are needed to find the turn again
+		if id, _ := block["id"].(string); block["type"] == "tool_use" && id != "" {
+			f.toolUseIDs = append(f.toolUseIDs, id)
+		}
+		f.layout = append(f.layout, nil)
+		return
+	}
+
+	if block["type"] == "thinking" {
+		if _, ok := block["signature"].(string); !ok {
+			block["signature"] = ""
+		}
+	}
+	f.layoutPosition[index] = len(f.layout)
+	f.layout = append(f.layout, block)
+}
+
+// layoutBlock returns the thinking block with the given index in the layout
+func (f *StreamFilter) layoutBlock(index int) map[string]any {
+	position, ok := f.layoutPosition[index]
+	if !ok {
+		return nil
+	}
+	return f.layout[position]
+}
+
+// Layout returns the content blocks of the response in order, holding the
+// completed thinking blocks with their signatures and nil in place of the
+// forwarded blocks, and the ids of the tool_use blocks. The thinking of blocks
+// spilled to disk is left out of them and returned by position in the layout
+// instead, handed over to the caller to close once it is no longer needed.
+func (f *StreamFilter) Layout() ([]map[string]any, map[int]*spillBuffer, []string) {
+	var spilled map[int]*spillBuffer
+	for i, completed := range f.completed {
+		position, ok := f.layoutPosition[completed.index]
+		if !ok || f.layout[position]["type"] != "thinking" {
+			continue
+		}
+		if !completed.content.Spilled() {
+			f.layout[position]["thinking"] = completed.content.String()
+			continue
+		}
+		if spilled == nil {
+			spilled = make(map[int]*spillBuffer)
+		}
+		spilled[position] = completed.content
+		f.completed[i].handedOver = true
+	}
+	return f.layout, spilled, f.toolUseIDs
+}
+
+// logLive logs the complete lines of thinking received so far for a block,
+// breaking long lines at a space. The rest is logged when the block ends.
+func (f *StreamFilter) logLive(index int, delta string, end bool) {
+	pending := f.livePending[index] + delta
+	for {
+		line, rest, found := strings.Cut(pending, "\n")
+		if !found {
+			if len(pending) <= liveLineLength || end {
+				break
+			}
+			cut := strings.LastIndexByte(pending[:liveLineLength], ' ')
+			if cut <= 0 {
+				cut = liveLineLength
+			}
+			line, rest = pending[:cut], strings.TrimLeft(pending[cut:], " ")
+		}
+		if line != "" {
+			log.Printf("[%s, thinking %d] %s", f.label, index, line)
+		}
+		pending = rest
+	}
+
+	if end {
+		if pending != "" {
+			log.Printf("[%s, thinking %d] %s", f.label, index, pending)
+		}
+		delete(f.livePending, index)
+		return
+	}
+	f.livePending[index] = pending
+}
+
+// remapIndex rewrites the index of a forwarded content block event to its
+// position among the forwarded blocks
+func (f *StreamFilter) remapIndex(event *sse.Event) {
+	if event.Event != "content_block_start" && !isContentBlockDelta(event) && !isContentBlockStop(event) {
+		return
+	}
+	index, err := getContentBlockIndex(event)
+	if err != nil {
+		return
+	}
+
+	// Blocks are numbered in the order they start
+	if event.Event == "content_block_start" {
+		f.clientIndices[index] = len(f.clientIndices)
+	}
+	clientIndex, ok := f.clientIndices[index]
+	if !ok || clientIndex == index {
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(event.Data), &fields); err != nil {
+		return
+	}
+	fields["index"] = json.RawMessage(strconv.Itoa(clientIndex))
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	event.Data = string(data)
+	event.Raw = ""
+}
+
+// Thinking returns the content of the thinking blocks completed so far, up to
+// limit bytes, reading the blocks spilled to disk back from it
+func (f *StreamFilter) Thinking(limit int64) string {
+	var thinking strings.Builder
+	for _, completed := range f.completed {
+		if thinking.Len() > 0 {
+			thinking.WriteString("\n\n")
+		}
+		remaining := limit - int64(thinking.Len())
+		if remaining <= 0 {
+			break
+		}
+		r, err := completed.content.reader()
+		if err != nil {
+			log.Printf("[%s] Error reading spilled thinking: %v", f.label, err)
+			continue
+		}
+		_, err = io.Copy(&thinking, io.LimitReader(r, remaining))
+		r.Close()
+		if err != nil {
+			log.Printf("[%s] Error reading spilled thinking: %v", f.label, err)
+		}
+	}
+	if int64(thinking.Len()) >= limit {
+		log.Printf("[%s] Thinking exceeds %d bytes, keeping its start", f.label, limit)
+	}
+	// A character may have been cut at the limit
+	return strings.ToValidUTF8(thinking.String(), "")
+}
+
+// Close frees the memory and the files holding the thinking content
+func (f *StreamFilter) Close() {
+	for _, content := range f.thinkingBlocks {
+		content.Close()
+	}
+	for _, completed := range f.completed {
+		if !completed.handedOver {
+			completed.content.Close()
+		}
+	}
+	clear(f.thinkingBlocks)
+	f.completed = nil
+}
+
+// ThinkingDuration returns the time from the start of the first thinking block
+// to the end of the last completed one
+func (f *StreamFilter) ThinkingDuration() time.Duration {
+	if f.thinkingEnd.IsZero() {
+		return 0
+	}
+	return f.thinkingEnd.Sub(f.thinkingStart)
+}
+
+// extractSignatureDelta extracts the signature from a signature_delta event
+func extractSignatureDelta(event *sse.Event) (string, error) {
+	var deltaEvent struct {
+		Delta struct {
+			Type      string `json:"type"`
+			Signature string `json:"signature"`
+		} `json:"delta"`
+	}
+
+	if err := json.Unmarshal([]byte(event.Data), &deltaEvent); err != nil {
+		return "", err
+	}
+
+	if deltaEvent.Delta.Type != "signature_delta" {
+		return "", nil
+	}
+
+	return deltaEvent.Delta.Signature, nil
+}
+
+// isThinkingBlock checks if an event starts a thinking or redacted thinking content block
+func isThinkingBlock(event *sse.Event) bool {
+	if event.Event != "content_block_start" {
+		return false
+	}
+
+	var contentBlockStart struct {
+		Type         string `json:"type"`
+		Index        int    `json:"index"`
+		ContentBlock struct {
+			Type string `json:"type"`
+		} `json:"content_block"`
+	}
+
+	if err := json.Unmarshal([]byte(event.Data), &contentBlockStart); err != nil {
+		return false
+	}
+
+	return contentBlockStart.ContentBlock.Type == "thinking" ||
+		contentBlockStart.ContentBlock.Type == "redacted_thinking"
+}
+
+// isContentBlockDelta checks if an event is a content_block_delta
+func isContentBlockDelta(event *sse.Event) bool {
+	return event.Event == "content_block_delta"
+}
+
+// isContentBlockStop checks if an event is a content_block_stop
+func isContentBlockStop(event *sse.Event) bool {
+	return event.Event == "content_block_stop"
+}
+
+// getContentBlockIndex extracts the index from content block events
+func getContentBlockIndex(event *sse.Event) (int, error) {
+	var blockEvent struct {
+		Type  string `json:"type"`
+		Index int    `json:"index"`
+	}
+
+	if err := json.Unmarshal([]byte(event.Data), &blockEvent); err != nil {
+		return -1, err
+	}
+
+	return blockEvent.Index, nil
+}
+
+// extractThinkingDelta extracts thinking content from a thinking_delta event
+func extractThinkingDelta(event *sse.Event) (string, error) {
+	var deltaEvent struct {
+		Type  string `json:"type"`
+		Index int    `json:"index"`
+		Delta struct {
+			Type     string `json:"type"`
+			Thinking string `json:"thinking"`
+		} `json:"delta"`
+	}
+
+	if err := json.Unmarshal([]byte(event.Data), &deltaEvent); err != nil {
+		return "", err
+	}
+
+	if deltaEvent.Delta.Type != "thinking_delta" {
+		return "", nil
+	}
+
+	return deltaEvent.Delta.Thinking, nil
+}
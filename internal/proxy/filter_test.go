@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// event returns an SSE event with its data encoded as JSON
+func event(name string, data map[string]any) *sse.Event {
+	data["type"] = name
+	encoded, _ := json.Marshal(data)
+	return &sse.Event{Event: name, Data: string(encoded)}
+}
+
+// thinkingPart is a part of a thinking block passed on by a filter
+type thinkingPart struct {
+	index, part int
+	text        string
+	last        bool
+}
+
+// TestSpilledThinking forces thinking to spill to disk and checks that the
+// sinks, the layout kept for reinjection and the summary still get all of it
+func TestSpilledThinking(t *testing.T) {
+	limits := newMemoryLimits(16, 0)
+	var parts []thinkingPart
+	filter := NewStreamFilter(func(index, part int, thinking string, last bool) {
+		parts = append(parts, thinkingPart{index, part, thinking, last})
+	}, false, false, "test")
+	filter.SetMemory(limits.newAccount("test"))
+
+	// Multi-byte characters make sure the parts are split between characters,
+	// and the thinking spans several parts
+	delta := strings.Repeat("é", 1000) + "… "
+	var thinking strings.Builder
+	events := []*sse.Event{
+		event("content_block_start", map[string]any{"index": 0, "content_block": map[string]any{"type": "thinking", "thinking": ""}}),
+	}
+	for thinking.Len() < 3*spillChunkSize {
+		thinking.WriteString(delta)
+		events = append(events, event("content_block_delta", map[string]any{"index": 0, "delta": map[string]any{"type": "thinking_delta", "thinking": delta}}))
+	}
+	events = append(events,
+		event("content_block_delta", map[string]any{"index": 0, "delta": map[string]any{"type": "signature_delta", "signature": "sig"}}),
+		event("content_block_stop", map[string]any{"index": 0}),
+		event("content_block_start", map[string]any{"index": 1, "content_block": map[string]any{"type": "tool_use", "id": "toolu_1", "name": "read", "input": map[string]any{}}}),
+		event("content_block_stop", map[string]any{"index": 1}),
+	)
+	for _, e := range events {
+		filter.Process(e)
+	}
+
+	if stats := limits.snapshot(); stats.Spilled != 1 || stats.OnDisk != int64(thinking.Len()) {
+		t.Fatalf("got %d spilled buffers with %d bytes on disk, want 1 with %d", stats.Spilled, stats.OnDisk, thinking.Len())
+	}
+
+	// The sinks get the whole block in numbered parts
+	if len(parts) < 3 {
+		t.Fatalf("got %d parts, want the block in at least 3", len(parts))
+	}
+	var sunk strings.Builder
+	for i, part := range parts {
+		if part.index != 0 || part.part != i+1 || part.last != (i == len(parts)-1) {
+			t.Errorf("part %d: got index %d, part %d, last %v", i, part.index, part.part, part.last)
+		}
+		if len(part.text) > spillChunkSize || !utf8.ValidString(part.text) {
+			t.Errorf("part %d: %d bytes, valid UTF-8 %v", i, len(part.text), utf8.ValidString(part.text))
+		}
+		sunk.WriteString(part.text)
+	}
+	if sunk.String() != thinking.String() {
+		t.Errorf("sinks got %d bytes of thinking, want %d", sunk.Len(), thinking.Len())
+	}
+
+	// The summary gets the start of the thinking
+	if summary := filter.Thinking(1000); summary != thinking.String()[:1000] {
+		t.Errorf("got summary input %q", summary)
+	}
+
+	// The layout hands the spilled block over, and it survives the filter
+	layout, spilled, toolUseIDs := filter.Layout()
+	filter.Close()
+	if len(layout) != 2 || layout[0]["signature"] != "sig" || layout[1] != nil {
+		t.Fatalf("got layout %v", layout)
+	}
+	if len(spilled) != 1 || spilled[0] == nil {
+		t.Fatalf("got spilled blocks %v, want the one at position 0", spilled)
+	}
+	file := spilled[0].file.Name()
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("spilled thinking removed with the filter: %v", err)
+	}
+
+	// Reinjection restores the block from disk
+	memory := newThinkingMemory()
+	memory.remember(layout, spilled, toolUseIDs)
+	body := map[string]any{"messages": []any{
+		map[string]any{"role": "user", "content": "read it"},
+		map[string]any{"role": "assistant", "content": []any{
+			map[string]any{"type": "tool_use", "id": "toolu_1", "name": "read", "input": map[string]any{}},
+		}},
+	}}
+	if restored := memory.reinject(body); restored != 1 {
+		t.Fatalf("restored %d turns, want 1", restored)
+	}
+	content := body["messages"].([]any)[1].(map[string]any)["content"].([]any)
+	block := content[0].(map[string]any)
+	if block["type"] != "thinking" || block["thinking"] != thinking.String() || block["signature"] != "sig" {
+		t.Errorf("got restored block of type %v with %d bytes of thinking", block["type"], len(block["thinking"].(string)))
+	}
+
+	// Forgetting the turn removes the file
+	memory.mu.Lock()
+	memory.forget("toolu_1")
+	memory.mu.Unlock()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("spilled thinking kept after the turn was forgotten: %v", err)
+	}
+	if stats := limits.snapshot(); stats.OnDisk != 0 {
+		t.Errorf("got %d bytes on disk after the turn was forgotten", stats.OnDisk)
+	}
+}
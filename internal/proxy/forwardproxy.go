@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// upstreamProxy returns the function choosing the forward proxy for upstream
+// requests. Without an explicit proxy URL, HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// are used as usual; with one, hosts listed in NO_PROXY still bypass it. Proxy
+// credentials are given as the user info of the URL.
+func upstreamProxy(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid upstream proxy %q: scheme must be http, https or socks5", parsed.Redacted())
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy %q: missing host", parsed.Redacted())
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	return func(r *http.Request) (*url.URL, error) {
+		if bypassProxy(noProxy, r.URL) {
+			return nil, nil
+		}
+		return parsed, nil
+	}, nil
+}
+
+// bypassProxy checks if a NO_PROXY list matches the host of a URL. Entries are
+// "*", IP addresses, CIDR ranges or domain names, which match their subdomains
+// too, each optionally followed by a port.
+func bypassProxy(noProxy string, target *url.URL) bool {
+	host, port := target.Hostname(), target.Port()
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		// CIDR ranges match IP addresses
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		// Entries restricted to a port only match that port
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
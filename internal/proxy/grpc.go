@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// GRPCSendMessagePath is the path of the SendMessage method of the gRPC
+// service defined in proto/messages.proto
+const GRPCSendMessagePath = "/zedclaudeproxy.v1.Messages/SendMessage"
+
+// gRPC status codes returned by the proxy
+const (
+	grpcOK                = 0
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// isGRPCRequest checks if a request is a call of the proxy's gRPC service
+func isGRPCRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == GRPCSendMessagePath &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcFrontend serves the SendMessage method of the gRPC service, for tools
+// that would rather not parse server-sent events. The request message holds
+// the JSON body of a Messages API request, which is passed to next as a POST
+// request with the metadata of the call as headers, so it runs through the
+// same pipeline as any other request. Each event of the response is streamed
+// back as an Event message, a response that isn't streamed as a single one,
+// and API errors end the call with the matching gRPC status.
+func (p *Proxy) grpcFrontend(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		if r.ProtoMajor != 2 {
+			writeGRPCStatus(w, grpcUnimplemented, "gRPC requires HTTP/2, enable -h2c or TLS")
+			return
+		}
+
+		message, err := readGRPCMessage(r)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		fields, err := parseProtoStrings(message)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, "invalid SendMessageRequest: "+err.Error())
+			return
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, MessagesEndpoint, strings.NewReader(fields[1]))
+		if err != nil {
+			writeGRPCStatus(w, grpcInternal, err.Error())
+			return
+		}
+		req.Header = r.Header.Clone()
+		for name := range req.Header {
+			if lower := strings.ToLower(name); strings.HasPrefix(lower, "grpc-") || lower == "te" || lower == "content-type" {
+				req.Header.Del(name)
+			}
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr, req.Host = r.RemoteAddr, r.Host
+
+		w.WriteHeader(http.StatusOK)
+		tw := newTunnelWriter(func(event *sse.Event) error {
+			return writeGRPCEvent(w, event.Event, event.Data)
+		})
+		next.ServeHTTP(tw, req)
+		body := tw.finish()
+
+		if tw.status >= 300 {
+			code, message := grpcStatusForError(tw.status, body)
+			writeGRPCStatus(w, code, message)
+			return
+		}
+		if len(body) > 0 {
+			var data struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal(body, &data)
+			if err := writeGRPCEvent(w, data.Type, string(body)); err != nil {
+				log.Printf("Error writing gRPC response: %v", err)
+			}
+		}
+		writeGRPCStatus(w, grpcOK, "")
+	})
+}
+
+// readGRPCMessage reads the single length-prefixed message of a call,
+// decompressing it when it was sent gzipped
+func readGRPCMessage(r *http.Request) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return nil, fmt.Errorf("reading request message: %w", err)
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > wsMaxMessage {
+		return nil, errors.New("request message too big")
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r.Body, message); err != nil {
+		return nil, fmt.Errorf("reading request message: %w", err)
+	}
+	if prefix[0] == 0 {
+		return message, nil
+	}
+
+	if encoding := r.Header.Get("Grpc-Encoding"); encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported message encoding %q", encoding)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(message))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing request message: %w", err)
+	}
+	return io.ReadAll(io.LimitReader(reader, wsMaxMessage))
+}
+
+// writeGRPCEvent sends an Event message and flushes it to the client
+func writeGRPCEvent(w http.ResponseWriter, eventType, data string) error {
+	message := appendProtoString(nil, 1, eventType)
+	message = appendProtoString(message, 2, data)
+
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+	if _, err := w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// writeGRPCStatus ends a call with a status, sent in the trailers
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		// The message is percent-encoded, spaces included
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", strings.ReplaceAll(url.QueryEscape(message), "+", "%20"))
+	}
+}
+
+// grpcStatusForError returns the gRPC status matching an API error response
+func grpcStatusForError(status int, body []byte) (int, string) {
+	var apiError struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := string(body)
+	if json.Unmarshal(body, &apiError) == nil && apiError.Error.Message != "" {
+		message = apiError.Error.Message
+	}
+
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument, message
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated, message
+	case http.StatusForbidden:
+		return grpcPermissionDenied, message
+	case http.StatusNotFound:
+		return grpcNotFound, message
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted, message
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return grpcUnavailable, message
+	}
+	if status >= 500 {
+		return grpcInternal, message
+	}
+	return grpcUnknown, message
+}
+
+// appendProtoString appends a string field in the protobuf wire format
+func appendProtoString(b []byte, field int, value string) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// parseProtoStrings returns the length-delimited fields of a protobuf message
+// by number, skipping the fields of other wire types
+func parseProtoStrings(data []byte) (map[int]string, error) {
+	fields := make(map[int]string)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid field key")
+		}
+		data = data[n:]
+
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return nil, errors.New("invalid varint")
+			}
+		case 1:
+			n = 8
+		case 2:
+			length, m := binary.Uvarint(data)
+			if m <= 0 || length > uint64(len(data)-m) {
+				return nil, errors.New("invalid length")
+			}
+			fields[int(key>>3)] = string(data[m : m+int(length)])
+			n = m + int(length)
+		case 5:
+			n = 4
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if n > len(data) {
+			return nil, errors.New("truncated field")
+		}
+		data = data[n:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Actions of header rules
+const (
+	HeaderSet    = "set"
+	HeaderAdd    = "add"
+	HeaderRemove = "remove"
+)
+
+// hopByHopHeaders only concern a single connection and are never forwarded,
+// like the headers named by the Connection header (RFC 7230 section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeaders adds the end-to-end headers of src to dst, leaving out the
+// hop-by-hop ones
+func copyHeaders(dst, src http.Header) {
+	hopByHop := slices.Clone(hopByHopHeaders)
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hopByHop = append(hopByHop, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	for name, values := range src {
+		if slices.Contains(hopByHop, http.CanonicalHeaderKey(name)) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// protectedHeaders are managed by the proxy and can't be changed by rules
+var protectedHeaders = []string{"Host", "Content-Length", "Transfer-Encoding"}
+
+// HeaderRule changes a header of the requests forwarded to the Anthropic API
+type HeaderRule struct {
+	// Action is set, replacing the values of the header, add, adding a value
+	// next to the ones the client sent, or remove
+	Action string `json:"action"`
+	// Name of the header, which may contain glob patterns such as
+	// "X-Forwarded-*" to remove several headers
+	Name string `json:"name"`
+	// Value set or added, read from the environment when of the form env:NAME
+	Value string `json:"value,omitempty"`
+}
+
+// validateHeaderRules checks the header rules, resolving the values read from
+// the environment
+func validateHeaderRules(rules []HeaderRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			return fmt.Errorf("header_rules: rule %d has no name", i)
+		}
+		if _, err := path.Match(strings.ToLower(rule.Name), ""); err != nil {
+			return fmt.Errorf("header_rules: invalid name pattern %q: %w", rule.Name, err)
+		}
+		if slices.ContainsFunc(protectedHeaders, func(name string) bool { return strings.EqualFold(name, rule.Name) }) {
+			return fmt.Errorf("header_rules: %s is managed by the proxy", rule.Name)
+		}
+
+		switch rule.Action {
+		case HeaderRemove:
+			continue
+		case HeaderSet, HeaderAdd:
+			if strings.ContainsAny(rule.Name, "*?[") {
+				return fmt.Errorf("header_rules: %s %q: patterns are only supported by remove", rule.Action, rule.Name)
+			}
+		default:
+			return fmt.Errorf("header_rules: unknown action %q for %s: must be set, add or remove", rule.Action, rule.Name)
+		}
+
+		if name, ok := strings.CutPrefix(rule.Value, "env:"); ok {
+			rule.Value = os.Getenv(name)
+			if rule.Value == "" {
+				return fmt.Errorf("header_rules: environment variable %s for %s is not set", name, rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// applyHeaderRules changes the headers of a forwarded request, applying the
+// rules in order
+func applyHeaderRules(rules []HeaderRule, header http.Header) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderSet:
+			header.Set(rule.Name, rule.Value)
+		case HeaderAdd:
+			header.Add(rule.Name, rule.Value)
+		case HeaderRemove:
+			pattern := strings.ToLower(rule.Name)
+			for name := range header {
+				if matched, _ := path.Match(pattern, strings.ToLower(name)); matched {
+					header.Del(name)
+				}
+			}
+		}
+	}
+}
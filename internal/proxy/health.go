@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	healthEndpoint = "/healthz"
+	readyEndpoint  = "/readyz"
+)
+
+// readyWindow is how long a response from an upstream counts as proof of
+// connectivity before the readiness check probes it again
+const readyWindow = time.Minute
+
+// probeTimeout bounds the connectivity probe of the readiness check
+const probeTimeout = 5 * time.Second
+
+// handleHealth reports that the process is up
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady reports whether an upstream was reachable recently, probing the
+// upstreams in priority order when none was
+func (p *Proxy) handleReady(w http.ResponseWriter, r *http.Request) {
+	// There is no upstream to depend on in mock and replay modes
+	if p.cfg.Mock || p.cfg.ReplayDir != "" {
+		writeHealth(w, http.StatusOK, map[string]string{"status": "ready"})
+		return
+	}
+
+	var lastErr error = errAllCircuitsOpen
+	for _, target := range p.upstreams {
+		if target.breaker.isOpen() {
+			continue
+		}
+
+		lastContact := time.Unix(0, target.lastContact.Load())
+		if time.Since(lastContact) > readyWindow {
+			if err := p.probeUpstream(r.Context(), target); err != nil {
+				lastErr = fmt.Errorf("%s: %w", target.url, err)
+				continue
+			}
+		}
+
+		writeHealth(w, http.StatusOK, map[string]string{"status": "ready", "upstream": target.url})
+		return
+	}
+
+	log.Printf("Readiness check failed: %v", lastErr)
+	writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": lastErr.Error()})
+}
+
+// probeUpstream checks that the upstream can be reached. Any HTTP response
+// counts, as the probe carries no credentials and must not spend tokens.
+func (p *Proxy) probeUpstream(ctx context.Context, target *upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("no response within %s", probeTimeout)
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	target.lastContact.Store(time.Now().UnixNano())
+	return nil
+}
+
+// writeHealth writes the JSON response of a health endpoint
+func writeHealth(w http.ResponseWriter, statusCode int, body map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing health response: %v", err)
+	}
+}
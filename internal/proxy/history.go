@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// Transcript is a completed streamed request with the request body forwarded
+// upstream and the content blocks of the response, thinking included
+type Transcript struct {
+	Time         time.Time        `json:"time"`
+	Request      string           `json:"request"`
+	Conversation string           `json:"conversation,omitempty"`
+	Client       string           `json:"client"`
+	ClientModel  string           `json:"client_model"`
+	Model        string           `json:"model"`
+	DurationMS   int64            `json:"duration_ms"`
+	StopReason   string           `json:"stop_reason,omitempty"`
+	Usage        tokenUsage       `json:"usage"`
+	Body         json.RawMessage  `json:"body"`
+	Content      []map[string]any `json:"content"`
+}
+
+// historyBatchKey matches the keys of the batches the uploader writes after
+// its prefix, so pruning leaves other objects under the prefix alone
+var historyBatchKey = regexp.MustCompile(`^\d{4}/\d{2}/\d{2}/\d{8}T\d{6}Z-\d+-\d+\.jsonl\.gz$`)
+
+// Delivery settings of the history uploader
+const (
+	historyQueueSize     = 1024
+	historyUploadTimeout = time.Minute
+	historyUploadRetries = 3
+)
+
+// historyUploader batches transcripts and uploads each batch to the history
+// store as gzipped JSON lines, from a background queue dropping transcripts
+// when the store can't keep up
+type historyUploader struct {
+	store     historyStore
+	prefix    string
+	batchSize int
+	interval  time.Duration
+
+	queue chan *Transcript
+	done  chan struct{}
+	seq   int
+}
+
+// newHistoryUploader starts uploading transcripts to the store described by
+// spec, in batches of up to batchSize sent at least every interval, encrypted
+// with enc when it is set
+func newHistoryUploader(spec, endpoint string, batchSize int, interval time.Duration, enc *encryptor) (*historyUploader, error) {
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("invalid history batch size %d: must be positive", batchSize)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid history batch interval %s: must be positive", interval)
+	}
+	store, prefix, err := parseHistoryStore(spec, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("history store %q: %w", spec, err)
+	}
+	u := &historyUploader{
+		store:     encryptStore(store, enc),
+		prefix:    prefix,
+		batchSize: batchSize,
+		interval:  interval,
+		queue:     make(chan *Transcript, historyQueueSize),
+		done:      make(chan struct{}),
+	}
+	go u.run()
+	return u, nil
+}
+
+// run collects the queued transcripts into batches until the uploader is closed
+func (u *historyUploader) run() {
+	defer close(u.done)
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	var batch []*Transcript
+	for {
+		select {
+		case transcript, ok := <-u.queue:
+			if !ok {
+				u.upload(batch)
+				return
+			}
+			batch = append(batch, transcript)
+			if len(batch) >= u.batchSize {
+				u.upload(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			u.upload(batch)
+			batch = nil
+		}
+	}
+}
+
+// upload sends a batch to the store, retrying failed uploads
+func (u *historyUploader) upload(batch []*Transcript) {
+	if len(batch) == 0 {
+		return
+	}
+	data, err := encodeTranscripts(batch)
+	if err != nil {
+		log.Printf("Error encoding transcripts: %v", err)
+		return
+	}
+
+	// Keys sort by time, the process id and sequence number keep them unique
+	// across restarts and proxies sharing the prefix. Pruning expects them to
+	// match historyBatchKey.
+	now := time.Now().UTC()
+	u.seq++
+	key := fmt.Sprintf("%s%s-%d-%d.jsonl.gz", u.prefix, now.Format("2006/01/02/20060102T150405Z"), os.Getpid(), u.seq)
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), historyUploadTimeout)
+		err = u.store.Put(ctx, key, data)
+		cancel()
+		if err == nil {
+			log.Printf("Uploaded %d transcripts to %s", len(batch), u.store.Location(key))
+			return
+		}
+		if attempt == historyUploadRetries {
+			log.Printf("Error uploading %d transcripts to %s, dropping them: %v", len(batch), u.store.Location(key), err)
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// encodeTranscripts returns the transcripts as gzipped JSON lines
+func encodeTranscripts(batch []*Transcript) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	encoder := json.NewEncoder(writer)
+	for _, transcript := range batch {
+		if err := encoder.Encode(transcript); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// write queues a transcript for upload
+func (u *historyUploader) write(transcript *Transcript) error {
+	select {
+	case u.queue <- transcript:
+		return nil
+	default:
+		return errors.New("history queue full, dropping transcript")
+	}
+}
+
+// Close uploads the queued transcripts and stops the uploader
+func (u *historyUploader) Close() error {
+	close(u.queue)
+	<-u.done
+	return nil
+}
+
+// historyRecorder is the built-in middleware recording the transcripts of
+// streamed responses to the history store. It runs before the thinking filter
+// so transcripts keep the thinking blocks, and redacts their text itself as
+// the text redaction runs later.
+type historyRecorder struct {
+	proxy *Proxy
+}
+
+// Request returns a hook collecting the content blocks of streamed responses
+func (m historyRecorder) Request(req *Request) (StreamHook, error) {
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		return nil, nil
+	}
+	return &historyHook{proxy: m.proxy, req: req, collector: newTranscriptCollector(m.proxy.textRedactors, m.proxy.memory.newAccount(req.label))}, nil
+}
+
+// transcriptBlock accumulates a content block from its events
+type transcriptBlock struct {
+	fields map[string]any
+	// Text, thinking and signature deltas, set in the fields once complete
+	deltas map[string]*spillBuffer
+	input  bytes.Buffer
+}
+
+// transcriptCollector accumulates the content blocks of a streamed response,
+// redacting their text the way the client gets it. The deltas are held in
+// buffers charged to the request's memory account.
+type transcriptCollector struct {
+	blocks    map[int]*transcriptBlock
+	order     []int
+	redactors []redactor
+	account   *memoryAccount
+}
+
+// newTranscriptCollector returns an empty collector applying redactors to text
+// and holding the deltas with account
+func newTranscriptCollector(redactors []redactor, account *memoryAccount) *transcriptCollector {
+	return &transcriptCollector{blocks: make(map[int]*transcriptBlock), redactors: redactors, account: account}
+}
+
+// append appends to a string field of a block
+func (c *transcriptCollector) append(block *transcriptBlock, name, value string) {
+	buffer, ok := block.deltas[name]
+	if !ok {
+		buffer = &spillBuffer{account: c.account}
+		if initial, _ := block.fields[name].(string); initial != "" {
+			buffer.WriteString(initial)
+		}
+		if block.deltas == nil {
+			block.deltas = make(map[string]*spillBuffer)
+		}
+		block.deltas[name] = buffer
+	}
+	buffer.WriteString(value)
+}
+
+// observe accumulates the content block an event starts, extends or stops
+func (c *transcriptCollector) observe(event *sse.Event) {
+	var data struct {
+		Type         string         `json:"type"`
+		Index        int            `json:"index"`
+		ContentBlock map[string]any `json:"content_block"`
+		Delta        struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			Thinking    string `json:"thinking"`
+			Signature   string `json:"signature"`
+			PartialJSON string `json:"partial_json"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return
+	}
+
+	switch data.Type {
+	case "content_block_start":
+		if data.ContentBlock != nil {
+			if previous, ok := c.blocks[data.Index]; ok {
+				for _, buffer := range previous.deltas {
+					buffer.Close()
+				}
+			} else {
+				c.order = append(c.order, data.Index)
+			}
+			c.blocks[data.Index] = &transcriptBlock{fields: data.ContentBlock}
+		}
+	case "content_block_delta":
+		block, ok := c.blocks[data.Index]
+		if !ok {
+			return
+		}
+		switch data.Delta.Type {
+		case "text_delta":
+			c.append(block, "text", data.Delta.Text)
+		case "thinking_delta":
+			c.append(block, "thinking", data.Delta.Thinking)
+		case "signature_delta":
+			c.append(block, "signature", data.Delta.Signature)
+		case "input_json_delta":
+			block.input.WriteString(data.Delta.PartialJSON)
+		}
+	case "content_block_stop":
+		if block, ok := c.blocks[data.Index]; ok && block.input.Len() > 0 {
+			var input any
+			if err := json.Unmarshal(block.input.Bytes(), &input); err == nil {
+				block.fields["input"] = input
+			} else {
+				block.fields["input"] = block.input.String()
+			}
+		}
+	}
+}
+
+// content returns the content blocks in the order they started
+func (c *transcriptCollector) content() []map[string]any {
+	content := make([]map[string]any, 0, len(c.order))
+	for _, index := range c.order {
+		block := c.blocks[index]
+		fields := block.fields
+		for name, buffer := range block.deltas {
+			fields[name] = buffer.String()
+		}
+		if text, ok := fields["text"].(string); ok && len(c.redactors) > 0 {
+			fields["text"] = redactText(c.redactors, text)
+		}
+		content = append(content, fields)
+	}
+	return content
+}
+
+// close frees the buffers holding the deltas
+func (c *transcriptCollector) close() {
+	for _, block := range c.blocks {
+		for _, buffer := range block.deltas {
+			buffer.Close()
+		}
+	}
+}
+
+// historyHook collects the content blocks of a single response
+type historyHook struct {
+	proxy     *Proxy
+	req       *Request
+	collector *transcriptCollector
+}
+
+// Event accumulates the content blocks of the response. Events are never modified.
+func (h *historyHook) Event(event *sse.Event) bool {
+	h.collector.observe(event)
+	return true
+}
+
+// Done queues the transcript of the response for upload
+func (h *historyHook) Done() {
+	defer h.collector.close()
+	if h.req.usage.Model == "" {
+		// The upstream never started a message, there is nothing to record
+		return
+	}
+	transcript, err := h.proxy.newTranscript(h.req, h.req.Body, h.req.usage, h.collector.content())
+	if err != nil {
+		log.Printf("[%s] Error encoding request for history: %v", h.req.label, err)
+		return
+	}
+	if err := h.proxy.history.write(transcript); err != nil {
+		log.Printf("[%s] Error recording history: %v", h.req.label, err)
+	}
+}
+
+// newTranscript returns the transcript of a response to req, sent with body,
+// with sensitive values of the body masked
+func (p *Proxy) newTranscript(req *Request, body map[string]any, usage *requestUsage, content []map[string]any) (*Transcript, error) {
+	encoded, err := json.Marshal(p.sensitive.Value(body))
+	if err != nil {
+		return nil, err
+	}
+	return &Transcript{
+		Time:         req.started,
+		Request:      req.label,
+		Conversation: req.Conversation,
+		Client:       req.Client,
+		ClientModel:  req.ClientModel,
+		Model:        usage.Model,
+		DurationMS:   time.Since(req.started).Milliseconds(),
+		StopReason:   usage.StopReason,
+		Usage:        usage.Usage,
+		Body:         encoded,
+		Content:      content,
+	}, nil
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// isEventStream checks if a response is a server-sent event stream
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// finishInterruptedStream ends a stream the upstream didn't complete with the
+// error event of the Messages API and a message_stop, so clients surface the
+// failure instead of hanging on a truncated stream. err is the read error, or
+// nil when the upstream closed the stream early. The error event is skipped
+// when the upstream already sent one.
+func finishInterruptedStream(w io.Writer, err error, usage *requestUsage) {
+	if !usage.UpstreamError {
+		message := "Upstream closed the stream before the message was complete"
+		if errors.Is(err, errStreamIdle) {
+			message = "Upstream stream stalled: no data received before the idle timeout"
+		} else if err != nil {
+			message = fmt.Sprintf("Upstream stream interrupted: %v", err)
+		}
+		log.Printf("Ending interrupted stream: %s", message)
+
+		if err := sse.WriteJSON(w, "error", map[string]any{
+			"type": "error",
+			"error": map[string]string{
+				"type":    "api_error",
+				"message": message,
+			},
+		}); err != nil {
+			log.Printf("Error writing stream error: %v", err)
+			return
+		}
+	}
+
+	if err := sse.WriteJSON(w, "message_stop", map[string]string{"type": "message_stop"}); err != nil {
+		log.Printf("Error writing stream error: %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how often the signing keys are fetched again
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefresh is the minimum time between fetches caused by tokens
+	// signed with an unknown key, so bogus tokens can't hammer the provider
+	jwksMinRefresh = time.Minute
+	// jwtLeeway is the clock skew allowed when checking the token lifetime
+	jwtLeeway = time.Minute
+	// oidcFetchTimeout bounds fetching the discovery document and the keys
+	oidcFetchTimeout = 10 * time.Second
+)
+
+// jwtValidator validates the JWTs issued by an OIDC provider, as an
+// alternative to the static proxy tokens
+type jwtValidator struct {
+	issuer      string
+	audience    string
+	jwksURL     string
+	clientClaim string
+	client      *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	// refreshing is closed once the keys being fetched are in place, nil
+	// when no fetch is in progress
+	refreshing chan struct{}
+}
+
+// newJWTValidator returns a validator for the tokens of issuer meant for
+// audience, identifying clients by clientClaim. The signing keys are read from
+// jwksURL, or the URL the discovery document of the issuer points at.
+func newJWTValidator(issuer, audience, jwksURL, clientClaim string) (*jwtValidator, error) {
+	if issuer == "" {
+		return nil, errors.New("the OIDC issuer is required")
+	}
+	if audience == "" {
+		return nil, errors.New("the OIDC audience is required")
+	}
+	v := &jwtValidator{
+		issuer:      issuer,
+		audience:    audience,
+		jwksURL:     jwksURL,
+		clientClaim: clientClaim,
+		client:      &http.Client{Timeout: oidcFetchTimeout},
+	}
+	if v.jwksURL == "" {
+		jwksURL, err := v.discoverJWKSURL()
+		if err != nil {
+			return nil, err
+		}
+		v.jwksURL = jwksURL
+	}
+	keys, err := v.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetched = keys, time.Now()
+	return v, nil
+}
+
+// discoverJWKSURL reads the URL of the signing keys from the discovery
+// document of the issuer
+func (v *jwtValidator) discoverJWKSURL() (string, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	target := strings.TrimSuffix(v.issuer, "/") + "/.well-known/openid-configuration"
+	if err := v.fetchJSON(target, &discovery); err != nil {
+		return "", fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if discovery.JWKSURI == "" {
+		return "", fmt.Errorf("OIDC discovery: %s has no jwks_uri", target)
+	}
+	return discovery.JWKSURI, nil
+}
+
+// fetchJSON fetches and decodes a JSON document
+func (v *jwtValidator) fetchJSON(target string, value any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(value)
+}
+
+// fetchKeys fetches the signing keys
+func (v *jwtValidator) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := v.fetchJSON(v.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			log.Printf("Skipping JWKS key: %v", err)
+			continue
+		}
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no usable signing keys", v.jwksURL)
+	}
+	return keys, nil
+}
+
+// refresh fetches the signing keys without holding the lock, so validations
+// with known keys go on meanwhile, then swaps them in and closes done
+func (v *jwtValidator) refresh(done chan struct{}) {
+	keys, err := v.fetchKeys()
+	if err != nil {
+		log.Printf("Error refreshing the OIDC signing keys: %v", err)
+	}
+	v.mu.Lock()
+	if err == nil {
+		v.keys, v.fetched = keys, time.Now()
+	}
+	v.refreshing = nil
+	v.mu.Unlock()
+	close(done)
+}
+
+// key returns the signing key with the given id, fetching the keys again when
+// they are stale or the key is unknown, as the provider may have rotated them.
+// A single fetch runs at a time, waited for only by tokens with unknown keys.
+func (v *jwtValidator) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > jwksRefreshInterval
+	if (!ok || stale) && v.refreshing == nil && time.Since(v.attempted) > jwksMinRefresh {
+		v.attempted = time.Now()
+		v.refreshing = make(chan struct{})
+		go v.refresh(v.refreshing)
+	}
+	refreshing := v.refreshing
+	v.mu.Unlock()
+
+	if !ok && refreshing != nil {
+		<-refreshing
+		v.mu.Lock()
+		key, ok = v.keys[kid]
+		v.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// parseJWK parses an RSA, EC or Ed25519 public key of a JWKS
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, fmt.Errorf("key %q is not a signing key", jwk.Kid)
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			return "", nil, fmt.Errorf("invalid RSA key %q", jwk.Kid)
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		return jwk.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", nil, fmt.Errorf("unsupported curve %q of key %q", jwk.Crv, jwk.Kid)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return "", nil, fmt.Errorf("invalid EC key %q", jwk.Kid)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return "", nil, fmt.Errorf("invalid EC key %q", jwk.Kid)
+		}
+		return jwk.Kid, key, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return "", nil, fmt.Errorf("invalid OKP key %q", jwk.Kid)
+		}
+		return jwk.Kid, ed25519.PublicKey(x), nil
+	}
+	return "", nil, fmt.Errorf("unsupported key type %q of key %q", jwk.Kty, jwk.Kid)
+}
+
+// looksLikeJWT reports whether a token has the three parts of a JWT
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// validate checks the signature, issuer, audience and lifetime of a token,
+// returning the client name its claims map to
+func (v *jwtValidator) validate(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("invalid signature encoding")
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid claims: %w", err)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return "", err
+	}
+	name, _ := claims[v.clientClaim].(string)
+	if name == "" {
+		return "", fmt.Errorf("token has no %q claim", v.clientClaim)
+	}
+	return name, nil
+}
+
+// checkClaims checks the issuer, audience and lifetime of a token
+func (v *jwtValidator) checkClaims(claims map[string]any, now time.Time) error {
+	if issuer, _ := claims["iss"].(string); issuer != v.issuer {
+		return fmt.Errorf("unexpected issuer %q", issuer)
+	}
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []any:
+		for _, value := range aud {
+			if value, ok := value.(string); ok {
+				audiences = append(audiences, value)
+			}
+		}
+	}
+	if !slices.Contains(audiences, v.audience) {
+		return fmt.Errorf("token is not meant for audience %q", v.audience)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	return nil
+}
+
+// decodeJWTPart decodes the JSON of a base64url encoded part of a JWT
+func decodeJWTPart(part string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// verifyJWTSignature checks the signature of a JWT made with alg, which must
+// match the type of the key
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(len(alg), 2):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+
+	invalid := errors.New("invalid signature")
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case hash != 0 && strings.HasPrefix(alg, "RS"):
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+				return invalid
+			}
+			return nil
+		case hash != 0 && strings.HasPrefix(alg, "PS"):
+			if rsa.VerifyPSS(key, hash, digest, signature, nil) != nil {
+				return invalid
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if hash != 0 && strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return invalid
+			}
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			if !ed25519.Verify(key, []byte(signed), signature) {
+				return invalid
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %q doesn't match the signing key", alg)
+}
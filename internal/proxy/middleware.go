@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"zedclaudeproxy/internal/rewrite"
+	"zedclaudeproxy/internal/sse"
+)
+
+// Request is a Messages API request passing through the middlewares
+type Request struct {
+	// Header holds the headers forwarded upstream
+	Header http.Header
+	// Body is the decoded JSON body forwarded upstream
+	Body map[string]any
+	// ClientModel is the model as sent by the client, after resolving aliases
+	ClientModel string
+	// Client identifies the authenticated client, or its IP address
+	Client string
+	// Conversation identifies the conversation the request belongs to
+	Conversation string
+	// ThinkingBudget overrides the configured thinking budget when positive
+	ThinkingBudget int
+	// Modified must be set by middlewares that change Body so it is re-encoded
+	Modified bool
+
+	// State of the response shared with the hooks of built-in middlewares
+	id       uint64
+	label    string
+	started  time.Time
+	original *requestSnapshot
+	usage    *requestUsage
+	hooks    []StreamHook
+	// compare is set when the request is also sent to the comparison model
+	compare    bool
+	comparison *comparison
+}
+
+// newRequest returns a request for the middlewares, labelled with its
+// conversation so the logs of a session can be grouped
+func (p *Proxy) newRequest(r *http.Request, bodyJSON map[string]any, clientModel string) *Request {
+	conversation := conversationID(r.Header, bodyJSON)
+	r.Header.Del(ConversationHeader)
+
+	id, label := p.newRequestLabel()
+	if conversation != "" {
+		label += ", conversation " + conversation
+	}
+	return &Request{
+		Header:       r.Header,
+		Body:         bodyJSON,
+		ClientModel:  clientModel,
+		Client:       clientID(r),
+		Conversation: conversation,
+		id:           id,
+		label:        label,
+		started:      time.Now(),
+		usage:        &requestUsage{},
+	}
+}
+
+// Middleware transforms Messages API requests and the events of their responses
+type Middleware interface {
+	// Request may modify the request, and returns a hook for the events of its
+	// response or nil. An error rejects the request with a 400 response.
+	Request(req *Request) (StreamHook, error)
+}
+
+// StreamHook observes and modifies the events of a single response. Responses
+// with at least one hook are parsed into events, others are copied as-is.
+type StreamHook interface {
+	// Event may modify the event, returning false to drop it. Modified events
+	// must have their Raw field cleared.
+	Event(event *sse.Event) bool
+	// Done is called once a successful response is complete
+	Done()
+}
+
+// EventInserter is implemented by hooks that hold content back and send it in
+// events of their own, e.g. before the end of a content block
+type EventInserter interface {
+	// Insert returns the events to send before event, which are passed through
+	// the later hooks. It is called before Event for the same event.
+	Insert(event *sse.Event) []*sse.Event
+}
+
+// Use registers a middleware, which runs after the ones registered before it.
+// Middlewares must be registered before the proxy starts serving.
+func (p *Proxy) Use(m Middleware) {
+	p.middlewares = append(p.middlewares, m)
+}
+
+// applyMiddlewares runs the request through every middleware in order,
+// collecting the hooks for the events of its response
+func (p *Proxy) applyMiddlewares(req *Request) error {
+	for _, m := range p.middlewares {
+		hook, err := m.Request(req)
+		if err != nil {
+			return err
+		}
+		if hook != nil {
+			req.hooks = append(req.hooks, hook)
+		}
+	}
+	return nil
+}
+
+// thinkingRewrite is the built-in middleware enabling thinking for "-thinking"
+// model aliases and applying the other proxy-managed request transformations
+type thinkingRewrite struct {
+	rewriter *rewrite.Rewriter
+	memory   *thinkingMemory // nil unless thinking is reinjected
+}
+
+// Request rewrites the request
+func (m thinkingRewrite) Request(req *Request) (StreamHook, error) {
+	if !rewrite.HasThinkingSuffix(req.ClientModel) {
+		log.Printf("Forwarding request for regular model without modifications")
+		if m.rewriter.Passthrough(req.Header, req.Body, req.ClientModel) {
+			req.Modified = true
+		}
+		return nil, nil
+	}
+
+	// Enable thinking and apply the proxy-managed transformations
+	log.Printf("Detected model with thinking suffix: %s", req.ClientModel)
+	m.rewriter.Thinking(req.Header, req.Body, req.ClientModel, req.ThinkingBudget)
+	if m.memory != nil {
+		m.memory.reinject(req.Body)
+	}
+	req.Modified = true
+	return nil, nil
+}
+
+// thinkingFilter is the built-in middleware removing the thinking content from
+// the responses to "-thinking" model aliases
+type thinkingFilter struct {
+	proxy *Proxy
+}
+
+// Request returns a filter for the response to a thinking request
+func (m thinkingFilter) Request(req *Request) (StreamHook, error) {
+	if !rewrite.HasThinkingSuffix(req.ClientModel) {
+		return nil, nil
+	}
+	model := rewrite.ModifyModelName(req.ClientModel)
+
+	// Send each completed thinking block to the sinks
+	settings := m.proxy.settings()
+	var onThinking func(index, part int, thinking string, last bool)
+	if sinks := m.proxy.activeThinkingSinks(settings); len(sinks) > 0 {
+		onThinking = func(index, part int, thinking string, last bool) {
+			emitThinking(sinks, ThinkingRecord{
+				Time:         time.Now(),
+				Request:      req.label,
+				Conversation: req.Conversation,
+				Client:       req.Client,
+				Model:        model,
+				Index:        index,
+				Thinking:     thinking,
+				Part:         part,
+				Continued:    !last,
+			})
+		}
+	}
+
+	filter := NewStreamFilter(onThinking, settings.logThinkingLive, m.proxy.cfg.RemapIndices, req.label)
+	filter.SetPreview(m.proxy.cfg.ThinkingPreviewChars)
+	filter.SetProgress(m.proxy.cfg.ThinkingProgress, m.proxy.cfg.ThinkingProgressInterval)
+	filter.SetMemory(m.proxy.memory.newAccount(req.label))
+	return &thinkingFilterHook{
+		proxy:  m.proxy,
+		req:    req,
+		model:  model,
+		filter: filter,
+	}, nil
+}
+
+// thinkingFilterHook filters the thinking content of a single response
+type thinkingFilterHook struct {
+	proxy  *Proxy
+	req    *Request
+	model  string
+	filter *StreamFilter
+}
+
+// Event drops the events of thinking blocks, broadcasting their content to the
+// thinking tails
+func (h *thinkingFilterHook) Event(event *sse.Event) bool {
+	h.proxy.thinkingTail.publishEvent(h.req.label, h.model, event)
+	return h.filter.Process(event)
+}
+
+// Insert reports the progress of thinking and ends the text of thinking previews
+func (h *thinkingFilterHook) Insert(event *sse.Event) []*sse.Event {
+	return h.filter.Insert(event)
+}
+
+// Done tunes the budget, remembers the thinking of tool calls, notifies about
+// long thinking and summarizes the thinking content of the response
+func (h *thinkingFilterHook) Done() {
+	usage := h.req.usage
+	defer h.filter.Close()
+
+	// Tune the budget of later requests on the thinking this one used, unless
+	// the response was cut short, replayed from the cache or had its own budget
+	ownBudget := h.req.ThinkingBudget > 0 || rewrite.ThinkingEffort(h.req.ClientModel) != ""
+	if usage.Stopped && !usage.Cached && !ownBudget {
+		h.proxy.rewriter.ObserveThinking(h.model, int(usage.thinkingTokens()))
+	}
+
+	// Read the thinking to summarize before the spilled blocks are handed over
+	var thinking string
+	if h.proxy.cfg.SummaryModel != "" {
+		thinking = h.filter.Thinking(summaryMaxThinking)
+	}
+
+	// Keep the thinking of tool calls to send it back with their results
+	if usage.Stopped && h.proxy.thinkingMemory != nil {
+		h.proxy.thinkingMemory.remember(h.filter.Layout())
+	}
+
+	// Let the user know when a long thinking run is over
+	if after := h.proxy.cfg.NotifyAfter; after > 0 && !usage.Cached {
+		if duration := h.filter.ThinkingDuration(); duration >= after {
+			go h.proxy.notifyThinkingDone(h.req.label, h.model, duration, usage)
+		}
+	}
+
+	// Summarize the thinking content without holding up the response
+	if thinking != "" {
+		go h.proxy.summarizeThinking(h.req.Header.Clone(), ThinkingRecord{
+			Request:      h.req.label,
+			Conversation: h.req.Conversation,
+			Client:       h.req.Client,
+			Model:        h.model,
+		}, thinking)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"zedclaudeproxy/internal/rewrite"
+	"zedclaudeproxy/internal/sse"
+)
+
+// mockResponse synthesizes a plausible Messages API response, including a
+// thinking block when thinking is enabled
+func (p *Proxy) mockResponse(r *http.Request, bodyBytes []byte) (*http.Response, error) {
+	if r.Method != http.MethodPost || r.URL.Path != MessagesEndpoint {
+		return nil, errUnsupportedEndpoint
+	}
+
+	var bodyJSON map[string]any
+	if err := json.Unmarshal(bodyBytes, &bodyJSON); err != nil {
+		return nil, fmt.Errorf("mock mode requires a JSON body: %w", err)
+	}
+	model, _ := bodyJSON["model"].(string)
+	stream, _ := bodyJSON["stream"].(bool)
+
+	thinking := ""
+	if rewrite.ThinkingEnabled(bodyJSON) {
+		thinking = "The user is talking to a mock upstream. I should reply with a short canned answer " +
+			"that echoes their last message so the integration can be checked end to end."
+	}
+	text := "This is a mock response from zedclaudeproxy."
+	if prompt := lastUserText(bodyJSON); prompt != "" {
+		text += " You said: " + truncate(prompt, 200)
+	}
+
+	header := http.Header{}
+	if !stream {
+		header.Set("Content-Type", "application/json")
+		body, err := json.Marshal(mockMessage(model, thinking, text))
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}, nil
+	}
+
+	header.Set("Content-Type", "text/event-stream")
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeMockStream(pw, p.cfg.MockDelay, model, thinking, text))
+	}()
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          pr,
+		ContentLength: -1,
+	}, nil
+}
+
+// mockMessage builds a complete, non-streamed message
+func mockMessage(model, thinking, text string) map[string]any {
+	var content []any
+	if thinking != "" {
+		content = append(content, map[string]any{"type": "thinking", "thinking": thinking, "signature": "mock-signature"})
+	}
+	content = append(content, map[string]any{"type": "text", "text": text})
+
+	return map[string]any{
+		"id":            fmt.Sprintf("msg_mock_%d", time.Now().UnixNano()),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       content,
+		"stop_reason":   "end_turn",
+		"stop_sequence": nil,
+		"usage": map[string]int{
+			"input_tokens":  10,
+			"output_tokens": (len(thinking) + len(text)) / 4,
+		},
+	}
+}
+
+// writeMockStream writes the events of a streamed message, pausing between them
+func writeMockStream(w io.Writer, delay time.Duration, model, thinking, text string) error {
+	send := func(event string, data any) error {
+		time.Sleep(delay)
+		return sse.WriteJSON(w, event, data)
+	}
+
+	message := mockMessage(model, "", "")
+	message["content"] = []any{}
+	message["stop_reason"] = nil
+	message["usage"] = map[string]int{"input_tokens": 10, "output_tokens": 1}
+	if err := send("message_start", map[string]any{"type": "message_start", "message": message}); err != nil {
+		return err
+	}
+
+	index := 0
+	if thinking != "" {
+		if err := send("content_block_start", map[string]any{
+			"type": "content_block_start", "index": index,
+			"content_block": map[string]any{"type": "thinking", "thinking": ""},
+		}); err != nil {
+			return err
+		}
+		for _, chunk := range splitWords(thinking, 4) {
+			if err := send("content_block_delta", map[string]any{
+				"type": "content_block_delta", "index": index,
+				"delta": map[string]any{"type": "thinking_delta", "thinking": chunk},
+			}); err != nil {
+				return err
+			}
+		}
+		if err := send("content_block_delta", map[string]any{
+			"type": "content_block_delta", "index": index,
+			"delta": map[string]any{"type": "signature_delta", "signature": "mock-signature"},
+		}); err != nil {
+			return err
+		}
+		if err := send("content_block_stop", map[string]any{"type": "content_block_stop", "index": index}); err != nil {
+			return err
+		}
+		index++
+	}
+
+	if err := send("content_block_start", map[string]any{
+		"type": "content_block_start", "index": index,
+		"content_block": map[string]any{"type": "text", "text": ""},
+	}); err != nil {
+		return err
+	}
+	for _, chunk := range splitWords(text, 4) {
+		if err := send("content_block_delta", map[string]any{
+			"type": "content_block_delta", "index": index,
+			"delta": map[string]any{"type": "text_delta", "text": chunk},
+		}); err != nil {
+			return err
+		}
+	}
+	if err := send("content_block_stop", map[string]any{"type": "content_block_stop", "index": index}); err != nil {
+		return err
+	}
+
+	if err := send("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": "end_turn", "stop_sequence": nil},
+		"usage": map[string]int{"output_tokens": (len(thinking) + len(text)) / 4},
+	}); err != nil {
+		return err
+	}
+	return send("message_stop", map[string]any{"type": "message_stop"})
+}
+
+// lastUserText returns the text of the last user message in a request body
+func lastUserText(bodyJSON map[string]any) string {
+	messages, _ := bodyJSON["messages"].([]any)
+	for i := len(messages) - 1; i >= 0; i-- {
+		message, _ := messages[i].(map[string]any)
+		if message["role"] != "user" {
+			continue
+		}
+		switch content := message["content"].(type) {
+		case string:
+			return content
+		case []any:
+			var texts []string
+			for _, block := range content {
+				if block, ok := block.(map[string]any); ok && block["type"] == "text" {
+					text, _ := block["text"].(string)
+					texts = append(texts, text)
+				}
+			}
+			return strings.Join(texts, "\n")
+		}
+	}
+	return ""
+}
+
+// truncate shortens a string to at most n bytes, marking the cut
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "") + "…"
+}
+
+// splitWords splits text into chunks of n words, keeping the separating spaces
+func splitWords(text string, n int) []string {
+	words := strings.SplitAfter(text, " ")
+	var chunks []string
+	for i := 0; i < len(words); i += n {
+		chunks = append(chunks, strings.Join(words[i:min(i+n, len(words))], ""))
+	}
+	return chunks
+}
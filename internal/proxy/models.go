@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// ModelsEndpoint is the path of the model listing API
+const ModelsEndpoint = "/v1/models"
+
+// modelInfo is an entry of the model list
+type modelInfo struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// forwardModels forwards a model listing request, adding a "-thinking" variant
+// after every model that supports thinking and the configured aliases, so clients
+// can offer them without manual configuration
+func (p *Proxy) forwardModels(w http.ResponseWriter, r *http.Request) {
+	resp, err := p.sendOrReplay(r, nil)
+	if errors.Is(err, errNoRecording) || errors.Is(err, errUnsupportedEndpoint) {
+		writeAPIError(w, http.StatusNotFound, "not_found_error",
+			fmt.Sprintf("%s %s is not supported by the configured backend", r.Method, r.URL.Path))
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error forwarding request: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Error reading response: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// Add the synthetic models to the first page of a successful listing
+	firstPage := r.URL.Query().Get("after_id") == "" && r.URL.Query().Get("before_id") == ""
+	if resp.StatusCode == http.StatusOK && firstPage {
+		if modified, err := p.addSyntheticModels(body); err != nil {
+			log.Printf("Error adding thinking models to the model list: %v", err)
+		} else {
+			body = modified
+		}
+	}
+
+	copyHeaders(w.Header(), resp.Header)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// addSyntheticModels adds the thinking variants and aliases to a model list
+func (p *Proxy) addSyntheticModels(body []byte) ([]byte, error) {
+	var list map[string]json.RawMessage
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	var models []modelInfo
+	if err := json.Unmarshal(list["data"], &models); err != nil {
+		return nil, err
+	}
+
+	var result []modelInfo
+	byID := make(map[string]modelInfo)
+	for _, model := range models {
+		result = append(result, model)
+		byID[model.ID] = model
+		if p.supportsThinking(model.ID) {
+			result = append(result, modelInfo{
+				Type:        model.Type,
+				ID:          model.ID + rewrite.ThinkingSuffix,
+				DisplayName: model.DisplayName + " Thinking",
+				CreatedAt:   model.CreatedAt,
+			})
+			for _, effort := range rewrite.EffortLevels {
+				result = append(result, modelInfo{
+					Type:        model.Type,
+					ID:          model.ID + rewrite.ThinkingSuffix + "-" + effort,
+					DisplayName: fmt.Sprintf("%s Thinking (%s)", model.DisplayName, effort),
+					CreatedAt:   model.CreatedAt,
+				})
+			}
+		}
+	}
+
+	aliases := p.rewriter.ModelAliases()
+	for _, alias := range slices.Sorted(maps.Keys(aliases)) {
+		target := aliases[alias]
+		result = append(result, modelInfo{
+			Type:        "model",
+			ID:          alias,
+			DisplayName: alias,
+			CreatedAt:   byID[rewrite.ModifyModelName(target)].CreatedAt,
+		})
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	list["data"] = data
+	return json.Marshal(list)
+}
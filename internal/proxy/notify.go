@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds the notification command
+const notifyTimeout = 10 * time.Second
+
+// notifyThinkingDone sends a desktop notification for a response that thought
+// for longer than the configured threshold
+func (p *Proxy) notifyThinkingDone(label, model string, duration time.Duration, usage *requestUsage) {
+	message := fmt.Sprintf("%s (%s) thought for %s: %d output tokens (~%d thinking)",
+		label, model, duration.Round(time.Second), usage.Usage.OutputTokens, usage.thinkingTokens())
+	log.Printf("Notifying: %s", message)
+	p.notify("Claude finished thinking", message)
+}
+
+// notify runs the notification command with a title and message. A configured
+// command gets them as its last two arguments, otherwise notify-send or
+// osascript on macOS is used.
+func (p *Proxy) notify(title, message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	switch fields := strings.Fields(p.cfg.NotifyCommand); {
+	case len(fields) > 0:
+		cmd = exec.CommandContext(ctx, fields[0], append(fields[1:], title, message)...)
+	case runtime.GOOS == "darwin":
+		script := fmt.Sprintf("display notification %q with title %q", message, title)
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	default:
+		cmd = exec.CommandContext(ctx, "notify-send", title, message)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Error sending notification with %s: %v %s", cmd.Path, err, strings.TrimSpace(string(output)))
+	}
+}
@@ -0,0 +1,496 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyStore saves objects to the storage backend of the history
+type historyStore interface {
+	// Put saves data under a key, replacing any object with the same key
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the data saved under a key
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the objects whose keys start with a prefix, in lexical order
+	List(ctx context.Context, prefix string) ([]storedObject, error)
+	// Delete removes the object saved under a key
+	Delete(ctx context.Context, key string) error
+	// Location describes where a key is saved, for the logs
+	Location(key string) string
+}
+
+// storedObject describes an object of a history store
+type storedObject struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// parseHistoryStore returns the store described by spec and the prefix of the
+// keys saved to it: "file:<dir>", "s3://<bucket>[/<prefix>]" or
+// "gs://<bucket>[/<prefix>]". The endpoint, when set, replaces the API
+// endpoint of object stores, e.g. for S3 compatible stores.
+func parseHistoryStore(spec, endpoint string) (historyStore, string, error) {
+	if dir, ok := strings.CutPrefix(spec, "file:"); ok {
+		if dir == "" {
+			return nil, "", errors.New("missing directory")
+		}
+		return fileStore{dir: dir}, "", nil
+	}
+
+	parsed, err := url.Parse(spec)
+	if err != nil || parsed.Host == "" {
+		return nil, "", errors.New("expected file:<dir>, s3://<bucket>/<prefix> or gs://<bucket>/<prefix>")
+	}
+	bucket := parsed.Host
+	prefix := strings.TrimPrefix(parsed.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var store historyStore
+	switch parsed.Scheme {
+	case "s3":
+		store, err = newS3Store(bucket, endpoint)
+	case "gs":
+		store, err = newGCSStore(bucket, endpoint)
+	default:
+		err = fmt.Errorf("unknown store type %q", parsed.Scheme)
+	}
+	return store, prefix, err
+}
+
+// objectStoreClient is the client of object store APIs
+var objectStoreClient = &http.Client{Timeout: historyUploadTimeout}
+
+// checkObjectStoreResponse returns an error with the start of the body when
+// an object store API call failed
+func checkObjectStoreResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// readObjectStoreResponse returns the body of a successful object store API call
+func readObjectStoreResponse(resp *http.Response, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkObjectStoreResponse(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fileStore saves objects as files in a directory
+type fileStore struct {
+	dir string
+}
+
+// Put writes data to the file of a key, creating its directories
+func (s fileStore) Put(_ context.Context, key string, data []byte) error {
+	path := s.Location(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// Get reads the file of a key
+func (s fileStore) Get(_ context.Context, key string) ([]byte, error) {
+	return os.ReadFile(s.Location(key))
+}
+
+// List returns the files under the directory whose keys start with prefix
+func (s fileStore) List(_ context.Context, prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	err := filepath.WalkDir(s.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, storedObject{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	slices.SortFunc(objects, func(a, b storedObject) int { return strings.Compare(a.Key, b.Key) })
+	return objects, err
+}
+
+// Delete removes the file of a key and the directories it leaves empty
+func (s fileStore) Delete(_ context.Context, key string) error {
+	path := s.Location(key)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != filepath.Clean(s.dir); dir = filepath.Dir(dir) {
+		// Removing fails on the first directory holding other files
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Location returns the path of the file of a key
+func (s fileStore) Location(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// s3Store saves objects to an S3 bucket, signing requests with the AWS
+// credentials from the environment
+type s3Store struct {
+	bucket, region string
+	// endpoint is the URL objects are saved under, with a trailing slash
+	endpoint string
+	creds    awsCredentials
+}
+
+// newS3Store returns a store for a bucket in the region from AWS_REGION, using
+// path-style URLs on a custom endpoint and virtual-hosted ones on AWS
+func newS3Store(bucket, endpoint string) (*s3Store, error) {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		return nil, errors.New("AWS_REGION is required for the s3 store")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, region)
+	} else {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/"
+	}
+	return &s3Store{bucket: bucket, region: region, endpoint: endpoint, creds: creds}, nil
+}
+
+// do sends a signed request to the bucket
+func (s *s3Store) do(ctx context.Context, method, target string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	signV4(req, data, s.creds, s.region, "s3", time.Now())
+	return objectStoreClient.Do(req)
+}
+
+// Put uploads an object
+func (s *s3Store) Put(ctx context.Context, key string, data []byte) error {
+	_, err := readObjectStoreResponse(s.do(ctx, http.MethodPut, s.endpoint+key, data))
+	return err
+}
+
+// Get downloads an object
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	return readObjectStoreResponse(s.do(ctx, http.MethodGet, s.endpoint+key, nil))
+}
+
+// List returns the objects starting with prefix, a page of ListObjectsV2 at a time
+func (s *s3Store) List(ctx context.Context, prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		data, err := readObjectStoreResponse(s.do(ctx, http.MethodGet, s.endpoint+"?"+query.Encode(), nil))
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("parsing object list: %w", err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, storedObject{Key: object.Key, Size: object.Size, Modified: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// Delete removes an object
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	_, err := readObjectStoreResponse(s.do(ctx, http.MethodDelete, s.endpoint+key, nil))
+	return err
+}
+
+// Location returns the S3 URI of a key
+func (s *s3Store) Location(key string) string {
+	return "s3://" + s.bucket + "/" + key
+}
+
+// GCS API settings
+const (
+	gcsEndpoint      = "https://storage.googleapis.com"
+	gcsScope         = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcsStore saves objects to a Cloud Storage bucket with the JSON API, using the
+// service account key from GOOGLE_APPLICATION_CREDENTIALS or else the
+// service account of the instance from the metadata server
+type gcsStore struct {
+	bucket, endpoint string
+	account          *serviceAccountKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// serviceAccountKey holds the fields of a service account key file used to
+// get access tokens
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// newGCSStore returns a store for a bucket
+func newGCSStore(bucket, endpoint string) (*gcsStore, error) {
+	if endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+	s := &gcsStore{bucket: bucket, endpoint: strings.TrimSuffix(endpoint, "/")}
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		account, err := loadServiceAccountKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+		s.account = account
+	}
+	return s, nil
+}
+
+// loadServiceAccountKey reads a service account key file
+func loadServiceAccountKey(path string) (*serviceAccountKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccountKey
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("not a service account key file")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	var ok bool
+	if account.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return &account, nil
+}
+
+// do sends an authorized request to the API
+func (s *gcsStore) do(ctx context.Context, method, target string, data []byte) (*http.Response, error) {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting access token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return objectStoreClient.Do(req)
+}
+
+// Put uploads an object with a simple media upload
+func (s *gcsStore) Put(ctx context.Context, key string, data []byte) error {
+	query := url.Values{"uploadType": {"media"}, "name": {key}}
+	target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", s.endpoint, url.PathEscape(s.bucket), query.Encode())
+	_, err := readObjectStoreResponse(s.do(ctx, http.MethodPost, target, data))
+	return err
+}
+
+// Get downloads the data of an object
+func (s *gcsStore) Get(ctx context.Context, key string) ([]byte, error) {
+	target := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(key))
+	return readObjectStoreResponse(s.do(ctx, http.MethodGet, target, nil))
+}
+
+// List returns the objects whose names start with prefix, a page at a time
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,updated),nextPageToken"}}
+	for {
+		target := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.endpoint, url.PathEscape(s.bucket), query.Encode())
+		data, err := readObjectStoreResponse(s.do(ctx, http.MethodGet, target, nil))
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    int64     `json:"size,string"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("parsing object list: %w", err)
+		}
+		for _, object := range page.Items {
+			objects = append(objects, storedObject{Key: object.Name, Size: object.Size, Modified: object.Updated})
+		}
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// Delete removes an object
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	target := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(key))
+	_, err := readObjectStoreResponse(s.do(ctx, http.MethodDelete, target, nil))
+	return err
+}
+
+// Location returns the Cloud Storage URI of a key
+func (s *gcsStore) Location(key string) string {
+	return "gs://" + s.bucket + "/" + key
+}
+
+// accessToken returns a cached access token, getting a new one shortly before it expires
+func (s *gcsStore) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expires) > time.Minute {
+		return s.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if s.account != nil {
+		req, err = s.account.tokenRequest(ctx)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataToken, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := objectStoreClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkObjectStoreResponse(resp); err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token in response")
+	}
+	s.token = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// tokenRequest returns a request exchanging a JWT signed with the service
+// account key for an access token
+func (a *serviceAccountKey) tokenRequest(ctx context.Context) (*http.Request, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": gcsScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// streamsBody reports whether the body of r is streamed to the upstream as it
+// is read. The proxy only rewrites Messages API, token counting and batch
+// requests, so the bodies of the others, such as Files API uploads, are
+// passed through without being read into memory.
+func streamsBody(r *http.Request) bool {
+	if r.ContentLength == 0 {
+		return false
+	}
+	if r.Method != http.MethodPost {
+		return true
+	}
+	switch r.URL.Path {
+	case MessagesEndpoint, CountTokensEndpoint, BatchesEndpoint:
+		return false
+	}
+	return true
+}
+
+// forwardStreamed forwards a request whose body is streamed to the upstream
+func (p *Proxy) forwardStreamed(w http.ResponseWriter, r *http.Request) {
+	// Mocks and recordings need the whole body to match the request
+	if p.cfg.Mock || p.cfg.ReplayDir != "" || p.cfg.RecordDir != "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		p.forwardRequestAsIs(w, r, body)
+		return
+	}
+
+	log.Printf("Streaming request body of %s", describeSize(r.ContentLength))
+	p.forwardAndHandleResponse(w, r, nil, func() (*http.Response, error) {
+		return p.sendStreamed(r)
+	})
+}
+
+// sendStreamed sends a request with a streamed body to the first healthy
+// upstream. The body is read as it is sent, so unlike other requests it is
+// neither retried nor failed over once it started.
+func (p *Proxy) sendStreamed(r *http.Request) (*http.Response, error) {
+	for _, target := range p.upstreams {
+		if !target.breaker.allow() {
+			continue
+		}
+		if target.bedrock {
+			target.breaker.release()
+			return nil, errUnsupportedEndpoint
+		}
+
+		limitKey := rateLimitKey(target.url, r)
+		if p.upstreamLimits != nil {
+			if err := p.upstreamLimits.wait(r.Context(), limitKey, nil); err != nil {
+				target.breaker.release()
+				return nil, err
+			}
+		}
+
+		forwardReq, err := newStreamedForwardRequest(r, target.url)
+		if err != nil {
+			target.breaker.release()
+			return nil, err
+		}
+		applyHeaderRules(p.cfg.HeaderRules, forwardReq.Header)
+		resp, err := p.client.Do(forwardReq)
+		if err != nil && r.Context().Err() != nil {
+			target.breaker.release()
+			return nil, err
+		}
+		if err != nil {
+			target.breaker.failure()
+			log.Printf("Error forwarding request to %s: %v", target.url, err)
+			return nil, err
+		}
+
+		target.lastContact.Store(time.Now().UnixNano())
+		if p.upstreamLimits != nil {
+			p.upstreamLimits.observe(limitKey, resp.Header)
+		}
+		if resp.StatusCode < 500 {
+			target.breaker.success()
+		} else {
+			target.breaker.failure()
+		}
+		if err := decompressResponse(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp, nil
+	}
+	return nil, errAllCircuitsOpen
+}
+
+// newStreamedForwardRequest builds the request to send to the target from the
+// incoming request, reading its body as it is sent
+func newStreamedForwardRequest(r *http.Request, target string) (*http.Request, error) {
+	forwardURL, err := upstreamURL(target, r.URL)
+	if err != nil {
+		return nil, err
+	}
+	forwardReq, err := http.NewRequestWithContext(r.Context(), r.Method, forwardURL, r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	copyHeaders(forwardReq.Header, r.Header)
+	forwardReq.Header.Del("Accept-Encoding")
+
+	// Keep the length of the body when the client sent it, the upload is
+	// chunked otherwise
+	forwardReq.Header.Del("Content-Length")
+	forwardReq.ContentLength = r.ContentLength
+	forwardReq.Host = forwardReq.URL.Host
+	return forwardReq, nil
+}
+
+// describeSize describes a body length for the logs
+func describeSize(length int64) string {
+	if length < 0 {
+		return "unknown size"
+	}
+	return fmt.Sprintf("%d bytes", length)
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// latestSuffix ends the model aliases Anthropic moves to new snapshots
+const latestSuffix = "-latest"
+
+// pinLookupTimeout bounds the lookup of the snapshot a "-latest" alias points at
+const pinLookupTimeout = 10 * time.Second
+
+// modelPins rewrites "-latest" model aliases to pinned snapshots, so results
+// stay reproducible when Anthropic moves an alias, and checks in the
+// background whether the aliases still point at their pins
+type modelPins struct {
+	// auto pins aliases without a configured pin to the snapshot they point
+	// at when first used, saved to file when set
+	auto bool
+	file string
+	// interval between the checks of what a pinned alias points at
+	interval time.Duration
+
+	mu sync.Mutex
+	// Pins from the configuration file, which win over the learned ones
+	configured map[string]string
+	// Pins learned from the upstream in auto mode
+	learned map[string]string
+	// When each alias was last checked, and the snapshot it pointed at
+	checked  map[string]time.Time
+	latest   map[string]string
+	checking map[string]bool
+}
+
+// newModelPins returns the pins of the configured aliases and, in auto mode,
+// the ones learned before and saved to file. It returns nil when nothing is
+// pinned.
+func newModelPins(configured map[string]string, auto bool, file string, interval time.Duration) (*modelPins, error) {
+	if len(configured) == 0 && !auto {
+		return nil, nil
+	}
+	for alias, snapshot := range configured {
+		if !strings.HasSuffix(alias, latestSuffix) || snapshot == "" {
+			return nil, fmt.Errorf("pinned_models: %q must map a %s alias to a snapshot", alias, latestSuffix)
+		}
+	}
+	pins := &modelPins{
+		auto:       auto,
+		file:       file,
+		interval:   interval,
+		configured: configured,
+		learned:    make(map[string]string),
+		checked:    make(map[string]time.Time),
+		latest:     make(map[string]string),
+		checking:   make(map[string]bool),
+	}
+	if auto && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("pin file: %w", err)
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &pins.learned); err != nil {
+				return nil, fmt.Errorf("pin file %s: %w", file, err)
+			}
+		}
+	}
+	return pins, nil
+}
+
+// pinned returns the snapshot an alias is pinned to, if any
+func (m *modelPins) pinned(alias string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if snapshot, ok := m.configured[alias]; ok {
+		return snapshot, true
+	}
+	snapshot, ok := m.learned[alias]
+	return snapshot, ok
+}
+
+// all returns every pin, the configured ones winning over the learned ones
+func (m *modelPins) all() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pins := maps.Clone(m.learned)
+	maps.Copy(pins, m.configured)
+	return pins
+}
+
+// learn pins an alias to a snapshot, saving the learned pins to the pin file
+func (m *modelPins) learn(alias, snapshot string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.learned[alias]; ok {
+		return
+	}
+	m.learned[alias] = snapshot
+	m.checked[alias], m.latest[alias] = time.Now(), snapshot
+	if m.file == "" {
+		return
+	}
+	if err := writeFileAtomic(m.file, m.learned); err != nil {
+		log.Printf("Error saving the pinned models to %s: %v", m.file, err)
+	}
+}
+
+// checkDue reports whether an alias is due for a check, marking it as being
+// checked when it is
+func (m *modelPins) checkDue(alias string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checking[alias] || time.Since(m.checked[alias]) < m.interval {
+		return false
+	}
+	m.checking[alias] = true
+	return true
+}
+
+// observe records the snapshot an alias points at, reporting the one it
+// pointed at before if it changed since the last check
+func (m *modelPins) observe(alias, snapshot string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checking[alias] = false
+	m.checked[alias] = time.Now()
+	previous, seen := m.latest[alias]
+	m.latest[alias] = snapshot
+	return previous, seen && previous != snapshot
+}
+
+// failed notes that a check of an alias failed, to be retried after the interval
+func (m *modelPins) failed(alias string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checking[alias] = false
+	m.checked[alias] = time.Now()
+}
+
+// writeFileAtomic writes a value as JSON to a file through a temporary file,
+// so readers never see it half written
+func writeFileAtomic(path string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pinModel rewrites the "-latest" alias of a request to its pinned snapshot,
+// keeping any "-thinking" suffix, and reports whether the body changed. With
+// the client's request r, aliases are pinned to the snapshot they point at on
+// first use in auto mode, and checked for a newer snapshot in the background.
+func (p *Proxy) pinModel(r *http.Request, bodyJSON map[string]any) bool {
+	if p.pins == nil {
+		return false
+	}
+	model, _ := bodyJSON["model"].(string)
+	alias := rewrite.ModifyModelName(model)
+	if !strings.HasSuffix(alias, latestSuffix) || !strings.HasPrefix(model, alias) {
+		return false
+	}
+
+	snapshot, ok := p.pins.pinned(alias)
+	if !ok && p.pins.auto && r != nil {
+		var err error
+		if snapshot, err = p.resolveModel(r.Context(), r.Header, clientID(r), alias); err != nil {
+			log.Printf("Error looking up the snapshot of %s, forwarding it unpinned: %v", alias, err)
+			return false
+		}
+		log.Printf("Pinned %s to %s, the snapshot it points at now", alias, snapshot)
+		p.pins.learn(alias, snapshot)
+		ok = true
+	}
+	if !ok {
+		return false
+	}
+	if r != nil && p.pins.checkDue(alias) {
+		go p.checkPin(r.Header.Clone(), clientID(r), alias, snapshot)
+	}
+
+	pinned := snapshot + model[len(alias):]
+	log.Printf("Pinned model '%s' to '%s'", model, pinned)
+	bodyJSON["model"] = pinned
+	return true
+}
+
+// checkPin looks up the snapshot a pinned alias points at, with the
+// credentials of the request that used it, logging when it moved
+func (p *Proxy) checkPin(header http.Header, client, alias, snapshot string) {
+	latest, err := p.resolveModel(context.Background(), header, client, alias)
+	if err != nil {
+		p.pins.failed(alias)
+		log.Printf("Error checking the snapshot of %s: %v", alias, err)
+		return
+	}
+	previous, changed := p.pins.observe(alias, latest)
+	switch {
+	case changed:
+		log.Printf("Anthropic moved %s from %s to %s, requests stay pinned to %s", alias, previous, latest, snapshot)
+	case latest != snapshot && previous == "":
+		log.Printf("%s points at %s, requests stay pinned to %s", alias, latest, snapshot)
+	}
+}
+
+// resolveModel looks up the snapshot a model alias points at with the model
+// API, sending the headers of the client's request for its credentials
+func (p *Proxy) resolveModel(ctx context.Context, header http.Header, client, alias string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, clientIDKey, client), pinLookupTimeout)
+	defer cancel()
+	lookup, err := http.NewRequestWithContext(ctx, http.MethodGet, ModelsEndpoint+"/"+url.PathEscape(alias), nil)
+	if err != nil {
+		return "", err
+	}
+	lookup.Header = header.Clone()
+	lookup.Header.Del("Content-Type")
+
+	resp, err := p.sendOrReplay(lookup, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("model API returned %s: %s", resp.Status, truncate(string(body), 200))
+	}
+	var model modelInfo
+	if err := json.Unmarshal(body, &model); err != nil {
+		return "", err
+	}
+	if model.ID == "" {
+		return "", errors.New("model API returned no model ID")
+	}
+	return model.ID, nil
+}
@@ -0,0 +1,1232 @@
+// Package proxy implements an HTTP proxy for Anthropic's Claude API that enables
+// access to Claude's thinking process by intercepting requests with "-thinking"
+// model suffix, adding the thinking capability, and filtering the thinking
+// content from responses while logging it to the console.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// MessagesEndpoint is the path of the Messages API
+const MessagesEndpoint = "/v1/messages"
+
+// CountTokensEndpoint is the path of the token counting API
+const CountTokensEndpoint = "/v1/messages/count_tokens"
+
+// Config holds the proxy configuration
+type Config struct {
+	// Target is the upstream API URL, or a comma separated list of URLs in failover order
+	Target string
+	// Backend selects the upstream API: "anthropic" or "bedrock"
+	Backend string
+	// BedrockRegion is the AWS region for the Bedrock backend, defaulting to AWS_REGION
+	BedrockRegion string
+	// BedrockModels holds comma separated model=bedrock-model-id mappings
+	BedrockModels string
+
+	// UpstreamProxy is the URL of a forward proxy for upstream requests, with
+	// optional credentials as its user info. Empty uses HTTPS_PROXY and
+	// HTTP_PROXY, NO_PROXY is honored either way.
+	UpstreamProxy string
+
+	// UpstreamCA is a PEM bundle of certificates trusted for upstream
+	// connections in addition to the system roots, e.g. a corporate TLS gateway
+	UpstreamCA string
+	// UpstreamInsecure disables certificate verification of upstream connections
+	UpstreamInsecure bool
+	// UpstreamTLSMinVersion is the minimum TLS version of upstream connections,
+	// "1.2" (the default) or "1.3"
+	UpstreamTLSMinVersion string
+
+	// RepairTruncated completes streams the upstream cuts off as if the message
+	// hit max_tokens, instead of ending them with an error event
+	RepairTruncated bool
+
+	// UpstreamTimeout is the total deadline for an upstream request including
+	// its streamed response, 0 disables it
+	UpstreamTimeout time.Duration
+	// IdleTimeout aborts a response when the upstream sends no data for this
+	// long, 0 disables it
+	IdleTimeout time.Duration
+	// KeepAliveInterval sends a ping event to the client when filtering kept
+	// it from receiving any event for this long, 0 disables it
+	KeepAliveInterval time.Duration
+	// KeepAliveComment sends ": keepalive" SSE comments instead of ping events
+	KeepAliveComment bool
+
+	// ValidateRequests checks the shape of Messages API requests before they
+	// are forwarded, rejecting malformed ones with an error naming the field
+	ValidateRequests bool
+
+	// LogThinking controls whether thinking content is logged
+	LogThinking bool
+	// ThinkingSinks is a comma separated list of sinks receiving each thinking
+	// block when LogThinking is set: stdout, file:<path>, syslog[:<address>]
+	// or webhook:<url>. Empty logs to stdout.
+	ThinkingSinks string
+	// LogThinkingLive logs thinking line by line as it arrives instead of once
+	// per completed block
+	LogThinkingLive bool
+	// RemapIndices renumbers the content blocks left after removing thinking
+	// blocks so their indices are contiguous from 0
+	RemapIndices bool
+	// ThinkingPreviewChars forwards the first characters of each thinking
+	// block to clients as a text block, 0 removes thinking entirely
+	ThinkingPreviewChars int
+	// ThinkingProgress reports the thinking tokens generated so far while
+	// thinking is filtered, every ThinkingProgressInterval, as SSE comments
+	// (ThinkingProgressComment) or as text blocks in place of the thinking
+	// blocks (ThinkingProgressText). Empty disables it.
+	ThinkingProgress         string
+	ThinkingProgressInterval time.Duration
+	// ThinkingMemoryRequestBytes and ThinkingMemoryTotalBytes cap the memory
+	// holding the thinking content of each response and of all of them, the
+	// rest is spilled to temporary files. 0 leaves them unlimited.
+	ThinkingMemoryRequestBytes int64
+	ThinkingMemoryTotalBytes   int64
+	// WarnThinkingExhausted adds an SSE comment to responses whose thinking
+	// used up its budget, which is always logged
+	WarnThinkingExhausted bool
+	// AnnotateUsage adds a "proxy" object with the estimated thinking tokens
+	// and the thinking budget to the message_delta of streamed responses
+	AnnotateUsage bool
+	// FinishOnDisconnect reads Messages API responses to the end after the
+	// client went away, instead of cancelling them, so the history store and
+	// the usage get the complete response
+	FinishOnDisconnect bool
+	// EscalateBudgetMax retries streamed "-thinking" requests whose thinking
+	// used up its budget without an answer once with a doubled budget, up to
+	// this many tokens, 0 disables it
+	EscalateBudgetMax int
+	// ReinjectThinking puts the thinking blocks stripped from responses calling
+	// tools back into the assistant turns sent with the tool results, as the
+	// API requires
+	ReinjectThinking bool
+	// SummaryModel is the model asked for a short summary of the thinking
+	// content of each response, empty disables summaries
+	SummaryModel string
+	// NotifyAfter sends a desktop notification when a response that thought
+	// for at least this long completes, 0 disables notifications
+	NotifyAfter time.Duration
+	// NotifyCommand is the command sending notifications, given the title and
+	// message as its last arguments. Empty uses notify-send, or osascript on macOS.
+	NotifyCommand string
+	// Rewrite controls how requests are rewritten
+	Rewrite rewrite.Config
+
+	// MaxAttempts is the maximum number of attempts for upstream requests failing with 429/500/529
+	MaxAttempts int
+	// RetryBaseDelay is the initial backoff delay between upstream retries
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay is the maximum backoff delay between upstream retries
+	RetryMaxDelay time.Duration
+
+	// BreakerThreshold is the number of consecutive upstream failures before
+	// failing fast, 0 disables the circuit breaker
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit stays open before a half-open probe
+	BreakerCooldown time.Duration
+
+	// AuthTokens holds comma separated name:token pairs required to use the proxy
+	AuthTokens string
+	// AuthTokensFile is a file with one name:token pair per line
+	AuthTokensFile string
+	// OIDCIssuer enables authentication with the JWTs of an OIDC provider,
+	// checked against OIDCAudience and the keys at OIDCJWKSURL, discovered
+	// from the issuer when empty. Clients are named after OIDCClientClaim.
+	OIDCIssuer      string
+	OIDCAudience    string
+	OIDCJWKSURL     string
+	OIDCClientClaim string
+	// ClientAPIKeys maps authenticated client names to the Anthropic API key
+	// their requests are sent with, "*" matching the other clients
+	ClientAPIKeys map[string]string
+	// HeaderRules set, add or remove headers of the requests forwarded to the
+	// Anthropic API, applied in order
+	HeaderRules []HeaderRule
+	// Schedules override runtime settings while their cron expressions match
+	Schedules []ScheduleRule
+
+	// WebSocketOrigins holds the comma separated origins, such as
+	// https://app.example.com, allowed to open WebSocket tunnels. Handshakes
+	// sending any other Origin header are rejected, so web pages can't use
+	// the proxy through a browser.
+	WebSocketOrigins string
+
+	// AdminToken is the bearer token required by the admin endpoints, which
+	// serve the runtime configuration only when it is set
+	AdminToken string
+
+	// RateLimitRPM is the maximum requests per minute per client, 0 disables it
+	RateLimitRPM int
+	// RateLimitConcurrent is the maximum concurrent requests per client, 0 disables it
+	RateLimitConcurrent int
+
+	// MaxThinkingBudget and MaxOutputTokens reject requests whose thinking
+	// budget or max_tokens, once rewritten, exceed them, 0 disables them
+	MaxThinkingBudget int
+	MaxOutputTokens   int
+	// DailyTokenBudget and DailyCostBudget reject the requests of a client
+	// once it used this many tokens or estimated USD in the current UTC day,
+	// 0 disables them
+	DailyTokenBudget int64
+	DailyCostBudget  float64
+
+	// AdaptiveRateLimit holds back requests the rate limits reported by the
+	// upstream can't cover yet, instead of letting them fail with a 429
+	AdaptiveRateLimit bool
+	// AdaptiveRateLimitMaxDelay is the longest a request is held back
+	AdaptiveRateLimitMaxDelay time.Duration
+
+	// MaxUpstreamConcurrent is the maximum number of requests in flight to the
+	// upstream across all clients, 0 disables the limit
+	MaxUpstreamConcurrent int
+	// UpstreamQueueSize is the number of requests waiting for a slot in FIFO
+	// order before further ones are rejected
+	UpstreamQueueSize int
+
+	// SensitiveFields holds comma separated header and JSON field names whose
+	// values are masked in logs and stored requests, next to the credentials
+	// masked by default
+	SensitiveFields string
+	// AuditLog is a file recording every forwarded call, empty disables it
+	AuditLog string
+	// AuditRedactContent replaces message and system prompt content in the
+	// audit log with its size. Credentials are always redacted.
+	AuditRedactContent bool
+
+	// ContextOverflow decides what happens to requests too long for the context
+	// window of their model, one of the ContextOverflow constants
+	ContextOverflow string
+	// ContextWindow is the context window of models, in tokens
+	ContextWindow int
+	// ContextWindows overrides ContextWindow for models matching the glob
+	// patterns, the most specific (longest) matching pattern wins
+	ContextWindows map[string]int
+	// ContextCountTokens checks requests close to the context window with the
+	// token counting API instead of relying on the local estimate
+	ContextCountTokens bool
+
+	// ModelValidation decides what happens to requests exceeding the
+	// capabilities of their model, one of the ModelValidation constants
+	ModelValidation string
+	// Models add model capabilities to the built-in registry by glob pattern,
+	// replacing the built-in entries of the same patterns
+	Models map[string]ModelCapabilities
+
+	// FallbackModels maps model glob patterns to the model Messages API
+	// requests are sent to once more when the upstream is still overloaded
+	// after the retries, the most specific (longest) matching pattern wins
+	FallbackModels map[string]string
+
+	// PinnedModels rewrites "-latest" model aliases to the snapshots they map to
+	PinnedModels map[string]string
+	// PinLatest pins the other "-latest" aliases to the snapshot they point
+	// at when first used, saved to PinFile when set so they survive restarts
+	PinLatest bool
+	PinFile   string
+	// PinCheckInterval is how often pinned aliases are looked up to log when
+	// Anthropic moved them to a new snapshot
+	PinCheckInterval time.Duration
+
+	// Redactions replace matches in the text of streamed responses before it
+	// reaches the client
+	Redactions []RedactionRule
+	// RequestRedactions replace matches in the system prompt and messages of
+	// requests before they are forwarded
+	RequestRedactions []RedactionRule
+
+	// LogToolCalls logs the name and input of the tool calls in streamed responses
+	LogToolCalls bool
+	// ToolCallLog is a file recording every tool call as a JSON line, empty disables it
+	ToolCallLog string
+	// EventLog is a file recording every event of streamed responses as a
+	// JSON line, as received from the upstream and as forwarded to the
+	// client, empty disables it
+	EventLog string
+
+	// HistoryStore uploads the transcripts of streamed requests in batches,
+	// "file:<dir>", "s3://<bucket>/<prefix>" or "gs://<bucket>/<prefix>", empty disables it
+	HistoryStore string
+	// HistoryStoreEndpoint replaces the API endpoint of the history object store
+	HistoryStoreEndpoint string
+	// HistoryBatchSize is the number of transcripts uploaded together at most
+	HistoryBatchSize int
+	// HistoryBatchInterval is the longest a transcript waits for its batch to be uploaded
+	HistoryBatchInterval time.Duration
+	// CompareModel is the model compared requests are also sent to, in the
+	// background, empty disables comparisons
+	CompareModel string
+	// ComparePercent is the share of streamed requests compared, next to those
+	// whose model ends with CompareSuffix
+	ComparePercent float64
+	// CompareStore is where the transcripts of both responses of compared
+	// requests are saved, with the syntax of HistoryStore
+	CompareStore string
+	// RetentionMaxAge deletes the history batches and thinking file backups
+	// older than this, 0 keeps them forever
+	RetentionMaxAge time.Duration
+	// RetentionMaxBytes deletes the oldest history batches, and separately the
+	// oldest thinking file backups, beyond this size, 0 leaves it unlimited
+	RetentionMaxBytes int64
+	// RetentionInterval is how often the retention limits are enforced
+	RetentionInterval time.Duration
+	// EncryptionKey encrypts the transcripts of the history store and the
+	// thinking of file sinks with AES-256-GCM: "env:NAME" or "file:PATH" hold a
+	// base64 encoded 32 byte key, "kms:BLOB" is a data key encrypted with AWS
+	// KMS. Empty stores them in plain text.
+	EncryptionKey string
+
+	// Chaos injects faults into Messages API responses to test clients, a comma
+	// separated list of delay=<duration>, disconnect=<probability>,
+	// 429=<probability> and 529=<probability>, empty disables it
+	Chaos string
+
+	// ResponseCacheTTL is how long complete responses to Messages API requests
+	// are replayed for identical requests, 0 disables the response cache
+	ResponseCacheTTL time.Duration
+	// ResponseCacheSize is the maximum number of cached responses
+	ResponseCacheSize int
+
+	// UsageLogInterval is the interval between usage summaries in the log, 0 disables them
+	UsageLogInterval time.Duration
+	// StatsFile is a file each usage summary is appended to as a JSON line,
+	// empty disables it
+	StatsFile string
+	// UsageReport sends a report of the usage and estimated cost per client
+	// and model at the end of each period, ReportDaily, ReportWeekly or a
+	// duration, to the UsageReportTargets. Empty disables it.
+	UsageReport string
+	// UsageReportTargets holds comma separated "webhook:<url>" targets posting
+	// Slack compatible messages and "file:<dir>" targets writing Markdown
+	UsageReportTargets string
+
+	// RecordDir is a directory to save upstream transcripts to
+	RecordDir string
+	// ReplayDir is a directory of transcripts to serve instead of contacting the upstream
+	ReplayDir string
+	// Mock synthesizes responses locally instead of calling the upstream
+	Mock bool
+	// MockDelay is the delay between synthesized streaming events in mock mode
+	MockDelay time.Duration
+}
+
+// Proxy forwards requests to the upstream API, rewriting requests for thinking
+// models and filtering the thinking content from their responses
+type Proxy struct {
+	cfg          Config
+	rewriter     *rewrite.Rewriter
+	upstreams    []*upstream
+	client       *http.Client
+	clientTokens map[string]string
+	// Validator of the JWTs of the OIDC provider, nil when disabled
+	jwt     *jwtValidator
+	limiter *rateLimiter
+	usage   *usageTracker
+	// Tokens and cost of each client today, for the daily budgets
+	spend         *spendTracker
+	bedrockModels map[string]string
+	// Capabilities of the known models by glob pattern
+	models map[string]ModelCapabilities
+	// Snapshots "-latest" aliases are pinned to, nil when none are
+	pins *modelPins
+
+	// Audit log of forwarded calls, nil when disabled
+	auditLog *auditLog
+	// Log of the tool calls of responses, nil when disabled
+	toolCallLog *toolCallLog
+	// Log of the events of streamed responses, nil when disabled
+	eventLog *eventLog
+	// Uploader of the transcripts to the history store, nil when disabled
+	history *historyUploader
+	// Store of the compared responses, nil when not comparing
+	comparisons *comparisonStore
+	// Pruner of the history store and thinking files, nil without either
+	retention *retention
+	// Cache of complete responses, nil when disabled
+	responses *responseCache
+	// Broadcaster of thinking deltas to the admin tails
+	thinkingTail *thinkingTail
+	// Subscriptions to the events of the in-flight responses
+	streams *streamRegistry
+	// Sinks receiving the completed thinking blocks
+	thinkingSinks []ThinkingSink
+	// Whether the sinks are the stdout dump used when none are configured
+	stdoutDump bool
+	// Targets of the usage reports
+	reportTargets []reportTarget
+	// Thinking of tool calls to reinject, nil when disabled
+	thinkingMemory *thinkingMemory
+	// Masking of the credentials in logs and stored requests
+	sensitive *sensitiveData
+	// Caps on the memory holding thinking content, with their metrics
+	memory *memoryLimits
+	// History of the requests of recent conversations
+	conversations *conversationTracker
+	// Rules scrubbing request content before it is forwarded
+	requestRedactors []redactor
+	// Rules redacting the text of responses, also applied to the transcripts
+	textRedactors []redactor
+	// Queue of requests waiting for an upstream slot, nil when unlimited
+	queue *upstreamQueue
+	// Rate limits reported by the upstream, nil when not adapting to them
+	upstreamLimits *upstreamLimits
+	// Faults injected into responses, nil unless in chaos mode
+	chaos *chaosConfig
+
+	// Number of responses currently being streamed to clients
+	activeStreams atomic.Int64
+	// Sequence number labelling requests in the logs
+	requestSeq atomic.Uint64
+	// WebSocket tunnels serving a request
+	tunnels sync.WaitGroup
+	// Origins allowed to open WebSocket tunnels, in lower case
+	webSocketOrigins map[string]bool
+
+	// Settings changed at runtime through the admin API, and the lock
+	// serializing the changes
+	runtime  atomic.Pointer[runtimeSettings]
+	configMu sync.Mutex
+	// Runtime configuration the schedules apply to, the schedules and the
+	// names of the active ones, guarded by configMu
+	baseConfig      RuntimeConfig
+	schedules       []schedule
+	activeSchedules []string
+
+	// Middlewares transforming Messages API requests and their responses
+	middlewares []Middleware
+}
+
+// New validates the configuration and returns a Proxy
+func New(cfg Config) (*Proxy, error) {
+	// Reach the upstream through the configured forward proxy
+	forwardProxy, err := upstreamProxy(cfg.UpstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := upstreamTLSConfig(cfg.UpstreamCA, cfg.UpstreamInsecure, cfg.UpstreamTLSMinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream TLS configuration: %w", err)
+	}
+
+	p := &Proxy{
+		cfg:      cfg,
+		rewriter: rewrite.New(cfg.Rewrite),
+		client: &http.Client{
+			Transport: newUpstreamTransport(forwardProxy, tlsConfig),
+			Timeout:   cfg.UpstreamTimeout,
+		},
+		limiter:       newRateLimiter(),
+		usage:         newUsageTracker(),
+		spend:         newSpendTracker(),
+		thinkingTail:  newThinkingTail(),
+		streams:       newStreamRegistry(),
+		conversations: newConversationTracker(),
+		sensitive:     newSensitiveData(strings.Split(cfg.SensitiveFields, ",")),
+		memory:        newMemoryLimits(cfg.ThinkingMemoryRequestBytes, cfg.ThinkingMemoryTotalBytes),
+	}
+	p.webSocketOrigins = make(map[string]bool)
+	for _, origin := range strings.Split(cfg.WebSocketOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			p.webSocketOrigins[strings.ToLower(origin)] = true
+		}
+	}
+
+	// Parse the upstream targets
+	switch cfg.Backend {
+	case "", "anthropic":
+		p.upstreams, err = p.parseUpstreams(cfg.Target)
+	case "bedrock":
+		p.upstreams, err = p.bedrockUpstreams()
+	default:
+		err = fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream configuration: %w", err)
+	}
+
+	if err := rewrite.ValidateCacheStrategy(cfg.Rewrite.CacheStrategy); err != nil {
+		return nil, err
+	}
+	if cfg.Rewrite.AutoBudget && (cfg.Rewrite.AutoBudgetPercentile <= 0 || cfg.Rewrite.AutoBudgetPercentile > 100) {
+		return nil, fmt.Errorf("invalid auto budget percentile %g: must be between 0 and 100", cfg.Rewrite.AutoBudgetPercentile)
+	}
+
+	if err := validateContextOverflow(cfg.ContextOverflow); err != nil {
+		return nil, err
+	}
+	if err := validateModelValidation(cfg.ModelValidation); err != nil {
+		return nil, err
+	}
+	p.models = newModelRegistry(cfg.Models)
+	if cfg.PinCheckInterval <= 0 && (cfg.PinLatest || len(cfg.PinnedModels) > 0) {
+		return nil, fmt.Errorf("invalid pin check interval %s: must be positive", cfg.PinCheckInterval)
+	}
+	if p.pins, err = newModelPins(cfg.PinnedModels, cfg.PinLatest, cfg.PinFile, cfg.PinCheckInterval); err != nil {
+		return nil, err
+	}
+
+	// Load the proxy client tokens
+	if p.clientTokens, err = loadClientTokens(cfg.AuthTokens, cfg.AuthTokensFile); err != nil {
+		return nil, fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+	if cfg.OIDCIssuer != "" {
+		if p.jwt, err = newJWTValidator(cfg.OIDCIssuer, cfg.OIDCAudience, cfg.OIDCJWKSURL, cfg.OIDCClientClaim); err != nil {
+			return nil, fmt.Errorf("invalid authentication configuration: %w", err)
+		}
+	}
+	if len(cfg.ClientAPIKeys) > 0 && p.clientTokens == nil && p.jwt == nil {
+		return nil, errors.New("invalid authentication configuration: client API keys require client authentication")
+	}
+
+	// Open the audit log
+	if cfg.AuditLog != "" {
+		if p.auditLog, err = openAuditLog(cfg.AuditLog, cfg.AuditRedactContent); err != nil {
+			return nil, fmt.Errorf("invalid audit log: %w", err)
+		}
+	}
+
+	// Open the tool call log
+	if cfg.ToolCallLog != "" {
+		if p.toolCallLog, err = openToolCallLog(cfg.ToolCallLog); err != nil {
+			return nil, fmt.Errorf("invalid tool call log: %w", err)
+		}
+	}
+
+	// Open the event log
+	if cfg.EventLog != "" {
+		if p.eventLog, err = openEventLog(cfg.EventLog, p.sensitive); err != nil {
+			return nil, fmt.Errorf("invalid event log: %w", err)
+		}
+	}
+
+	// Load the key encrypting what is persisted
+	encryption, err := loadEncryptor(context.Background(), cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start uploading transcripts to the history store
+	if cfg.HistoryStore != "" {
+		if p.history, err = newHistoryUploader(cfg.HistoryStore, cfg.HistoryStoreEndpoint, cfg.HistoryBatchSize, cfg.HistoryBatchInterval, encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	// Save the responses of the comparison model next to the requested one's
+	if cfg.ComparePercent < 0 || cfg.ComparePercent > 100 {
+		return nil, fmt.Errorf("invalid comparison percentage %g: must be between 0 and 100", cfg.ComparePercent)
+	}
+	if (cfg.CompareModel == "") != (cfg.CompareStore == "") {
+		return nil, errors.New("comparisons need both a comparison model and a comparison store")
+	}
+	if cfg.CompareModel != "" {
+		if p.comparisons, err = newComparisonStore(cfg.CompareStore, cfg.HistoryStoreEndpoint, encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the thinking sinks, even with thinking logging off as it can be
+	// turned on at runtime. Without sinks thinking is dumped to stdout, which
+	// live logging replaces while it is on.
+	specs := cfg.ThinkingSinks
+	if specs == "" {
+		specs, p.stdoutDump = "stdout", true
+	}
+	if p.thinkingSinks, err = parseThinkingSinks(specs, encryption); err != nil {
+		return nil, err
+	}
+	p.runtime.Store(&runtimeSettings{
+		logThinking:         cfg.LogThinking,
+		logThinkingLive:     cfg.LogThinkingLive,
+		logToolCalls:        cfg.LogToolCalls,
+		rateLimitRPM:        cfg.RateLimitRPM,
+		rateLimitConcurrent: cfg.RateLimitConcurrent,
+	})
+
+	// Apply the schedules active now on top of the runtime configuration
+	p.baseConfig = p.runtimeConfig()
+	if p.schedules, err = parseSchedules(cfg.Schedules, p.baseConfig); err != nil {
+		return nil, err
+	}
+	p.applySchedules(time.Now())
+
+	// Check the usage report settings, the reports are sent by RunUsageReporter
+	if cfg.UsageReport != "" {
+		if err := parseReportPeriod(cfg.UsageReport); err != nil {
+			return nil, err
+		}
+		if p.reportTargets, err = parseReportTargets(cfg.UsageReportTargets); err != nil {
+			return nil, err
+		}
+		if len(p.reportTargets) == 0 {
+			return nil, errors.New("the usage report requires at least one target")
+		}
+	}
+
+	// Prune the history store and thinking files beyond the retention limits
+	if p.retention, err = newRetention(cfg.RetentionMaxAge, cfg.RetentionMaxBytes, cfg.RetentionInterval, p.history, p.thinkingSinks); err != nil {
+		return nil, err
+	}
+
+	// Check the thinking progress settings
+	switch cfg.ThinkingProgress {
+	case "", ThinkingProgressComment, ThinkingProgressText:
+	default:
+		return nil, fmt.Errorf("invalid thinking progress %q: must be %s or %s", cfg.ThinkingProgress, ThinkingProgressComment, ThinkingProgressText)
+	}
+	if cfg.ThinkingProgress != "" && cfg.ThinkingProgressInterval <= 0 {
+		return nil, fmt.Errorf("invalid thinking progress interval %s: must be positive", cfg.ThinkingProgressInterval)
+	}
+	if cfg.ThinkingProgress == ThinkingProgressText && cfg.ThinkingPreviewChars > 0 {
+		return nil, errors.New("text thinking progress can't be combined with thinking previews")
+	}
+
+	// Check the caps and budgets
+	if cfg.MaxThinkingBudget < 0 || cfg.MaxOutputTokens < 0 || cfg.DailyTokenBudget < 0 || cfg.DailyCostBudget < 0 {
+		return nil, errors.New("invalid caps: the maximum thinking budget, output tokens and daily budgets must not be negative")
+	}
+
+	// Create the response cache
+	if cfg.ResponseCacheTTL > 0 {
+		if cfg.ResponseCacheSize <= 0 {
+			return nil, fmt.Errorf("invalid response cache size %d: must be positive", cfg.ResponseCacheSize)
+		}
+		p.responses = newResponseCache(cfg.ResponseCacheTTL, cfg.ResponseCacheSize)
+	}
+
+	// Create the upstream request queue
+	if cfg.MaxUpstreamConcurrent > 0 {
+		if cfg.UpstreamQueueSize < 0 {
+			return nil, fmt.Errorf("invalid upstream queue size %d: must not be negative", cfg.UpstreamQueueSize)
+		}
+		p.queue = newUpstreamQueue(cfg.MaxUpstreamConcurrent, cfg.UpstreamQueueSize)
+	}
+
+	if cfg.AdaptiveRateLimit {
+		p.upstreamLimits = newUpstreamLimits(cfg.AdaptiveRateLimitMaxDelay)
+	}
+
+	if p.requestRedactors, err = compileRedactions(cfg.RequestRedactions); err != nil {
+		return nil, err
+	}
+	if p.textRedactors, err = compileRedactions(cfg.Redactions); err != nil {
+		return nil, err
+	}
+
+	// Thinking support is built from the first middlewares
+	if cfg.ReinjectThinking {
+		p.thinkingMemory = newThinkingMemory()
+	}
+	p.Use(thinkingRewrite{rewriter: p.rewriter, memory: p.thinkingMemory})
+	if p.history != nil {
+		p.Use(historyRecorder{proxy: p})
+	}
+	if p.comparisons != nil {
+		p.Use(comparisonRecorder{proxy: p})
+	}
+	p.Use(thinkingFilter{proxy: p})
+	p.Use(toolCallLogger{proxy: p})
+	p.Use(thinkingBudgetMonitor{proxy: p})
+	if cfg.AnnotateUsage {
+		p.Use(usageAnnotator{})
+	}
+	if len(p.requestRedactors) > 0 {
+		p.Use(requestRedaction{redactors: p.requestRedactors})
+	}
+	if len(p.textRedactors) > 0 {
+		p.Use(textRedaction{redactors: p.textRedactors})
+	}
+	if p.chaos, err = parseChaos(cfg.Chaos); err != nil {
+		return nil, err
+	}
+	if p.chaos != nil {
+		p.Use(chaosMonkey{config: p.chaos})
+	}
+
+	return p, nil
+}
+
+// Close flushes and closes the thinking sinks, the tool call and event logs
+// and the history uploader, once the server stopped
+func (p *Proxy) Close() {
+	for _, sink := range p.thinkingSinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Error closing thinking sink: %v", err)
+		}
+	}
+	if p.toolCallLog != nil {
+		if err := p.toolCallLog.file.Close(); err != nil {
+			log.Printf("Error closing tool call log: %v", err)
+		}
+	}
+	if p.eventLog != nil {
+		if err := p.eventLog.file.Close(); err != nil {
+			log.Printf("Error closing event log: %v", err)
+		}
+	}
+	if p.retention != nil {
+		p.retention.Close()
+	}
+	if p.history != nil {
+		p.history.Close()
+	}
+}
+
+// Handler returns the HTTP handler serving the proxy, requiring a proxy token
+// when authentication is enabled
+func (p *Proxy) Handler() http.Handler {
+	return p.handler(p.requireAuth)
+}
+
+// TrustedHandler returns the HTTP handler serving the proxy without requiring
+// a proxy token, for listeners only trusted clients can reach
+func (p *Proxy) TrustedHandler() http.Handler {
+	return p.handler(p.trustClients)
+}
+
+// handler returns the HTTP handler serving the proxy, authenticating clients with auth
+func (p *Proxy) handler(auth func(http.Handler) http.Handler) http.Handler {
+	proxied := auth(decompressRequest(p.rateLimit(p.audit(http.HandlerFunc(p.handle)))))
+	tunneled := auth(p.webSocketTunnel(p.rateLimit(p.audit(http.HandlerFunc(p.handle)))))
+	grpc := p.grpcFrontend(proxied)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Health checks bypass authentication, rate limiting and forwarding so
+		// probes work without credentials and don't reach the API
+		if r.Method == http.MethodGet {
+			switch r.URL.Path {
+			case healthEndpoint:
+				handleHealth(w, r)
+				return
+			case readyEndpoint:
+				p.handleReady(w, r)
+				return
+			}
+		}
+		// Messages API requests over WebSocket are tunneled through the same handlers
+		if r.URL.Path == MessagesEndpoint && isWebSocketUpgrade(r) {
+			tunneled.ServeHTTP(w, r)
+			return
+		}
+		if isGRPCRequest(r) {
+			grpc.ServeHTTP(w, r)
+			return
+		}
+		proxied.ServeHTTP(w, r)
+	})
+}
+
+// ActiveStreams returns the number of responses currently being streamed to
+// clients, so shutdown can wait for them to finish
+func (p *Proxy) ActiveStreams() int64 {
+	return p.activeStreams.Load()
+}
+
+// LogStartup logs the effective configuration
+func (p *Proxy) LogStartup() {
+	if p.cfg.Mock {
+		log.Printf("Mock mode: responses are synthesized locally")
+	}
+	for i, target := range p.upstreams {
+		log.Printf("Forwarding to %s (priority %d)", target.url, i+1)
+	}
+	log.Printf("Thinking budget: %d tokens", p.cfg.Rewrite.ThinkingBudget)
+	if p.cfg.Rewrite.AutoBudget {
+		log.Printf("Auto budget: p%g of recent thinking, up to %d tokens", p.cfg.Rewrite.AutoBudgetPercentile, p.cfg.Rewrite.AutoBudgetMax)
+	}
+	for _, pattern := range slices.Sorted(maps.Keys(p.cfg.Rewrite.ThinkingBudgets)) {
+		log.Printf("Thinking budget for %s: %d tokens", pattern, p.cfg.Rewrite.ThinkingBudgets[pattern])
+	}
+	for _, effort := range rewrite.EffortLevels {
+		if budget, ok := p.cfg.Rewrite.EffortBudgets[effort]; ok {
+			log.Printf("Thinking budget for effort %s: %d tokens", effort, budget)
+		}
+	}
+	if p.cfg.ContextOverflow != "" && p.cfg.ContextOverflow != ContextOverflowOff {
+		log.Printf("Context overflow: %s (window %d tokens, token counting: %v)", p.cfg.ContextOverflow, p.cfg.ContextWindow, p.cfg.ContextCountTokens)
+		for _, pattern := range slices.Sorted(maps.Keys(p.cfg.ContextWindows)) {
+			log.Printf("Context window for %s: %d tokens", pattern, p.cfg.ContextWindows[pattern])
+		}
+	}
+	for _, pattern := range slices.Sorted(maps.Keys(p.cfg.FallbackModels)) {
+		log.Printf("Fallback on overload for %s: %s", pattern, p.cfg.FallbackModels[pattern])
+	}
+	if p.comparisons != nil {
+		log.Printf("Comparing %g%% of the requests and those ending with %s with %s, saved to %s",
+			p.cfg.ComparePercent, CompareSuffix, p.cfg.CompareModel, p.comparisons.store.Location(p.comparisons.prefix))
+	}
+	if p.pins != nil {
+		pins := p.pins.all()
+		log.Printf("Model pinning: automatic %v, checked every %s", p.cfg.PinLatest, p.cfg.PinCheckInterval)
+		for _, alias := range slices.Sorted(maps.Keys(pins)) {
+			log.Printf("Pinned %s to %s", alias, pins[alias])
+		}
+	}
+	if p.cfg.ModelValidation != "" && p.cfg.ModelValidation != ModelValidationOff {
+		log.Printf("Model validation: %s (%d known model patterns, %d configured)", p.cfg.ModelValidation, len(p.models), len(p.cfg.Models))
+	}
+	if p.cfg.Rewrite.MaxToolResultBytes > 0 {
+		log.Printf("Tool results truncated to %d bytes", p.cfg.Rewrite.MaxToolResultBytes)
+	}
+	if p.cfg.Rewrite.CacheStrategy != "" && p.cfg.Rewrite.CacheStrategy != rewrite.CacheNone {
+		log.Printf("Prompt caching markers: %s", p.cfg.Rewrite.CacheStrategy)
+	}
+	log.Printf("Reinject thinking of tool calls: %v", p.cfg.ReinjectThinking)
+	log.Printf("Log thinking: %v (live: %v, %d sinks)", p.cfg.LogThinking, p.cfg.LogThinkingLive, len(p.thinkingSinks))
+	if len(p.cfg.RequestRedactions) > 0 {
+		log.Printf("Redacting request content matching: %s", describeRedactions(p.cfg.RequestRedactions))
+	}
+	if len(p.cfg.Redactions) > 0 {
+		log.Printf("Redacting response text matching: %s", describeRedactions(p.cfg.Redactions))
+	}
+	if p.history != nil {
+		log.Printf("Uploading transcripts to %s (batches of %d, every %s)", p.history.store.Location(p.history.prefix), p.cfg.HistoryBatchSize, p.cfg.HistoryBatchInterval)
+	}
+	if p.chaos != nil {
+		log.Printf("Chaos mode: %s", p.chaos)
+	}
+	if p.cfg.LogToolCalls || p.toolCallLog != nil {
+		log.Printf("Log tool calls: %v (file: %q)", p.cfg.LogToolCalls, p.cfg.ToolCallLog)
+	}
+	if p.cfg.NotifyAfter > 0 {
+		log.Printf("Notifying when thinking takes over %s", p.cfg.NotifyAfter)
+	}
+	if p.cfg.SummaryModel != "" {
+		log.Printf("Thinking summaries: %s", p.cfg.SummaryModel)
+	}
+	if p.cfg.UpstreamProxy != "" {
+		if parsed, err := url.Parse(p.cfg.UpstreamProxy); err == nil {
+			log.Printf("Upstream proxy: %s", parsed.Redacted())
+		}
+	}
+	if p.cfg.UpstreamCA != "" {
+		log.Printf("Upstream CA bundle: %s", p.cfg.UpstreamCA)
+	}
+	if p.cfg.UpstreamInsecure {
+		log.Printf("WARNING: upstream TLS certificate verification is disabled, API keys and prompts can be intercepted")
+	}
+	log.Printf("Upstream retries: %d attempts", p.cfg.MaxAttempts)
+	log.Printf("Upstream timeout: %s total, %s idle", p.cfg.UpstreamTimeout, p.cfg.IdleTimeout)
+	if p.responses != nil {
+		log.Printf("Response cache: %s TTL, up to %d responses", p.cfg.ResponseCacheTTL, p.cfg.ResponseCacheSize)
+	}
+	if p.upstreamLimits != nil {
+		log.Printf("Adaptive rate limiting: delaying requests up to %s", p.cfg.AdaptiveRateLimitMaxDelay)
+	}
+	if p.queue != nil {
+		log.Printf("Upstream concurrency: %d requests, up to %d queued", p.cfg.MaxUpstreamConcurrent, p.cfg.UpstreamQueueSize)
+	}
+	log.Printf("Client authentication: %v (%d tokens)", p.clientTokens != nil || p.jwt != nil, len(p.clientTokens))
+	if p.jwt != nil {
+		log.Printf("OIDC authentication: issuer %s, audience %s, clients named by the %q claim", p.cfg.OIDCIssuer, p.cfg.OIDCAudience, p.cfg.OIDCClientClaim)
+	}
+	if len(p.cfg.ClientAPIKeys) > 0 {
+		log.Printf("Client API keys: %s", strings.Join(slices.Sorted(maps.Keys(p.cfg.ClientAPIKeys)), ", "))
+	}
+}
+
+// handle routes a request to the right forwarding strategy
+func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Received request: %s %s %s from %s", r.Method, r.URL.Path, r.Proto, clientID(r))
+
+	// Serve the accumulated usage locally
+	if r.Method == http.MethodGet && r.URL.Path == usageEndpoint {
+		p.handleUsage(w, r)
+		return
+	}
+
+	// Only process POST requests to messages endpoint
+	if r.Method == "POST" && r.URL.Path == MessagesEndpoint {
+		// Read the request body
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		original := bodyBytes
+
+		// Keep the headers as sent for a retry with a larger thinking budget
+		var clientHeader http.Header
+		if p.cfg.EscalateBudgetMax > 0 {
+			clientHeader = r.Header.Clone()
+		}
+
+		// Try to parse the request body
+		var bodyJSON map[string]any
+		if err := json.Unmarshal(bodyBytes, &bodyJSON); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			if p.cfg.ValidateRequests {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON body: "+err.Error())
+				return
+			}
+			// If we can't parse the body, just forward it as-is
+			p.forwardRequestAsIs(w, r, bodyBytes)
+			return
+		}
+
+		// Reject malformed requests with an error pointing at the invalid field
+		if p.cfg.ValidateRequests {
+			if err := validateMessagesRequest(bodyJSON); err != nil {
+				log.Printf("Invalid request: %v", err)
+				writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+
+		// Resolve configured model aliases and pin "-latest" ones, then the
+		// thinking headers
+		marked := p.comparisons != nil && stripCompareSuffix(bodyJSON)
+		aliased := p.rewriter.ResolveAlias(bodyJSON) || marked
+		aliased = p.pinModel(r, bodyJSON) || aliased
+		modelName, budget, overridden, err := thinkingOverride(r.Header, bodyJSON)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		// Check that the model can think before enabling thinking for it
+		if checked, err := p.checkThinkingSupport(bodyJSON, modelName); err != nil {
+			log.Printf("Request rejected: %v", err)
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		} else if checked != modelName {
+			modelName, overridden = checked, true
+		}
+		if aliased || overridden {
+			if bodyBytes, err = json.Marshal(bodyJSON); err != nil {
+				http.Error(w, "Error re-encoding JSON", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Fail some requests on purpose in chaos mode
+		dryRun := isDryRun(r)
+		if p.chaos != nil && !dryRun && p.chaos.injectError(w) {
+			return
+		}
+
+		// Reject clients that used up their daily budget
+		if p.checkDailyBudget(w, clientID(r)) {
+			return
+		}
+
+		// Run the middlewares, which enable thinking for "-thinking" models
+		req := p.newRequest(r, bodyJSON, modelName)
+		req.ThinkingBudget = budget
+		req.original = &requestSnapshot{body: original, header: r.Header.Clone()}
+		req.compare = p.comparing(marked)
+		if err := p.applyMiddlewares(req); err != nil {
+			log.Printf("Request rejected: %v", err)
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		// Keep the request within the context window of its model
+		if err := p.fitContextWindow(r, req); err != nil {
+			log.Printf("Request rejected: %v", err)
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		// Keep the request within the capabilities of its model
+		if err := p.checkModelCapabilities(req); err != nil {
+			log.Printf("Request rejected: %v", err)
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		// Enforce the caps on the thinking budget and max_tokens
+		if err := p.checkRequestCaps(req); err != nil {
+			log.Printf("Request rejected: %v", err)
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		// Re-encode the body if it changed
+		if req.Modified {
+			if bodyBytes, err = json.Marshal(bodyJSON); err != nil {
+				http.Error(w, "Error re-encoding JSON", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Show the request instead of sending it when asked to
+		if dryRun {
+			p.writeDryRun(w, r, bodyBytes, req)
+			return
+		}
+
+		// Send the request to the comparison model too when comparing
+		p.startComparison(r, req)
+		defer p.endComparison(req)
+
+		// Retry requests whose thinking used up its budget with a larger one
+		if p.escalatable(r, req) {
+			p.forwardEscalating(w, r, bodyBytes, req, original, clientHeader)
+			return
+		}
+
+		p.forwardRequestAndHandleResponse(w, r, bodyBytes, req)
+	} else if r.Method == http.MethodGet && r.URL.Path == ModelsEndpoint {
+		p.forwardModels(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == CountTokensEndpoint {
+		p.forwardCountTokens(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == BatchesEndpoint {
+		p.forwardBatch(w, r)
+	} else if streamsBody(r) {
+		// Stream the bodies of other requests to the upstream
+		p.forwardStreamed(w, r)
+	} else {
+		// Requests without a body are forwarded directly, with retries
+		r.Body.Close()
+		p.forwardRequestAsIs(w, r, nil)
+	}
+}
+
+// forwardCountTokens forwards a token counting request, rewritten like the
+// Messages API request it pre-flights
+func (p *Proxy) forwardCountTokens(w http.ResponseWriter, r *http.Request) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	var bodyJSON map[string]any
+	if err := json.Unmarshal(bodyBytes, &bodyJSON); err != nil {
+		log.Printf("Error parsing request body: %v", err)
+		p.forwardRequestAsIs(w, r, bodyBytes)
+		return
+	}
+
+	aliased := p.rewriter.ResolveAlias(bodyJSON)
+	aliased = p.pinModel(r, bodyJSON) || aliased
+	modelName, budget, overridden, err := thinkingOverride(r.Header, bodyJSON)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if checked, err := p.checkThinkingSupport(bodyJSON, modelName); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	} else if checked != modelName {
+		modelName, overridden = checked, true
+	}
+	changed := true
+	if rewrite.HasThinkingSuffix(modelName) {
+		log.Printf("Counting tokens for model with thinking suffix: %s", modelName)
+		p.rewriter.CountTokens(r.Header, bodyJSON, modelName, budget)
+		if p.thinkingMemory != nil {
+			p.thinkingMemory.reinject(bodyJSON)
+		}
+	} else {
+		changed = p.rewriter.Passthrough(r.Header, bodyJSON, modelName) || aliased || overridden
+	}
+	changed = redactRequest(p.requestRedactors, bodyJSON) || changed
+
+	if changed {
+		if bodyBytes, err = json.Marshal(bodyJSON); err != nil {
+			http.Error(w, "Error re-encoding JSON", http.StatusInternalServerError)
+			return
+		}
+	}
+	p.forwardRequestAsIs(w, r, bodyBytes)
+}
+
+// forwardRequestAsIs forwards request exactly as received
+func (p *Proxy) forwardRequestAsIs(w http.ResponseWriter, r *http.Request, bodyBytes []byte) {
+	// Forward request without modifications and stream response as-is
+	p.forwardRequestAndHandleResponse(w, r, bodyBytes, nil)
+}
+
+// writeAPIError writes an error response using Anthropic's error schema
+func writeAPIError(w http.ResponseWriter, statusCode int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"type": "error",
+		"error": map[string]string{
+			"type":    errorType,
+			"message": message,
+		},
+	}); err != nil {
+		log.Printf("Error writing error response: %v", err)
+	}
+}
+
+// newForwardRequest builds the request to send to the target from the incoming request
+func newForwardRequest(r *http.Request, target string, bodyBytes []byte) (*http.Request, error) {
+	// Create a new request to forward to the target, under its path prefix.
+	// It shares the context of the incoming request, so the upstream call is
+	// cancelled as soon as the client goes away.
+	forwardURL, err := upstreamURL(target, r.URL)
+	if err != nil {
+		return nil, err
+	}
+	forwardReq, err := http.NewRequestWithContext(r.Context(), r.Method, forwardURL, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers, except the hop-by-hop ones
+	copyHeaders(forwardReq.Header, r.Header)
+
+	// Let the transport negotiate compression so it can decode the response
+	// before it is parsed, it is compressed again for clients that accept it
+	forwardReq.Header.Del("Accept-Encoding")
+
+	// Set content length for the modified body
+	forwardReq.ContentLength = int64(len(bodyBytes))
+	forwardReq.Header.Set("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
+
+	// Set host header
+	forwardReq.Host = forwardReq.URL.Host
+
+	return forwardReq, nil
+}
+
+// forwardRequestAndHandleResponse handles the actual forwarding and response
+// processing. req is the Messages API request the middlewares ran on, or nil
+// for other requests.
+func (p *Proxy) forwardRequestAndHandleResponse(w http.ResponseWriter, r *http.Request, bodyBytes []byte, req *Request) {
+	// Keep the upstream request going when the client goes away, so the full
+	// response is accounted for and recorded
+	upstreamReq := r
+	if req != nil && p.cfg.FinishOnDisconnect {
+		upstreamReq = r.WithContext(context.WithoutCancel(r.Context()))
+	}
+	p.forwardAndHandleResponse(w, r, req, func() (*http.Response, error) {
+		// Send the request to the first healthy target, or replay a recording
+		if req != nil && len(p.cfg.FallbackModels) > 0 {
+			return p.sendWithFallback(upstreamReq, bodyBytes, req)
+		}
+		return p.sendOrReplay(upstreamReq, bodyBytes)
+	})
+}
+
+// forwardAndHandleResponse gets the response to r from send, once an upstream
+// slot is free, and streams it to the client
+func (p *Proxy) forwardAndHandleResponse(w http.ResponseWriter, r *http.Request, req *Request, send func() (*http.Response, error)) {
+	// Wait for an upstream slot, holding it until the response is complete
+	if p.queue != nil {
+		wait, err := p.queue.acquire(r.Context())
+		if errors.Is(err, errQueueFull) {
+			log.Printf("Rejecting request: upstream queue is full")
+			writeAPIError(w, 529, "overloaded_error", "Proxy request queue is full, try again later")
+			return
+		}
+		if err != nil {
+			log.Printf("Client gave up while queued: %v", err)
+			return
+		}
+		defer p.queue.release()
+		if wait > 0 {
+			log.Printf("Waited %s for an upstream slot", wait.Round(time.Millisecond))
+		}
+	}
+
+	resp, err := send()
+	if err != nil && req != nil {
+		p.usage.recordFailure(req)
+	}
+	if errors.Is(err, errNoRecording) {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "Replay mode: no recording found for this request")
+		return
+	}
+	if errors.Is(err, errUnsupportedEndpoint) {
+		writeAPIError(w, http.StatusNotFound, "not_found_error",
+			fmt.Sprintf("%s %s is not supported by the configured backend", r.Method, r.URL.Path))
+		return
+	}
+	if errors.Is(err, errAllCircuitsOpen) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(p.breakerRetryIn().Seconds())+1))
+		writeAPIError(w, http.StatusServiceUnavailable, "api_error",
+			"Upstream unavailable: circuit breaker is open after repeated failures")
+		return
+	}
+	if err != nil && r.Context().Err() != nil {
+		log.Printf("Client cancelled the request before the upstream responded")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error forwarding request: "+p.sensitive.Text(err.Error()), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Abort the response if the upstream goes silent
+	if p.cfg.IdleTimeout > 0 {
+		resp.Body = watchIdle(resp.Body, p.cfg.IdleTimeout)
+	}
+
+	// Copy headers from the target response, except the hop-by-hop ones. The
+	// body of Messages API responses may change, so its length is left out too.
+	copyHeaders(w.Header(), resp.Header)
+	if req != nil {
+		w.Header().Del("Content-Length")
+	}
+
+	// Compress the response again for clients that asked for it
+	if resp.Uncompressed && acceptsGzip(r) {
+		gz := newGzipResponseWriter(w)
+		defer gz.Close()
+		w = gz
+	}
+
+	// Set SSE specific headers, leaving JSON responses such as token counts as they are
+	if isEventStream(resp) || resp.Header.Get("Content-Type") == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+
+	// Add what the proxy changed to the errors of Messages API requests
+	if req != nil && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		p.writeUpstreamError(w, resp, req)
+		return
+	}
+
+	// Set status code
+	w.WriteHeader(resp.StatusCode)
+
+	// If response is an error (non-2xx), just copy the body directly
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Printf("Error copying error response: %v", err)
+		}
+		return
+	}
+
+	// Track the stream so shutdown can drain it
+	p.activeStreams.Add(1)
+	defer p.activeStreams.Add(-1)
+
+	// Flush headers to client
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	// Stream the response through the hooks of the middlewares
+	stream := p.newStreamProcessor(w, r, req)
+	stream.usage.Cached = resp.Header.Get(cacheStatusHeader) == "hit"
+	defer stream.finish()
+	stream.run(resp)
+}
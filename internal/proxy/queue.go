@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// QueueEndpoint is the admin endpoint serving the upstream queue metrics
+const QueueEndpoint = "/queue"
+
+// errQueueFull is returned when a request arrives while the queue is full
+var errQueueFull = errors.New("upstream request queue is full")
+
+// upstreamQueue caps the number of concurrent upstream requests, holding the
+// others in a bounded FIFO queue until a slot frees up
+type upstreamQueue struct {
+	maxActive int
+	maxQueued int
+
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+	stats   queueStats
+}
+
+// queueStats holds the queue metrics
+type queueStats struct {
+	Active   int `json:"active"`
+	Waiting  int `json:"waiting"`
+	MaxSlots int `json:"max_active"`
+
+	// Requests that had to wait for a slot, and were rejected as the queue was full
+	Queued   int64 `json:"queued_total"`
+	Rejected int64 `json:"rejected_total"`
+	// Time spent waiting for a slot
+	TotalWaitMS int64 `json:"total_wait_ms"`
+	MaxWaitMS   int64 `json:"max_wait_ms"`
+}
+
+// newUpstreamQueue returns a queue allowing maxActive concurrent requests and
+// up to maxQueued waiting ones
+func newUpstreamQueue(maxActive, maxQueued int) *upstreamQueue {
+	return &upstreamQueue{maxActive: maxActive, maxQueued: maxQueued}
+}
+
+// acquire waits for a slot in FIFO order, returning how long it waited. The
+// slot must be released once the response is complete.
+func (q *upstreamQueue) acquire(ctx context.Context) (time.Duration, error) {
+	q.mu.Lock()
+	if q.active < q.maxActive {
+		q.active++
+		q.mu.Unlock()
+		return 0, nil
+	}
+	if len(q.waiters) >= q.maxQueued {
+		q.stats.Rejected++
+		q.mu.Unlock()
+		return 0, errQueueFull
+	}
+	ready := make(chan struct{})
+	q.waiters = append(q.waiters, ready)
+	q.stats.Queued++
+	q.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-ready:
+		wait := time.Since(start)
+		q.recordWait(wait)
+		return wait, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, waiter := range q.waiters {
+			if waiter == ready {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				return 0, ctx.Err()
+			}
+		}
+		// The slot was handed over while giving up, pass it on
+		q.releaseLocked()
+		return 0, ctx.Err()
+	}
+}
+
+// recordWait adds a wait to the metrics
+func (q *upstreamQueue) recordWait(wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.TotalWaitMS += wait.Milliseconds()
+	q.stats.MaxWaitMS = max(q.stats.MaxWaitMS, wait.Milliseconds())
+}
+
+// release frees a slot, handing it to the first waiting request
+func (q *upstreamQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+// releaseLocked frees a slot with the lock held
+func (q *upstreamQueue) releaseLocked() {
+	if len(q.waiters) > 0 {
+		close(q.waiters[0])
+		q.waiters = q.waiters[1:]
+		return
+	}
+	q.active--
+}
+
+// snapshot returns the current metrics
+func (q *upstreamQueue) snapshot() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Active, stats.Waiting, stats.MaxSlots = q.active, len(q.waiters), q.maxActive
+	return stats
+}
+
+// handleQueue serves the queue metrics
+func (p *Proxy) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if p.queue == nil {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "Request queueing is disabled")
+		return
+	}
+	writeJSON(w, p.queue.snapshot())
+}
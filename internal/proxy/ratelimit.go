@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clientLimit tracks the request budget and in-flight requests of a single client
+type clientLimit struct {
+	tokens   float64
+	updated  time.Time
+	inFlight int
+}
+
+// rateLimitSweepInterval is how often the clients back to a full budget
+// without requests in flight are forgotten
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter enforces per-client request rate and concurrency limits
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimit
+	swept   time.Time
+}
+
+// newRateLimiter returns a rate limiter without any client state
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{clients: make(map[string]*clientLimit)}
+}
+
+// acquire reserves a request slot for the client, returning how long to wait
+// before retrying when a limit is exceeded
+func (l *rateLimiter) acquire(client string, rpm, concurrent int, now time.Time) (bool, time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= rateLimitSweepInterval {
+		l.sweep(rpm, now)
+	}
+
+	limit, ok := l.clients[client]
+	if !ok {
+		limit = &clientLimit{tokens: float64(rpm), updated: now}
+		l.clients[client] = limit
+	}
+
+	if concurrent > 0 && limit.inFlight >= concurrent {
+		return false, time.Second, fmt.Sprintf("too many concurrent requests (limit %d)", concurrent)
+	}
+
+	if rpm > 0 {
+		// Refill the token bucket based on the elapsed time
+		perSecond := float64(rpm) / 60
+		limit.tokens = math.Min(float64(rpm), limit.tokens+now.Sub(limit.updated).Seconds()*perSecond)
+		limit.updated = now
+
+		if limit.tokens < 1 {
+			wait := time.Duration((1 - limit.tokens) / perSecond * float64(time.Second))
+			return false, wait, fmt.Sprintf("too many requests (limit %d per minute)", rpm)
+		}
+		limit.tokens--
+	}
+
+	limit.inFlight++
+	return true, 0, ""
+}
+
+// sweep forgets the clients without requests in flight whose budget refilled,
+// as they are back to the state of a new client. The lock must be held.
+func (l *rateLimiter) sweep(rpm int, now time.Time) {
+	l.swept = now
+	for client, limit := range l.clients {
+		if limit.inFlight > 0 {
+			continue
+		}
+		if rpm > 0 && limit.tokens+now.Sub(limit.updated).Seconds()*float64(rpm)/60 < float64(rpm) {
+			continue
+		}
+		delete(l.clients, client)
+	}
+}
+
+// release frees the client's concurrent request slot
+func (l *rateLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit, ok := l.clients[client]; ok {
+		limit.inFlight--
+	}
+}
+
+// rateLimit rejects requests exceeding the per-client limits with a 429
+func (p *Proxy) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := p.settings()
+		if settings.rateLimitRPM <= 0 && settings.rateLimitConcurrent <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := clientID(r)
+		ok, wait, reason := p.limiter.acquire(client, settings.rateLimitRPM, settings.rateLimitConcurrent, time.Now())
+		if !ok {
+			log.Printf("Rate limited client %s: %s", client, reason)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			writeAPIError(w, http.StatusTooManyRequests, "rate_limit_error", "Proxy rate limit exceeded: "+reason)
+			return
+		}
+		defer p.limiter.release(client)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errNoRecording is returned in replay mode when a request was never recorded
+var errNoRecording = errors.New("no recording found for request")
+
+// recording is a saved request and the raw upstream response to it
+type recording struct {
+	RecordedAt time.Time `json:"recorded_at"`
+	Request    struct {
+		Method string          `json:"method"`
+		Path   string          `json:"path"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header"`
+		Body       string      `json:"body"`
+	} `json:"response"`
+}
+
+// recordingPath returns the file a request is recorded to, keyed by a hash of
+// the method, path and body sent upstream
+func recordingPath(dir string, r *http.Request, bodyBytes []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+	hash.Write(bodyBytes)
+	return filepath.Join(dir, hex.EncodeToString(hash.Sum(nil))[:24]+".json")
+}
+
+// sendOrReplay gets the response for a request from the mock in mock mode, from
+// the recordings in replay mode, and otherwise from the response cache or the
+// upstream, recording and caching it when enabled
+func (p *Proxy) sendOrReplay(r *http.Request, bodyBytes []byte) (*http.Response, error) {
+	if p.cfg.Mock {
+		return p.mockResponse(r, bodyBytes)
+	}
+	if p.cfg.ReplayDir != "" {
+		return replayResponse(p.cfg.ReplayDir, r, bodyBytes)
+	}
+
+	if p.responses != nil && cacheable(r) {
+		if resp := p.responses.get(r, bodyBytes); resp != nil {
+			return resp, nil
+		}
+	}
+
+	resp, err := p.sendUpstream(r, bodyBytes)
+	if err == nil {
+		if err = decompressResponse(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	if err == nil && p.cfg.RecordDir != "" {
+		recordResponse(p.cfg.RecordDir, r, bodyBytes, resp, p.sensitive)
+	}
+	if err == nil && p.responses != nil && cacheable(r) {
+		p.responses.store(r, bodyBytes, resp)
+	}
+	return resp, err
+}
+
+// replayResponse builds a response from a recorded transcript
+func replayResponse(dir string, r *http.Request, bodyBytes []byte) (*http.Response, error) {
+	path := recordingPath(dir, r, bodyBytes)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoRecording
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("parsing recording %s: %w", path, err)
+	}
+	log.Printf("Replaying recorded response from %s", path)
+
+	return &http.Response{
+		StatusCode:    rec.Response.StatusCode,
+		Header:        rec.Response.Header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(rec.Response.Body))),
+		ContentLength: int64(len(rec.Response.Body)),
+	}, nil
+}
+
+// recordResponse tees the response body so the full transcript is saved when
+// the body is closed
+func recordResponse(dir string, r *http.Request, bodyBytes []byte, resp *http.Response, sensitive *sensitiveData) {
+	rec := &recording{RecordedAt: time.Now()}
+	rec.Request.Method = r.Method
+	rec.Request.Path = r.URL.Path
+	if json.Valid(bodyBytes) {
+		rec.Request.Body = sensitive.JSON(bodyBytes)
+	}
+	rec.Response.StatusCode = resp.StatusCode
+	rec.Response.Header = sensitive.Headers(resp.Header)
+
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		recording:  rec,
+		path:       recordingPath(dir, r, bodyBytes),
+	}
+}
+
+// recordingBody captures everything read from a response body
+type recordingBody struct {
+	io.ReadCloser
+	recording *recording
+	path      string
+	captured  bytes.Buffer
+}
+
+// Read reads from the response body, capturing the data
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.captured.Write(p[:n])
+	return n, err
+}
+
+// Close closes the response body and saves the recording
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+
+	b.recording.Response.Body = b.captured.String()
+	data, marshalErr := json.MarshalIndent(b.recording, "", "  ")
+	if marshalErr != nil {
+		log.Printf("Error encoding recording: %v", marshalErr)
+		return err
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(b.path), 0o755); mkdirErr != nil {
+		log.Printf("Error creating recording directory: %v", mkdirErr)
+		return err
+	}
+	if writeErr := os.WriteFile(b.path, data, 0o644); writeErr != nil {
+		log.Printf("Error writing recording: %v", writeErr)
+		return err
+	}
+	log.Printf("Recorded transcript to %s", b.path)
+
+	return err
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// redactionHoldback is how much text is held back at the end of a text block
+// so matches spanning delta boundaries are redacted. Longer matches split
+// across deltas may slip through, except those of detectors with an opening.
+const redactionHoldback = 256
+
+// redactionDetectors are built-in patterns for common secrets and personal data
+var redactionDetectors = map[string]string{
+	"aws_access_key":    `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	"anthropic_api_key": `sk-ant-[A-Za-z0-9_-]{20,}`,
+	"github_token":      `\bgh[pousr]_[A-Za-z0-9]{36,}\b`,
+	"private_key":       `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+	"email":             `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+}
+
+// redactionOpenings start the matches of detectors longer than the holdback.
+// Text from an opening is held back until the whole match arrived or the
+// block stops.
+var redactionOpenings = map[string]string{
+	"private_key": `-----BEGIN [A-Z ]*PRIVATE KEY-----`,
+}
+
+// RedactionRule replaces the matches of a pattern or built-in detector
+type RedactionRule struct {
+	// Pattern is a Go regular expression
+	Pattern string `json:"pattern,omitempty"`
+	// Detector names a built-in pattern instead: aws_access_key,
+	// anthropic_api_key, github_token, private_key or email
+	Detector string `json:"detector,omitempty"`
+	// Replacement replaces each match and may refer to groups as $1,
+	// "[REDACTED]" when empty
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// name identifies the rule in logs without revealing what it matched
+func (rule RedactionRule) name() string {
+	if rule.Detector != "" {
+		return rule.Detector
+	}
+	return rule.Pattern
+}
+
+// redactor is a compiled redaction rule
+type redactor struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+	// opening starts the matches of the pattern, nil for patterns whose
+	// matches fit in the holdback
+	opening *regexp.Regexp
+}
+
+// compileRedactions compiles the redaction rules
+func compileRedactions(rules []RedactionRule) ([]redactor, error) {
+	var redactors []redactor
+	for _, rule := range rules {
+		expr := rule.Pattern
+		if rule.Detector != "" {
+			if rule.Pattern != "" {
+				return nil, fmt.Errorf("invalid redaction rule: detector %q and a pattern are both set", rule.Detector)
+			}
+			var ok bool
+			if expr, ok = redactionDetectors[rule.Detector]; !ok {
+				return nil, fmt.Errorf("invalid redaction rule: unknown detector %q", rule.Detector)
+			}
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil || expr == "" {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", expr, err)
+		}
+		replacement := rule.Replacement
+		if replacement == "" {
+			replacement = "[REDACTED]"
+		}
+		var opening *regexp.Regexp
+		if expr, ok := redactionOpenings[rule.Detector]; ok {
+			opening = regexp.MustCompile(expr)
+		}
+		redactors = append(redactors, redactor{name: rule.name(), pattern: pattern, replacement: replacement, opening: opening})
+	}
+	return redactors, nil
+}
+
+// redactText applies every rule to text
+func redactText(redactors []redactor, text string) string {
+	for _, r := range redactors {
+		text = r.pattern.ReplaceAllString(text, r.replacement)
+	}
+	return text
+}
+
+// textRedaction is the built-in middleware redacting the text of streamed
+// responses before it reaches the client
+type textRedaction struct {
+	redactors []redactor
+}
+
+// Request returns a hook redacting the text of the response. Only streamed
+// responses are parsed into events.
+func (m textRedaction) Request(req *Request) (StreamHook, error) {
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		return nil, nil
+	}
+	return &redactionHook{redactors: m.redactors, label: req.label, pending: make(map[int]string)}, nil
+}
+
+// redactionHook redacts the text blocks of a single response
+type redactionHook struct {
+	redactors []redactor
+	label     string
+	// Text of each block held back until it can't be part of a match
+	pending  map[int]string
+	redacted int
+}
+
+// textDeltaEvent is the data of a text delta event
+type textDeltaEvent struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+}
+
+// Event sends the text of deltas that can no longer be part of a match,
+// redacted, and drops deltas whose text is all held back
+func (h *redactionHook) Event(event *sse.Event) bool {
+	if !isContentBlockDelta(event) {
+		return true
+	}
+	var data textDeltaEvent
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil || data.Delta.Type != "text_delta" {
+		return true
+	}
+
+	text := h.pending[data.Index] + data.Delta.Text
+	cut := h.safeCut(text)
+	h.pending[data.Index] = text[cut:]
+	if cut == 0 {
+		return false
+	}
+	h.setText(event, data, h.redact(text[:cut]))
+	return true
+}
+
+// Insert sends the text held back for a block before the block stops
+func (h *redactionHook) Insert(event *sse.Event) []*sse.Event {
+	if !isContentBlockStop(event) {
+		return nil
+	}
+	index, err := getContentBlockIndex(event)
+	if err != nil {
+		return nil
+	}
+	text, ok := h.pending[index]
+	delete(h.pending, index)
+	if !ok || text == "" {
+		return nil
+	}
+
+	var data textDeltaEvent
+	data.Type, data.Index = "content_block_delta", index
+	data.Delta.Type = "text_delta"
+	inserted := &sse.Event{Event: "content_block_delta"}
+	h.setText(inserted, data, h.redact(text))
+	return []*sse.Event{inserted}
+}
+
+// safeCut returns how much of text can be sent: all but the held back end,
+// nothing from the start of a match reaching into it, and nothing from an
+// opening whose match is yet to complete
+func (h *redactionHook) safeCut(text string) int {
+	cut := len(text) - redactionHoldback
+	if cut <= 0 {
+		return 0
+	}
+	for _, r := range h.redactors {
+		if r.opening == nil {
+			continue
+		}
+		matched := make(map[int]bool)
+		for _, match := range r.pattern.FindAllStringIndex(text, -1) {
+			matched[match[0]] = true
+		}
+		for _, opening := range r.opening.FindAllStringIndex(text, -1) {
+			if opening[0] < cut && !matched[opening[0]] {
+				cut = opening[0]
+				break
+			}
+		}
+	}
+	// Moving the cut back may make it split the match of another rule
+	for moved := true; moved; {
+		moved = false
+		for _, r := range h.redactors {
+			for _, match := range r.pattern.FindAllStringIndex(text, -1) {
+				if match[0] < cut && match[1] > cut {
+					cut, moved = match[0], true
+				}
+			}
+		}
+	}
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return cut
+}
+
+// redact applies the rules to text, counting the redacted matches
+func (h *redactionHook) redact(text string) string {
+	redacted := redactText(h.redactors, text)
+	if redacted != text {
+		h.redacted++
+	}
+	return redacted
+}
+
+// setText replaces the text of a delta event
+func (h *redactionHook) setText(event *sse.Event, data textDeltaEvent, text string) {
+	data.Delta.Text = text
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	event.Data = string(encoded)
+	event.Raw = ""
+}
+
+// Done logs how much of the response was redacted
+func (h *redactionHook) Done() {
+	if h.redacted > 0 {
+		log.Printf("[%s] Redacted text in %d deltas", h.label, h.redacted)
+	}
+}
+
+// describeRedactions lists the rules for the startup log
+func describeRedactions(rules []RedactionRule) string {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.name()
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// redactRequest scrubs the system prompt and message content of a Messages API
+// request, logging how many matches of each rule were redacted but never what
+// they were. Thinking blocks are left alone as their signatures cover them, as
+// are images and documents.
+func redactRequest(redactors []redactor, bodyJSON map[string]any) bool {
+	counts := make(map[string]int)
+	redact := func(text string) string {
+		for _, r := range redactors {
+			if matches := len(r.pattern.FindAllStringIndex(text, -1)); matches > 0 {
+				counts[r.name] += matches
+				text = r.pattern.ReplaceAllString(text, r.replacement)
+			}
+		}
+		return text
+	}
+
+	if system, ok := bodyJSON["system"].(string); ok {
+		bodyJSON["system"] = redact(system)
+	} else {
+		redactBlocks(bodyJSON["system"], redact)
+	}
+	messages, _ := bodyJSON["messages"].([]any)
+	for _, message := range messages {
+		message, ok := message.(map[string]any)
+		if !ok {
+			continue
+		}
+		if content, ok := message["content"].(string); ok {
+			message["content"] = redact(content)
+		} else {
+			redactBlocks(message["content"], redact)
+		}
+	}
+
+	if len(counts) == 0 {
+		return false
+	}
+	var summary []string
+	for _, name := range slices.Sorted(maps.Keys(counts)) {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[name], name))
+	}
+	log.Printf("Redacted from request: %s", strings.Join(summary, ", "))
+	return true
+}
+
+// redactBlocks scrubs the text of content blocks, the content of tool results
+// and the string values of tool inputs
+func redactBlocks(blocks any, redact func(string) string) {
+	list, _ := blocks.([]any)
+	for _, block := range list {
+		block, ok := block.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch block["type"] {
+		case "text":
+			if text, ok := block["text"].(string); ok {
+				block["text"] = redact(text)
+			}
+		case "tool_result":
+			if content, ok := block["content"].(string); ok {
+				block["content"] = redact(content)
+			} else {
+				redactBlocks(block["content"], redact)
+			}
+		case "tool_use":
+			block["input"] = redactValues(block["input"], redact)
+		}
+	}
+}
+
+// redactValues scrubs every string in a decoded JSON value
+func redactValues(value any, redact func(string) string) any {
+	switch v := value.(type) {
+	case string:
+		return redact(v)
+	case map[string]any:
+		for key, item := range v {
+			v[key] = redactValues(item, redact)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactValues(item, redact)
+		}
+	}
+	return value
+}
+
+// requestRedaction is the built-in middleware scrubbing request content
+// before it is forwarded
+type requestRedaction struct {
+	redactors []redactor
+}
+
+// Request redacts the request
+func (m requestRedaction) Request(req *Request) (StreamHook, error) {
+	if redactRequest(m.redactors, req.Body) {
+		req.Modified = true
+	}
+	return nil, nil
+}
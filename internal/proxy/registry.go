@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"strings"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// Modes of checking requests against the capabilities of their model
+const (
+	ModelValidationOff     = "off"     // Forward requests as they are
+	ModelValidationReject  = "reject"  // Reject requests the model can't serve
+	ModelValidationCorrect = "correct" // Adjust requests to what the model supports
+)
+
+// ModelCapabilities describe what a model supports
+type ModelCapabilities struct {
+	// ContextWindow is the number of input and output tokens the model accepts
+	ContextWindow int `json:"context_window"`
+	// MaxOutput is the largest max_tokens the model accepts
+	MaxOutput int `json:"max_output"`
+	// Thinking tells whether the model supports extended thinking
+	Thinking bool `json:"thinking"`
+	// OutputBeta is an anthropic-beta value raising the maximum output to
+	// BetaMaxOutput when the request carries it
+	OutputBeta    string `json:"output_beta,omitempty"`
+	BetaMaxOutput int    `json:"beta_max_output,omitempty"`
+}
+
+// maxOutput returns the largest max_tokens the model accepts with the betas of
+// a request
+func (caps ModelCapabilities) maxOutput(header http.Header) int {
+	if caps.OutputBeta != "" && caps.BetaMaxOutput > caps.MaxOutput && hasBeta(header, caps.OutputBeta) {
+		return caps.BetaMaxOutput
+	}
+	return caps.MaxOutput
+}
+
+// hasBeta checks if the anthropic-beta header of a request includes a value
+func hasBeta(header http.Header, beta string) bool {
+	for _, value := range header.Values("anthropic-beta") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.TrimSpace(name) == beta {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// builtinModels are the capabilities of the Claude models by glob pattern, the
+// most specific (longest) matching pattern winning
+var builtinModels = map[string]ModelCapabilities{
+	"claude-3-haiku*":    {ContextWindow: 200000, MaxOutput: 4096},
+	"claude-3-opus*":     {ContextWindow: 200000, MaxOutput: 4096},
+	"claude-3-sonnet*":   {ContextWindow: 200000, MaxOutput: 4096},
+	"claude-3-5-haiku*":  {ContextWindow: 200000, MaxOutput: 8192},
+	"claude-3-5-sonnet*": {ContextWindow: 200000, MaxOutput: 8192},
+	"claude-3-7-sonnet*": {ContextWindow: 200000, MaxOutput: 64000, Thinking: true, OutputBeta: "output-128k-2025-02-19", BetaMaxOutput: 128000},
+	"claude-sonnet-4*":   {ContextWindow: 200000, MaxOutput: 64000, Thinking: true},
+	"claude-opus-4*":     {ContextWindow: 200000, MaxOutput: 32000, Thinking: true},
+	"claude-opus-4-5*":   {ContextWindow: 200000, MaxOutput: 64000, Thinking: true},
+	"claude-haiku-4*":    {ContextWindow: 200000, MaxOutput: 64000, Thinking: true},
+}
+
+// validateModelValidation checks that a model validation mode is known
+func validateModelValidation(mode string) error {
+	switch mode {
+	case "", ModelValidationOff, ModelValidationReject, ModelValidationCorrect:
+		return nil
+	}
+	return fmt.Errorf("invalid model validation mode %q: must be %s, %s or %s",
+		mode, ModelValidationOff, ModelValidationReject, ModelValidationCorrect)
+}
+
+// validateModels checks the patterns and capabilities added to the registry
+func validateModels(models map[string]ModelCapabilities) error {
+	for pattern, caps := range models {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("models: invalid pattern %q: %w", pattern, err)
+		}
+		if caps.ContextWindow <= 0 || caps.MaxOutput <= 0 {
+			return fmt.Errorf("models: %q needs a positive context_window and max_output", pattern)
+		}
+		if caps.MaxOutput > caps.ContextWindow {
+			return fmt.Errorf("models: max_output %d of %q exceeds its context window of %d", caps.MaxOutput, pattern, caps.ContextWindow)
+		}
+		if (caps.OutputBeta == "") != (caps.BetaMaxOutput == 0) {
+			return fmt.Errorf("models: %q needs both output_beta and beta_max_output, or neither", pattern)
+		}
+		if caps.BetaMaxOutput > caps.ContextWindow {
+			return fmt.Errorf("models: beta_max_output %d of %q exceeds its context window of %d", caps.BetaMaxOutput, pattern, caps.ContextWindow)
+		}
+	}
+	return nil
+}
+
+// newModelRegistry returns the built-in models with the configured ones added,
+// replacing the built-in entries of the same patterns
+func newModelRegistry(models map[string]ModelCapabilities) map[string]ModelCapabilities {
+	registry := maps.Clone(builtinModels)
+	maps.Copy(registry, models)
+	return registry
+}
+
+// modelCapabilities returns the capabilities of a model from the most specific
+// matching pattern of the registry, and whether the registry knows the model
+func (p *Proxy) modelCapabilities(model string) (ModelCapabilities, bool) {
+	var caps ModelCapabilities
+	matched := ""
+	for pattern, patternCaps := range p.models {
+		if ok, _ := path.Match(pattern, model); ok && len(pattern) > len(matched) {
+			caps, matched = patternCaps, pattern
+		}
+	}
+	return caps, matched != ""
+}
+
+// supportsThinking checks if a model supports extended thinking, according to
+// the registry or else the built-in thinking model patterns
+func (p *Proxy) supportsThinking(model string) bool {
+	if caps, ok := p.modelCapabilities(model); ok {
+		return caps.Thinking
+	}
+	return rewrite.SupportsThinking(model)
+}
+
+// checkThinkingSupport handles a "-thinking" alias of a model the registry
+// says can't think, before the middlewares enable thinking for it. It returns
+// the model name to handle the request as, without the suffix when corrected.
+func (p *Proxy) checkThinkingSupport(bodyJSON map[string]any, clientModel string) (string, error) {
+	mode := p.cfg.ModelValidation
+	if mode == "" || mode == ModelValidationOff || !rewrite.HasThinkingSuffix(clientModel) {
+		return clientModel, nil
+	}
+	model := rewrite.ModifyModelName(clientModel)
+	if caps, ok := p.modelCapabilities(model); !ok || caps.Thinking {
+		return clientModel, nil
+	}
+	if mode == ModelValidationReject {
+		return "", fmt.Errorf("model %s doesn't support extended thinking: use %s without the %q suffix, or a model that supports thinking",
+			model, model, rewrite.ThinkingSuffix)
+	}
+	log.Printf("Model %s doesn't support extended thinking, forwarding %s without it", model, clientModel)
+	bodyJSON["model"] = model
+	return model, nil
+}
+
+// checkModelCapabilities checks a request, as the middlewares rewrote it,
+// against the capabilities of its model: extended thinking, and max_tokens
+// within the model's maximum output, raised by an output beta the request
+// carries, and context window. In correct mode
+// thinking is removed and max_tokens lowered instead of rejecting the request.
+func (p *Proxy) checkModelCapabilities(req *Request) error {
+	mode := p.cfg.ModelValidation
+	if mode == "" || mode == ModelValidationOff {
+		return nil
+	}
+	changed, err := p.fitModelCapabilities(req.Header, req.Body, mode == ModelValidationCorrect)
+	req.Modified = req.Modified || changed
+	return err
+}
+
+// fitModelCapabilities checks a request body, sent with header, against the
+// capabilities of its model, correcting it when correct is set, and reports
+// whether it changed
+func (p *Proxy) fitModelCapabilities(header http.Header, bodyJSON map[string]any, correct bool) (bool, error) {
+	model, _ := bodyJSON["model"].(string)
+	caps, ok := p.modelCapabilities(model)
+	if !ok {
+		return false, nil
+	}
+
+	changed := false
+	if rewrite.ThinkingEnabled(bodyJSON) && !caps.Thinking {
+		if !correct {
+			return false, fmt.Errorf("model %s doesn't support extended thinking: remove the thinking parameter or use a model that supports it", model)
+		}
+		log.Printf("Model %s doesn't support extended thinking, removing it from the request", model)
+		delete(bodyJSON, "thinking")
+		changed = true
+	}
+
+	limit := min(caps.maxOutput(header), caps.ContextWindow)
+	maxTokens := intValue(bodyJSON["max_tokens"])
+	if maxTokens <= limit {
+		return changed, nil
+	}
+	if !correct {
+		return changed, fmt.Errorf("max_tokens %d exceeds the maximum output of %s, %d tokens: lower max_tokens to at most %d",
+			maxTokens, model, limit, limit)
+	}
+	log.Printf("Lowering max_tokens from %d to the maximum output of %s, %d tokens", maxTokens, model, limit)
+	bodyJSON["max_tokens"] = limit
+
+	// The thinking budget must stay below max_tokens
+	if budget := thinkingBudget(bodyJSON); budget >= limit {
+		budget = max(limit-p.cfg.Rewrite.MaxTokensHeadroom, limit/2, rewrite.MinThinkingBudget)
+		if budget >= limit {
+			return true, fmt.Errorf("the maximum output of %s, %d tokens, leaves no room for the minimum thinking budget of %d",
+				model, limit, rewrite.MinThinkingBudget)
+		}
+		log.Printf("Lowering thinking budget to %d to fit under the maximum output of %s", budget, model)
+		bodyJSON["thinking"] = rewrite.ThinkingConfig{Type: "enabled", BudgetTokens: budget}
+	}
+	return true, nil
+}
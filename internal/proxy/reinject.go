@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Bounds of the thinking kept for reinjection. Tool results normally come back
+// within seconds, a long TTL covers users reviewing a tool call before running it.
+const (
+	thinkingMemoryTTL  = time.Hour
+	thinkingMemorySize = 4096
+)
+
+// thinkingMemory keeps the thinking blocks stripped from responses that called
+// tools. The API requires them to be sent back with the assistant turn when the
+// tool results are returned, which clients can't do since they never saw them.
+type thinkingMemory struct {
+	mu      sync.Mutex
+	entries map[string]*rememberedTurn
+}
+
+// rememberedTurn is the layout of an assistant turn, holding its thinking blocks
+// and nil in place of the blocks the client received
+type rememberedTurn struct {
+	storedAt time.Time
+	layout   []map[string]any
+	// Thinking spilled to disk by position in the layout, read back when the
+	// turn is restored and removed once no tool call refers to the turn
+	spilled map[int]*spillBuffer
+	refs    int
+}
+
+// newThinkingMemory returns an empty thinking memory
+func newThinkingMemory() *thinkingMemory {
+	return &thinkingMemory{entries: make(map[string]*rememberedTurn)}
+}
+
+// remember keeps the layout of a turn, found again by its tool_use ids. The
+// spilled thinking of the turn is closed once it is forgotten.
+func (m *thinkingMemory) remember(layout []map[string]any, spilled map[int]*spillBuffer, toolUseIDs []string) {
+	thinking := false
+	for _, block := range layout {
+		thinking = thinking || block != nil
+	}
+	if !thinking || len(toolUseIDs) == 0 {
+		for _, content := range spilled {
+			content.Close()
+		}
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Drop expired turns, then the oldest ones to stay within the size limit
+	for id, turn := range m.entries {
+		if time.Since(turn.storedAt) > thinkingMemoryTTL {
+			m.forget(id)
+		}
+	}
+	for len(m.entries)+len(toolUseIDs) > thinkingMemorySize && len(m.entries) > 0 {
+		var oldest string
+		for id, turn := range m.entries {
+			if oldest == "" || turn.storedAt.Before(m.entries[oldest].storedAt) {
+				oldest = id
+			}
+		}
+		m.forget(oldest)
+	}
+
+	turn := &rememberedTurn{storedAt: time.Now(), layout: layout, spilled: spilled}
+	for _, id := range toolUseIDs {
+		if m.entries[id] == turn {
+			continue
+		}
+		m.forget(id)
+		m.entries[id] = turn
+		turn.refs++
+	}
+}
+
+// forget drops the turn of a tool call, closing its spilled thinking once no
+// other tool call refers to it. The lock must be held.
+func (m *thinkingMemory) forget(id string) {
+	turn, ok := m.entries[id]
+	if !ok {
+		return
+	}
+	delete(m.entries, id)
+	if turn.refs--; turn.refs == 0 {
+		for _, content := range turn.spilled {
+			content.Close()
+		}
+	}
+}
+
+// lookupAndRestore restores the content of an assistant turn with the thinking
+// of the remembered turn that made one of the tool calls, if any. The lock is
+// held while spilled thinking is read back, so the turn can't be forgotten in
+// the meantime.
+func (m *thinkingMemory) lookupAndRestore(toolUseIDs []string, content []any) ([]any, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range toolUseIDs {
+		if turn, ok := m.entries[id]; ok && time.Since(turn.storedAt) <= thinkingMemoryTTL {
+			return turn.restore(content), true
+		}
+	}
+	return nil, false
+}
+
+// reinject puts the remembered thinking blocks back into the assistant turns
+// of a request that lack them, returning how many turns were restored
+func (m *thinkingMemory) reinject(bodyJSON map[string]any) int {
+	messages, _ := bodyJSON["messages"].([]any)
+	restored := 0
+	for _, message := range messages {
+		message, ok := message.(map[string]any)
+		if !ok || message["role"] != "assistant" {
+			continue
+		}
+		content, ok := message["content"].([]any)
+		if !ok {
+			continue
+		}
+
+		// Find the tool calls of the turn, leaving turns with thinking alone
+		var toolUseIDs []string
+		hasThinking := false
+		for _, block := range content {
+			block, _ := block.(map[string]any)
+			switch block["type"] {
+			case "thinking", "redacted_thinking":
+				hasThinking = true
+			case "tool_use":
+				if id, _ := block["id"].(string); id != "" {
+					toolUseIDs = append(toolUseIDs, id)
+				}
+			}
+		}
+		if hasThinking || len(toolUseIDs) == 0 {
+			continue
+		}
+		restoredContent, ok := m.lookupAndRestore(toolUseIDs, content)
+		if !ok {
+			continue
+		}
+
+		message["content"] = restoredContent
+		restored++
+	}
+
+	if restored > 0 {
+		log.Printf("Reinjected thinking blocks into %d assistant turns", restored)
+	}
+	return restored
+}
+
+// restore interleaves the thinking blocks of the turn with the content the
+// client sent back. When the client changed the number of blocks, the thinking
+// blocks are put first, where the API expects them.
+func (t *rememberedTurn) restore(content []any) []any {
+	var thinking []any
+	forwarded := 0
+	for i, block := range t.layout {
+		if block != nil {
+			thinking = append(thinking, t.block(i))
+		} else {
+			forwarded++
+		}
+	}
+	if forwarded != len(content) {
+		return append(thinking, content...)
+	}
+
+	restored := make([]any, 0, len(t.layout))
+	next := 0
+	for i, block := range t.layout {
+		if block != nil {
+			restored = append(restored, t.block(i))
+			continue
+		}
+		restored = append(restored, content[next])
+		next++
+	}
+	return restored
+}
+
+// block returns the thinking block at a position of the layout, with its
+// thinking read back from disk when it was spilled
+func (t *rememberedTurn) block(position int) map[string]any {
+	content, ok := t.spilled[position]
+	if !ok {
+		return t.layout[position]
+	}
+	block := maps.Clone(t.layout[position])
+	block["thinking"] = content.String()
+	return block
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// openBlock is a content block forwarded to the client that wasn't stopped yet
+type openBlock struct {
+	blockType string
+	// Input JSON of a tool_use block received so far
+	partialJSON strings.Builder
+}
+
+// openBlocks tracks the content blocks a client has seen start but not stop, by
+// index, so a truncated stream can be completed
+type openBlocks map[int]*openBlock
+
+// observe updates the open blocks from the data of a forwarded event
+func (b openBlocks) observe(data string) {
+	if b == nil {
+		return
+	}
+	var event struct {
+		Type         string `json:"type"`
+		Index        int    `json:"index"`
+		ContentBlock struct {
+			Type string `json:"type"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			PartialJSON string `json:"partial_json"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return
+	}
+
+	switch event.Type {
+	case "content_block_start":
+		b[event.Index] = &openBlock{blockType: event.ContentBlock.Type}
+	case "content_block_delta":
+		if block, ok := b[event.Index]; ok && event.Delta.Type == "input_json_delta" {
+			block.partialJSON.WriteString(event.Delta.PartialJSON)
+		}
+	case "content_block_stop":
+		delete(b, event.Index)
+	}
+}
+
+// repairTruncatedStream completes a stream the upstream cut off as if the
+// message had hit max_tokens: the open blocks are stopped, with the input of
+// tool_use blocks completed to valid JSON, followed by message_delta and
+// message_stop. It reports false when the message never started, as there is
+// nothing to complete.
+func repairTruncatedStream(w io.Writer, usage *requestUsage, blocks openBlocks) bool {
+	if usage.Model == "" || usage.UpstreamError {
+		return false
+	}
+	log.Printf("Completing truncated stream with %d open content blocks", len(blocks))
+
+	for _, index := range slices.Sorted(maps.Keys(blocks)) {
+		block := blocks[index]
+		if block.blockType == "tool_use" {
+			if suffix := closeJSON(block.partialJSON.String()); suffix != "" {
+				if err := sse.WriteJSON(w, "content_block_delta", map[string]any{
+					"type":  "content_block_delta",
+					"index": index,
+					"delta": map[string]string{"type": "input_json_delta", "partial_json": suffix},
+				}); err != nil {
+					return true
+				}
+			}
+		}
+		if err := sse.WriteJSON(w, "content_block_stop", map[string]any{"type": "content_block_stop", "index": index}); err != nil {
+			return true
+		}
+	}
+
+	events := []struct {
+		name string
+		data any
+	}{
+		{"message_delta", map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": "max_tokens", "stop_sequence": nil},
+			"usage": map[string]int64{"output_tokens": usage.Usage.OutputTokens},
+		}},
+		{"message_stop", map[string]string{"type": "message_stop"}},
+	}
+	for _, event := range events {
+		if err := sse.WriteJSON(w, event.name, event.data); err != nil {
+			log.Printf("Error completing truncated stream: %v", err)
+			return true
+		}
+	}
+	return true
+}
+
+// closeJSON returns the text completing a truncated JSON document: unfinished
+// strings, literals and numbers are ended, values missing after a key or comma
+// are filled with null and open objects and arrays are closed
+func closeJSON(partial string) string {
+	const (
+		expectValue = iota // Start of an array, after ":" or after "," in an array
+		expectKey          // Start of an object or after "," in an object
+		expectColon        // After a key
+		afterValue         // After a complete value
+	)
+	type frame struct {
+		object     bool
+		state      int
+		afterComma bool
+	}
+
+	var (
+		stack    []frame
+		inString bool
+		isKey    bool
+		escaped  bool
+		unicode  int // Hex digits still expected in a \u escape
+		literal  strings.Builder
+	)
+	top := func() *frame {
+		if len(stack) == 0 {
+			return nil
+		}
+		return &stack[len(stack)-1]
+	}
+	valueDone := func() {
+		if f := top(); f != nil {
+			f.state, f.afterComma = afterValue, false
+		}
+	}
+
+	for _, c := range partial {
+		if inString {
+			switch {
+			case unicode > 0:
+				unicode--
+			case escaped:
+				escaped = false
+				if c == 'u' {
+					unicode = 4
+				}
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+				if isKey {
+					top().state = expectColon
+				} else {
+					valueDone()
+				}
+			}
+			continue
+		}
+
+		// A literal or number ends at the first character that can't be part of it
+		if literal.Len() > 0 && !strings.ContainsRune("truefalsn0123456789+-.eE", c) {
+			literal.Reset()
+			valueDone()
+		}
+
+		switch c {
+		case ' ', '\t', '\n', '\r':
+		case '{':
+			stack = append(stack, frame{object: true, state: expectKey})
+		case '[':
+			stack = append(stack, frame{state: expectValue})
+		case '}', ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			valueDone()
+		case '"':
+			inString = true
+			f := top()
+			isKey = f != nil && f.object && f.state == expectKey
+		case ':':
+			if f := top(); f != nil {
+				f.state = expectValue
+			}
+		case ',':
+			if f := top(); f != nil {
+				f.afterComma = true
+				f.state = expectValue
+				if f.object {
+					f.state = expectKey
+				}
+			}
+		default:
+			literal.WriteRune(c)
+		}
+	}
+
+	var suffix strings.Builder
+
+	// End the value being written
+	switch {
+	case inString:
+		if escaped {
+			suffix.WriteString(`\`)
+		}
+		suffix.WriteString(strings.Repeat("0", unicode))
+		suffix.WriteString(`"`)
+		if isKey {
+			top().state = expectColon
+		} else {
+			valueDone()
+		}
+	case literal.Len() > 0:
+		text := literal.String()
+		completed := false
+		for _, word := range []string{"true", "false", "null"} {
+			if strings.HasPrefix(word, text) {
+				suffix.WriteString(word[len(text):])
+				completed = true
+				break
+			}
+		}
+		if !completed && strings.ContainsAny(text[len(text)-1:], "+-.eE") {
+			suffix.WriteString("0")
+		}
+		valueDone()
+	}
+
+	// Fill in missing values and close the open containers
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		switch {
+		case f.state == expectColon:
+			suffix.WriteString(":null")
+		case f.state == expectValue && (f.object || f.afterComma):
+			suffix.WriteString("null")
+		case f.state == expectKey && f.afterComma:
+			suffix.WriteString(`"":null`)
+		}
+		if f.object {
+			suffix.WriteString("}")
+		} else {
+			suffix.WriteString("]")
+		}
+		stack = stack[:len(stack)-1]
+		valueDone()
+	}
+
+	// A tool input that never started is an empty object
+	if strings.TrimSpace(partial) == "" {
+		return "{}"
+	}
+	return suffix.String()
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"zedclaudeproxy/internal/rewrite"
+	"zedclaudeproxy/internal/sse"
+)
+
+// replayAPIVersion is the API version replayed requests are sent with, as
+// transcripts don't keep the headers of requests
+const replayAPIVersion = "2023-06-01"
+
+// ReplayOptions selects the recorded request to replay and how its response
+// is printed
+type ReplayOptions struct {
+	// Source is a JSON file holding a transcript of the history store or a
+	// Messages API request body, or else the number of a request recorded in
+	// the history store, e.g. "12" or "request 12"
+	Source string
+	// Store, StoreEndpoint and EncryptionKey describe the history store, as in Config
+	Store         string
+	StoreEndpoint string
+	EncryptionKey string
+	// Conversation narrows the requests of the history store to a conversation
+	Conversation string
+	// Since skips the batches uploaded on earlier days when set
+	Since time.Time
+	// Thinking prints the thinking of the response before the answer
+	Thinking bool
+}
+
+// Replay sends a recorded request through the proxy as a client would and
+// prints the response the client gets, along with the thinking the filter
+// removed from it. The API key is taken from ANTHROPIC_API_KEY unless the
+// proxy configures one. Replay is meant for a proxy created for it, not one
+// serving clients.
+func (p *Proxy) Replay(ctx context.Context, w io.Writer, opts ReplayOptions) error {
+	body, err := loadReplayRequest(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	// Print the thinking before the thinking filter drops it, right after the
+	// rewrite set the budget
+	if opts.Thinking {
+		p.middlewares = slices.Insert(p.middlewares, 1, Middleware(replayThinking{w: w}))
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, MessagesEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.RemoteAddr = "replay"
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Anthropic-Version", replayAPIVersion)
+	if key := os.Getenv("ANTHROPIC_API_KEY"); key != "" {
+		r.Header.Set("X-Api-Key", key)
+	}
+
+	out := &replayWriter{w: w, header: make(http.Header), status: http.StatusOK}
+	p.TrustedHandler().ServeHTTP(out, r)
+	return out.finish()
+}
+
+// loadReplayRequest returns the body of the request to replay, as the client
+// sent it: recorded bodies are the ones forwarded upstream, so their model is
+// set back to the one the client asked for for the rewrites to run again
+func loadReplayRequest(ctx context.Context, opts ReplayOptions) ([]byte, error) {
+	var transcript *Transcript
+	if data, err := os.ReadFile(opts.Source); err == nil {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", opts.Source, err)
+		}
+		if _, ok := fields["messages"]; ok {
+			log.Printf("Replaying the request of %s", opts.Source)
+			return data, nil
+		}
+		transcript = new(Transcript)
+		if err := json.Unmarshal(data, transcript); err != nil || transcript.Body == nil {
+			return nil, fmt.Errorf("%s is neither a transcript nor a Messages API request", opts.Source)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	} else if transcript, err = findTranscript(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(transcript.Body, &body); err != nil {
+		return nil, fmt.Errorf("parsing the body of %s: %w", transcript.Request, err)
+	}
+	if transcript.ClientModel != "" {
+		body["model"] = transcript.ClientModel
+		// The rewrite adds the thinking of "-thinking" models again
+		if rewrite.HasThinkingSuffix(transcript.ClientModel) {
+			delete(body, "thinking")
+		}
+	}
+	log.Printf("Replaying %s of %s (model %s)", transcript.Request, transcript.Time.Format(time.RFC3339), transcript.ClientModel)
+	return json.Marshal(body)
+}
+
+// findTranscript looks the request to replay up in the history store. Request
+// numbers restart with the proxy, so the latest matching request wins.
+func findTranscript(ctx context.Context, opts ReplayOptions) (*Transcript, error) {
+	if opts.Store == "" {
+		return nil, fmt.Errorf("%s is not a file and no history store is set to look it up in", opts.Source)
+	}
+	label := opts.Source
+	if _, err := strconv.Atoi(label); err == nil {
+		label = "request " + label
+	}
+
+	store, prefix, err := openHistoryStore(ctx, opts.Store, opts.StoreEndpoint, opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	transcripts, err := loadTranscripts(ctx, store, prefix, opts.Since, func(t *Transcript) bool {
+		// Labels go on with the conversation of the request
+		matches := t.Request == label || strings.HasPrefix(t.Request, label+", ")
+		return matches && (opts.Conversation == "" || t.Conversation == opts.Conversation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(transcripts) == 0 {
+		return nil, fmt.Errorf("%s not found in %s", label, store.Location(prefix))
+	}
+	if len(transcripts) > 1 {
+		log.Printf("Found %d recordings of %s, replaying the latest", len(transcripts), label)
+	}
+	return transcripts[len(transcripts)-1], nil
+}
+
+// replayThinking is the middleware printing the thinking of replayed responses
+type replayThinking struct {
+	w io.Writer
+}
+
+// Request returns a hook printing the thinking of streamed responses
+func (m replayThinking) Request(req *Request) (StreamHook, error) {
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		return nil, nil
+	}
+	return &replayThinkingHook{w: m.w, blocks: make(map[int]bool)}, nil
+}
+
+// replayThinkingHook prints the thinking blocks of a single response
+type replayThinkingHook struct {
+	w io.Writer
+	// Indices of the open thinking blocks
+	blocks map[int]bool
+}
+
+// Event prints the thinking deltas as they arrive, between <thinking> tags
+func (h *replayThinkingHook) Event(event *sse.Event) bool {
+	var data struct {
+		Type         string `json:"type"`
+		Index        int    `json:"index"`
+		ContentBlock struct {
+			Type string `json:"type"`
+		} `json:"content_block"`
+		Delta struct {
+			Type     string `json:"type"`
+			Thinking string `json:"thinking"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return true
+	}
+
+	switch data.Type {
+	case "content_block_start":
+		switch data.ContentBlock.Type {
+		case "thinking":
+			h.blocks[data.Index] = true
+			fmt.Fprintln(h.w, "<thinking>")
+		case "redacted_thinking":
+			fmt.Fprint(h.w, "<redacted_thinking/>\n\n")
+		}
+	case "content_block_delta":
+		if h.blocks[data.Index] && data.Delta.Type == "thinking_delta" {
+			fmt.Fprint(h.w, data.Delta.Thinking)
+		}
+	case "content_block_stop":
+		if h.blocks[data.Index] {
+			delete(h.blocks, data.Index)
+			fmt.Fprint(h.w, "\n</thinking>\n\n")
+		}
+	}
+	return true
+}
+
+// Done does nothing
+func (h *replayThinkingHook) Done() {}
+
+// replayWriter receives the response of a replayed request, printing the
+// text and tool calls of streamed responses as they arrive
+type replayWriter struct {
+	w      io.Writer
+	header http.Header
+	status int
+	// Body of error and non-streamed responses, and the incomplete event of
+	// streamed ones
+	buffer bytes.Buffer
+	// Content block types by index, their type deciding how they print
+	blocks     map[int]string
+	stopReason string
+	// streamErr is an error event of the stream
+	streamErr error
+}
+
+// Header returns the headers of the response
+func (rw *replayWriter) Header() http.Header {
+	return rw.header
+}
+
+// WriteHeader records the status of the response
+func (rw *replayWriter) WriteHeader(status int) {
+	rw.status = status
+}
+
+// Write prints the complete events of a streamed response and buffers the rest
+func (rw *replayWriter) Write(p []byte) (int, error) {
+	rw.buffer.Write(p)
+	if rw.status != http.StatusOK || !strings.HasPrefix(rw.header.Get("Content-Type"), "text/event-stream") {
+		return len(p), nil
+	}
+	for {
+		data := bytes.ReplaceAll(rw.buffer.Bytes(), []byte("\r\n"), []byte("\n"))
+		end := bytes.Index(data, []byte("\n\n"))
+		if end < 0 {
+			return len(p), nil
+		}
+		rw.buffer.Reset()
+		rw.buffer.Write(data[end+2:])
+		// Comments such as keep-alives don't parse as events
+		if event, err := sse.Parse(string(data[:end])); err == nil {
+			rw.printEvent(event)
+		}
+	}
+}
+
+// Flush does nothing, events are printed as soon as they are complete
+func (rw *replayWriter) Flush() {}
+
+// printEvent prints the text and tool calls of a streamed event
+func (rw *replayWriter) printEvent(event *sse.Event) {
+	var data struct {
+		Type         string `json:"type"`
+		Index        int    `json:"index"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			PartialJSON string `json:"partial_json"`
+			StopReason  string `json:"stop_reason"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return
+	}
+
+	switch data.Type {
+	case "content_block_start":
+		if rw.blocks == nil {
+			rw.blocks = make(map[int]string)
+		}
+		rw.blocks[data.Index] = data.ContentBlock.Type
+		if data.ContentBlock.Type == "tool_use" {
+			fmt.Fprintf(rw.w, "[tool call %s] ", data.ContentBlock.Name)
+		}
+	case "content_block_delta":
+		switch data.Delta.Type {
+		case "text_delta":
+			fmt.Fprint(rw.w, data.Delta.Text)
+		case "input_json_delta":
+			fmt.Fprint(rw.w, data.Delta.PartialJSON)
+		}
+	case "content_block_stop":
+		if blockType := rw.blocks[data.Index]; blockType == "text" || blockType == "tool_use" {
+			fmt.Fprint(rw.w, "\n\n")
+		}
+	case "message_delta":
+		if data.Delta.StopReason != "" {
+			rw.stopReason = data.Delta.StopReason
+		}
+	case "error":
+		var apiError map[string]any
+		json.Unmarshal([]byte(event.Data), &apiError)
+		errorType, message := describeAPIError(apiError)
+		rw.streamErr = fmt.Errorf("stream failed with %s: %s", errorType, message)
+	}
+}
+
+// finish prints a non-streamed response and returns the error the response
+// reported, if any
+func (rw *replayWriter) finish() error {
+	if rw.status != http.StatusOK {
+		return fmt.Errorf("status %d: %s", rw.status, strings.TrimSpace(rw.buffer.String()))
+	}
+	if rw.streamErr != nil {
+		return rw.streamErr
+	}
+	if !strings.HasPrefix(rw.header.Get("Content-Type"), "text/event-stream") {
+		var message struct {
+			Content    []map[string]any `json:"content"`
+			StopReason string           `json:"stop_reason"`
+		}
+		if err := json.Unmarshal(rw.buffer.Bytes(), &message); err != nil {
+			return fmt.Errorf("parsing response: %w", err)
+		}
+		for _, block := range message.Content {
+			switch block["type"] {
+			case "text":
+				fmt.Fprintf(rw.w, "%s\n\n", block["text"])
+			case "tool_use":
+				input, _ := json.Marshal(block["input"])
+				fmt.Fprintf(rw.w, "[tool call %s] %s\n\n", block["name"], input)
+			}
+		}
+		rw.stopReason = message.StopReason
+	}
+	log.Printf("Replay finished with stop reason %s", cmp.Or(rw.stopReason, "unknown"))
+	return nil
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Periods of the usage report
+const (
+	ReportDaily  = "daily"
+	ReportWeekly = "weekly"
+)
+
+// reportTimeout bounds the delivery of a report to a webhook
+const reportTimeout = 30 * time.Second
+
+// reportTarget receives the usage reports
+type reportTarget interface {
+	send(report string) error
+}
+
+// parseReportTargets creates the targets from a comma separated list of specs:
+// "webhook:<url>" posts Slack compatible messages and "file:<dir>" writes
+// Markdown files
+func parseReportTargets(specs string) ([]reportTarget, error) {
+	var targets []reportTarget
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		kind, arg, _ := strings.Cut(spec, ":")
+		switch kind {
+		case "webhook":
+			parsed, err := url.Parse(arg)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("usage report target %q: invalid webhook URL", spec)
+			}
+			targets = append(targets, webhookReport{url: arg})
+		case "file":
+			if arg == "" {
+				return nil, fmt.Errorf("usage report target %q: missing directory", spec)
+			}
+			targets = append(targets, fileReport{dir: arg})
+		default:
+			return nil, fmt.Errorf("usage report target %q: unknown target type", spec)
+		}
+	}
+	return targets, nil
+}
+
+// parseReportPeriod validates the period of the usage report: daily, weekly or
+// a duration
+func parseReportPeriod(period string) error {
+	if period == ReportDaily || period == ReportWeekly {
+		return nil
+	}
+	if d, err := time.ParseDuration(period); err != nil || d < time.Minute {
+		return fmt.Errorf("invalid usage report period %q: must be %s, %s or a duration of at least 1m", period, ReportDaily, ReportWeekly)
+	}
+	return nil
+}
+
+// nextReport returns when the period containing now ends, in UTC: midnight for
+// daily reports, Monday midnight for weekly ones, and multiples of the
+// duration since the zero time otherwise
+func nextReport(period string, now time.Time) time.Time {
+	now = now.UTC()
+	switch period {
+	case ReportDaily:
+		return now.Truncate(24*time.Hour).AddDate(0, 0, 1)
+	case ReportWeekly:
+		day := now.Truncate(24 * time.Hour)
+		return day.AddDate(0, 0, 7-(int(day.Weekday())+6)%7)
+	}
+	d, _ := time.ParseDuration(period)
+	return now.Truncate(d).Add(d)
+}
+
+// RunUsageReporter sends a report of the usage and estimated cost of each
+// client and model at the end of every report period, covering the requests
+// of the period. Periods without requests aren't reported.
+func (p *Proxy) RunUsageReporter() {
+	if p.cfg.UsageReport == "" || len(p.reportTargets) == 0 {
+		return
+	}
+
+	start, previous := time.Now(), p.usage.snapshot()
+	for {
+		end := nextReport(p.cfg.UsageReport, time.Now())
+		time.Sleep(time.Until(end))
+
+		current := p.usage.snapshot()
+		period := current.since(previous, start)
+		start, previous = end, current
+		if period.Total.Requests == 0 {
+			continue
+		}
+		title := "Claude usage report, " + describeReportPeriod(period.Since, end)
+		report := renderUsageReport(title, period)
+		for _, target := range p.reportTargets {
+			if err := target.send(report); err != nil {
+				log.Printf("Error sending usage report: %v", err)
+			}
+		}
+		log.Printf("Sent the usage report of %s: %s", describeReportPeriod(period.Since, end), period.Total.describe())
+	}
+}
+
+// since returns the usage accumulated after an earlier snapshot taken at start
+func (s usageSnapshot) since(earlier usageSnapshot, start time.Time) usageSnapshot {
+	diff := usageSnapshot{
+		Since:   start,
+		Total:   s.Total.sub(earlier.Total),
+		Models:  make(map[string]usageTotals),
+		Clients: make(map[string]usageTotals),
+	}
+	for model, totals := range s.Models {
+		if totals = totals.sub(earlier.Models[model]); totals.Requests > 0 {
+			diff.Models[model] = totals
+		}
+	}
+	for client, totals := range s.Clients {
+		if totals = totals.sub(earlier.Clients[client]); totals.Requests > 0 {
+			diff.Clients[client] = totals
+		}
+	}
+	return diff
+}
+
+// sub returns the totals accumulated after earlier ones
+func (t usageTotals) sub(earlier usageTotals) usageTotals {
+	return usageTotals{
+		Requests:                 t.Requests - earlier.Requests,
+		CachedRequests:           t.CachedRequests - earlier.CachedRequests,
+		Errors:                   t.Errors - earlier.Errors,
+		DurationMS:               t.DurationMS - earlier.DurationMS,
+		InputTokens:              t.InputTokens - earlier.InputTokens,
+		OutputTokens:             t.OutputTokens - earlier.OutputTokens,
+		ThinkingTokens:           t.ThinkingTokens - earlier.ThinkingTokens,
+		CacheCreationInputTokens: t.CacheCreationInputTokens - earlier.CacheCreationInputTokens,
+		CacheReadInputTokens:     t.CacheReadInputTokens - earlier.CacheReadInputTokens,
+		CostUSD:                  t.CostUSD - earlier.CostUSD,
+	}
+}
+
+// describeReportPeriod describes the period of a report in UTC
+func describeReportPeriod(start, end time.Time) string {
+	const layout = "2006-01-02 15:04"
+	return fmt.Sprintf("%s to %s UTC", start.UTC().Format(layout), end.UTC().Format(layout))
+}
+
+// renderUsageReport renders the usage of a period as Markdown, with the tables
+// in code blocks so they line up in chat clients too
+func renderUsageReport(title string, usage usageSnapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	t := usage.Total
+	fmt.Fprintf(&b, "%d requests (%d failed, %d from the cache), %s input tokens, %s output tokens (~%s thinking), ~$%.2f\n",
+		t.Requests, t.Errors, t.CachedRequests, formatTokens(t.InputTokens+t.CacheCreationInputTokens+t.CacheReadInputTokens),
+		formatTokens(t.OutputTokens), formatTokens(t.ThinkingTokens), t.CostUSD)
+	writeUsageTable(&b, "Clients", "Client", usage.Clients)
+	writeUsageTable(&b, "Models", "Model", usage.Models)
+	return b.String()
+}
+
+// writeUsageTable writes a table of usage totals, the most expensive first
+func writeUsageTable(b *strings.Builder, heading, column string, rows map[string]usageTotals) {
+	names := make([]string, 0, len(rows))
+	for name := range rows {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(rows[b].CostUSD, rows[a].CostUSD), strings.Compare(a, b))
+	})
+
+	fmt.Fprintf(b, "\n## %s\n\n```\n", heading)
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tRequests\tFailed\tInput\tOutput\tThinking\tCost\n", column)
+	for _, name := range names {
+		t := rows[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t$%.2f\n", name, t.Requests, t.Errors,
+			formatTokens(t.InputTokens+t.CacheCreationInputTokens+t.CacheReadInputTokens),
+			formatTokens(t.OutputTokens), formatTokens(t.ThinkingTokens), t.CostUSD)
+	}
+	w.Flush()
+	b.WriteString("```\n")
+}
+
+// formatTokens shortens token counts to thousands and millions
+func formatTokens(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 10_000:
+		return fmt.Sprintf("%dk", n/1000)
+	}
+	return fmt.Sprint(n)
+}
+
+// webhookReport posts reports as Slack compatible messages, which most chat
+// tools accept in their incoming webhooks
+type webhookReport struct {
+	url string
+}
+
+// send posts a report
+func (t webhookReport) send(report string) error {
+	body, err := json.Marshal(map[string]string{"text": report})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: reportTimeout}
+	resp, err := client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// fileReport writes reports as Markdown files in a directory, named after the
+// time they were written
+type fileReport struct {
+	dir string
+}
+
+// send writes a report
+func (t fileReport) send(report string) error {
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(t.dir, "usage-"+time.Now().UTC().Format("2006-01-02T1504")+".md")
+	return os.WriteFile(path, []byte(report), 0o644)
+}
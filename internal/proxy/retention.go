@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PurgeEndpoint is the admin endpoint pruning the stored history on demand
+const PurgeEndpoint = "/purge"
+
+// pruneTimeout bounds a pruning run of the history store
+const pruneTimeout = 10 * time.Minute
+
+// retention prunes the history store and the thinking files in the background
+// once they hold data older than a maximum age or more than a maximum size,
+// deleting the oldest data first
+type retention struct {
+	maxAge   time.Duration
+	maxBytes int64
+	history  *historyUploader
+	files    []*fileSink
+
+	// mu serializes the runs of the pruner and the purge endpoint
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// pruneLimits are the limits a pruning run enforces, 0 leaving either unlimited
+type pruneLimits struct {
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+// pruneResult reports what a pruning run deleted and kept
+type pruneResult struct {
+	Deleted      int      `json:"deleted"`
+	DeletedBytes int64    `json:"deleted_bytes"`
+	Kept         int      `json:"kept"`
+	KeptBytes    int64    `json:"kept_bytes"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// newRetention starts pruning the history store and the file sinks every
+// interval, returning nil when there is nothing to prune
+func newRetention(maxAge time.Duration, maxBytes int64, interval time.Duration, history *historyUploader, sinks []ThinkingSink) (*retention, error) {
+	if maxAge < 0 || maxBytes < 0 {
+		return nil, errors.New("invalid retention: the maximum age and size can't be negative")
+	}
+	r := &retention{maxAge: maxAge, maxBytes: maxBytes, history: history}
+	for _, sink := range sinks {
+		if file, ok := sink.(*fileSink); ok {
+			r.files = append(r.files, file)
+		}
+	}
+	if r.history == nil && len(r.files) == 0 {
+		return nil, nil
+	}
+	if maxAge == 0 && maxBytes == 0 {
+		// Nothing is pruned in the background, but the purge endpoint works
+		return r, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid retention interval %s: must be positive", interval)
+	}
+
+	r.stop, r.done = make(chan struct{}), make(chan struct{})
+	go r.run(interval)
+	return r, nil
+}
+
+// run prunes at startup and then every interval until the pruner is closed
+func (r *retention) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result := r.prune(pruneLimits{maxAge: r.maxAge, maxBytes: r.maxBytes})
+		if result.Deleted > 0 || len(result.Errors) > 0 {
+			log.Printf("Pruned %d stored files (%s), keeping %d (%s), %d errors",
+				result.Deleted, describeSize(result.DeletedBytes), result.Kept, describeSize(result.KeptBytes), len(result.Errors))
+		}
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background pruning
+func (r *retention) Close() {
+	if r.stop != nil {
+		close(r.stop)
+		<-r.done
+	}
+}
+
+// prune deletes the data beyond the limits from the history store and from
+// each thinking file, each held to the limits on its own
+func (r *retention) prune(limits pruneLimits) pruneResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result pruneResult
+	now := time.Now()
+	if r.history != nil {
+		r.pruneHistory(limits, now, &result)
+	}
+	for _, file := range r.files {
+		file.prune(limits, now, &result)
+	}
+	return result
+}
+
+// pruneHistory deletes the oldest batches of the history store. Other objects
+// under its prefix, such as comparisons saved to the same place, are left
+// alone and don't count toward the limits.
+func (r *retention) pruneHistory(limits pruneLimits, now time.Time, result *pruneResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), pruneTimeout)
+	defer cancel()
+
+	store, prefix := r.history.store, r.history.prefix
+	listed, err := store.List(ctx, prefix)
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("listing %s: %v", store.Location(prefix), err))
+		return
+	}
+	var objects []storedObject
+	for _, object := range listed {
+		if historyBatchKey.MatchString(strings.TrimPrefix(object.Key, prefix)) {
+			objects = append(objects, object)
+		}
+	}
+	expired := expiredObjects(objects, 0, limits, now)
+	for i, object := range objects {
+		if i < expired {
+			err := store.Delete(ctx, object.Key)
+			if err == nil {
+				result.deleted(object)
+				continue
+			}
+			result.Errors = append(result.Errors, fmt.Sprintf("deleting %s: %v", store.Location(object.Key), err))
+		}
+		result.kept(object)
+	}
+}
+
+// prune deletes the oldest backups of the file. The file being written is
+// counted toward the size but never deleted.
+func (s *fileSink) prune(limits pruneLimits, now time.Time, result *pruneResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var backups []storedObject
+	for i := 1; i <= s.backups; i++ {
+		path := fmt.Sprintf("%s.%d", s.path, i)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, storedObject{Key: path, Size: info.Size(), Modified: info.ModTime()})
+	}
+	expired := expiredObjects(backups, s.size, limits, now)
+	for i, backup := range backups {
+		if i < expired {
+			err := os.Remove(backup.Key)
+			if err == nil {
+				result.deleted(backup)
+				continue
+			}
+			result.Errors = append(result.Errors, err.Error())
+		}
+		result.kept(backup)
+	}
+	result.kept(storedObject{Key: s.path, Size: s.size})
+}
+
+// deleted counts a deleted object
+func (result *pruneResult) deleted(object storedObject) {
+	result.Deleted++
+	result.DeletedBytes += object.Size
+}
+
+// kept counts an object left in place
+func (result *pruneResult) kept(object storedObject) {
+	result.Kept++
+	result.KeptBytes += object.Size
+}
+
+// expiredObjects sorts the objects from the oldest and returns how many of the
+// first ones to delete for the rest to be within the limits. inUse bytes that
+// can't be deleted are counted toward the maximum size.
+func expiredObjects(objects []storedObject, inUse int64, limits pruneLimits, now time.Time) int {
+	slices.SortStableFunc(objects, func(a, b storedObject) int { return a.Modified.Compare(b.Modified) })
+	total := inUse
+	for _, object := range objects {
+		total += object.Size
+	}
+
+	for i, object := range objects {
+		tooOld := limits.maxAge > 0 && now.Sub(object.Modified) > limits.maxAge
+		tooBig := limits.maxBytes > 0 && total > limits.maxBytes
+		if !tooOld && !tooBig {
+			return i
+		}
+		total -= object.Size
+	}
+	return len(objects)
+}
+
+// handlePurge prunes the stored history right away, with the configured
+// limits or the max_age and max_bytes of the query
+func (p *Proxy) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if p.retention == nil {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "Neither a history store nor a thinking file is configured")
+		return
+	}
+	limits := pruneLimits{maxAge: p.retention.maxAge, maxBytes: p.retention.maxBytes}
+	if value := r.URL.Query().Get("max_age"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil || age <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid max_age: expected a positive duration such as 720h")
+			return
+		}
+		limits.maxAge = age
+	}
+	if value := r.URL.Query().Get("max_bytes"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid max_bytes: expected a number of bytes")
+			return
+		}
+		// max_bytes=0 deletes everything that can be deleted
+		limits.maxBytes = max(size, 1)
+	}
+	if limits.maxAge == 0 && limits.maxBytes == 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "No retention is configured, set max_age or max_bytes")
+		return
+	}
+
+	result := p.retention.prune(limits)
+	log.Printf("History purged by %s: deleted %d files (%s)", clientID(r), result.Deleted, describeSize(result.DeletedBytes))
+	writeJSON(w, result)
+}
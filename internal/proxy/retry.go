@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// isRetryableStatus checks if an upstream status code is worth retrying
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, 529:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses the retry-after header, returning zero if absent or invalid
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+
+	return 0
+}
+
+// backoffDelay computes the delay before the given retry attempt using
+// exponential backoff with full jitter, honoring retry-after when present
+func (p *Proxy) backoffDelay(attempt int, resp *http.Response) time.Duration {
+	if delay := retryAfter(resp); delay > 0 {
+		return min(delay, p.cfg.RetryMaxDelay)
+	}
+
+	delay := p.cfg.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.cfg.RetryMaxDelay {
+		delay = p.cfg.RetryMaxDelay
+	}
+
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+// doWithRetry sends requests built by newRequest until one succeeds, returns a
+// non-retryable status, or the attempts are exhausted. Nothing has been written
+// to the client at this point, so retrying is always safe.
+func (p *Proxy) doWithRetry(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	attempts := max(p.cfg.MaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isRetryableStatus(resp.StatusCode) || attempt >= attempts {
+			return resp, nil
+		}
+
+		delay := p.backoffDelay(attempt, resp)
+		resp.Body.Close()
+		log.Printf("Upstream returned %d, retrying in %v (attempt %d/%d)", resp.StatusCode, delay, attempt+1, attempts)
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
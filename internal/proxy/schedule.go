@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchedulesEndpoint is the admin endpoint serving the schedules and which of
+// them are active
+const SchedulesEndpoint = "/schedules"
+
+// ScheduleRule overrides runtime settings while its cron expression matches,
+// e.g. lower thinking budgets and stricter rate limits during business hours
+type ScheduleRule struct {
+	// Name identifies the schedule in the logs
+	Name string `json:"name"`
+	// Cron is a five field expression, minute hour day-of-month month
+	// day-of-week, matched every minute
+	Cron string `json:"cron"`
+	// Timezone is the IANA time zone of the expression, the local one by default
+	Timezone string `json:"timezone,omitempty"`
+	// Settings hold the fields of the runtime configuration to override, as
+	// accepted by PUT /admin/config
+	Settings json.RawMessage `json:"settings"`
+}
+
+// schedule is a parsed ScheduleRule
+type schedule struct {
+	rule     ScheduleRule
+	cron     *cronExpr
+	location *time.Location
+}
+
+// parseSchedules checks the schedules, and that their settings apply to base
+func parseSchedules(rules []ScheduleRule, base RuntimeConfig) ([]schedule, error) {
+	schedules := make([]schedule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("schedule %d", i+1)
+		}
+		if slices.ContainsFunc(schedules, func(s schedule) bool { return s.rule.Name == rule.Name }) {
+			return nil, fmt.Errorf("schedules: duplicate name %q", rule.Name)
+		}
+		cron, err := parseCron(rule.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedules: %s: %w", rule.Name, err)
+		}
+		location := time.Local
+		if rule.Timezone != "" {
+			if location, err = time.LoadLocation(rule.Timezone); err != nil {
+				return nil, fmt.Errorf("schedules: %s: %w", rule.Name, err)
+			}
+		}
+		if len(rule.Settings) == 0 {
+			return nil, fmt.Errorf("schedules: %s: no settings", rule.Name)
+		}
+		overridden, err := base.overlay(rule.Settings)
+		if err == nil {
+			err = overridden.validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("schedules: %s: invalid settings: %w", rule.Name, err)
+		}
+		schedules = append(schedules, schedule{rule: rule, cron: cron, location: location})
+	}
+	return schedules, nil
+}
+
+// overlay returns the configuration with the fields present in settings
+// replaced. Maps replace the current ones as a whole.
+func (c RuntimeConfig) overlay(settings []byte) (RuntimeConfig, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(settings, &fields); err != nil {
+		return c, err
+	}
+	if _, ok := fields["thinking_budgets"]; ok {
+		c.ThinkingBudgets = nil
+	}
+	if _, ok := fields["model_aliases"]; ok {
+		c.ModelAliases = nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(settings))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// activeSchedules returns the names of the schedules matching a time
+func activeSchedules(schedules []schedule, now time.Time) []string {
+	var active []string
+	for _, s := range schedules {
+		if s.cron.matches(now.In(s.location)) {
+			active = append(active, s.rule.Name)
+		}
+	}
+	return active
+}
+
+// scheduledConfig returns the base configuration with the settings of the
+// active schedules applied in order, the later ones winning
+func (p *Proxy) scheduledConfig(active []string) RuntimeConfig {
+	c := p.baseConfig
+	for _, s := range p.schedules {
+		if !slices.Contains(active, s.rule.Name) {
+			continue
+		}
+		// The settings were checked against the base configuration, but a
+		// base changed at runtime can still conflict with them
+		next, err := c.overlay(s.rule.Settings)
+		if err == nil {
+			err = next.validate()
+		}
+		if err != nil {
+			log.Printf("Error applying schedule %s: %v", s.rule.Name, err)
+			continue
+		}
+		c = next
+	}
+	return c
+}
+
+// applySchedules switches the runtime configuration when the active schedules
+// changed since the last check. The config lock must be held.
+func (p *Proxy) applySchedules(now time.Time) {
+	active := activeSchedules(p.schedules, now)
+	if slices.Equal(active, p.activeSchedules) {
+		return
+	}
+	p.activeSchedules = active
+	p.applyRuntimeConfig(p.scheduledConfig(active))
+	if len(active) == 0 {
+		log.Printf("No schedule is active, back to the base runtime configuration")
+	} else {
+		log.Printf("Active schedules: %s", strings.Join(active, ", "))
+	}
+}
+
+// RunSchedules applies the schedules at the start of every minute
+func (p *Proxy) RunSchedules() {
+	if len(p.schedules) == 0 {
+		return
+	}
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		p.configMu.Lock()
+		p.applySchedules(time.Now())
+		p.configMu.Unlock()
+	}
+}
+
+// scheduleStatus describes a schedule for the schedules endpoint
+type scheduleStatus struct {
+	ScheduleRule
+	Active bool `json:"active"`
+}
+
+// handleSchedules serves the schedules, which of them are active and the base
+// configuration they apply to
+func (p *Proxy) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	statuses := make([]scheduleStatus, 0, len(p.schedules))
+	for _, s := range p.schedules {
+		statuses = append(statuses, scheduleStatus{ScheduleRule: s.rule, Active: slices.Contains(p.activeSchedules, s.rule.Name)})
+	}
+	writeJSON(w, struct {
+		Schedules []scheduleStatus `json:"schedules"`
+		Base      RuntimeConfig    `json:"base"`
+	}{statuses, p.baseConfig})
+}
+
+// cronExpr is a parsed five field cron expression, each field a bit set of
+// the values it matches
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+	// Day of month and day of week restricted, in which case a day matching
+	// either of them matches, as in cron
+	domRestricted, dowRestricted bool
+}
+
+// cronFields are the ranges of the fields of cron expressions. Day of week 7
+// is Sunday like 0.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCron parses a cron expression whose fields are *, values, ranges such
+// as 9-17, steps such as */15 or 1-5/2, and comma separated lists of them
+func parseCron(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, minute hour day-of-month month day-of-week", expr)
+	}
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s: %w", expr, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	// Sunday can be written 0 or 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	// Like cron, a day field starting with * such as */2 doesn't restrict the
+	// day, so it combines with the other day field with and rather than or
+	return &cronExpr{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domRestricted: !strings.HasPrefix(fields[2], "*"),
+		dowRestricted: !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField returns the bit set of the values a field matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, step, hasStep := strings.Cut(part, "/")
+		lo, hi := min, max
+		if values != "*" {
+			first, last, isRange := strings.Cut(values, "-")
+			var err error
+			if lo, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				// A start with a step runs to the end of the range
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		n := 1
+		if hasStep {
+			var err error
+			if n, err = strconv.Atoi(step); err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", step)
+			}
+		}
+		for v := lo; v <= hi; v += n {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the expression matches the minute of t
+func (c *cronExpr) matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// redactedValue replaces credentials in logs and stored requests
+const redactedValue = "[redacted]"
+
+// sensitiveHeaders hold credentials and are never logged or stored
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", proxyTokenHeader, "Cookie", "Set-Cookie", "X-Amz-Security-Token"}
+
+// sensitiveFields are the names of JSON fields holding credentials, compared
+// case insensitively
+var sensitiveFields = []string{"api_key", "x-api-key", "authorization", "password", "client_secret", "access_token", "refresh_token"}
+
+// sensitiveData masks credentials before anything is logged or stored: the
+// sensitive headers, the sensitive fields of JSON bodies, and credentials
+// found in text such as log lines and error messages
+type sensitiveData struct {
+	headers []string
+	fields  []string
+	text    []redactor
+}
+
+// newSensitiveData returns the masking of the default credentials and the
+// configured header and field names
+func newSensitiveData(extra []string) *sensitiveData {
+	s := &sensitiveData{headers: slices.Clone(sensitiveHeaders), fields: slices.Clone(sensitiveFields)}
+	for _, name := range extra {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		s.headers = append(s.headers, http.CanonicalHeaderKey(name))
+		s.fields = append(s.fields, strings.ToLower(name))
+	}
+
+	// Values following the sensitive names, including the whole "Bearer ..."
+	// of Authorization headers and the list form of logged http.Header maps
+	names := make([]string, 0, len(s.headers)+len(s.fields))
+	for _, name := range slices.Concat(s.headers, s.fields) {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	s.text = []redactor{
+		{
+			pattern:     regexp.MustCompile(`(?i)(\b(?:` + strings.Join(names, "|") + `)\b["']?\s*[:=]\s*\[?["']?)(?:Bearer\s+)?[^\s"',\]}]+`),
+			replacement: "${1}" + redactedValue,
+		},
+		{pattern: regexp.MustCompile(`(?i)\bBearer\s+[A-Za-z0-9._~+/=-]{8,}`), replacement: "Bearer " + redactedValue},
+		{pattern: regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]{8,}`), replacement: "sk-ant-" + redactedValue},
+		{pattern: regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), replacement: "${1}" + redactedValue + "@"},
+	}
+	return s
+}
+
+// Headers returns a copy of headers with the credentials replaced
+func (s *sensitiveData) Headers(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range s.headers {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, redactedValue)
+		}
+	}
+	return redacted
+}
+
+// Value returns a copy of a decoded JSON value with the sensitive fields
+// replaced at any depth
+func (s *sensitiveData) Value(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		redacted := make(map[string]any, len(value))
+		for key, field := range value {
+			if slices.Contains(s.fields, strings.ToLower(key)) {
+				redacted[key] = redactedValue
+			} else {
+				redacted[key] = s.Value(field)
+			}
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(value))
+		for i, item := range value {
+			redacted[i] = s.Value(item)
+		}
+		return redacted
+	}
+	return value
+}
+
+// JSON returns a JSON document with the sensitive fields replaced, or the
+// text with the credentials found in it replaced when it isn't JSON
+func (s *sensitiveData) JSON(data []byte) []byte {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []byte(s.Text(string(data)))
+	}
+	redacted, err := json.Marshal(s.Value(value))
+	if err != nil {
+		return []byte(s.Text(string(data)))
+	}
+	return redacted
+}
+
+// Text returns text with the credentials found in it replaced
+func (s *sensitiveData) Text(text string) string {
+	for _, r := range s.text {
+		text = r.pattern.ReplaceAllString(text, r.replacement)
+	}
+	return text
+}
+
+// LogWriter returns a writer masking the credentials of the log lines it
+// writes to w, to be set as the output of the standard logger
+func (p *Proxy) LogWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w, sensitive: p.sensitive}
+}
+
+// redactingWriter masks credentials in the log lines written through it. The
+// standard logger writes each line with a single call.
+type redactingWriter struct {
+	w         io.Writer
+	sensitive *sensitiveData
+}
+
+// Write writes the line with its credentials masked
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.sensitive.Text(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThinkingRecord is a completed thinking block sent to the thinking sinks, or
+// the summary of the thinking of a response
+type ThinkingRecord struct {
+	Time         time.Time `json:"time"`
+	Request      string    `json:"request"`
+	Conversation string    `json:"conversation,omitempty"`
+	Client       string    `json:"client"`
+	Model        string    `json:"model"`
+	Index        int       `json:"index"`
+	Thinking     string    `json:"thinking"`
+	// Part numbers the records of a block spilled to disk, which is sent in
+	// parts from 1 with Continued set on all but the last
+	Part      int  `json:"part,omitempty"`
+	Continued bool `json:"continued,omitempty"`
+	// Summary is set on the record summarizing all the thinking blocks of the
+	// request, which has an index of -1 and no thinking
+	Summary string `json:"summary,omitempty"`
+}
+
+// summaryIndex is the index of the records holding a thinking summary
+const summaryIndex = -1
+
+// ThinkingSink receives the thinking blocks of all responses. Write is called
+// from the streams, so slow sinks must queue records rather than block.
+type ThinkingSink interface {
+	Write(record ThinkingRecord) error
+	Close() error
+}
+
+// parseThinkingSinks creates the sinks from a comma separated list of specs:
+// "stdout", "file:<path>", "syslog[:<network>://<address>]" and "webhook:<url>".
+// File sinks encrypt their lines with enc when it is set.
+func parseThinkingSinks(specs string, enc *encryptor) ([]ThinkingSink, error) {
+	var sinks []ThinkingSink
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		kind, arg, _ := strings.Cut(spec, ":")
+		var (
+			sink ThinkingSink
+			err  error
+		)
+		switch kind {
+		case "stdout":
+			sink = stdoutSink{}
+		case "file":
+			sink, err = newFileSink(arg, fileSinkMaxBytes, fileSinkBackups, enc)
+		case "syslog":
+			sink, err = newSyslogSink(arg)
+		case "webhook":
+			sink, err = newWebhookSink(arg)
+		default:
+			err = errors.New("unknown sink type")
+		}
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, fmt.Errorf("thinking sink %q: %w", spec, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// activeThinkingSinks returns the sinks thinking goes to with the runtime
+// settings, none while thinking logging is off or live logging replaces the
+// stdout dump
+func (p *Proxy) activeThinkingSinks(settings *runtimeSettings) []ThinkingSink {
+	if !settings.logThinking || (settings.logThinkingLive && p.stdoutDump) {
+		return nil
+	}
+	return p.thinkingSinks
+}
+
+// emitThinking sends a thinking block to every sink
+func emitThinking(sinks []ThinkingSink, record ThinkingRecord) {
+	for _, sink := range sinks {
+		if err := sink.Write(record); err != nil {
+			log.Printf("Error writing thinking to sink: %v", err)
+		}
+	}
+}
+
+// stdoutSink logs thinking blocks to the console
+type stdoutSink struct{}
+
+// Write logs a thinking block or summary
+func (stdoutSink) Write(record ThinkingRecord) error {
+	if record.Summary != "" {
+		log.Printf("\n===== THINKING SUMMARY (%s) =====\n%s\n==========================\n", record.Request, record.Summary)
+		return nil
+	}
+	if record.Part > 0 {
+		log.Printf("\n===== THINKING CONTENT (%s, block %d, part %d) =====\n%s\n==========================\n",
+			record.Request, record.Index, record.Part, record.Thinking)
+		return nil
+	}
+	log.Printf("\n===== THINKING CONTENT (%s, block %d) =====\n%s\n==========================\n",
+		record.Request, record.Index, record.Thinking)
+	return nil
+}
+
+// Close does nothing
+func (stdoutSink) Close() error {
+	return nil
+}
+
+// Rotation settings of file sinks
+const (
+	fileSinkMaxBytes = 100 << 20
+	fileSinkBackups  = 5
+)
+
+// fileSink appends thinking blocks as JSON lines to a file, rotating it to
+// numbered backups once it grows past a size. With an encryptor each line is
+// encrypted on its own.
+type fileSink struct {
+	path      string
+	maxBytes  int64
+	backups   int
+	encryptor *encryptor
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// newFileSink opens a file sink appending to path
+func newFileSink(path string, maxBytes int64, backups int, enc *encryptor) (*fileSink, error) {
+	if path == "" {
+		return nil, errors.New("missing file path")
+	}
+	s := &fileSink{path: path, maxBytes: maxBytes, backups: backups, encryptor: enc}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the file for appending
+func (s *fileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the backups, moves the file to the first backup and reopens it
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	for i := s.backups - 1; i >= 1; i-- {
+		// Missing backups are expected until the file rotated enough times
+		_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.backups > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Write appends a thinking block
+func (s *fileSink) Write(record ThinkingRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if s.encryptor != nil {
+		line = s.encryptor.sealLine(line)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %w", s.path, err)
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the file
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Delivery settings of webhook sinks
+const (
+	webhookQueueSize = 1024
+	webhookTimeout   = 10 * time.Second
+)
+
+// webhookSink POSTs thinking blocks as JSON to a URL from a background queue,
+// dropping blocks when the endpoint can't keep up
+type webhookSink struct {
+	url    string
+	client *http.Client
+	queue  chan ThinkingRecord
+	done   chan struct{}
+}
+
+// newWebhookSink starts a webhook sink posting to rawURL
+func newWebhookSink(rawURL string) (*webhookSink, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+	}
+	s := &webhookSink{
+		url:    rawURL,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan ThinkingRecord, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// run delivers the queued blocks until the sink is closed
+func (s *webhookSink) run() {
+	defer close(s.done)
+	for record := range s.queue {
+		if err := s.post(record); err != nil {
+			log.Printf("Error posting thinking to webhook: %v", err)
+		}
+	}
+}
+
+// post sends a single block
+func (s *webhookSink) post(record ThinkingRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Write queues a thinking block for delivery
+func (s *webhookSink) Write(record ThinkingRecord) error {
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		return errors.New("webhook queue full, dropping thinking block")
+	}
+}
+
+// Close delivers the queued blocks and stops the sink
+func (s *webhookSink) Close() error {
+	close(s.queue)
+	<-s.done
+	return nil
+}
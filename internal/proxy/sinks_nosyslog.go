@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package proxy
+
+import "errors"
+
+// newSyslogSink fails as syslog isn't available on this platform
+func newSyslogSink(string) (ThinkingSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
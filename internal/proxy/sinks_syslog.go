@@ -0,0 +1,48 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogSink sends thinking blocks to syslog
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog daemon, or to a remote one given
+// as network://address
+func newSyslogSink(address string) (*syslogSink, error) {
+	var network, raddr string
+	if address != "" {
+		parsed, err := url.Parse(address)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q: must be network://host:port", address)
+		}
+		network, raddr = parsed.Scheme, parsed.Host
+	}
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_USER, "zedclaudeproxy")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+// Write sends a thinking block
+func (s *syslogSink) Write(record ThinkingRecord) error {
+	if record.Summary != "" {
+		return s.writer.Info(fmt.Sprintf("thinking summary (%s, model %s): %s", record.Request, record.Model, record.Summary))
+	}
+	if record.Part > 0 {
+		return s.writer.Info(fmt.Sprintf("thinking (%s, model %s, block %d, part %d): %s", record.Request, record.Model, record.Index, record.Part, record.Thinking))
+	}
+	return s.writer.Info(fmt.Sprintf("thinking (%s, model %s, block %d): %s", record.Request, record.Model, record.Index, record.Thinking))
+}
+
+// Close closes the connection to syslog
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
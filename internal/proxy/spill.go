@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MemoryEndpoint is the admin endpoint serving the thinking buffer metrics
+const MemoryEndpoint = "/memory"
+
+// memoryLimits caps the memory holding the thinking content of responses, both
+// per request and across all of them. Thinking beyond the caps is spilled to
+// temporary files, so a few giant reasoning traces can't run the proxy out of
+// memory.
+type memoryLimits struct {
+	perRequest int64
+	total      int64
+
+	mu    sync.Mutex
+	stats memoryStats
+}
+
+// memoryStats holds the thinking buffer metrics
+type memoryStats struct {
+	InMemory     int64 `json:"in_memory_bytes"`
+	PeakInMemory int64 `json:"peak_in_memory_bytes"`
+	OnDisk       int64 `json:"on_disk_bytes"`
+	PerRequest   int64 `json:"max_request_bytes"`
+	Total        int64 `json:"max_total_bytes"`
+
+	// Buffers spilled to disk, and the bytes written to them
+	Spilled      int64 `json:"spilled_total"`
+	SpilledBytes int64 `json:"spilled_bytes_total"`
+}
+
+// newMemoryLimits returns limits allowing perRequest bytes of thinking in
+// memory for each request and total bytes overall, 0 leaving either unlimited
+func newMemoryLimits(perRequest, total int64) *memoryLimits {
+	return &memoryLimits{perRequest: perRequest, total: total}
+}
+
+// reserve takes n bytes of memory for a request already holding held bytes,
+// reporting whether they fit within the caps
+func (l *memoryLimits) reserve(held, n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perRequest > 0 && held+n > l.perRequest {
+		return false
+	}
+	if l.total > 0 && l.stats.InMemory+n > l.total {
+		return false
+	}
+	l.stats.InMemory += n
+	l.stats.PeakInMemory = max(l.stats.PeakInMemory, l.stats.InMemory)
+	return true
+}
+
+// release gives back memory taken with reserve
+func (l *memoryLimits) release(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.InMemory -= n
+}
+
+// written accounts for bytes written to disk, spilled counting a new file
+func (l *memoryLimits) written(n int64, spilled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.OnDisk += n
+	l.stats.SpilledBytes += n
+	if spilled {
+		l.stats.Spilled++
+	}
+}
+
+// removed accounts for a spilled file being removed
+func (l *memoryLimits) removed(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.OnDisk -= n
+}
+
+// snapshot returns the current metrics
+func (l *memoryLimits) snapshot() memoryStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.PerRequest, stats.Total = l.perRequest, l.total
+	return stats
+}
+
+// memoryAccount holds the memory used by the buffers of a single request
+type memoryAccount struct {
+	limits *memoryLimits
+	label  string
+	held   int64
+}
+
+// newAccount returns an account for the buffers of a request
+func (l *memoryLimits) newAccount(label string) *memoryAccount {
+	return &memoryAccount{limits: l, label: label}
+}
+
+// spillBuffer accumulates text in memory while the account allows it and in a
+// temporary file after that. Without an account it stays in memory.
+type spillBuffer struct {
+	account *memoryAccount
+	memory  strings.Builder
+	file    *os.File
+	onDisk  int64
+}
+
+// WriteString appends text to the buffer, moving it to disk once it no longer
+// fits in memory. Text that can't be written to disk is dropped.
+func (b *spillBuffer) WriteString(s string) {
+	n := int64(len(s))
+	if b.file == nil {
+		if b.account == nil {
+			b.memory.WriteString(s)
+			return
+		}
+		if b.account.limits.reserve(b.account.held, n) {
+			b.account.held += n
+			b.memory.WriteString(s)
+			return
+		}
+		if !b.spill() {
+			return
+		}
+	}
+	if _, err := b.file.WriteString(s); err != nil {
+		log.Printf("Error writing spilled thinking (%s): %v", b.account.label, err)
+		return
+	}
+	b.onDisk += n
+	b.account.limits.written(n, false)
+}
+
+// spill moves the content of the buffer to a temporary file
+func (b *spillBuffer) spill() bool {
+	file, err := os.CreateTemp("", "zedclaudeproxy-thinking-*")
+	if err != nil {
+		log.Printf("Error spilling thinking to disk (%s): %v", b.account.label, err)
+		return false
+	}
+	held := int64(b.memory.Len())
+	if _, err := file.WriteString(b.memory.String()); err != nil {
+		log.Printf("Error spilling thinking to disk (%s): %v", b.account.label, err)
+		file.Close()
+		os.Remove(file.Name())
+		return false
+	}
+	log.Printf("Thinking of %s exceeds the memory limits, spilling it to %s", b.account.label, file.Name())
+	b.file, b.onDisk = file, held
+	b.memory.Reset()
+	b.account.held -= held
+	b.account.limits.release(held)
+	b.account.limits.written(held, true)
+	return true
+}
+
+// Len returns the length of the text written to the buffer
+func (b *spillBuffer) Len() int64 {
+	return int64(b.memory.Len()) + b.onDisk
+}
+
+// Spilled reports whether the buffer moved to disk, so its text is read back
+// in chunks rather than all at once
+func (b *spillBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// spillChunkSize is the most text of a spilled buffer read back at once
+const spillChunkSize = 64 << 10
+
+// reader returns a reader of the text written to the buffer, from disk when it
+// was spilled
+func (b *spillBuffer) reader() (io.ReadCloser, error) {
+	if b.file == nil {
+		return io.NopCloser(strings.NewReader(b.memory.String())), nil
+	}
+	return os.Open(b.file.Name())
+}
+
+// chunks passes the text of the buffer to fn in chunks of at most size bytes,
+// split between characters, last being set on the final one
+func (b *spillBuffer) chunks(size int, fn func(text string, last bool)) error {
+	rc, err := b.reader()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	total := b.Len()
+	r := io.LimitReader(rc, total)
+	buf := make([]byte, size)
+	var read int64
+	carry := 0
+	for {
+		n, err := io.ReadFull(r, buf[carry:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		read += int64(n)
+		n += carry
+		// A short read means the file holds less than was written
+		last := read >= total || err != nil
+		end := n
+		if !last {
+			end = completeRunes(buf[:n])
+		}
+		fn(string(buf[:end]), last)
+		if last {
+			return nil
+		}
+		carry = copy(buf, buf[end:n])
+	}
+}
+
+// completeRunes returns the length of the longest prefix of b that doesn't end
+// inside a UTF-8 character
+func completeRunes(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// String returns the text written to the buffer, reading it back from disk
+// when it was spilled
+func (b *spillBuffer) String() string {
+	if b.file == nil {
+		return b.memory.String()
+	}
+	data, err := os.ReadFile(b.file.Name())
+	if err != nil {
+		log.Printf("Error reading spilled thinking (%s): %v", b.account.label, err)
+	}
+	return string(data)
+}
+
+// Close frees the memory or the file holding the buffer
+func (b *spillBuffer) Close() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.account.limits.removed(b.onDisk)
+		b.file, b.onDisk = nil, 0
+	}
+	if held := int64(b.memory.Len()); held > 0 && b.account != nil {
+		b.account.held -= held
+		b.account.limits.release(held)
+	}
+	b.memory.Reset()
+}
+
+// handleMemory serves the thinking buffer metrics
+func (p *Proxy) handleMemory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.memory.snapshot())
+}
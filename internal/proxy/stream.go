@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// streamProcessor streams a single upstream response to the client. It owns all
+// the state of the response, so concurrent streams only share the proxy's
+// synchronized trackers. A processor is created for each response, run once
+// and then finished.
+type streamProcessor struct {
+	proxy *Proxy
+	w     http.ResponseWriter
+	r     *http.Request
+
+	// label identifies the request in the logs of concurrent streams
+	label string
+	usage *requestUsage
+	hooks []StreamHook
+
+	// Messages API request the response is for, nil for other requests
+	req *Request
+
+	// Subscriptions to the upstream events of the response
+	bus *eventBus
+	// Content blocks the client saw start but not stop
+	blocks openBlocks
+	// Phases and event counts of the response
+	timing *streamTiming
+	// Bytes written to the client, and whether it went away before the end
+	delivered    *deliveredWriter
+	disconnected bool
+	// When an event was last sent to the client, for the keep-alives
+	lastSent time.Time
+}
+
+// newStreamProcessor returns a processor for the response to r, running the
+// hooks the middlewares returned for req when it is set
+func (p *Proxy) newStreamProcessor(w http.ResponseWriter, r *http.Request, req *Request) *streamProcessor {
+	s := &streamProcessor{proxy: p, w: w, r: r, req: req, blocks: make(openBlocks)}
+	info := inFlightStream{Client: clientID(r), Path: r.URL.Path}
+	if req != nil {
+		s.label, s.usage, s.hooks = req.label, req.usage, req.hooks
+		s.timing = newStreamTiming(req.started)
+		info.ID, info.Conversation, info.Started = req.id, req.Conversation, req.started
+	} else {
+		info.ID, s.label = p.newRequestLabel()
+		s.usage = &requestUsage{}
+		s.timing = newStreamTiming(time.Now())
+		info.Started = s.timing.started
+	}
+	info.Label = s.label
+	s.bus = p.streams.open(info)
+	return s
+}
+
+// newRequestLabel returns the sequence number of a request and a label
+// identifying it in the logs
+func (p *Proxy) newRequestLabel() (uint64, string) {
+	id := p.requestSeq.Add(1)
+	return id, fmt.Sprintf("request %d", id)
+}
+
+// run streams the response body to the client, parsing it into events only
+// when there are hooks to run on them
+func (s *streamProcessor) run(resp *http.Response) {
+	resp.Body = s.timing.body(resp.Body)
+	s.delivered = &deliveredWriter{ResponseWriter: s.w}
+	s.w = s.delivered
+	// Log the events on both sides of the proxy when debugging
+	if s.proxy.eventLog != nil && isEventStream(resp) {
+		resp.Body, s.w = s.proxy.eventLog.tap(s.label, resp.Body, s.w)
+	}
+	if len(s.hooks) == 0 {
+		s.copyRaw(resp)
+		return
+	}
+	s.processEvents(resp)
+}
+
+// finish ends the subscriptions to the response, accounts for the tokens it
+// used, adds it to the history of its conversation, completes the hooks and
+// reports the timing of Messages API responses, once the response is complete
+func (s *streamProcessor) finish() {
+	s.proxy.streams.close(s.bus)
+	s.usage.Duration = time.Since(s.timing.started)
+	s.proxy.usage.record(clientID(s.r), s.usage)
+	s.proxy.spend.record(clientID(s.r), s.usage)
+	if s.req != nil && s.req.Conversation != "" && s.usage.Model != "" {
+		s.proxy.conversations.record(s.req.Conversation, conversationRequest{
+			Label:          s.label,
+			Time:           s.req.started,
+			DurationMS:     time.Since(s.req.started).Milliseconds(),
+			Client:         s.req.Client,
+			Model:          s.usage.Model,
+			StopReason:     s.usage.StopReason,
+			InputTokens:    s.usage.Usage.InputTokens,
+			OutputTokens:   s.usage.Usage.OutputTokens,
+			ThinkingTokens: s.usage.thinkingTokens(),
+			Cached:         s.usage.Cached,
+		}, s.usage)
+	}
+	for _, hook := range s.hooks {
+		hook.Done()
+	}
+	if s.req != nil && s.usage.Model != "" {
+		s.timing.report(s.label, s.usage)
+	}
+}
+
+// disconnect notes that the client went away, logging how much of the response
+// it received. Messages API responses are read to the end when finishing on
+// disconnect, so they are still accounted for and recorded in full.
+func (s *streamProcessor) disconnect() {
+	if s.disconnected {
+		return
+	}
+	s.disconnected = true
+	finishing := ""
+	if s.finishing() {
+		finishing = ", reading the rest of the response"
+	}
+	log.Printf("[%s] Client disconnected after receiving %d bytes in %d events%s",
+		s.label, s.delivered.written, s.timing.forwarded, finishing)
+}
+
+// finishing reports whether the response is read to the end after the client
+// went away
+func (s *streamProcessor) finishing() bool {
+	return s.req != nil && s.proxy.cfg.FinishOnDisconnect
+}
+
+// clientGone reports whether the client went away, noting it the first time
+func (s *streamProcessor) clientGone() bool {
+	if !s.disconnected && s.r.Context().Err() != nil {
+		s.disconnect()
+	}
+	return s.disconnected
+}
+
+// flush sends the data written so far to the client
+func (s *streamProcessor) flush() {
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// copyRaw streams the response as-is, observing usage on the way
+func (s *streamProcessor) copyRaw(resp *http.Response) {
+	buffer := make([]byte, 4096)
+	tap := &sseDataTap{usage: s.usage, blocks: s.blocks, timing: s.timing, bus: s.bus}
+	// The usage of Messages API responses that aren't streamed, and of batch
+	// results, is read from their body
+	var message *messageTap
+	if s.req != nil && !isEventStream(resp) {
+		message = &messageTap{}
+	}
+	var results *batchResultsTap
+	batchID := batchResultsID(s.r)
+	if batchID != "" {
+		results = &batchResultsTap{}
+	}
+	var readErr error
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			tap.write(buffer[:n])
+			if message != nil {
+				message.write(buffer[:n])
+			}
+			if results != nil {
+				results.write(buffer[:n])
+			}
+			if !s.clientGone() {
+				if _, err := s.w.Write(buffer[:n]); err != nil {
+					s.disconnect()
+				} else {
+					s.flush()
+				}
+			}
+			if s.disconnected && !s.finishing() {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && s.clientGone() {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading response: %v", err)
+			readErr = err
+			break
+		}
+	}
+
+	if readErr == nil && message != nil && !message.overflow {
+		s.usage.observeMessage(message.body.Bytes())
+	}
+	if readErr == nil && results != nil {
+		s.proxy.recordBatchResults(clientID(s.r), batchID, results.close())
+	}
+
+	// End a stream the upstream didn't complete
+	if isEventStream(resp) && !s.usage.Stopped && !s.disconnected {
+		// Terminate a partially forwarded event before adding ours
+		if tap.midEvent() {
+			fmt.Fprint(s.w, "\n\n")
+		}
+		s.finishInterrupted(readErr)
+	}
+}
+
+// finishInterrupted ends a stream the upstream didn't complete, completing the
+// message when truncated streams are repaired and otherwise with an error
+func (s *streamProcessor) finishInterrupted(err error) {
+	if s.proxy.cfg.RepairTruncated && repairTruncatedStream(s.w, s.usage, s.blocks) {
+		return
+	}
+	finishInterruptedStream(s.w, err, s.usage)
+}
+
+// processEvents parses the SSE stream and forwards the events the hooks keep
+func (s *streamProcessor) processEvents(resp *http.Response) {
+	reader := sse.NewReader(resp.Body)
+	s.lastSent = time.Now()
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			if !s.usage.Stopped && !s.disconnected {
+				s.finishInterrupted(nil)
+			}
+			return
+		}
+		var parseErr *sse.ParseError
+		if errors.As(err, &parseErr) {
+			log.Printf("Error parsing SSE: %v", err)
+			continue
+		}
+		if err != nil && s.clientGone() {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading SSE stream: %v", err)
+			if !s.usage.Stopped {
+				s.finishInterrupted(err)
+			}
+			return
+		}
+		s.usage.observeData(event.Data)
+		s.timing.observe(event.Data)
+		// Subscribers see the upstream events, before the hooks change them
+		s.bus.publish(event)
+
+		// Run the hooks in order, any of them can drop the event or insert others
+		events := s.runHooks(event, 0)
+		if !slices.Contains(events, event) {
+			s.timing.filtered++
+		}
+		// Keep reading without a client only to finish the response
+		if s.clientGone() {
+			if !s.finishing() {
+				return
+			}
+			continue
+		}
+		for _, event := range events {
+			if err := sse.Write(s.w, event); err != nil {
+				s.disconnect()
+				break
+			}
+			s.blocks.observe(event.Data)
+			s.timing.forwarded++
+			s.lastSent = time.Now()
+		}
+		if len(events) == 0 {
+			s.keepAlive()
+		}
+		if s.disconnected && !s.finishing() {
+			return
+		}
+		s.flush()
+	}
+}
+
+// keepAlive sends a ping event, or an SSE comment when configured, once the
+// hooks dropped every event for the keep-alive interval, so clients don't time
+// out while a long thinking block is filtered
+func (s *streamProcessor) keepAlive() {
+	interval := s.proxy.cfg.KeepAliveInterval
+	if interval <= 0 || time.Since(s.lastSent) < interval {
+		return
+	}
+	ping := &sse.Event{Event: "ping", Data: `{"type": "ping"}`}
+	if s.proxy.cfg.KeepAliveComment {
+		ping = &sse.Event{Comments: []string{"keepalive"}}
+	}
+	if err := sse.Write(s.w, ping); err != nil {
+		s.disconnect()
+		return
+	}
+	s.lastSent = time.Now()
+}
+
+// runHooks passes an event through the hooks from the given one on, returning
+// the events to forward: none when a hook drops it, and the events hooks
+// inserted before it
+func (s *streamProcessor) runHooks(event *sse.Event, from int) []*sse.Event {
+	var events []*sse.Event
+	for i := from; i < len(s.hooks); i++ {
+		if inserter, ok := s.hooks[i].(EventInserter); ok {
+			for _, inserted := range inserter.Insert(event) {
+				events = append(events, s.runHooks(inserted, i+1)...)
+			}
+		}
+		if !s.hooks[i].Event(event) {
+			return events
+		}
+	}
+	return append(events, event)
+}
+
+// deliveredWriter counts the bytes written to the client
+type deliveredWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+// Write writes to the client, counting the bytes written
+func (w *deliveredWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush sends the data written so far to the client
+func (w *deliveredWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
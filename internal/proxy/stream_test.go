@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// memorySink keeps the thinking records it receives
+type memorySink struct {
+	mu      sync.Mutex
+	records []ThinkingRecord
+}
+
+func (s *memorySink) Write(record ThinkingRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+// thinkingChunks is the number of thinking deltas of each streamed response
+const thinkingChunks = 20
+
+// expectedThinking and expectedText are what the upstream answers for a token
+func expectedThinking(token string) string {
+	var b strings.Builder
+	for i := range thinkingChunks {
+		fmt.Fprintf(&b, "%s thinks %d. ", token, i)
+	}
+	return b.String()
+}
+
+func expectedText(token string) string {
+	return "answer for " + token
+}
+
+// thinkingUpstream streams a thinking block and a text block built from the
+// token sent as the request's message, yielding between events so concurrent
+// streams interleave. The events are held back until gate is closed, when set.
+func thinkingUpstream(t *testing.T, gate <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model    string `json:"model"`
+			Stream   bool   `json:"stream"`
+			Thinking *struct {
+				Type string `json:"type"`
+			} `json:"thinking"`
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Messages) == 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !body.Stream || body.Thinking == nil || body.Thinking.Type != "enabled" || strings.Contains(body.Model, "-thinking") {
+			t.Errorf("request not rewritten for thinking: model %q, stream %v", body.Model, body.Stream)
+		}
+		token := body.Messages[0].Content
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		send := func(event string, data any) {
+			encoded, _ := json.Marshal(data)
+			sse.Write(w, &sse.Event{Event: event, Data: string(encoded)})
+			flusher.Flush()
+			time.Sleep(time.Millisecond)
+		}
+
+		if gate != nil {
+			flusher.Flush()
+			<-gate
+		}
+		send("message_start", map[string]any{"type": "message_start", "message": map[string]any{
+			"id": "msg_" + token, "type": "message", "role": "assistant", "model": body.Model, "content": []any{},
+			"usage": map[string]any{"input_tokens": 10, "output_tokens": 1},
+		}})
+		send("content_block_start", map[string]any{"type": "content_block_start", "index": 0,
+			"content_block": map[string]any{"type": "thinking", "thinking": ""}})
+		for i := range thinkingChunks {
+			send("content_block_delta", map[string]any{"type": "content_block_delta", "index": 0,
+				"delta": map[string]any{"type": "thinking_delta", "thinking": fmt.Sprintf("%s thinks %d. ", token, i)}})
+		}
+		send("content_block_delta", map[string]any{"type": "content_block_delta", "index": 0,
+			"delta": map[string]any{"type": "signature_delta", "signature": "sig"}})
+		send("content_block_stop", map[string]any{"type": "content_block_stop", "index": 0})
+		send("content_block_start", map[string]any{"type": "content_block_start", "index": 1,
+			"content_block": map[string]any{"type": "text", "text": ""}})
+		for _, word := range strings.SplitAfter(expectedText(token), " ") {
+			send("content_block_delta", map[string]any{"type": "content_block_delta", "index": 1,
+				"delta": map[string]any{"type": "text_delta", "text": word}})
+		}
+		send("content_block_stop", map[string]any{"type": "content_block_stop", "index": 1})
+		send("message_delta", map[string]any{"type": "message_delta",
+			"delta": map[string]any{"stop_reason": "end_turn"}, "usage": map[string]any{"output_tokens": 100}})
+		send("message_stop", map[string]any{"type": "message_stop"})
+	}))
+}
+
+// streamText sends a "-thinking" request for a token and returns the text of
+// its response, failing when the response still carries thinking
+func streamText(client *http.Client, url, token string) (string, error) {
+	body, _ := json.Marshal(map[string]any{
+		"model":      "claude-sonnet-4-5-thinking",
+		"max_tokens": 1024,
+		"stream":     true,
+		"messages":   []any{map[string]any{"role": "user", "content": token}},
+	})
+	resp, err := client.Post(url+MessagesEndpoint, "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("status %s: %s", resp.Status, data)
+	}
+
+	var text strings.Builder
+	reader := sse.NewReader(resp.Body)
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			return text.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		var data struct {
+			ContentBlock struct {
+				Type string `json:"type"`
+			} `json:"content_block"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+			return "", fmt.Errorf("event %q: %w", event.Data, err)
+		}
+		if isThinkingType(data.ContentBlock.Type) || data.Delta.Type == "thinking_delta" {
+			return "", fmt.Errorf("thinking reached the client: %s", event.Data)
+		}
+		if data.Delta.Type == "text_delta" {
+			text.WriteString(data.Delta.Text)
+		}
+	}
+}
+
+// TestConcurrentThinkingStreams runs many thinking streams at once, checking
+// that each client gets its own text without thinking, and that the thinking
+// sent to the sinks stays tied to the label of the request it came from
+func TestConcurrentThinkingStreams(t *testing.T) {
+	upstream := thinkingUpstream(t, nil)
+	defer upstream.Close()
+
+	p, err := New(Config{Target: upstream.URL, LogThinking: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	sink := &memorySink{}
+	p.thinkingSinks = []ThinkingSink{sink}
+
+	server := httptest.NewServer(p.TrustedHandler())
+	defer server.Close()
+
+	const streams = 64
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for i := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token := fmt.Sprintf("token-%d", i)
+			text, err := streamText(server.Client(), server.URL, token)
+			if err != nil {
+				errs <- fmt.Errorf("%s: %w", token, err)
+				return
+			}
+			if text != expectedText(token) {
+				errs <- fmt.Errorf("%s: got text %q, want %q", token, text, expectedText(token))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Each request's thinking must be the whole thinking of a single token,
+	// with every label and every token seen once
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.records) != streams {
+		t.Fatalf("got %d thinking records, want %d", len(sink.records), streams)
+	}
+	labels := make(map[string]string)
+	tokens := make(map[string]string)
+	for _, record := range sink.records {
+		token, _, _ := strings.Cut(record.Thinking, " ")
+		if record.Thinking != expectedThinking(token) {
+			t.Errorf("%s: thinking %q mixes streams", record.Request, record.Thinking)
+			continue
+		}
+		if previous, ok := labels[record.Request]; ok {
+			t.Errorf("%s: thinking of both %s and %s", record.Request, previous, token)
+		}
+		if previous, ok := tokens[token]; ok {
+			t.Errorf("%s: thinking under both %s and %s", token, previous, record.Request)
+		}
+		labels[record.Request], tokens[token] = token, record.Request
+	}
+}
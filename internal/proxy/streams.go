@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// RequestsEndpoint is the admin endpoint listing the in-flight responses, each
+// of which can be followed at RequestsEndpoint/{id}/stream
+const RequestsEndpoint = "/requests"
+
+// streamSubscriberBuffer is the number of events a slow subscriber can lag
+// behind before it misses events
+const streamSubscriberBuffer = 1024
+
+// inFlightStream describes a response being streamed, for the admin endpoints
+type inFlightStream struct {
+	ID           uint64    `json:"id"`
+	Label        string    `json:"label"`
+	Client       string    `json:"client"`
+	Conversation string    `json:"conversation,omitempty"`
+	Path         string    `json:"path"`
+	Started      time.Time `json:"started"`
+	Events       int64     `json:"events"`
+	Subscribers  int       `json:"subscribers"`
+}
+
+// eventBus passes the upstream events of a single response on to the
+// observers that subscribed to it, next to the client the response is for.
+// Slow subscribers miss events rather than holding up the response.
+type eventBus struct {
+	info   inFlightStream
+	events atomic.Int64
+
+	mu          sync.Mutex
+	subscribers map[chan *sse.Event]struct{}
+	count       atomic.Int32
+	closed      bool
+}
+
+// active reports whether anyone subscribed, so events are only built for
+// publishing when someone is watching
+func (b *eventBus) active() bool {
+	return b.count.Load() > 0
+}
+
+// subscribe returns a channel receiving the events published from now on,
+// closed when the response is complete, or nil once it is
+func (b *eventBus) subscribe() chan *sse.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	ch := make(chan *sse.Event, streamSubscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	b.count.Add(1)
+	return ch
+}
+
+// unsubscribe stops publishing to a channel
+func (b *eventBus) unsubscribe(ch chan *sse.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		b.count.Add(-1)
+	}
+}
+
+// publish passes a copy of an event to every subscriber with room for it, so
+// the hooks can go on changing the event while subscribers write it
+func (b *eventBus) publish(event *sse.Event) {
+	b.events.Add(1)
+	if !b.active() {
+		return
+	}
+	published := *event
+	published.Comments = slices.Clone(event.Comments)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- &published:
+		default:
+		}
+	}
+}
+
+// publishData publishes the data of an event of a stream that isn't parsed,
+// naming the event after its type as the API does
+func (b *eventBus) publishData(data string) {
+	if !b.active() {
+		b.events.Add(1)
+		return
+	}
+	var event struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal([]byte(data), &event)
+	b.publish(&sse.Event{Event: event.Type, Data: data})
+}
+
+// describe returns the description of the response with its current counts
+func (b *eventBus) describe() inFlightStream {
+	info := b.info
+	info.Events = b.events.Load()
+	info.Subscribers = int(b.count.Load())
+	return info
+}
+
+// close ends the subscriptions, once the response is complete
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, ch)
+	}
+	b.count.Store(0)
+}
+
+// streamRegistry holds the event buses of the in-flight responses
+type streamRegistry struct {
+	mu    sync.Mutex
+	buses map[uint64]*eventBus
+}
+
+// newStreamRegistry returns a registry without responses
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{buses: make(map[uint64]*eventBus)}
+}
+
+// open returns the bus of a response starting to stream
+func (s *streamRegistry) open(info inFlightStream) *eventBus {
+	bus := &eventBus{info: info, subscribers: make(map[chan *sse.Event]struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buses[info.ID] = bus
+	return bus
+}
+
+// close ends the subscriptions to a response and forgets it
+func (s *streamRegistry) close(bus *eventBus) {
+	s.mu.Lock()
+	delete(s.buses, bus.info.ID)
+	s.mu.Unlock()
+	bus.close()
+}
+
+// get returns the bus of an in-flight response
+func (s *streamRegistry) get(id uint64) (*eventBus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bus, ok := s.buses[id]
+	return bus, ok
+}
+
+// list describes the in-flight responses, oldest first
+func (s *streamRegistry) list() []inFlightStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]inFlightStream, 0, len(s.buses))
+	for _, bus := range s.buses {
+		list = append(list, bus.describe())
+	}
+	slices.SortFunc(list, func(a, b inFlightStream) int {
+		return a.Started.Compare(b.Started)
+	})
+	return list
+}
+
+// handleRequests serves the list of in-flight responses
+func (p *Proxy) handleRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.streams.list())
+}
+
+// handleRequestStream streams the upstream events of an in-flight response,
+// thinking included, as server-sent events until the response is complete or
+// the client disconnects. The first event describes the request.
+func (p *Proxy) handleRequestStream(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	bus, ok := p.streams.get(id)
+	if err != nil || !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "No in-flight response with this id")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := bus.subscribe()
+	if ch == nil {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "The response is already complete")
+		return
+	}
+	defer bus.unsubscribe(ch)
+	log.Printf("Subscriber from %s following %s", r.RemoteAddr, bus.info.Label)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := sse.WriteJSON(w, "request", bus.describe()); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case event, open := <-ch:
+			if !open {
+				return
+			}
+			err = sse.Write(w, event)
+		case <-keepAlive.C:
+			err = sse.Write(w, &sse.Event{Comments: []string{"keep-alive"}})
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
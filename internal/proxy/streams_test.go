@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// TestRequestStreamSubscriber follows a response while the filter removes its
+// thinking and renumbers the blocks left, checking that the subscriber gets
+// the upstream events as they were sent. Run with -race, the hooks changing
+// the events must not race with the subscriber writing them.
+func TestRequestStreamSubscriber(t *testing.T) {
+	gate := make(chan struct{})
+	upstream := thinkingUpstream(t, gate)
+	defer upstream.Close()
+
+	p, err := New(Config{Target: upstream.URL, LogThinking: true, RemapIndices: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.thinkingSinks = []ThinkingSink{&memorySink{}}
+
+	server := httptest.NewServer(p.TrustedHandler())
+	defer server.Close()
+	admin := http.NewServeMux()
+	admin.HandleFunc("GET "+RequestsEndpoint+"/{id}/stream", p.handleRequestStream)
+	adminServer := httptest.NewServer(admin)
+	defer adminServer.Close()
+
+	type result struct {
+		text string
+		err  error
+	}
+	client := make(chan result, 1)
+	go func() {
+		text, err := streamText(server.Client(), server.URL, "token")
+		client <- result{text, err}
+	}()
+
+	// The upstream holds its events back until the subscriber is attached
+	var streams []inFlightStream
+	for deadline := time.Now().Add(5 * time.Second); len(streams) == 0; {
+		if time.Now().After(deadline) {
+			close(gate)
+			t.Fatal("the response never showed up in flight")
+		}
+		time.Sleep(time.Millisecond)
+		streams = p.streams.list()
+	}
+	resp, err := adminServer.Client().Get(fmt.Sprintf("%s%s/%d/stream", adminServer.URL, RequestsEndpoint, streams[0].ID))
+	if err != nil {
+		close(gate)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := sse.NewReader(resp.Body)
+	if event, err := reader.Next(); err != nil || event.Event != "request" {
+		close(gate)
+		t.Fatalf("got %v, %v, want the request event first", event, err)
+	}
+	close(gate)
+
+	var thinking, text strings.Builder
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data struct {
+			Index int `json:"index"`
+			Delta struct {
+				Type     string `json:"type"`
+				Thinking string `json:"thinking"`
+				Text     string `json:"text"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+			t.Fatalf("event %q: %v", event.Data, err)
+		}
+		switch data.Delta.Type {
+		case "thinking_delta":
+			thinking.WriteString(data.Delta.Thinking)
+		case "text_delta":
+			if data.Index != 1 {
+				t.Errorf("subscriber got text at index %d, want the upstream's 1", data.Index)
+			}
+			text.WriteString(data.Delta.Text)
+		}
+	}
+	if thinking.String() != expectedThinking("token") || text.String() != expectedText("token") {
+		t.Errorf("subscriber got thinking %q and text %q", thinking.String(), text.String())
+	}
+
+	if r := <-client; r.err != nil || r.text != expectedText("token") {
+		t.Errorf("client got %q, %v", r.text, r.err)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// summaryPrompt asks the summary model for a short digest of the thinking content
+const summaryPrompt = "Summarize the following reasoning of an AI assistant in 2-3 sentences. " +
+	"Focus on the approach taken and the conclusion reached. Reply with the summary only.\n\n<reasoning>\n%s\n</reasoning>"
+
+// summaryMaxTokens bounds the length of a thinking summary
+const summaryMaxTokens = 300
+
+// summaryMaxThinking bounds the thinking sent to the summary model, well within
+// its context window
+const summaryMaxThinking = 400 << 10
+
+// summarizeThinking asks the summary model for a digest of the thinking content
+// of a response and sends it to the thinking sinks, next to the thinking blocks
+// of the same request, or logs it when thinking isn't sent to them. The request
+// reuses the credentials of the original request, as the proxy has none of its
+// own.
+func (p *Proxy) summarizeThinking(header http.Header, record ThinkingRecord, thinking string) {
+	summary, err := p.requestSummary(header, record.Client, thinking)
+	if err != nil {
+		log.Printf("Error summarizing thinking: %v", err)
+		return
+	}
+	sinks := p.activeThinkingSinks(p.settings())
+	if len(sinks) == 0 {
+		log.Printf("\n===== THINKING SUMMARY (%s) =====\n%s\n==========================\n", record.Request, summary)
+		return
+	}
+	record.Time, record.Index, record.Summary = time.Now(), summaryIndex, summary
+	emitThinking(sinks, record)
+}
+
+// requestSummary sends the thinking content to the summary model and returns its reply
+func (p *Proxy) requestSummary(header http.Header, client, thinking string) (string, error) {
+	bodyBytes, err := json.Marshal(map[string]any{
+		"model":      p.cfg.SummaryModel,
+		"max_tokens": summaryMaxTokens,
+		"messages": []map[string]any{
+			{"role": "user", "content": fmt.Sprintf(summaryPrompt, thinking)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	r, err := http.NewRequest(http.MethodPost, MessagesEndpoint, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return "", err
+	}
+	r.Header = header
+	r.Header.Del("anthropic-beta")
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.sendOrReplay(r, bodyBytes)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("summary model returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var message struct {
+		Model   string `json:"model"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage tokenUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return "", fmt.Errorf("parsing summary response: %w", err)
+	}
+
+	// The summary is billed like any other request
+	usage := &requestUsage{Model: message.Model, Usage: message.Usage, Stopped: true}
+	p.usage.record(client, usage)
+	p.spend.record(client, usage)
+
+	var summary strings.Builder
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			summary.WriteString(block.Text)
+		}
+	}
+	return strings.TrimSpace(summary.String()), nil
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// ThinkingStreamEndpoint is the admin endpoint streaming the thinking of all
+// in-flight requests as it is generated
+const ThinkingStreamEndpoint = "/thinking/stream"
+
+// tailKeepAlive is the interval between comments keeping idle tails open
+const tailKeepAlive = 15 * time.Second
+
+// thinkingDelta is a piece of thinking content broadcast to tails
+type thinkingDelta struct {
+	Request  string `json:"request"`
+	Model    string `json:"model"`
+	Index    int    `json:"index"`
+	Thinking string `json:"thinking"`
+}
+
+// thinkingTail broadcasts thinking deltas to the connected tails. Slow tails
+// miss deltas rather than holding up the responses.
+type thinkingTail struct {
+	mu          sync.Mutex
+	subscribers map[chan thinkingDelta]struct{}
+	count       atomic.Int32
+}
+
+// newThinkingTail returns a broadcaster without tails
+func newThinkingTail() *thinkingTail {
+	return &thinkingTail{subscribers: make(map[chan thinkingDelta]struct{})}
+}
+
+// active reports whether any tail is connected, so responses only extract
+// deltas when someone is watching
+func (t *thinkingTail) active() bool {
+	return t.count.Load() > 0
+}
+
+// subscribe returns a channel receiving the broadcast deltas
+func (t *thinkingTail) subscribe() chan thinkingDelta {
+	ch := make(chan thinkingDelta, 256)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subscribers[ch] = struct{}{}
+	t.count.Add(1)
+	return ch
+}
+
+// unsubscribe stops broadcasting to a channel
+func (t *thinkingTail) unsubscribe(ch chan thinkingDelta) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subscribers, ch)
+	t.count.Add(-1)
+}
+
+// publish broadcasts a delta to every tail with room for it
+func (t *thinkingTail) publish(delta thinkingDelta) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.subscribers {
+		select {
+		case ch <- delta:
+		default:
+		}
+	}
+}
+
+// publishEvent broadcasts the thinking in an event of a request's response
+func (t *thinkingTail) publishEvent(label, model string, event *sse.Event) {
+	if !t.active() || !isContentBlockDelta(event) {
+		return
+	}
+	thinking, err := extractThinkingDelta(event)
+	if err != nil || thinking == "" {
+		return
+	}
+	index, _ := getContentBlockIndex(event)
+	t.publish(thinkingDelta{Request: label, Model: model, Index: index, Thinking: thinking})
+}
+
+// handleThinkingStream streams the thinking deltas of all in-flight requests
+// as server-sent events until the client disconnects
+func (p *Proxy) handleThinkingStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := p.thinkingTail.subscribe()
+	defer p.thinkingTail.unsubscribe(ch)
+	log.Printf("Thinking tail connected from %s", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case delta := <-ch:
+			err = sse.WriteJSON(w, "thinking_delta", delta)
+		case <-keepAlive.C:
+			err = sse.Write(w, &sse.Event{Comments: []string{"keep-alive"}})
+		case <-r.Context().Done():
+			log.Printf("Thinking tail from %s disconnected", r.RemoteAddr)
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// AdminHandler returns the HTTP handler of the admin endpoints, to be served
+// on a separate, private listener
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ThinkingStreamEndpoint, p.handleThinkingStream)
+	mux.HandleFunc("GET "+ConversationsEndpoint, p.handleConversations)
+	mux.HandleFunc("GET "+ConversationsEndpoint+"/{id}", p.handleConversation)
+	mux.HandleFunc("GET "+QueueEndpoint, p.handleQueue)
+	mux.HandleFunc("GET "+MemoryEndpoint, p.handleMemory)
+	mux.HandleFunc("POST "+PurgeEndpoint, p.handlePurge)
+	mux.HandleFunc("GET "+RateLimitsEndpoint, p.handleRateLimits)
+	mux.HandleFunc("GET "+RequestsEndpoint, p.handleRequests)
+	mux.HandleFunc("GET "+RequestsEndpoint+"/{id}/stream", p.handleRequestStream)
+	mux.HandleFunc("GET "+AdminConfigEndpoint, p.handleGetConfig)
+	mux.HandleFunc("PUT "+AdminConfigEndpoint, p.handlePutConfig)
+	mux.HandleFunc("GET "+SchedulesEndpoint, p.handleSchedules)
+	return p.requireAdminToken(mux)
+}
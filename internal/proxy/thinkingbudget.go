@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// thinkingExhaustedRatio is the share of the budget the estimated thinking
+// tokens must reach for the budget to count as used up, leaving room for the
+// error of estimating tokens from the thinking text
+const thinkingExhaustedRatio = 0.95
+
+// thinkingBudgetMonitor is the built-in middleware warning when the thinking
+// of a streamed response used up its budget, so its reasoning was likely cut
+// short and the budget should be raised
+type thinkingBudgetMonitor struct {
+	proxy *Proxy
+}
+
+// Request returns a hook comparing the thinking of the response to the budget
+// of the request, once the thinking rewrite set it
+func (m thinkingBudgetMonitor) Request(req *Request) (StreamHook, error) {
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		return nil, nil
+	}
+	budget := thinkingBudget(req.Body)
+	if budget <= 0 {
+		return nil, nil
+	}
+	return &thinkingBudgetHook{proxy: m.proxy, req: req, budget: budget}, nil
+}
+
+// thinkingBudgetHook checks the thinking of a single response against its budget
+type thinkingBudgetHook struct {
+	proxy  *Proxy
+	req    *Request
+	budget int
+}
+
+// Insert warns before message_stop when the thinking used up its budget,
+// adding an SSE comment to the response when configured to. The usage of the
+// request is updated before the hooks run, so thinking filtered by earlier
+// hooks is accounted for.
+func (h *thinkingBudgetHook) Insert(event *sse.Event) []*sse.Event {
+	if event.Event != "message_stop" {
+		return nil
+	}
+	used := h.req.usage.thinkingTokens()
+	if float64(used) < thinkingExhaustedRatio*float64(h.budget) {
+		return nil
+	}
+
+	warning := fmt.Sprintf("thinking used ~%d of its %d token budget, the reasoning was likely truncated: consider raising the budget", used, h.budget)
+	log.Printf("[%s] Warning: %s", h.req.label, warning)
+	if !h.proxy.cfg.WarnThinkingExhausted {
+		return nil
+	}
+	return []*sse.Event{{Comments: []string{"warning: " + warning}}}
+}
+
+// Event forwards every event
+func (h *thinkingBudgetHook) Event(event *sse.Event) bool {
+	return true
+}
+
+// Done does nothing
+func (h *thinkingBudgetHook) Done() {}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"zedclaudeproxy/internal/rewrite"
+)
+
+// Headers letting clients override the thinking decision of a single request.
+// They are removed before the request is forwarded.
+const (
+	// ThinkingHeader turns thinking on or off regardless of the model name
+	ThinkingHeader = "X-Thinking"
+	// ThinkingBudgetHeader enables thinking with the given budget
+	ThinkingBudgetHeader = "X-Thinking-Budget"
+)
+
+// thinkingOverride applies the thinking headers of a request to its model: a
+// request turning thinking on is handled as the "-thinking" alias of its model,
+// and one turning it off as the model without the suffix. It returns the model
+// to handle the request as, the budget override or 0, and whether the body changed.
+func thinkingOverride(header http.Header, bodyJSON map[string]any) (string, int, bool, error) {
+	model, _ := bodyJSON["model"].(string)
+	toggle := strings.ToLower(strings.TrimSpace(header.Get(ThinkingHeader)))
+	budgetValue := strings.TrimSpace(header.Get(ThinkingBudgetHeader))
+	header.Del(ThinkingHeader)
+	header.Del(ThinkingBudgetHeader)
+	if model == "" || toggle == "" && budgetValue == "" {
+		return model, 0, false, nil
+	}
+
+	var enable bool
+	switch toggle {
+	case "", "on", "true", "1", "enabled":
+		enable = true
+	case "off", "false", "0", "disabled":
+		if budgetValue != "" {
+			return "", 0, false, fmt.Errorf("%s: off conflicts with %s", ThinkingHeader, ThinkingBudgetHeader)
+		}
+	default:
+		return "", 0, false, fmt.Errorf("invalid %s header %q: must be on or off", ThinkingHeader, toggle)
+	}
+
+	budget := 0
+	if budgetValue != "" {
+		var err error
+		if budget, err = strconv.Atoi(budgetValue); err != nil || budget < rewrite.MinThinkingBudget {
+			return "", 0, false, fmt.Errorf("invalid %s header %q: must be an integer of at least %d",
+				ThinkingBudgetHeader, budgetValue, rewrite.MinThinkingBudget)
+		}
+	}
+
+	// Handle the request as the alias matching the decision
+	base := rewrite.ModifyModelName(model)
+	if !enable {
+		log.Printf("Thinking turned off by the %s header", ThinkingHeader)
+		bodyJSON["model"] = base
+		return base, 0, base != model, nil
+	}
+	log.Printf("Thinking turned on by the thinking headers (budget %s)", cmp.Or(budgetValue, "default"))
+	thinkingModel := model
+	if !rewrite.HasThinkingSuffix(model) {
+		thinkingModel = base + rewrite.ThinkingSuffix
+	}
+	bodyJSON["model"] = thinkingModel
+	return thinkingModel, budget, thinkingModel != model, nil
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// streamTiming measures the phases of a streamed response and counts its
+// events, to report how much latency thinking adds
+type streamTiming struct {
+	started   time.Time
+	firstByte time.Time
+
+	// When the first block of a phase started and its last block stopped.
+	// Text covers every block that isn't thinking, tool calls included.
+	thinkingStart, thinkingEnd time.Time
+	textStart, textEnd         time.Time
+
+	// Events read from the upstream, written to the client, and read but
+	// dropped by the hooks
+	received, forwarded, filtered int
+
+	// Type of the open content blocks by index
+	blocks map[int]string
+}
+
+// newStreamTiming returns the timing of a response to a request received at started
+func newStreamTiming(started time.Time) *streamTiming {
+	return &streamTiming{started: started, blocks: make(map[int]string)}
+}
+
+// observe accounts for the data of an event read from the upstream
+func (t *streamTiming) observe(data string) {
+	t.received++
+	var event struct {
+		Type         string `json:"type"`
+		Index        int    `json:"index"`
+		ContentBlock struct {
+			Type string `json:"type"`
+		} `json:"content_block"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return
+	}
+
+	now := time.Now()
+	switch event.Type {
+	case "content_block_start":
+		t.blocks[event.Index] = event.ContentBlock.Type
+		if isThinkingType(event.ContentBlock.Type) {
+			if t.thinkingStart.IsZero() {
+				t.thinkingStart = now
+			}
+		} else if t.textStart.IsZero() {
+			t.textStart = now
+		}
+	case "content_block_stop":
+		if isThinkingType(t.blocks[event.Index]) {
+			t.thinkingEnd = now
+		} else {
+			t.textEnd = now
+		}
+		delete(t.blocks, event.Index)
+	}
+}
+
+// isThinkingType checks if a content block type holds thinking
+func isThinkingType(blockType string) bool {
+	return blockType == "thinking" || blockType == "redacted_thinking"
+}
+
+// body returns the response body, noting when its first byte arrives
+func (t *streamTiming) body(body io.ReadCloser) io.ReadCloser {
+	return &firstByteBody{ReadCloser: body, timing: t}
+}
+
+// firstByteBody records when the first byte of a body is read
+type firstByteBody struct {
+	io.ReadCloser
+	timing *streamTiming
+}
+
+// Read reads from the body, noting the time of the first byte
+func (b *firstByteBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timing.firstByte.IsZero() {
+		b.timing.firstByte = time.Now()
+	}
+	return n, err
+}
+
+// report logs the timing of the response as key=value pairs
+func (t *streamTiming) report(label string, usage *requestUsage) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] Timing: model=%s", label, usage.Model)
+	phase := func(name string, start, end time.Time) {
+		if !start.IsZero() && !end.IsZero() {
+			fmt.Fprintf(&b, " %s=%s", name, end.Sub(start).Round(time.Millisecond))
+		}
+	}
+	phase("ttfb", t.started, t.firstByte)
+	phase("thinking", t.thinkingStart, t.thinkingEnd)
+	phase("text", t.textStart, t.textEnd)
+	fmt.Fprintf(&b, " total=%s", time.Since(t.started).Round(time.Millisecond))
+	fmt.Fprintf(&b, " input_tokens=%d output_tokens=%d thinking_tokens=%d",
+		usage.Usage.InputTokens+usage.Usage.CacheCreationInputTokens+usage.Usage.CacheReadInputTokens,
+		usage.Usage.OutputTokens, usage.thinkingTokens())
+	if usage.StopReason != "" {
+		fmt.Fprintf(&b, " stop_reason=%s", usage.StopReason)
+	}
+	fmt.Fprintf(&b, " events_received=%d events_forwarded=%d events_filtered=%d", t.received, t.forwarded, t.filtered)
+	log.Print(b.String())
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+// TLSConfig holds the TLS settings of the listener
+type TLSConfig struct {
+	// CertFile and KeyFile hold the certificate to serve
+	CertFile string
+	KeyFile  string
+	// SelfSigned serves a generated self-signed certificate
+	SelfSigned bool
+	// SelfSignedOut is a file to write the generated certificate to so clients can trust it
+	SelfSignedOut string
+}
+
+// ListenerTLSConfig returns the TLS configuration for the listeners on the
+// given addresses, or nil to serve plain HTTP
+func ListenerTLSConfig(cfg TLSConfig, listenAddresses []string) (*tls.Config, error) {
+	switch {
+	case cfg.CertFile != "" || cfg.KeyFile != "":
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS key pair: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+
+	case cfg.SelfSigned:
+		cert, err := generateSelfSignedCert(listenAddresses, cfg.SelfSignedOut)
+		if err != nil {
+			return nil, fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	return nil, nil
+}
+
+// generateSelfSignedCert creates a certificate valid for the listen hosts plus localhost
+func generateSelfSignedCert(listenAddresses []string, outFile string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "zedclaudeproxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	// Include the hosts we are listening on
+	for _, listenAddress := range listenAddresses {
+		host, _, err := net.SplitHostPort(listenAddress)
+		if err != nil || host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else if !slices.Contains(template.DNSNames, host) {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	log.Printf("Generated self-signed certificate, SHA-256 fingerprint: %X", fingerprint)
+
+	if outFile != "" {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err := os.WriteFile(outFile, certPEM, 0o644); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Printf("Wrote self-signed certificate to %s", outFile)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// upstreamTLSConfig returns the TLS configuration for upstream connections,
+// trusting the system roots plus the certificates in caFile, which may be
+// empty. insecure disables certificate verification altogether.
+func upstreamTLSConfig(caFile string, insecure bool, minVersion string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	switch minVersion {
+	case "", "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid minimum TLS version %q: must be 1.2 or 1.3", minVersion)
+	}
+
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream CA bundle: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			log.Printf("Error loading system certificates, trusting only %s: %v", caFile, err)
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in upstream CA bundle %s", caFile)
+		}
+		config.RootCAs = roots
+	}
+
+	if insecure {
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
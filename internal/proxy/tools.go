@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// maxLoggedToolInput is the length tool inputs are truncated to in the console log
+const maxLoggedToolInput = 1000
+
+// ToolCall is a tool call emitted by the model
+type ToolCall struct {
+	Time         time.Time       `json:"time"`
+	Request      string          `json:"request"`
+	Conversation string          `json:"conversation,omitempty"`
+	Client       string          `json:"client"`
+	Model        string          `json:"model"`
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Type         string          `json:"type"`
+	Input        json.RawMessage `json:"input"`
+}
+
+// toolCallLog appends a JSON line per tool call to a file
+type toolCallLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openToolCallLog opens the tool call log file for appending
+func openToolCallLog(path string) (*toolCallLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &toolCallLog{file: file}, nil
+}
+
+// write appends a tool call to the log
+func (l *toolCallLog) write(call *ToolCall) {
+	line, err := json.Marshal(call)
+	if err != nil {
+		log.Printf("Error encoding tool call: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing tool call log: %v", err)
+	}
+}
+
+// toolCallLogger is the built-in middleware logging the tool calls of streamed
+// responses with their complete input
+type toolCallLogger struct {
+	proxy *Proxy
+}
+
+// Request returns a hook collecting the tool calls of the response when they
+// are logged. Only streamed responses are parsed into events.
+func (m toolCallLogger) Request(req *Request) (StreamHook, error) {
+	if !m.proxy.settings().logToolCalls && m.proxy.toolCallLog == nil {
+		return nil, nil
+	}
+	if stream, _ := req.Body["stream"].(bool); !stream {
+		return nil, nil
+	}
+	return &toolCallHook{proxy: m.proxy, req: req, calls: make(map[int]*toolCallBuilder)}, nil
+}
+
+// toolCallBuilder accumulates a tool call from its content block events
+type toolCallBuilder struct {
+	id, name, blockType string
+	input               strings.Builder
+}
+
+// toolCallHook collects the tool calls of a single response
+type toolCallHook struct {
+	proxy *Proxy
+	req   *Request
+	calls map[int]*toolCallBuilder
+	model string
+}
+
+// Event accumulates the input of tool_use blocks, logging each call once its
+// block stops. Events are never modified.
+func (h *toolCallHook) Event(event *sse.Event) bool {
+	var data struct {
+		Type    string `json:"type"`
+		Index   int    `json:"index"`
+		Message struct {
+			Model string `json:"model"`
+		} `json:"message"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			PartialJSON string `json:"partial_json"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return true
+	}
+
+	switch data.Type {
+	case "message_start":
+		h.model = data.Message.Model
+	case "content_block_start":
+		if blockType := data.ContentBlock.Type; blockType == "tool_use" || blockType == "server_tool_use" {
+			h.calls[data.Index] = &toolCallBuilder{id: data.ContentBlock.ID, name: data.ContentBlock.Name, blockType: blockType}
+		}
+	case "content_block_delta":
+		if call, ok := h.calls[data.Index]; ok && data.Delta.Type == "input_json_delta" {
+			call.input.WriteString(data.Delta.PartialJSON)
+		}
+	case "content_block_stop":
+		if call, ok := h.calls[data.Index]; ok {
+			delete(h.calls, data.Index)
+			h.record(call)
+		}
+	}
+	return true
+}
+
+// record logs a completed tool call and appends it to the tool call log
+func (h *toolCallHook) record(builder *toolCallBuilder) {
+	// A tool called without arguments streams no input
+	input := strings.TrimSpace(builder.input.String())
+	if input == "" {
+		input = "{}"
+	}
+	call := &ToolCall{
+		Time:         time.Now(),
+		Request:      h.req.label,
+		Conversation: h.req.Conversation,
+		Client:       h.req.Client,
+		Model:        h.model,
+		ID:           builder.id,
+		Name:         builder.name,
+		Type:         builder.blockType,
+		Input:        json.RawMessage(input),
+	}
+	if !json.Valid(call.Input) {
+		// Keep malformed input as a string so the log stays valid JSON
+		quoted, _ := json.Marshal(input)
+		call.Input = quoted
+	}
+
+	if h.proxy.settings().logToolCalls {
+		logged := input
+		if len(logged) > maxLoggedToolInput {
+			logged = fmt.Sprintf("%s... (%d bytes)", logged[:maxLoggedToolInput], len(input))
+		}
+		log.Printf("[%s] Tool call %s (%s): %s", h.req.label, call.Name, call.ID, logged)
+	}
+	if h.proxy.toolCallLog != nil {
+		h.proxy.toolCallLog.write(call)
+	}
+}
+
+// Done logs the tool calls whose blocks never stopped
+func (h *toolCallHook) Done() {
+	for index, call := range h.calls {
+		log.Printf("[%s] Tool call %s (%s) at index %d never completed", h.req.label, call.name, call.id, index)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// tunnelWriter is the response writer of a request tunneled through another
+// protocol, passing each event of a streamed response to send and buffering
+// other responses
+type tunnelWriter struct {
+	send   func(event *sse.Event) error
+	header http.Header
+	status int
+
+	// Streamed responses are parsed into events from a pipe
+	stream *io.PipeWriter
+	done   chan struct{}
+	// Other responses are returned once complete
+	body bytes.Buffer
+}
+
+// newTunnelWriter returns a writer passing the events of the response to send
+func newTunnelWriter(send func(event *sse.Event) error) *tunnelWriter {
+	return &tunnelWriter{send: send, header: make(http.Header)}
+}
+
+// Header returns the response headers, which aren't sent
+func (t *tunnelWriter) Header() http.Header {
+	return t.header
+}
+
+// WriteHeader starts parsing the events of a streamed response
+func (t *tunnelWriter) WriteHeader(status int) {
+	if t.status != 0 {
+		return
+	}
+	t.status = status
+	if !strings.HasPrefix(t.header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+
+	reader, writer := io.Pipe()
+	t.stream, t.done = writer, make(chan struct{})
+	go func() {
+		defer close(t.done)
+		events := sse.NewReader(reader)
+		for {
+			event, err := events.Next()
+			if err != nil {
+				var parseErr *sse.ParseError
+				if errors.As(err, &parseErr) {
+					continue
+				}
+				// Unblock the response when the client went away
+				reader.CloseWithError(err)
+				return
+			}
+			if event.Data == "" {
+				continue
+			}
+			if err := t.send(event); err != nil {
+				reader.CloseWithError(err)
+				return
+			}
+		}
+	}()
+}
+
+// Write passes streamed events on, or buffers the response
+func (t *tunnelWriter) Write(data []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if t.stream != nil {
+		return t.stream.Write(data)
+	}
+	return t.body.Write(data)
+}
+
+// Flush does nothing, events are sent as soon as they are complete
+func (t *tunnelWriter) Flush() {}
+
+// finish waits for the events of a streamed response to be sent, and returns
+// the body of a response that isn't streamed
+func (t *tunnelWriter) finish() []byte {
+	if t.stream != nil {
+		t.stream.Close()
+		<-t.done
+		return nil
+	}
+	return bytes.TrimSpace(t.body.Bytes())
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upstream is a single target the proxy can forward requests to
+type upstream struct {
+	url     string
+	breaker *circuitBreaker
+	bedrock bool
+
+	// Unix nanoseconds of the last response received from the upstream
+	lastContact atomic.Int64
+}
+
+// errAllCircuitsOpen is returned when every upstream is failing fast
+var errAllCircuitsOpen = errors.New("all upstream circuit breakers are open")
+
+// parseUpstreams parses a comma separated, prioritized list of target URLs
+func (p *Proxy) parseUpstreams(targets string) ([]*upstream, error) {
+	var result []*upstream
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimRight(strings.TrimSpace(target), "/")
+		if target == "" {
+			continue
+		}
+		parsed, err := url.Parse(target)
+		if err != nil || parsed.Scheme != "https" && parsed.Scheme != "http" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid target %q: must start with http:// or https://", target)
+		}
+		if parsed.Fragment != "" {
+			return nil, fmt.Errorf("invalid target %q: must not have a fragment", target)
+		}
+		result = append(result, &upstream{url: target, breaker: p.newCircuitBreaker()})
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("at least one target is required")
+	}
+
+	return result, nil
+}
+
+// upstreamURL joins the path and query of a request to a target, which may
+// have a path prefix and query parameters of its own, e.g. a gateway serving
+// the API under https://gateway.example.com/anthropic?team=x
+func upstreamURL(target string, requestURL *url.URL) (string, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	joined := *base
+	joined.Path = strings.TrimSuffix(base.Path, "/") + requestURL.Path
+	joined.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + requestURL.EscapedPath()
+	if base.RawQuery != "" && requestURL.RawQuery != "" {
+		joined.RawQuery = base.RawQuery + "&" + requestURL.RawQuery
+	} else {
+		joined.RawQuery = base.RawQuery + requestURL.RawQuery
+	}
+	return joined.String(), nil
+}
+
+// newUpstreamRequest builds the request to send to an upstream. Header rules
+// only apply to the Anthropic API, Bedrock requests carry their own headers.
+func (p *Proxy) newUpstreamRequest(u *upstream, r *http.Request, bodyBytes []byte) (*http.Request, error) {
+	if u.bedrock {
+		return p.newBedrockRequest(r, u.url, bodyBytes)
+	}
+	forwardReq, err := newForwardRequest(r, u.url, bodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	applyHeaderRules(p.cfg.HeaderRules, forwardReq.Header)
+	return forwardReq, nil
+}
+
+// sendUpstream sends the request to the first healthy upstream, failing over to
+// the next one when a target is unreachable or returns 5xx. Failover only happens
+// before anything is streamed to the client.
+func (p *Proxy) sendUpstream(r *http.Request, bodyBytes []byte) (*http.Response, error) {
+	var lastErr error = errAllCircuitsOpen
+	for i, target := range p.upstreams {
+		isLast := i == len(p.upstreams)-1
+
+		// Skip targets that are failing fast
+		if !target.breaker.allow() {
+			continue
+		}
+
+		// Hold the request back while the target's rate limits are exhausted
+		limitKey := rateLimitKey(target.url, r)
+		if p.upstreamLimits != nil {
+			if err := p.upstreamLimits.wait(r.Context(), limitKey, bodyBytes); err != nil {
+				target.breaker.release()
+				return nil, err
+			}
+		}
+
+		// Requests that can't be built, such as Bedrock requests without
+		// credentials or for unsupported endpoints, say nothing about the target
+		req, err := p.newUpstreamRequest(target, r, bodyBytes)
+		if err != nil {
+			target.breaker.release()
+			return nil, err
+		}
+
+		// Make the request to the target, retrying transient upstream failures
+		// with requests built again, as signatures expire
+		resp, err := p.doWithRetry(func() (*http.Request, error) {
+			if first := req; first != nil {
+				req = nil
+				return first, nil
+			}
+			return p.newUpstreamRequest(target, r, bodyBytes)
+		})
+		// A client that went away says nothing about the target
+		if err != nil && r.Context().Err() != nil {
+			target.breaker.release()
+			return nil, err
+		}
+		if err != nil {
+			target.breaker.failure()
+			log.Printf("Error forwarding request to %s: %v", target.url, err)
+			lastErr = err
+			continue
+		}
+
+		target.lastContact.Store(time.Now().UnixNano())
+		if p.upstreamLimits != nil {
+			p.upstreamLimits.observe(limitKey, resp.Header)
+		}
+		if resp.StatusCode < 500 {
+			target.breaker.success()
+			if target.bedrock {
+				adaptBedrockResponse(resp)
+			}
+			return resp, nil
+		}
+
+		target.breaker.failure()
+		if isLast {
+			return resp, nil
+		}
+
+		log.Printf("Upstream %s returned %d, failing over", target.url, resp.StatusCode)
+		resp.Body.Close()
+		lastErr = fmt.Errorf("upstream %s returned %d", target.url, resp.StatusCode)
+	}
+
+	return nil, lastErr
+}
+
+// newUpstreamTransport returns the transport used for upstream requests. HTTP/2
+// is preferred so concurrent streams share a connection, and more idle HTTP/1.1
+// connections are kept for upstreams that don't support it. Requests go through
+// the forward proxy chosen by proxy.
+func newUpstreamTransport(proxy func(*http.Request) (*url.URL, error), tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = 32
+	return transport
+}
+
+// newCircuitBreaker returns a circuit breaker using the configured thresholds
+func (p *Proxy) newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{threshold: p.cfg.BreakerThreshold, cooldown: p.cfg.BreakerCooldown}
+}
+
+// breakerRetryIn returns how long until the first open circuit allows a probe
+func (p *Proxy) breakerRetryIn() time.Duration {
+	var retryIn time.Duration
+	for i, target := range p.upstreams {
+		if d := target.breaker.retryIn(); i == 0 || d < retryIn {
+			retryIn = d
+		}
+	}
+	return retryIn
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// maxUpstreamErrorSize bounds the error bodies parsed for enrichment, larger
+// ones are forwarded as they are
+const maxUpstreamErrorSize = 1 << 20
+
+// requestSnapshot is a Messages API request as the client sent it, to tell
+// what the proxy changed before forwarding it
+type requestSnapshot struct {
+	body   []byte
+	header http.Header
+}
+
+// proxyErrorContext describes what the proxy did to a request the upstream
+// rejected. It is added to the error body next to the original error.
+type proxyErrorContext struct {
+	Request        string   `json:"request"`
+	UpstreamStatus int      `json:"upstream_status,omitempty"`
+	ClientModel    string   `json:"client_model"`
+	EffectiveModel string   `json:"effective_model"`
+	Thinking       any      `json:"thinking,omitempty"`
+	MaxTokens      any      `json:"max_tokens,omitempty"`
+	Modifications  []string `json:"modifications"`
+}
+
+// writeUpstreamError forwards an error response of the upstream to a Messages
+// API request, adding a "proxy" object describing the effective model, the
+// thinking settings and the changes the proxy made to the request. The
+// original error is kept as it is, and bodies that aren't Anthropic errors
+// are forwarded unchanged.
+func (p *Proxy) writeUpstreamError(w http.ResponseWriter, resp *http.Response, req *Request) {
+	p.usage.recordFailure(req)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorSize+1))
+	if err != nil {
+		log.Printf("Error reading error response: %v", err)
+	}
+
+	var apiError map[string]any
+	if len(body) <= maxUpstreamErrorSize && json.Unmarshal(body, &apiError) == nil && apiError["type"] == "error" {
+		details := req.errorContext(resp.StatusCode)
+		errorType, message := describeAPIError(apiError)
+		log.Printf("[%s] Upstream error %d %s: %s (model %s, modifications: %s)", req.label, resp.StatusCode,
+			errorType, message, details.EffectiveModel, joinOr(details.Modifications, "none"))
+
+		apiError["proxy"] = details
+		var enriched bytes.Buffer
+		encoder := json.NewEncoder(&enriched)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(apiError); err == nil {
+			body = enriched.Bytes()
+			w.Header().Del("Content-Length")
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Error copying error response: %v", err)
+		return
+	}
+	// Forward the rest of bodies too large to parse
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("Error copying error response: %v", err)
+	}
+}
+
+// describeAPIError returns the type and message of an Anthropic error body
+func describeAPIError(apiError map[string]any) (string, string) {
+	detail, _ := apiError["error"].(map[string]any)
+	errorType, _ := detail["type"].(string)
+	message, _ := detail["message"].(string)
+	return errorType, message
+}
+
+// errorContext describes the request as forwarded, compared to what the
+// client sent, with the status of the upstream response when there is one
+func (req *Request) errorContext(status int) *proxyErrorContext {
+	details := &proxyErrorContext{
+		Request:        req.label,
+		UpstreamStatus: status,
+		ClientModel:    req.ClientModel,
+		Thinking:       req.Body["thinking"],
+		MaxTokens:      req.Body["max_tokens"],
+		Modifications:  []string{},
+	}
+	details.EffectiveModel, _ = req.Body["model"].(string)
+	if req.original != nil {
+		details.Modifications = req.original.diff(req.Header, req.Body)
+	}
+	return details
+}
+
+// diff lists the changes between the snapshot and the request as forwarded.
+// Scalar fields show their old and new value, other fields and headers only
+// that they changed, so no content or credentials end up in the error.
+func (s *requestSnapshot) diff(header http.Header, body map[string]any) []string {
+	var original map[string]any
+	json.Unmarshal(s.body, &original)
+	// Compare the forwarded body as it is encoded, like the original
+	var forwarded map[string]any
+	if encoded, err := json.Marshal(body); err == nil {
+		json.Unmarshal(encoded, &forwarded)
+	}
+
+	changes := []string{}
+	for _, key := range unionKeys(original, forwarded) {
+		before, hadBefore := original[key]
+		after, hasAfter := forwarded[key]
+		switch {
+		case !hasAfter:
+			changes = append(changes, "removed "+key)
+		case !hadBefore:
+			changes = append(changes, strings.TrimSpace("added "+key+" "+scalarValue(after)))
+		case !reflect.DeepEqual(before, after):
+			if isScalar(before) && isScalar(after) {
+				changes = append(changes, fmt.Sprintf("%s %s -> %s", key, scalarValue(before), scalarValue(after)))
+			} else {
+				changes = append(changes, "changed "+key)
+			}
+		}
+	}
+
+	for _, name := range unionKeys(s.header, header) {
+		before, after := s.header.Values(name), header.Values(name)
+		switch {
+		case len(after) == 0:
+			changes = append(changes, "removed header "+name)
+		case len(before) == 0:
+			changes = append(changes, "added header "+name)
+		case !slices.Equal(before, after):
+			changes = append(changes, "changed header "+name)
+		}
+	}
+	return changes
+}
+
+// isScalar checks if a decoded JSON value is a string, number, boolean or null
+func isScalar(value any) bool {
+	switch value.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	return true
+}
+
+// scalarValue formats a scalar value as JSON, and other values as nothing
+func scalarValue(value any) string {
+	if !isScalar(value) {
+		return ""
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// unionKeys returns the keys of two maps, sorted
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := slices.Collect(maps.Keys(a))
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// joinOr joins a list with commas, or returns fallback when it is empty
+func joinOr(list []string, fallback string) string {
+	if len(list) == 0 {
+		return fallback
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitsEndpoint is the admin endpoint serving the upstream rate limit state
+const RateLimitsEndpoint = "/ratelimits"
+
+// rateLimitKinds are the limits reported in anthropic-ratelimit-<kind>-* headers
+var rateLimitKinds = []string{"requests", "tokens", "input-tokens", "output-tokens"}
+
+// limitBucket models a single upstream limit as a token bucket refilling to its
+// limit over a minute, as the API replenishes capacity continuously
+type limitBucket struct {
+	Limit     float64   `json:"limit"`
+	Remaining float64   `json:"remaining"`
+	Reset     time.Time `json:"reset,omitzero"`
+	updated   time.Time
+}
+
+// refill adds the capacity replenished since the last update
+func (b *limitBucket) refill(now time.Time) {
+	b.Remaining = min(b.Limit, b.Remaining+b.Limit/60*now.Sub(b.updated).Seconds())
+	b.updated = now
+}
+
+// reserve takes cost from the bucket, returning how long until it is covered
+func (b *limitBucket) reserve(cost float64, now time.Time) time.Duration {
+	b.refill(now)
+	b.Remaining -= cost
+	if b.Remaining >= 0 || b.Limit <= 0 {
+		return 0
+	}
+	return time.Duration(-b.Remaining / (b.Limit / 60) * float64(time.Second))
+}
+
+// upstreamLimits tracks the rate limits the upstream reports for each target
+// and API key, so requests that would be rejected are held back instead
+type upstreamLimits struct {
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*limitBucket
+}
+
+// newUpstreamLimits returns a tracker delaying requests by at most maxDelay
+func newUpstreamLimits(maxDelay time.Duration) *upstreamLimits {
+	return &upstreamLimits{maxDelay: maxDelay, buckets: make(map[string]map[string]*limitBucket)}
+}
+
+// rateLimitKey identifies the limits of a target and the API key a request uses.
+// Only a fingerprint of the key is kept.
+func rateLimitKey(target string, r *http.Request) string {
+	credential := r.Header.Get("X-Api-Key")
+	if credential == "" {
+		credential = r.Header.Get("Authorization")
+	}
+	if credential == "" {
+		return target
+	}
+	hash := sha256.Sum256([]byte(credential))
+	return target + " key " + hex.EncodeToString(hash[:])[:8]
+}
+
+// estimateInputTokens roughly estimates the input tokens of a request body
+func estimateInputTokens(bodyBytes []byte) float64 {
+	return float64(len(bodyBytes)) / 4
+}
+
+// wait reserves the capacity of a request, waiting until the modelled buckets
+// cover it. Requests needing a longer wait than the maximum are sent right away
+// and left to the upstream and the retries.
+func (l *upstreamLimits) wait(ctx context.Context, key string, bodyBytes []byte) error {
+	costs := map[string]float64{
+		"requests":      1,
+		"tokens":        estimateInputTokens(bodyBytes),
+		"input-tokens":  estimateInputTokens(bodyBytes),
+		"output-tokens": 1,
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	var delay time.Duration
+	var limiting string
+	for kind, bucket := range l.buckets[key] {
+		if d := bucket.reserve(costs[kind], now); d > delay {
+			delay, limiting = d, kind
+		}
+	}
+	if delay > l.maxDelay {
+		// Give the capacity back rather than starving later requests
+		for kind, bucket := range l.buckets[key] {
+			bucket.Remaining += costs[kind]
+		}
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	if delay > l.maxDelay {
+		log.Printf("Upstream %s limit of %s needs a %s wait, sending anyway", limiting, key, delay.Round(time.Millisecond))
+		return nil
+	}
+
+	log.Printf("Delaying request %s to stay within the upstream %s limit of %s", delay.Round(time.Millisecond), limiting, key)
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe updates the buckets from the anthropic-ratelimit-* headers of a response
+func (l *upstreamLimits) observe(key string, header http.Header) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, kind := range rateLimitKinds {
+		prefix := "Anthropic-Ratelimit-" + kind
+		limit, err := strconv.ParseFloat(header.Get(prefix+"-Limit"), 64)
+		if err != nil {
+			continue
+		}
+		remaining, err := strconv.ParseFloat(header.Get(prefix+"-Remaining"), 64)
+		if err != nil {
+			continue
+		}
+		reset, _ := time.Parse(time.RFC3339, header.Get(prefix+"-Reset"))
+
+		if l.buckets[key] == nil {
+			l.buckets[key] = make(map[string]*limitBucket)
+		}
+		l.buckets[key][kind] = &limitBucket{Limit: limit, Remaining: remaining, Reset: reset, updated: now}
+	}
+}
+
+// rateLimitState is the modelled state of the limits of a target and API key
+type rateLimitState struct {
+	Key    string                  `json:"key"`
+	Limits map[string]*limitBucket `json:"limits"`
+}
+
+// snapshot returns the current state of every tracked limit
+func (l *upstreamLimits) snapshot() []rateLimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	states := make([]rateLimitState, 0, len(l.buckets))
+	for key, buckets := range l.buckets {
+		state := rateLimitState{Key: key, Limits: make(map[string]*limitBucket, len(buckets))}
+		for kind, bucket := range buckets {
+			copied := *bucket
+			copied.refill(now)
+			state.Limits[kind] = &copied
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// handleRateLimits serves the modelled upstream rate limit state
+func (p *Proxy) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	if p.upstreamLimits == nil {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "Adaptive rate limiting is disabled")
+		return
+	}
+	writeJSON(w, p.upstreamLimits.snapshot())
+}
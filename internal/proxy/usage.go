@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageEndpoint serves the accumulated usage
+const usageEndpoint = "/usage"
+
+// modelPricing holds USD prices per million tokens
+type modelPricing struct {
+	Input  float64
+	Output float64
+}
+
+// pricing maps model name prefixes to prices, checked in order
+var pricing = []struct {
+	prefix string
+	price  modelPricing
+}{
+	{"claude-opus-4", modelPricing{15, 75}},
+	{"claude-3-opus", modelPricing{15, 75}},
+	{"claude-sonnet-4", modelPricing{3, 15}},
+	{"claude-3-7-sonnet", modelPricing{3, 15}},
+	{"claude-3-5-sonnet", modelPricing{3, 15}},
+	{"claude-3-5-haiku", modelPricing{0.8, 4}},
+	{"claude-3-haiku", modelPricing{0.25, 1.25}},
+}
+
+// priceFor returns the pricing for a model, falling back to Sonnet prices
+func priceFor(model string) modelPricing {
+	for _, p := range pricing {
+		if strings.HasPrefix(model, p.prefix) || strings.Contains(model, "."+p.prefix) {
+			return p.price
+		}
+	}
+	return modelPricing{3, 15}
+}
+
+// tokenUsage is the usage object reported by the Messages API
+type tokenUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// requestUsage accumulates the usage of a single streamed response
+type requestUsage struct {
+	Model         string
+	Usage         tokenUsage
+	ThinkingChars int64
+	StopReason    string
+
+	// AnswerStarted is set once a content block that isn't thinking starts,
+	// Stopped once message_stop is seen, UpstreamError when the upstream sent
+	// an error event
+	AnswerStarted bool
+	Stopped       bool
+	UpstreamError bool
+	// Cached is set when the response was replayed from the response cache
+	Cached bool
+	// Batch is set for the results of a message batch, billed at half price
+	Batch bool
+	// Duration is the time from receiving the request to its response ending
+	Duration time.Duration
+}
+
+// observeData updates the usage from the data of a streamed event
+func (u *requestUsage) observeData(data string) {
+	var event struct {
+		Type    string `json:"type"`
+		Message struct {
+			Model string     `json:"model"`
+			Usage tokenUsage `json:"usage"`
+		} `json:"message"`
+		ContentBlock struct {
+			Type string `json:"type"`
+		} `json:"content_block"`
+		Delta struct {
+			Type       string `json:"type"`
+			Thinking   string `json:"thinking"`
+			StopReason string `json:"stop_reason"`
+		} `json:"delta"`
+		Usage *tokenUsage `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return
+	}
+
+	switch event.Type {
+	case "message_start":
+		u.Model = event.Message.Model
+		u.Usage = event.Message.Usage
+	case "content_block_start":
+		if !isThinkingType(event.ContentBlock.Type) {
+			u.AnswerStarted = true
+		}
+	case "content_block_delta":
+		if event.Delta.Type == "thinking_delta" {
+			u.ThinkingChars += int64(len(event.Delta.Thinking))
+		}
+	case "message_delta":
+		// Usage in message_delta is cumulative, and only includes the input
+		// tokens when they changed since message_start
+		if event.Usage != nil {
+			u.Usage.OutputTokens = event.Usage.OutputTokens
+			if event.Usage.InputTokens > 0 {
+				u.Usage.InputTokens = event.Usage.InputTokens
+			}
+			if event.Usage.CacheCreationInputTokens > 0 {
+				u.Usage.CacheCreationInputTokens = event.Usage.CacheCreationInputTokens
+			}
+			if event.Usage.CacheReadInputTokens > 0 {
+				u.Usage.CacheReadInputTokens = event.Usage.CacheReadInputTokens
+			}
+		}
+		if event.Delta.StopReason != "" {
+			u.StopReason = event.Delta.StopReason
+		}
+	case "message_stop":
+		u.Stopped = true
+	case "error":
+		u.UpstreamError = true
+	}
+}
+
+// observeMessage updates the usage from the body of a response that wasn't
+// streamed, a complete message
+func (u *requestUsage) observeMessage(data []byte) {
+	var message struct {
+		Type    string `json:"type"`
+		Model   string `json:"model"`
+		Content []struct {
+			Type     string `json:"type"`
+			Thinking string `json:"thinking"`
+		} `json:"content"`
+		StopReason string     `json:"stop_reason"`
+		Usage      tokenUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil || message.Type != "message" {
+		return
+	}
+
+	u.Model = message.Model
+	u.Usage = message.Usage
+	u.StopReason = message.StopReason
+	u.Stopped = true
+	for _, block := range message.Content {
+		if isThinkingType(block.Type) {
+			u.ThinkingChars += int64(len(block.Thinking))
+		} else {
+			u.AnswerStarted = true
+		}
+	}
+}
+
+// maxMessageTapSize bounds the response bodies messageTap keeps
+const maxMessageTapSize = 16 << 20
+
+// messageTap keeps the body of a response that isn't streamed, so its usage is
+// read once it is complete
+type messageTap struct {
+	body     bytes.Buffer
+	overflow bool
+}
+
+// write keeps a chunk of the body, dropping it all once it grows too large
+func (t *messageTap) write(p []byte) {
+	if t.overflow {
+		return
+	}
+	if t.body.Len()+len(p) > maxMessageTapSize {
+		t.overflow = true
+		t.body = bytes.Buffer{}
+		return
+	}
+	t.body.Write(p)
+}
+
+// sseDataTap passes the data of a raw SSE stream to a requestUsage, for
+// responses that are streamed through without parsing
+type sseDataTap struct {
+	usage   *requestUsage
+	blocks  openBlocks    // Tracked when set
+	timing  *streamTiming // Tracked when set
+	bus     *eventBus     // Published to when set
+	partial []byte
+	data    []string
+	inEvent bool
+}
+
+// write splits the stream into lines and observes the data of each event
+func (t *sseDataTap) write(p []byte) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(t.partial[:i]), "\r")
+		t.partial = t.partial[i+1:]
+
+		// An empty line ends the event, its data lines are joined
+		if line == "" {
+			if len(t.data) > 0 {
+				data := strings.Join(t.data, "\n")
+				t.usage.observeData(data)
+				t.blocks.observe(data)
+				if t.timing != nil {
+					t.timing.observe(data)
+					t.timing.forwarded++
+				}
+				if t.bus != nil {
+					t.bus.publishData(data)
+				}
+			}
+			t.data, t.inEvent = nil, false
+			continue
+		}
+		t.inEvent = true
+		if data, ok := strings.CutPrefix(line, "data:"); ok {
+			t.data = append(t.data, strings.TrimPrefix(data, " "))
+		}
+	}
+}
+
+// midEvent reports whether the stream so far ends inside an event
+func (t *sseDataTap) midEvent() bool {
+	return t.inEvent || len(t.partial) > 0
+}
+
+// thinkingTokens estimates thinking tokens from the thinking text, which the
+// API bills as output tokens without reporting them separately
+func (u *requestUsage) thinkingTokens() int64 {
+	return min((u.ThinkingChars+3)/4, u.Usage.OutputTokens)
+}
+
+// usageTotals aggregates usage across requests
+type usageTotals struct {
+	Requests       int64 `json:"requests"`
+	CachedRequests int64 `json:"cached_requests"`
+	// Errors counts the requests the upstream failed or that were cut short
+	Errors int64 `json:"errors"`
+	// DurationMS is the total latency of the requests
+	DurationMS               int64   `json:"duration_ms"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	ThinkingTokens           int64   `json:"thinking_tokens_estimated"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	CostUSD                  float64 `json:"estimated_cost_usd"`
+}
+
+// add accumulates a request's usage into the totals
+func (t *usageTotals) add(u *requestUsage, cost float64) {
+	t.Requests++
+	t.DurationMS += u.Duration.Milliseconds()
+	if u.UpstreamError || !u.Stopped {
+		t.Errors++
+	}
+	if u.Cached {
+		// Responses replayed from the cache weren't billed
+		t.CachedRequests++
+		return
+	}
+	t.InputTokens += u.Usage.InputTokens
+	t.OutputTokens += u.Usage.OutputTokens
+	t.ThinkingTokens += u.thinkingTokens()
+	t.CacheCreationInputTokens += u.Usage.CacheCreationInputTokens
+	t.CacheReadInputTokens += u.Usage.CacheReadInputTokens
+	t.CostUSD += cost
+}
+
+// describe summarizes the totals for the log
+func (t usageTotals) describe() string {
+	var errorRate float64
+	var latency time.Duration
+	if t.Requests > 0 {
+		errorRate = 100 * float64(t.Errors) / float64(t.Requests)
+		latency = time.Duration(t.DurationMS/t.Requests) * time.Millisecond
+	}
+	return fmt.Sprintf("%d requests (%d failed, %.1f%%), %d input tokens, %d output tokens (~%d thinking), %s average latency, ~$%.4f",
+		t.Requests, t.Errors, errorRate, t.InputTokens, t.OutputTokens, t.ThinkingTokens, latency, t.CostUSD)
+}
+
+// usageTracker accumulates usage per model and per client
+type usageTracker struct {
+	since time.Time
+
+	mu       sync.Mutex
+	total    usageTotals
+	byModel  map[string]*usageTotals
+	byClient map[string]*usageTotals
+}
+
+// newUsageTracker returns a tracker accumulating usage from now on
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		since:    time.Now(),
+		byModel:  make(map[string]*usageTotals),
+		byClient: make(map[string]*usageTotals),
+	}
+}
+
+// estimateCost returns the estimated USD cost of a request's usage
+func estimateCost(u *requestUsage) float64 {
+	price := priceFor(u.Model)
+	input := float64(u.Usage.InputTokens) +
+		1.25*float64(u.Usage.CacheCreationInputTokens) +
+		0.1*float64(u.Usage.CacheReadInputTokens)
+	cost := (input*price.Input + float64(u.Usage.OutputTokens)*price.Output) / 1e6
+	if u.Batch {
+		cost /= 2
+	}
+	return cost
+}
+
+// record adds a completed request's usage to the totals
+func (t *usageTracker) record(client string, u *requestUsage) {
+	if u.Model == "" {
+		return
+	}
+	cost := estimateCost(u)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.total.add(u, cost)
+	if t.byModel[u.Model] == nil {
+		t.byModel[u.Model] = &usageTotals{}
+	}
+	t.byModel[u.Model].add(u, cost)
+	if t.byClient[client] == nil {
+		t.byClient[client] = &usageTotals{}
+	}
+	t.byClient[client].add(u, cost)
+}
+
+// usageSnapshot is the JSON representation of the accumulated usage
+type usageSnapshot struct {
+	Since   time.Time              `json:"since"`
+	Total   usageTotals            `json:"total"`
+	Models  map[string]usageTotals `json:"models"`
+	Clients map[string]usageTotals `json:"clients"`
+}
+
+// snapshot returns a copy of the accumulated usage
+func (t *usageTracker) snapshot() usageSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := usageSnapshot{
+		Since:   t.since,
+		Total:   t.total,
+		Models:  make(map[string]usageTotals, len(t.byModel)),
+		Clients: make(map[string]usageTotals, len(t.byClient)),
+	}
+	for model, totals := range t.byModel {
+		snapshot.Models[model] = *totals
+	}
+	for client, totals := range t.byClient {
+		snapshot.Clients[client] = *totals
+	}
+	return snapshot
+}
+
+// recordFailure adds a Messages API request the upstream answered with an
+// error, or that couldn't be forwarded, to the totals of its model
+func (t *usageTracker) recordFailure(req *Request) {
+	model, _ := req.Body["model"].(string)
+	t.record(req.Client, &requestUsage{Model: model, UpstreamError: true, Duration: time.Since(req.started)})
+}
+
+// handleUsage serves the accumulated usage as JSON
+func (p *Proxy) handleUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.usage.snapshot())
+}
+
+// LogUsageSummary logs the accumulated usage per model, and appends it to the
+// stats file when configured
+func (p *Proxy) LogUsageSummary() {
+	snapshot := p.usage.snapshot()
+	if p.cfg.StatsFile != "" {
+		if err := appendStats(p.cfg.StatsFile, snapshot); err != nil {
+			log.Printf("Error writing stats file: %v", err)
+		}
+	}
+
+	models := make([]string, 0, len(snapshot.Models))
+	for model := range snapshot.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	log.Printf("Usage summary since %s: %s", snapshot.Since.Format(time.DateTime), snapshot.Total.describe())
+	for _, model := range models {
+		log.Printf("  %s: %s", model, snapshot.Models[model].describe())
+	}
+}
+
+// appendStats appends a summary of the usage to the stats file as a JSON line
+func appendStats(path string, snapshot usageSnapshot) error {
+	line, err := json.Marshal(struct {
+		Time time.Time `json:"time"`
+		usageSnapshot
+	}{time.Now(), snapshot})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// RunUsageLogger periodically logs a usage summary when there was new activity
+func (p *Proxy) RunUsageLogger() {
+	if p.cfg.UsageLogInterval <= 0 {
+		return
+	}
+
+	var lastRequests int64
+	for range time.Tick(p.cfg.UsageLogInterval) {
+		requests := p.usage.snapshot().Total.Requests
+		if requests != lastRequests {
+			p.LogUsageSummary()
+			lastRequests = requests
+		}
+	}
+}
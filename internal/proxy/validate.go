@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// validationError points at the field of a request that is invalid, in the
+// "messages.1.content.0.text: ..." format of the API's own errors
+type validationError struct {
+	Field   string
+	Message string
+}
+
+// Error returns the error message
+func (e *validationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// invalid returns a validation error for a field path
+func invalid(path []any, format string, args ...any) error {
+	parts := make([]string, len(path))
+	for i, part := range path {
+		parts[i] = fmt.Sprint(part)
+	}
+	return &validationError{Field: strings.Join(parts, "."), Message: fmt.Sprintf(format, args...)}
+}
+
+// validateMessagesRequest checks the shape of a Messages API request before it
+// is forwarded. Only what the API is known to reject is checked, unknown fields
+// and content block types are left for the API to judge.
+func validateMessagesRequest(bodyJSON map[string]any) error {
+	if model, ok := bodyJSON["model"].(string); !ok || model == "" {
+		return invalid([]any{"model"}, "field required, must be a non-empty string")
+	}
+
+	switch maxTokens, ok := bodyJSON["max_tokens"].(float64); {
+	case bodyJSON["max_tokens"] == nil:
+		return invalid([]any{"max_tokens"}, "field required")
+	case !ok || maxTokens != math.Trunc(maxTokens) || maxTokens < 1:
+		return invalid([]any{"max_tokens"}, "must be a positive integer")
+	}
+
+	if stream, ok := bodyJSON["stream"]; ok && stream != nil {
+		if _, ok := stream.(bool); !ok {
+			return invalid([]any{"stream"}, "must be a boolean")
+		}
+	}
+	for _, name := range []string{"temperature", "top_p"} {
+		if value, ok := bodyJSON[name]; ok && value != nil {
+			if number, ok := value.(float64); !ok || number < 0 || number > 1 {
+				return invalid([]any{name}, "must be a number between 0 and 1")
+			}
+		}
+	}
+
+	if err := validateSystem(bodyJSON["system"]); err != nil {
+		return err
+	}
+	if err := validateTools(bodyJSON["tools"]); err != nil {
+		return err
+	}
+	return validateMessages(bodyJSON["messages"])
+}
+
+// validateSystem checks the system prompt, a string or a list of text blocks
+func validateSystem(system any) error {
+	switch system := system.(type) {
+	case nil, string:
+		return nil
+	case []any:
+		for i, block := range system {
+			path := []any{"system", i}
+			block, ok := block.(map[string]any)
+			if !ok {
+				return invalid(path, "must be an object")
+			}
+			if block["type"] != "text" {
+				return invalid(append(path, "type"), "system prompt blocks must have type \"text\"")
+			}
+			if _, ok := block["text"].(string); !ok {
+				return invalid(append(path, "text"), "field required, must be a string")
+			}
+		}
+		return nil
+	}
+	return invalid([]any{"system"}, "must be a string or a list of text blocks")
+}
+
+// validateTools checks that the tools are objects with a name
+func validateTools(tools any) error {
+	if tools == nil {
+		return nil
+	}
+	list, ok := tools.([]any)
+	if !ok {
+		return invalid([]any{"tools"}, "must be a list")
+	}
+	for i, tool := range list {
+		tool, ok := tool.(map[string]any)
+		if !ok {
+			return invalid([]any{"tools", i}, "must be an object")
+		}
+		if name, ok := tool["name"].(string); !ok || name == "" {
+			return invalid([]any{"tools", i, "name"}, "field required, must be a non-empty string")
+		}
+	}
+	return nil
+}
+
+// validateMessages checks the roles and content of the messages. Consecutive
+// messages with the same role are accepted, the API combines them into a turn.
+func validateMessages(messages any) error {
+	list, ok := messages.([]any)
+	if !ok {
+		return invalid([]any{"messages"}, "field required, must be a list")
+	}
+	if len(list) == 0 {
+		return invalid([]any{"messages"}, "at least one message is required")
+	}
+
+	for i, message := range list {
+		path := []any{"messages", i}
+		message, ok := message.(map[string]any)
+		if !ok {
+			return invalid(path, "must be an object")
+		}
+
+		role, _ := message["role"].(string)
+		if role != "user" && role != "assistant" {
+			return invalid(append(path, "role"), "must be \"user\" or \"assistant\", got %v", message["role"])
+		}
+
+		switch content := message["content"].(type) {
+		case string:
+			// Only a final assistant message, prefilling the answer, may be empty
+			if content == "" && (role != "assistant" || i < len(list)-1) {
+				return invalid(append(path, "content"), "must not be empty")
+			}
+		case []any:
+			for j, block := range content {
+				if err := validateContentBlock(append(path, "content", j), role, block); err != nil {
+					return err
+				}
+			}
+		default:
+			return invalid(append(path, "content"), "field required, must be a string or a list of content blocks")
+		}
+	}
+	return nil
+}
+
+// contentBlockFields lists the string fields required by the content block
+// types the proxy knows about
+var contentBlockFields = map[string][]string{
+	"text":              {"text"},
+	"tool_use":          {"id", "name"},
+	"tool_result":       {"tool_use_id"},
+	"thinking":          {"thinking", "signature"},
+	"redacted_thinking": {"data"},
+}
+
+// validateContentBlock checks a content block of a message with the given role
+func validateContentBlock(path []any, role string, block any) error {
+	fields, ok := block.(map[string]any)
+	if !ok {
+		return invalid(path, "must be an object")
+	}
+	blockType, ok := fields["type"].(string)
+	if !ok {
+		return invalid(append(path, "type"), "field required, must be a string")
+	}
+
+	for _, name := range contentBlockFields[blockType] {
+		if _, ok := fields[name].(string); !ok {
+			return invalid(append(path, name), "field required for %s blocks, must be a string", blockType)
+		}
+	}
+
+	switch blockType {
+	case "image", "document":
+		if _, ok := fields["source"].(map[string]any); !ok {
+			return invalid(append(path, "source"), "field required for %s blocks, must be an object", blockType)
+		}
+	case "tool_use":
+		if role != "assistant" {
+			return invalid(append(path, "type"), "tool_use blocks are only allowed in assistant messages")
+		}
+		if _, ok := fields["input"].(map[string]any); !ok {
+			return invalid(append(path, "input"), "field required for tool_use blocks, must be an object")
+		}
+	case "tool_result":
+		if role != "user" {
+			return invalid(append(path, "type"), "tool_result blocks are only allowed in user messages")
+		}
+	case "thinking", "redacted_thinking":
+		if role != "assistant" {
+			return invalid(append(path, "type"), "%s blocks are only allowed in assistant messages", blockType)
+		}
+	}
+	return nil
+}
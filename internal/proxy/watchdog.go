@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// errStreamIdle is returned when the upstream stops sending data mid-response
+var errStreamIdle = errors.New("upstream stream stalled")
+
+// idleWatchdog aborts a response body when no data arrives for the idle timeout
+type idleWatchdog struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu    sync.Mutex
+	fired bool
+}
+
+// watchIdle wraps a response body so reads fail with errStreamIdle once the
+// upstream has been silent for longer than timeout
+func watchIdle(body io.ReadCloser, timeout time.Duration) *idleWatchdog {
+	d := &idleWatchdog{ReadCloser: body, timeout: timeout}
+	d.timer = time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		d.fired = true
+		d.mu.Unlock()
+
+		// Closing the body unblocks the pending read
+		d.ReadCloser.Close()
+	})
+	return d
+}
+
+// Read reads from the response body, resetting the idle timer whenever data arrives
+func (d *idleWatchdog) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+
+	d.mu.Lock()
+	fired := d.fired
+	d.mu.Unlock()
+	if fired {
+		return n, errStreamIdle
+	}
+
+	if n > 0 {
+		d.timer.Reset(d.timeout)
+	}
+	return n, err
+}
+
+// Close stops the watchdog and closes the response body
+func (d *idleWatchdog) Close() error {
+	d.timer.Stop()
+	return d.ReadCloser.Close()
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"zedclaudeproxy/internal/sse"
+)
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocket tunnel settings
+const (
+	// wsAcceptGUID is appended to the client key to compute the accept header
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsMaxMessage bounds the size of the request message
+	wsMaxMessage = 64 << 20
+	// wsRequestTimeout is how long the client has to send the request after the handshake
+	wsRequestTimeout = time.Minute
+)
+
+// isWebSocketUpgrade checks if a request asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken checks if a comma separated header contains a token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketTunnel serves Messages API requests over WebSocket, for clients
+// behind middleboxes that buffer or break server-sent events. The first message
+// of the client is the request body, which is passed to next as a POST request
+// with the headers of the handshake, so it runs through the same pipeline as
+// any other request. Each event of the response is sent as a text message
+// holding its JSON data, a response that isn't streamed as a single message,
+// and the connection is closed once the response is complete.
+func (p *Proxy) webSocketTunnel(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := acceptWebSocket(w, r, p.webSocketOrigins)
+		if err != nil {
+			log.Printf("Error accepting WebSocket connection: %v", err)
+			return
+		}
+		defer conn.close()
+
+		p.tunnels.Add(1)
+		defer p.tunnels.Done()
+
+		// Read the request, then keep reading so pings are answered and the
+		// request is canceled when the client goes away
+		conn.raw.SetReadDeadline(time.Now().Add(wsRequestTimeout))
+		body, err := conn.readMessage()
+		if err != nil {
+			log.Printf("Error reading WebSocket request: %v", err)
+			conn.writeClose(1002, "expected the request as the first message")
+			return
+		}
+		conn.raw.SetReadDeadline(time.Time{})
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			defer cancel()
+			for {
+				if _, err := conn.readMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, MessagesEndpoint, bytes.NewReader(body))
+		if err != nil {
+			conn.writeClose(1011, "invalid request")
+			return
+		}
+		req.Header = r.Header.Clone()
+		for _, name := range []string{"Connection", "Upgrade", "Accept-Encoding", "Sec-Websocket-Key",
+			"Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol"} {
+			req.Header.Del(name)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr, req.Host, req.Proto = r.RemoteAddr, r.Host, r.Proto
+		req.ProtoMajor, req.ProtoMinor = r.ProtoMajor, r.ProtoMinor
+
+		tw := newTunnelWriter(func(event *sse.Event) error {
+			return conn.writeFrame(wsText, []byte(event.Data))
+		})
+		next.ServeHTTP(tw, req)
+		if body := tw.finish(); len(body) > 0 {
+			conn.writeFrame(wsText, body)
+		}
+		conn.writeClose(1000, "")
+	})
+}
+
+// WaitTunnels waits for the WebSocket tunnels to finish their responses, as
+// the server doesn't track connections once they switched protocols
+func (p *Proxy) WaitTunnels(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.tunnels.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// webSocketConn is a server side WebSocket connection
+type webSocketConn struct {
+	raw    net.Conn
+	reader *bufio.Reader
+
+	// Writes come from the response and from answers to pings
+	mu     sync.Mutex
+	closed bool
+}
+
+// acceptWebSocket completes the opening handshake and takes over the
+// connection. Browsers send the Origin of the page opening the connection,
+// which must be one of origins, so web pages can't reach the proxy through the
+// browsers of its clients. Other clients don't send it.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request, origins map[string]bool) (*webSocketConn, error) {
+	if origin := r.Header.Get("Origin"); origin != "" && !origins[strings.ToLower(origin)] {
+		writeAPIError(w, http.StatusForbidden, "permission_error", "WebSocket connections from this origin are not allowed")
+		return nil, fmt.Errorf("origin %q not allowed", origin)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Unsupported WebSocket version, expected 13")
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "WebSocket requires HTTP/1.1")
+		return nil, errors.New("connection can't be taken over")
+	}
+	raw, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(buffered, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(hash[:]))
+	if err := buffered.Flush(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return &webSocketConn{raw: raw, reader: buffered.Reader}, nil
+}
+
+// readMessage returns the next data message, answering pings and handling
+// fragmented messages. A close from the client is answered and returned as io.EOF.
+func (c *webSocketConn) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeClose(1000, "")
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if fragmented {
+				return nil, errors.New("new message before the previous one ended")
+			}
+		case wsContinuation:
+			if !fragmented {
+				return nil, errors.New("continuation without a message")
+			}
+		default:
+			return nil, fmt.Errorf("unknown opcode %d", opcode)
+		}
+
+		if len(message)+len(payload) > wsMaxMessage {
+			c.writeClose(1009, "message too big")
+			return nil, errors.New("message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads a single frame, unmasking its payload
+func (c *webSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[1]&0x80 == 0 {
+		err = errors.New("client frames must be masked")
+		return
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > wsMaxMessage {
+		c.writeClose(1009, "message too big")
+		err = errors.New("message too big")
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// writeFrame sends a single unfragmented frame
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+	if _, err := c.raw.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	return nil
+}
+
+// writeClose sends a close frame, once
+func (c *webSocketConn) writeClose(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	c.writeFrame(wsClose, append(payload, reason...))
+}
+
+// close closes the connection
+func (c *webSocketConn) close() {
+	c.raw.Close()
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestWebSocketOrigin checks that handshakes from browsers are only accepted
+// from the allowed origins, while clients sending no origin are accepted
+func TestWebSocketOrigin(t *testing.T) {
+	p, err := New(Config{Target: "http://localhost:1", WebSocketOrigins: "https://app.example.com, https://Other.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	server := httptest.NewServer(p.TrustedHandler())
+	defer server.Close()
+
+	for _, test := range []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"https://app.example.com", http.StatusSwitchingProtocols},
+		{"https://other.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+MessagesEndpoint, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("origin %q: %v", test.origin, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("origin %q: got status %d, want %d", test.origin, resp.StatusCode, test.status)
+		}
+	}
+}
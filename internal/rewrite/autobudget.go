@@ -0,0 +1,70 @@
+package rewrite
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+const (
+	// autoBudgetWindow is the number of recent requests per model the budget is tuned on
+	autoBudgetWindow = 50
+	// autoBudgetMinSamples is the number of requests needed before tuning starts
+	autoBudgetMinSamples = 5
+	// autoBudgetMargin leaves room above the percentile, which also lets the
+	// budget grow when thinking keeps using all of it
+	autoBudgetMargin = 1.25
+)
+
+// autoBudget tunes the thinking budget of each model from the thinking tokens
+// recent requests actually used
+type autoBudget struct {
+	percentile float64
+	max        int
+
+	mu      sync.Mutex
+	samples map[string][]int
+}
+
+// newAutoBudget returns a tuner using the given percentile (0-100) of recent usage, capped at max
+func newAutoBudget(percentile float64, max int) *autoBudget {
+	return &autoBudget{
+		percentile: percentile,
+		max:        max,
+		samples:    make(map[string][]int),
+	}
+}
+
+// observe records the thinking tokens used by a request
+func (a *autoBudget) observe(model string, thinkingTokens int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	samples := append(a.samples[model], thinkingTokens)
+	if len(samples) > autoBudgetWindow {
+		samples = samples[len(samples)-autoBudgetWindow:]
+	}
+	a.samples[model] = samples
+}
+
+// budget returns the tuned budget for a model and the number of requests it is
+// based on, or false until enough requests were observed
+func (a *autoBudget) budget(model string) (int, int, bool) {
+	a.mu.Lock()
+	samples := slices.Clone(a.samples[model])
+	a.mu.Unlock()
+
+	if len(samples) < autoBudgetMinSamples {
+		return 0, len(samples), false
+	}
+
+	slices.Sort(samples)
+	rank := int(math.Ceil(a.percentile/100*float64(len(samples)))) - 1
+	value := samples[min(max(rank, 0), len(samples)-1)]
+
+	budget := int(float64(value) * autoBudgetMargin)
+	if a.max > 0 {
+		budget = min(budget, a.max)
+	}
+	return max(budget, MinThinkingBudget), len(samples), true
+}
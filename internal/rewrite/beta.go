@@ -0,0 +1,92 @@
+package rewrite
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// BetaRule attaches an anthropic-beta value to requests matching all of its conditions
+type BetaRule struct {
+	Beta         string   `json:"beta"`
+	Models       []string `json:"models,omitempty"`         // Model name patterns, empty matches all
+	Thinking     bool     `json:"thinking,omitempty"`       // Only when thinking is enabled
+	Tools        bool     `json:"tools,omitempty"`          // Only when the request defines tools
+	MinMaxTokens int      `json:"min_max_tokens,omitempty"` // Only when max_tokens is at least this
+}
+
+// DefaultBetaRules are used when no beta rules are configured
+var DefaultBetaRules = []BetaRule{
+	{
+		Beta:     "interleaved-thinking-2025-05-14",
+		Models:   []string{"claude-opus-4*", "claude-sonnet-4*"},
+		Thinking: true,
+		Tools:    true,
+	},
+	{
+		Beta:         "output-128k-2025-02-19",
+		Models:       []string{"claude-3-7-sonnet*"},
+		MinMaxTokens: 64001,
+	},
+}
+
+// matches checks if a rule applies to a request body
+func (rule BetaRule) matches(bodyJSON map[string]any) bool {
+	model, _ := bodyJSON["model"].(string)
+	if len(rule.Models) > 0 && !MatchModel(rule.Models, model) {
+		return false
+	}
+
+	if rule.Thinking && !ThinkingEnabled(bodyJSON) {
+		return false
+	}
+
+	if rule.Tools {
+		if tools, _ := bodyJSON["tools"].([]any); len(tools) == 0 {
+			return false
+		}
+	}
+
+	if rule.MinMaxTokens > 0 {
+		if MaxTokens(bodyJSON) < rule.MinMaxTokens {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ApplyBetaRules adds the anthropic-beta values required by the request's features
+func (rw *Rewriter) ApplyBetaRules(header http.Header, bodyJSON map[string]any) {
+	rules := rw.cfg.Load().BetaRules
+	if rules == nil {
+		rules = DefaultBetaRules
+	}
+
+	// Collect the values the client already sent
+	var betas []string
+	present := make(map[string]bool)
+	for _, value := range header.Values("anthropic-beta") {
+		for _, beta := range strings.Split(value, ",") {
+			if beta = strings.TrimSpace(beta); beta != "" && !present[beta] {
+				betas = append(betas, beta)
+				present[beta] = true
+			}
+		}
+	}
+
+	added := false
+	for _, rule := range rules {
+		if rule.Beta == "" || present[rule.Beta] || !rule.matches(bodyJSON) {
+			continue
+		}
+		log.Printf("Adding anthropic-beta: %s", rule.Beta)
+		betas = append(betas, rule.Beta)
+		present[rule.Beta] = true
+		added = true
+	}
+
+	if added {
+		header.Set("anthropic-beta", strings.Join(betas, ","))
+	}
+}
@@ -0,0 +1,152 @@
+package rewrite
+
+import (
+	"fmt"
+	"log"
+)
+
+// Prompt caching strategies deciding where cache_control markers are inserted
+const (
+	CacheNone     = "none"     // Leave requests alone
+	CacheSystem   = "system"   // Mark the end of the system prompt
+	CacheMessages = "messages" // Mark the last user message
+	CacheAll      = "all"      // Mark both the system prompt and the last user message
+)
+
+// ValidateCacheStrategy checks that a prompt caching strategy is known
+func ValidateCacheStrategy(strategy string) error {
+	switch strategy {
+	case "", CacheNone, CacheSystem, CacheMessages, CacheAll:
+		return nil
+	}
+	return fmt.Errorf("invalid cache strategy %q: must be %s, %s, %s or %s", strategy, CacheNone, CacheSystem, CacheMessages, CacheAll)
+}
+
+// ApplyCacheControl inserts ephemeral cache_control markers according to the
+// configured strategy, returning whether the body was changed. Requests that
+// already carry markers manage caching themselves and are left alone.
+func (rw *Rewriter) ApplyCacheControl(bodyJSON map[string]any) bool {
+	strategy := rw.cfg.Load().CacheStrategy
+	if strategy == "" || strategy == CacheNone || hasCacheControl(bodyJSON) {
+		return false
+	}
+
+	changed := false
+	if strategy == CacheSystem || strategy == CacheAll {
+		changed = markSystem(bodyJSON) || changed
+	}
+	if strategy == CacheMessages || strategy == CacheAll {
+		changed = markLastUserMessage(bodyJSON) || changed
+	}
+
+	if changed {
+		log.Printf("Added cache_control markers (%s)", strategy)
+	}
+	return changed
+}
+
+// markSystem marks the last block of the system prompt
+func markSystem(bodyJSON map[string]any) bool {
+	switch system := bodyJSON["system"].(type) {
+	case string:
+		if system == "" {
+			return false
+		}
+		bodyJSON["system"] = []any{textBlock(system)}
+		return true
+	case []any:
+		return markLastBlock(system)
+	}
+	return false
+}
+
+// markLastUserMessage marks the last block of the last user message, so the
+// whole conversation up to it is cached for the next turn
+func markLastUserMessage(bodyJSON map[string]any) bool {
+	messages, _ := bodyJSON["messages"].([]any)
+	for i := len(messages) - 1; i >= 0; i-- {
+		message, ok := messages[i].(map[string]any)
+		if !ok || message["role"] != "user" {
+			continue
+		}
+
+		switch content := message["content"].(type) {
+		case string:
+			if content == "" {
+				return false
+			}
+			message["content"] = []any{textBlock(content)}
+			return true
+		case []any:
+			return markLastBlock(content)
+		}
+		return false
+	}
+	return false
+}
+
+// textBlock returns a text content block marked for caching
+func textBlock(text string) map[string]any {
+	return map[string]any{
+		"type":          "text",
+		"text":          text,
+		"cache_control": ephemeral(),
+	}
+}
+
+// markLastBlock marks the last content block that can be cached
+func markLastBlock(blocks []any) bool {
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block, ok := blocks[i].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		// Thinking blocks and empty text blocks can't carry a marker
+		switch block["type"] {
+		case "thinking", "redacted_thinking":
+			continue
+		case "text":
+			if text, _ := block["text"].(string); text == "" {
+				continue
+			}
+		}
+		block["cache_control"] = ephemeral()
+		return true
+	}
+	return false
+}
+
+// ephemeral returns a new ephemeral cache_control value
+func ephemeral() map[string]any {
+	return map[string]any{"type": "ephemeral"}
+}
+
+// hasCacheControl checks if the tools, system prompt or messages of a request
+// already carry a cache_control marker
+func hasCacheControl(bodyJSON map[string]any) bool {
+	tools, _ := bodyJSON["tools"].([]any)
+	system, _ := bodyJSON["system"].([]any)
+	if blocksHaveCacheControl(tools) || blocksHaveCacheControl(system) {
+		return true
+	}
+
+	messages, _ := bodyJSON["messages"].([]any)
+	for _, message := range messages {
+		message, _ := message.(map[string]any)
+		if content, ok := message["content"].([]any); ok && blocksHaveCacheControl(content) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocksHaveCacheControl checks if any of the blocks carries a cache_control marker
+func blocksHaveCacheControl(blocks []any) bool {
+	for _, block := range blocks {
+		if block, ok := block.(map[string]any); ok && block["cache_control"] != nil {
+			return true
+		}
+	}
+	return false
+}
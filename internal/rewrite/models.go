@@ -0,0 +1,33 @@
+package rewrite
+
+import (
+	"log"
+)
+
+// ThinkingModels are the model patterns that support extended thinking, which
+// get a "-thinking" variant in the model list
+var ThinkingModels = []string{"claude-3-7-sonnet*", "claude-sonnet-4*", "claude-opus-4*", "claude-haiku-4*"}
+
+// SupportsThinking checks if a model supports extended thinking
+func SupportsThinking(model string) bool {
+	return MatchModel(ThinkingModels, model)
+}
+
+// ModelAliases returns the configured model aliases
+func (rw *Rewriter) ModelAliases() map[string]string {
+	return rw.cfg.Load().ModelAliases
+}
+
+// ResolveAlias replaces a configured model alias in the request with the model
+// it stands for, returning whether the body was changed
+func (rw *Rewriter) ResolveAlias(bodyJSON map[string]any) bool {
+	model, _ := bodyJSON["model"].(string)
+	target, ok := rw.cfg.Load().ModelAliases[model]
+	if !ok {
+		return false
+	}
+
+	log.Printf("Resolved model alias '%s' to '%s'", model, target)
+	bodyJSON["model"] = target
+	return true
+}
@@ -0,0 +1,312 @@
+// Package rewrite turns Messages API requests for "-thinking" model aliases into
+// requests with extended thinking enabled, and applies the other request
+// transformations managed by the proxy.
+package rewrite
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ThinkingSuffix marks model names that should have thinking enabled
+const ThinkingSuffix = "-thinking"
+
+// MinThinkingBudget is the smallest budget the API accepts
+const MinThinkingBudget = 1024
+
+// EffortLevels are the reasoning effort levels that may follow the thinking
+// suffix, e.g. "claude-sonnet-4-5-thinking-high"
+var EffortLevels = []string{"low", "medium", "high"}
+
+// DefaultEffortBudgets are the thinking budgets of the effort levels
+var DefaultEffortBudgets = map[string]int{"low": 2048, "medium": 8192, "high": 24576}
+
+// ThinkingConfig represents the thinking field to add
+type ThinkingConfig struct {
+	BudgetTokens int    `json:"budget_tokens"`
+	Type         string `json:"type"`
+}
+
+// Config controls how requests are rewritten
+type Config struct {
+	// ThinkingBudget is the token budget for thinking
+	ThinkingBudget int
+	// ThinkingBudgets overrides ThinkingBudget for models matching the glob
+	// patterns, the most specific (longest) matching pattern wins
+	ThinkingBudgets map[string]int
+	// MaxTokensHeadroom is the minimum number of tokens left for the answer
+	// above the thinking budget when raising max_tokens
+	MaxTokensHeadroom int
+	// MaxTokensCap is a hard cap on max_tokens for thinking requests, 0 disables it
+	MaxTokensCap int
+	// BetaRules decide which anthropic-beta values are attached to requests,
+	// DefaultBetaRules are used when nil
+	BetaRules []BetaRule
+	// SystemPrompts add text to the system prompt of matching requests, applied in order
+	SystemPrompts []SystemPromptRule
+	// AutoBudget tunes the budget of each model to the AutoBudgetPercentile
+	// of the thinking tokens recent requests used, capped at AutoBudgetMax
+	AutoBudget           bool
+	AutoBudgetPercentile float64
+	AutoBudgetMax        int
+	// ModelAliases maps model names clients may use to the model they stand for,
+	// which may itself be a "-thinking" alias
+	ModelAliases map[string]string
+	// EffortBudgets overrides DefaultEffortBudgets for the effort levels
+	EffortBudgets map[string]int
+	// MaxToolResultBytes caps the text of tool_result blocks, keeping its head
+	// and tail, 0 disables truncation
+	MaxToolResultBytes int
+	// CacheStrategy decides where cache_control markers are inserted for
+	// prompt caching, one of the Cache constants
+	CacheStrategy string
+}
+
+// Rewriter rewrites request bodies and headers before they are forwarded
+type Rewriter struct {
+	cfg  atomic.Pointer[Config]
+	auto *autoBudget // nil unless budgets are tuned automatically
+}
+
+// New returns a Rewriter using the given configuration
+func New(cfg Config) *Rewriter {
+	rw := &Rewriter{}
+	rw.cfg.Store(&cfg)
+	if cfg.AutoBudget {
+		rw.auto = newAutoBudget(cfg.AutoBudgetPercentile, cfg.AutoBudgetMax)
+	}
+	return rw
+}
+
+// Config returns the configuration in use
+func (rw *Rewriter) Config() Config {
+	return *rw.cfg.Load()
+}
+
+// SetConfig replaces the configuration for the requests rewritten from now on.
+// Automatic budget tuning can't be turned on or off, as its history is kept
+// from the start.
+func (rw *Rewriter) SetConfig(cfg Config) {
+	rw.cfg.Store(&cfg)
+}
+
+// ModifyModelName changes the model name by removing "-thinking" suffix and
+// the effort level following it
+func ModifyModelName(modelName string) string {
+	if effort := ThinkingEffort(modelName); effort != "" {
+		modelName = strings.TrimSuffix(modelName, "-"+effort)
+	}
+	return strings.Replace(modelName, ThinkingSuffix, "", 1)
+}
+
+// ThinkingEffort returns the effort level following the "-thinking" suffix of
+// a model name, or "" if there is none
+func ThinkingEffort(modelName string) string {
+	_, rest, ok := strings.Cut(modelName, ThinkingSuffix)
+	if !ok {
+		return ""
+	}
+	if effort, ok := strings.CutPrefix(rest, "-"); ok && slices.Contains(EffortLevels, effort) {
+		return effort
+	}
+	return ""
+}
+
+// HasThinkingSuffix checks if a model name has the "-thinking" suffix
+func HasThinkingSuffix(modelName string) bool {
+	return strings.Contains(modelName, ThinkingSuffix)
+}
+
+// ThinkingEnabled checks if a request body enables extended thinking
+func ThinkingEnabled(bodyJSON map[string]any) bool {
+	switch thinking := bodyJSON["thinking"].(type) {
+	case ThinkingConfig:
+		return thinking.Type == "enabled"
+	case map[string]any:
+		return thinking["type"] == "enabled"
+	}
+	return false
+}
+
+// MaxTokens returns the max_tokens of a request body, whether it was decoded
+// from JSON as a float64 or set as an int by a rewrite
+func MaxTokens(bodyJSON map[string]any) int {
+	switch v := bodyJSON["max_tokens"].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// MatchModel checks if a model name matches any of the glob patterns
+func MatchModel(patterns []string, model string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Thinking rewrites a request for a "-thinking" model alias: it strips the
+// suffix, adds the thinking configuration, enables streaming and applies the
+// other proxy-managed transformations. A positive budget overrides the
+// configured one.
+func (rw *Rewriter) Thinking(header http.Header, bodyJSON map[string]any, clientModel string, budget int) {
+	// Modify model name
+	modifiedModelName := ModifyModelName(clientModel)
+	bodyJSON["model"] = modifiedModelName
+	log.Printf("Modified model name from '%s' to '%s'", clientModel, modifiedModelName)
+
+	// Make room for the thinking budget in max_tokens
+	budget = rw.EnforceMaxTokens(bodyJSON, rw.requestBudget(clientModel, budget))
+
+	// Add the "thinking" field
+	bodyJSON["thinking"] = ThinkingConfig{
+		BudgetTokens: budget,
+		Type:         "enabled",
+	}
+
+	// Ensure streaming is enabled
+	bodyJSON["stream"] = true
+
+	// Drop sampling parameters that are incompatible with thinking
+	SanitizeSampling(bodyJSON)
+
+	// Add the proxy-managed system prompt
+	rw.ApplySystemPrompt(bodyJSON, clientModel)
+
+	// Shorten oversized tool results
+	rw.TruncateToolResults(bodyJSON)
+
+	// Mark the prompt for caching, after the system prompt is final
+	rw.ApplyCacheControl(bodyJSON)
+
+	// Attach the beta headers required by the requested features
+	rw.ApplyBetaRules(header, bodyJSON)
+}
+
+// CountTokens rewrites a token counting request for a "-thinking" model alias
+// the same way as the request it pre-flights, so the count includes thinking.
+// Token counting accepts neither max_tokens nor stream, so those are left alone.
+func (rw *Rewriter) CountTokens(header http.Header, bodyJSON map[string]any, clientModel string, budget int) {
+	modifiedModelName := ModifyModelName(clientModel)
+	bodyJSON["model"] = modifiedModelName
+	log.Printf("Modified model name from '%s' to '%s'", clientModel, modifiedModelName)
+
+	bodyJSON["thinking"] = ThinkingConfig{
+		BudgetTokens: rw.requestBudget(clientModel, budget),
+		Type:         "enabled",
+	}
+
+	rw.ApplySystemPrompt(bodyJSON, clientModel)
+	rw.TruncateToolResults(bodyJSON)
+	rw.ApplyBetaRules(header, bodyJSON)
+}
+
+// ObserveThinking feeds the thinking tokens a request for model used back into
+// the automatic budget tuning
+func (rw *Rewriter) ObserveThinking(model string, thinkingTokens int) {
+	if rw.auto != nil {
+		rw.auto.observe(model, thinkingTokens)
+	}
+}
+
+// BudgetFor returns the thinking budget for a model
+func (rw *Rewriter) BudgetFor(model string) int {
+	if rw.auto != nil {
+		if budget, samples, ok := rw.auto.budget(model); ok {
+			log.Printf("Auto budget for %s: %d tokens (p%g of %d requests)", model, budget, rw.cfg.Load().AutoBudgetPercentile, samples)
+			return budget
+		}
+	}
+
+	cfg := rw.cfg.Load()
+	budget, matched := cfg.ThinkingBudget, ""
+	for pattern, patternBudget := range cfg.ThinkingBudgets {
+		if ok, _ := path.Match(pattern, model); ok && len(pattern) > len(matched) {
+			budget, matched = patternBudget, pattern
+		}
+	}
+	return budget
+}
+
+// requestBudget returns the thinking budget of a request for a "-thinking"
+// alias: the override when positive, else the budget of the effort level of
+// the alias, else the budget of the model
+func (rw *Rewriter) requestBudget(clientModel string, override int) int {
+	if override > 0 {
+		return override
+	}
+	if effort := ThinkingEffort(clientModel); effort != "" {
+		budget, ok := rw.cfg.Load().EffortBudgets[effort]
+		if !ok {
+			budget = DefaultEffortBudgets[effort]
+		}
+		log.Printf("Thinking budget for effort %s: %d tokens", effort, budget)
+		return budget
+	}
+	return rw.BudgetFor(ModifyModelName(clientModel))
+}
+
+// Passthrough applies the proxy-managed transformations to a request for a
+// regular model, returning whether the body was changed
+func (rw *Rewriter) Passthrough(header http.Header, bodyJSON map[string]any, clientModel string) bool {
+	rw.ApplyBetaRules(header, bodyJSON)
+	changed := rw.ApplySystemPrompt(bodyJSON, clientModel)
+	changed = rw.TruncateToolResults(bodyJSON) || changed
+	return rw.ApplyCacheControl(bodyJSON) || changed
+}
+
+// EnforceMaxTokens makes max_tokens larger than the thinking budget, as the API
+// requires, and applies the hard cap. It returns the budget to use, which is
+// lowered when the cap leaves no room for it.
+func (rw *Rewriter) EnforceMaxTokens(bodyJSON map[string]any, budget int) int {
+	cfg := rw.cfg.Load()
+	maxTokens := MaxTokens(bodyJSON)
+
+	// Raise max_tokens to leave room for the answer after thinking
+	if floor := budget + cfg.MaxTokensHeadroom; maxTokens < floor {
+		log.Printf("Raising max_tokens from %d to %d (budget %d + headroom %d)", maxTokens, floor, budget, cfg.MaxTokensHeadroom)
+		maxTokens = floor
+	}
+
+	// Apply the hard cap, shrinking the budget if needed
+	if cfg.MaxTokensCap > 0 && maxTokens > cfg.MaxTokensCap {
+		log.Printf("Capping max_tokens from %d to %d", maxTokens, cfg.MaxTokensCap)
+		maxTokens = cfg.MaxTokensCap
+		if budget >= maxTokens {
+			budget = max(maxTokens-cfg.MaxTokensHeadroom, maxTokens/2, MinThinkingBudget)
+			if budget >= maxTokens {
+				log.Printf("Warning: max_tokens cap %d leaves no room for the minimum thinking budget", maxTokens)
+			} else {
+				log.Printf("Lowering thinking budget to %d to fit under the max_tokens cap", budget)
+			}
+		}
+	}
+
+	bodyJSON["max_tokens"] = maxTokens
+	return budget
+}
+
+// SanitizeSampling removes sampling parameters the API rejects when thinking is
+// enabled: temperature must be 1 and top_p/top_k can't be set
+func SanitizeSampling(bodyJSON map[string]any) {
+	if temperature, ok := bodyJSON["temperature"]; ok && temperature != 1.0 {
+		log.Printf("Removing temperature %v, thinking requires the default of 1", temperature)
+		delete(bodyJSON, "temperature")
+	}
+
+	for _, param := range []string{"top_p", "top_k"} {
+		if value, ok := bodyJSON[param]; ok {
+			log.Printf("Removing %s %v, not supported with thinking", param, value)
+			delete(bodyJSON, param)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package rewrite
+
+import (
+	"log"
+)
+
+// SystemPromptRule adds proxy-managed text to the system prompt of matching requests
+type SystemPromptRule struct {
+	Models  []string `json:"models,omitempty"` // Model name patterns as sent by the client, empty matches all
+	Prepend string   `json:"prepend,omitempty"`
+	Append  string   `json:"append,omitempty"`
+}
+
+// ApplySystemPrompt prepends and appends the configured text to the system
+// prompt, returning whether the body was changed
+func (rw *Rewriter) ApplySystemPrompt(bodyJSON map[string]any, clientModel string) bool {
+	changed := false
+	for _, rule := range rw.cfg.Load().SystemPrompts {
+		if len(rule.Models) > 0 && !MatchModel(rule.Models, clientModel) {
+			continue
+		}
+		if rule.Prepend == "" && rule.Append == "" {
+			continue
+		}
+
+		switch system := bodyJSON["system"].(type) {
+		case []any:
+			// System prompt given as content blocks
+			var blocks []any
+			if rule.Prepend != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": rule.Prepend})
+			}
+			blocks = append(blocks, system...)
+			if rule.Append != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": rule.Append})
+			}
+			bodyJSON["system"] = blocks
+		default:
+			// System prompt given as a string, or missing
+			text, _ := system.(string)
+			bodyJSON["system"] = joinNonEmpty("\n\n", rule.Prepend, text, rule.Append)
+		}
+		changed = true
+	}
+
+	if changed {
+		log.Printf("Augmented system prompt for model %s", clientModel)
+	}
+	return changed
+}
+
+// joinNonEmpty joins the non-empty strings with the separator
+func joinNonEmpty(sep string, parts ...string) string {
+	var result string
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		if result != "" {
+			result += sep
+		}
+		result += part
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package rewrite
+
+import (
+	"fmt"
+	"log"
+	"unicode/utf8"
+)
+
+// TruncateToolResults shortens the text of tool_result blocks longer than the
+// configured cap to their head and tail, returning whether the body was
+// changed. Agents sometimes send megabytes of command output that would
+// otherwise fill the context window.
+func (rw *Rewriter) TruncateToolResults(bodyJSON map[string]any) bool {
+	limit := rw.cfg.Load().MaxToolResultBytes
+	if limit <= 0 {
+		return false
+	}
+
+	truncated := 0
+	messages, _ := bodyJSON["messages"].([]any)
+	for _, message := range messages {
+		message, _ := message.(map[string]any)
+		blocks, _ := message["content"].([]any)
+		for _, block := range blocks {
+			block, ok := block.(map[string]any)
+			if !ok || block["type"] != "tool_result" {
+				continue
+			}
+
+			switch content := block["content"].(type) {
+			case string:
+				if text, ok := truncateMiddle(content, limit); ok {
+					block["content"] = text
+					truncated++
+				}
+			case []any:
+				for _, part := range content {
+					part, ok := part.(map[string]any)
+					if !ok || part["type"] != "text" {
+						continue
+					}
+					if text, ok := part["text"].(string); ok {
+						if text, ok := truncateMiddle(text, limit); ok {
+							part["text"] = text
+							truncated++
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if truncated > 0 {
+		log.Printf("Truncated %d tool results to %d bytes", truncated, limit)
+	}
+	return truncated > 0
+}
+
+// truncateMiddle keeps the head and tail of text longer than limit bytes with
+// a marker in place of the rest, cutting on rune boundaries
+func truncateMiddle(text string, limit int) (string, bool) {
+	if len(text) <= limit {
+		return text, false
+	}
+
+	head := limit / 2
+	for head > 0 && !utf8.RuneStart(text[head]) {
+		head--
+	}
+	tail := len(text) - (limit - head)
+	for tail < len(text) && !utf8.RuneStart(text[tail]) {
+		tail++
+	}
+
+	marker := fmt.Sprintf("\n\n[... %d bytes truncated by the proxy ...]\n\n", tail-head)
+	return text[:head] + marker + text[tail:], true
+}
@@ -0,0 +1,134 @@
+package script
+
+import (
+	"encoding/json"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// arrayKey marks tables converted from JSON arrays in their metatable, so empty
+// arrays are encoded back as arrays rather than objects
+const arrayKey = "__array"
+
+// newJSONModule returns the json table exposed to scripts
+func newJSONModule(L *lua.LState) *lua.LTable {
+	module := L.NewTable()
+	module.RawSetString("encode", L.NewFunction(func(L *lua.LState) int {
+		data, err := json.Marshal(fromLua(L.CheckAny(1)))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(data))
+		return 1
+	}))
+	module.RawSetString("decode", L.NewFunction(func(L *lua.LState) int {
+		var value any
+		if err := json.Unmarshal([]byte(L.CheckString(1)), &value); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(toLua(L, value))
+		return 1
+	}))
+	module.RawSetString("array", L.NewFunction(func(L *lua.LState) int {
+		table := L.OptTable(1, L.NewTable())
+		L.SetMetatable(table, arrayMetatable(L))
+		L.Push(table)
+		return 1
+	}))
+	return module
+}
+
+// arrayMetatable returns the metatable marking arrays
+func arrayMetatable(L *lua.LState) *lua.LTable {
+	meta := L.NewTable()
+	meta.RawSetString(arrayKey, lua.LTrue)
+	return meta
+}
+
+// toLua converts a value decoded from JSON to a Lua value
+func toLua(L *lua.LState, value any) lua.LValue {
+	switch value := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(value)
+	case float64:
+		return lua.LNumber(value)
+	case int:
+		return lua.LNumber(value)
+	case string:
+		return lua.LString(value)
+	case []any:
+		table := L.CreateTable(len(value), 0)
+		for _, item := range value {
+			table.Append(toLua(L, item))
+		}
+		L.SetMetatable(table, arrayMetatable(L))
+		return table
+	case map[string]any:
+		table := L.CreateTable(0, len(value))
+		for key, item := range value {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	default:
+		// Convert other types through their JSON encoding
+		data, err := json.Marshal(value)
+		if err != nil {
+			return lua.LNil
+		}
+		var decoded any
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return lua.LNil
+		}
+		return toLua(L, decoded)
+	}
+}
+
+// fromLua converts a Lua value to a value that encodes to JSON. Tables are
+// arrays when marked as such or when they only have keys 1 to n.
+func fromLua(value lua.LValue) any {
+	switch value := value.(type) {
+	case lua.LBool:
+		return bool(value)
+	case lua.LNumber:
+		return float64(value)
+	case lua.LString:
+		return string(value)
+	case *lua.LTable:
+		if isArray(value) {
+			items := make([]any, 0, value.Len())
+			for i := 1; i <= value.Len(); i++ {
+				items = append(items, fromLua(value.RawGetInt(i)))
+			}
+			return items
+		}
+		fields := make(map[string]any)
+		value.ForEach(func(key, item lua.LValue) {
+			fields[key.String()] = fromLua(item)
+		})
+		return fields
+	default:
+		return nil
+	}
+}
+
+// isArray reports whether a table should be encoded as a JSON array
+func isArray(table *lua.LTable) bool {
+	if meta, ok := table.Metatable.(*lua.LTable); ok && meta.RawGetString(arrayKey) == lua.LTrue {
+		return true
+	}
+
+	// A table with only keys 1 to n is an array, an empty one an object
+	n := table.Len()
+	if n == 0 {
+		return false
+	}
+	count := 0
+	table.ForEach(func(lua.LValue, lua.LValue) { count++ })
+	return count == n
+}
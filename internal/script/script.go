@@ -0,0 +1,233 @@
+// Package script runs user Lua scripts as proxy middlewares, so deployments can
+// rewrite requests and filter or modify response events without recompiling.
+//
+// A script may define two global functions:
+//
+//	function on_request(req)  -- req.body, req.headers, req.model, req.client
+//	  return req              -- or nil, "reason" to reject the request
+//	end
+//
+//	function on_event(event)  -- event.event, event.data
+//	  return event            -- or nil to drop the event
+//	end
+//
+// Each request runs in a fresh Lua state, so globals set by on_request are
+// visible to on_event for the same response only. json.encode and json.decode
+// convert between tables and JSON strings.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"zedclaudeproxy/internal/proxy"
+	"zedclaudeproxy/internal/sse"
+)
+
+// callTimeout bounds a single call into a script
+const callTimeout = time.Second
+
+// Script is a compiled Lua script used as a middleware
+type Script struct {
+	name      string
+	proto     *lua.FunctionProto
+	onEvent   bool
+	onRequest bool
+}
+
+// Load compiles the script at path
+func Load(path string) (*Script, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(file, path)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("compiling %s: %w", path, err)
+	}
+	s := &Script{name: path, proto: proto}
+
+	// Find out which hooks the script defines
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	defer L.Close()
+	s.onRequest = L.GetGlobal("on_request").Type() == lua.LTFunction
+	s.onEvent = L.GetGlobal("on_event").Type() == lua.LTFunction
+	if !s.onRequest && !s.onEvent {
+		return nil, fmt.Errorf("%s defines neither on_request nor on_event", path)
+	}
+
+	return s, nil
+}
+
+// newState returns a sandboxed Lua state with the script loaded
+func (s *Script) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	// Only open the libraries without access to the system
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("json", newJSONModule(L))
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := s.call(L, 0, 0); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("running %s: %w", s.name, err)
+	}
+	return L, nil
+}
+
+// call calls the function on the stack with a timeout
+func (s *Script) call(L *lua.LState, nargs, nret int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	return L.PCall(nargs, nret, nil)
+}
+
+// Request runs on_request on the request and returns a hook running on_event
+// on the events of its response
+func (s *Script) Request(req *proxy.Request) (proxy.StreamHook, error) {
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.onRequest {
+		if err := s.runRequest(L, req); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+
+	if !s.onEvent {
+		L.Close()
+		return nil, nil
+	}
+	return &hook{script: s, L: L}, nil
+}
+
+// runRequest passes the request through on_request
+func (s *Script) runRequest(L *lua.LState, req *proxy.Request) error {
+	headers := L.NewTable()
+	for name := range req.Header {
+		headers.RawSetString(name, lua.LString(req.Header.Get(name)))
+	}
+	table := L.NewTable()
+	table.RawSetString("body", toLua(L, req.Body))
+	table.RawSetString("headers", headers)
+	table.RawSetString("model", lua.LString(req.ClientModel))
+	table.RawSetString("client", lua.LString(req.Client))
+
+	L.Push(L.GetGlobal("on_request"))
+	L.Push(table)
+	if err := s.call(L, 1, 2); err != nil {
+		return fmt.Errorf("%s: on_request: %w", s.name, err)
+	}
+	result, reason := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+
+	// A nil result rejects the request
+	returned, ok := result.(*lua.LTable)
+	if !ok {
+		if reason == lua.LNil {
+			return fmt.Errorf("request rejected by %s", s.name)
+		}
+		return errors.New(reason.String())
+	}
+
+	body, ok := fromLua(returned.RawGetString("body")).(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: on_request must return a table with a body", s.name)
+	}
+	clear(req.Body)
+	for key, value := range body {
+		req.Body[key] = value
+	}
+	req.Modified = true
+
+	// Headers missing from the returned table are removed
+	if returned, ok := returned.RawGetString("headers").(*lua.LTable); ok {
+		clear(req.Header)
+		returned.ForEach(func(name, value lua.LValue) {
+			req.Header.Set(name.String(), value.String())
+		})
+	}
+	return nil
+}
+
+// hook runs on_event on the events of a single response
+type hook struct {
+	script *Script
+	L      *lua.LState
+}
+
+// Event passes an event through on_event
+func (h *hook) Event(event *sse.Event) bool {
+	table := h.L.NewTable()
+	table.RawSetString("event", lua.LString(event.Event))
+	table.RawSetString("data", lua.LString(event.Data))
+
+	h.L.Push(h.L.GetGlobal("on_event"))
+	h.L.Push(table)
+	if err := h.script.call(h.L, 1, 1); err != nil {
+		// Forward the event unchanged rather than breaking the stream
+		log.Printf("Error running on_event of %s: %v", h.script.name, err)
+		return true
+	}
+	result := h.L.Get(-1)
+	h.L.Pop(1)
+
+	returned, ok := result.(*lua.LTable)
+	if !ok {
+		return false
+	}
+	// Fields left out of the returned table keep their value
+	name, data := event.Event, event.Data
+	if value := returned.RawGetString("event"); value != lua.LNil {
+		name = value.String()
+	}
+	if value := returned.RawGetString("data"); value != lua.LNil {
+		data = value.String()
+	}
+	if name != event.Event || data != event.Data {
+		event.Event, event.Data, event.Raw = name, data, ""
+	}
+	return true
+}
+
+// Done releases the Lua state
+func (h *hook) Done() {
+	h.L.Close()
+}
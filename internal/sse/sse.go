@@ -0,0 +1,184 @@
+// Package sse parses and encodes the server-sent events used by Anthropic's
+// streaming Messages API.
+package sse
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Event represents a server-sent event
+type Event struct {
+	Event string
+	// Data holds the data lines of the event joined with "\n"
+	Data     string
+	ID       string
+	Retry    string
+	Comments []string
+
+	// Raw is the text of the event as read from the stream, including the blank
+	// line ending it. Write sends it unchanged when set so events that aren't
+	// modified round-trip byte for byte; clear it after modifying the event.
+	Raw string
+}
+
+// Parse parses a server-sent event string into an Event, returning nil for an
+// empty event
+func Parse(eventStr string) (*Event, error) {
+	if strings.TrimSpace(eventStr) == "" {
+		return nil, nil // Empty event
+	}
+
+	lines := strings.Split(strings.TrimRight(eventStr, "\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return parseLines(lines)
+}
+
+// parseLines parses the lines of an event following the SSE specification:
+// fields are "name: value" with a single optional space after the colon, lines
+// starting with a colon are comments and unknown fields are ignored
+func parseLines(lines []string) (*Event, error) {
+	var (
+		event Event
+		data  []string
+		known bool
+	)
+	for _, line := range lines {
+		if comment, ok := strings.CutPrefix(line, ":"); ok {
+			event.Comments = append(event.Comments, strings.TrimPrefix(comment, " "))
+			known = true
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			event.ID = value
+		case "retry":
+			event.Retry = value
+		default:
+			continue
+		}
+		known = true
+	}
+
+	if !known {
+		return nil, fmt.Errorf("invalid SSE format: %s", strings.Join(lines, "\n"))
+	}
+	event.Data = strings.Join(data, "\n")
+	return &event, nil
+}
+
+// Write encodes an event to w
+func Write(w io.Writer, event *Event) error {
+	if event.Raw != "" {
+		_, err := io.WriteString(w, event.Raw)
+		return err
+	}
+
+	var b strings.Builder
+	for _, comment := range event.Comments {
+		fmt.Fprintf(&b, ": %s\n", comment)
+	}
+	if event.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event.Event)
+	}
+	if event.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", event.ID)
+	}
+	if event.Retry != "" {
+		fmt.Fprintf(&b, "retry: %s\n", event.Retry)
+	}
+	if event.Data != "" || event.Event != "" {
+		for _, line := range strings.Split(event.Data, "\n") {
+			fmt.Fprintf(&b, "data: %s\n", line)
+		}
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteJSON encodes an event with JSON encoded data to w
+func WriteJSON(w io.Writer, event string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return Write(w, &Event{Event: event, Data: string(encoded)})
+}
+
+// Reader reads events from a server-sent event stream. Lines are read
+// incrementally without a size limit, so large events such as big tool inputs
+// or long text deltas don't end the stream.
+type Reader struct {
+	reader *bufio.Reader
+	lines  []string
+	raw    strings.Builder
+}
+
+// NewReader returns a Reader reading events from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next event in the stream, or io.EOF at the end of the stream.
+// Events that fail to parse are returned as errors without ending the stream.
+// An incomplete event at the end of the stream is discarded.
+func (r *Reader) Next() (*Event, error) {
+	for {
+		rawLine, err := r.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		r.raw.WriteString(rawLine)
+		line := strings.TrimSuffix(strings.TrimSuffix(rawLine, "\n"), "\r")
+
+		// Lines accumulate until an empty line marks the end of an event
+		if line != "" {
+			r.lines = append(r.lines, line)
+			continue
+		}
+
+		lines, raw := r.lines, r.raw.String()
+		r.lines = nil
+		r.raw.Reset()
+
+		// Skip empty events
+		if len(lines) == 0 {
+			continue
+		}
+		event, err := parseLines(lines)
+		if err != nil {
+			return nil, &ParseError{err}
+		}
+		event.Raw = raw
+		return event, nil
+	}
+}
+
+// ParseError is returned by Reader.Next for a malformed event
+type ParseError struct {
+	Err error
+}
+
+// Error returns the error message
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
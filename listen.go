@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultListenPort is the port of listen addresses given without one
+const defaultListenPort = "8080"
+
+// Authentication modes of a listener
+const (
+	listenAuthDefault  = ""         // Require proxy tokens when they are configured
+	listenAuthRequired = "required" // Require proxy tokens, which must be configured
+	listenAuthNone     = "none"     // Trust every client that can reach the listener
+)
+
+// listenAddr is an address the proxy serves on, with its options
+type listenAddr struct {
+	address string
+	auth    string
+}
+
+// String returns the address with its options, as given on the command line
+func (l listenAddr) String() string {
+	if l.auth == listenAuthDefault {
+		return l.address
+	}
+	return l.address + "?auth=" + l.auth
+}
+
+// listenFlag collects the -listen addresses. The flag may be repeated and
+// takes comma separated addresses, each optionally followed by options in
+// query string form, e.g. "localhost:8080?auth=none,100.64.0.1:8080".
+type listenFlag struct {
+	addrs []listenAddr
+	// set is false until the flag replaces its default
+	set bool
+}
+
+// String returns the addresses as a comma separated list
+func (f *listenFlag) String() string {
+	var addrs []string
+	for _, addr := range f.addrs {
+		addrs = append(addrs, addr.String())
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Set parses addresses, replacing the default the first time
+func (f *listenFlag) Set(value string) error {
+	if !f.set {
+		f.addrs, f.set = nil, true
+	}
+	for _, entry := range strings.Split(value, ",") {
+		address, options, _ := strings.Cut(strings.TrimSpace(entry), "?")
+		if address == "" {
+			return fmt.Errorf("empty listen address in %q", value)
+		}
+		address, err := normalizeListenAddress(address)
+		if err != nil {
+			return err
+		}
+		query, err := url.ParseQuery(options)
+		if err != nil {
+			return fmt.Errorf("invalid options of listen address %s: %w", address, err)
+		}
+
+		addr := listenAddr{address: address}
+		for name := range query {
+			switch value := query.Get(name); name {
+			case "auth":
+				if value != listenAuthRequired && value != listenAuthNone {
+					return fmt.Errorf("invalid auth %q for listen address %s: must be required or none", value, address)
+				}
+				addr.auth = value
+			default:
+				return fmt.Errorf("unknown option %q for listen address %s: must be auth", name, address)
+			}
+		}
+		f.addrs = append(f.addrs, addr)
+	}
+	return nil
+}
+
+// normalizeListenAddress checks a listen address, adding the default port to
+// a bare host such as 0.0.0.0 or ::1
+func normalizeListenAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// Without a port, the address is a host: an IPv4 address, a bracketed
+		// IPv6 address or a name. Unbracketed IPv6 addresses are ambiguous.
+		host := address
+		if bracketed, ok := strings.CutPrefix(address, "["); ok {
+			host, ok = strings.CutSuffix(bracketed, "]")
+			if !ok || net.ParseIP(host) == nil {
+				host = ""
+			}
+		}
+		if host == "" || strings.ContainsAny(host, "[]") || strings.Contains(host, ":") && !strings.HasPrefix(address, "[") {
+			return "", fmt.Errorf("invalid listen address %q: expected host:port, with IPv6 addresses in brackets such as [::1]:8080", address)
+		}
+		return net.JoinHostPort(host, defaultListenPort), nil
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return "", fmt.Errorf("invalid port %q in listen address %q", port, address)
+		}
+	}
+	if strings.Contains(host, "%") {
+		// Zones of link-local IPv6 addresses are kept as they are
+		return address, nil
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid IPv6 address %q in listen address %q", host, address)
+	}
+	return address, nil
+}
+
+// public reports whether other hosts may reach the address: it is not bound
+// to the loopback interface, or its name resolves to other addresses
+func (l listenAddr) public() bool {
+	host, _, err := net.SplitHostPort(l.address)
+	if err != nil || host == "" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return !ip.IsLoopback()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		// The listener fails to start anyway
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
+
+// listenError explains the common reasons a listener can't be started
+func listenError(address string, err error) error {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Errorf("%s is already in use, by another proxy or service: stop it or pick another port with -listen", address)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Errorf("not allowed to listen on %s, ports below 1024 usually need privileges: pick a higher port with -listen", address)
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return fmt.Errorf("%s is not an address of this host, e.g. its VPN is not up: %w", address, err)
+	}
+	return err
+}
+
+// addresses returns the addresses without their options
+func (f *listenFlag) addresses() []string {
+	addresses := make([]string, len(f.addrs))
+	for i, addr := range f.addrs {
+		addresses[i] = addr.address
+	}
+	return addresses
+}
+
+// listenerName names the listener of the i-th address so it can be handed over
+// on upgrades. The first keeps the name of the single listener of earlier versions.
+func listenerName(i int) string {
+	if i == 0 {
+		return "proxy"
+	}
+	return fmt.Sprintf("proxy-%d", i+1)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"zedclaudeproxy/internal/proxy"
+)
+
+// replayCommand holds the flags of the replay subcommand, which also takes
+// every flag configuring the proxy so budgets can be compared on a request
+type replayCommand struct {
+	opts  proxy.ReplayOptions
+	since string
+}
+
+// register adds the flags of the replay subcommand to the proxy flags
+func (c *replayCommand) register(flags *flag.FlagSet) {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] <request file | request number>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Sends a request recorded in a JSON file or the history store through the proxy and prints the response with its thinking.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&c.opts.Conversation, "conversation", "", "Only look up requests of this conversation in the history store")
+	flags.StringVar(&c.since, "since", "", "Only read the transcripts uploaded on or after this day, as YYYY-MM-DD (empty reads all)")
+	flags.BoolVar(&c.opts.Thinking, "thinking", true, "Print the thinking of the response before the answer")
+}
+
+// run replays the request given as the only argument through the proxy, the
+// history store flags telling where recorded requests are looked up
+func (c *replayCommand) run(p *proxy.Proxy, cfg proxy.Config, args []string) error {
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c.opts.Source = args[0]
+	c.opts.Store, c.opts.StoreEndpoint, c.opts.EncryptionKey = cfg.HistoryStore, cfg.HistoryStoreEndpoint, cfg.EncryptionKey
+	if c.since != "" {
+		day, err := time.Parse("2006-01-02", c.since)
+		if err != nil {
+			return fmt.Errorf("invalid -since day %q: %w", c.since, err)
+		}
+		c.opts.Since = day
+	}
+
+	// An interrupt cancels the replayed request
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	writer := bufio.NewWriter(os.Stdout)
+	err := p.Replay(ctx, flushWriter{writer}, c.opts)
+	if flushErr := writer.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// flushWriter flushes after every write so the response prints as it streams
+type flushWriter struct {
+	*bufio.Writer
+}
+
+// Write writes and flushes p
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil {
+		err = w.Writer.Flush()
+	}
+	return n, err
+}
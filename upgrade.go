@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// inheritedListenersEnv names the listeners a process started by an upgrade
+// inherits, in the order of their file descriptors from 3 on. The descriptor
+// after them is a pipe the new process closes once it serves.
+const inheritedListenersEnv = "ZCP_INHERITED_LISTENERS"
+
+// upgradeTimeout bounds how long an upgrade waits for the new process to serve
+const upgradeTimeout = 30 * time.Second
+
+// listenerSet holds the listeners of the process by name, so that an upgrade
+// can hand them over to a new process without closing them
+type listenerSet struct {
+	names     []string
+	listeners map[string]net.Listener
+
+	// ready is the pipe to the process that started this one, nil unless upgraded
+	ready *os.File
+}
+
+// inheritListeners returns the listeners inherited from the process that
+// started this one, if any
+func inheritListeners() (*listenerSet, error) {
+	set := &listenerSet{listeners: make(map[string]net.Listener)}
+	value := os.Getenv(inheritedListenersEnv)
+	if value == "" {
+		return set, nil
+	}
+	os.Unsetenv(inheritedListenersEnv)
+
+	names := strings.Split(value, ",")
+	for i, name := range names {
+		file := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting %s listener: %w", name, err)
+		}
+		set.listeners[name] = ln
+	}
+	set.ready = os.NewFile(uintptr(3+len(names)), "ready")
+	return set, nil
+}
+
+// listen returns the inherited listener with the given name, or a new one on address
+func (s *listenerSet) listen(name, address string) (net.Listener, error) {
+	ln, ok := s.listeners[name]
+	if ok {
+		log.Printf("Inherited %s listener on %s", name, ln.Addr())
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", address); err != nil {
+			return nil, err
+		}
+		s.listeners[name] = ln
+	}
+	s.names = append(s.names, name)
+	return ln, nil
+}
+
+// notifyReady tells the process that started this one that it serves, so
+// that process can stop accepting connections and drain its streams
+func (s *listenerSet) notifyReady() {
+	if s.ready == nil {
+		return
+	}
+	s.ready.Write([]byte{1})
+	s.ready.Close()
+	s.ready = nil
+}
+
+// upgrade starts the proxy binary again with the same arguments, passing it the
+// listeners, and returns once the new process serves. The binary is looked up
+// again, so a new build installed over the running one is picked up.
+func (s *listenerSet) upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Duplicate the listener sockets for the new process
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, name := range s.names {
+		filer, ok := s.listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s listener can't be handed over", name)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("handing over %s listener: %w", name, err)
+		}
+		files = append(files, file)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), inheritedListenersEnv+"="+strings.Join(s.names, ","))
+	cmd.ExtraFiles = append(files, readyWriter)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Started %s (pid %d), waiting for it to serve", executable, cmd.Process.Pid)
+
+	// The pipe closes without data when the new process exits before serving
+	ready := make(chan bool, 1)
+	go func() {
+		buffer := make([]byte, 1)
+		n, _ := readyReader.Read(buffer)
+		ready <- n == 1
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			cmd.Wait()
+			return errors.New("new process exited before serving")
+		}
+		return nil
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process didn't serve within %s", upgradeTimeout)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// upgradeSignals is empty, listeners can't be handed over on this platform
+var upgradeSignals []os.Signal
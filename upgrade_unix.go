@@ -0,0 +1,11 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals start a zero-downtime upgrade to a new process
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}